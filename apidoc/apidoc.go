@@ -0,0 +1,152 @@
+// Package apidoc generates OpenAPI and AsyncAPI documents describing the
+// selectors of a qtalk API from a Reflection, using the schemas registered
+// with rpc.WithSchema to describe argument and reply values.
+//
+// A Reflection can be built locally from a RespondMux or received from
+// a remote peer calling its rpc.ReflectSelector:
+//
+//	doc := apidoc.OpenAPI(apidoc.Info{Title: "Users", Version: "1.0"}, rpc.Reflection{
+//		Selectors: mux.Patterns(),
+//		Schemas:   mux.Schemas(),
+//	})
+//
+// Documents are returned as generic values ready to be encoded as JSON.
+package apidoc
+
+import (
+	"strings"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Info describes the API in generated documents.
+type Info struct {
+	Title       string
+	Version     string
+	Description string
+}
+
+func (i Info) doc() map[string]any {
+	info := map[string]any{
+		"title":   i.Title,
+		"version": i.Version,
+	}
+	if i.Description != "" {
+		info["description"] = i.Description
+	}
+	return info
+}
+
+// Extension properties describing the streaming behavior of a selector,
+// corresponding to the StreamArgs and StreamReplies fields of rpc.Schema.
+const (
+	ExtStreamArgs    = "x-qtalk-stream-args"
+	ExtStreamReplies = "x-qtalk-stream-replies"
+)
+
+// OpenAPI returns an OpenAPI 3.1 document describing each selector as a POST
+// operation on its normalized path, taking the args as request body and
+// responding with the reply, or a remote error string. Prefix patterns are
+// described with a trailing selector path parameter.
+func OpenAPI(info Info, ref rpc.Reflection) map[string]any {
+	paths := make(map[string]any)
+	for _, sel := range ref.Selectors {
+		schema, _ := ref.Schema(sel)
+		op := map[string]any{
+			"operationId": operationID(sel),
+			"requestBody": map[string]any{
+				"content": jsonContent(schema.Args),
+			},
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "Reply",
+					"content":     jsonContent(schema.Reply),
+				},
+				"default": map[string]any{
+					"description": "Remote error",
+					"content":     jsonContent(map[string]any{"type": "string"}),
+				},
+			},
+		}
+		path := sel
+		if strings.HasSuffix(sel, "/") {
+			path += "{selector}"
+			op["parameters"] = []any{map[string]any{
+				"name":     "selector",
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			}}
+		}
+		streaming(op, schema)
+		paths[path] = map[string]any{"post": op}
+	}
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info":    info.doc(),
+		"paths":   paths,
+	}
+}
+
+// AsyncAPI returns an AsyncAPI 2.6 document describing each selector as
+// a channel, publishing the args and subscribing to the reply.
+func AsyncAPI(info Info, ref rpc.Reflection) map[string]any {
+	channels := make(map[string]any)
+	for _, sel := range ref.Selectors {
+		schema, _ := ref.Schema(sel)
+		id := operationID(sel)
+		channel := map[string]any{
+			"publish": map[string]any{
+				"operationId": id,
+				"message":     message("args", schema.Args),
+			},
+			"subscribe": map[string]any{
+				"operationId": id + "Reply",
+				"message":     message("reply", schema.Reply),
+			},
+		}
+		if strings.HasSuffix(sel, "/") {
+			channel["description"] = "Handles any selector beginning with " + sel
+		}
+		streaming(channel, schema)
+		channels[sel] = channel
+	}
+	return map[string]any{
+		"asyncapi": "2.6.0",
+		"info":     info.doc(),
+		"channels": channels,
+	}
+}
+
+// operationID returns the dotted form of a normalized selector.
+func operationID(sel string) string {
+	return strings.ReplaceAll(strings.Trim(sel, "/"), "/", ".")
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	if schema == nil {
+		schema = map[string]any{}
+	}
+	return map[string]any{
+		"application/json": map[string]any{"schema": schema},
+	}
+}
+
+func message(name string, schema map[string]any) map[string]any {
+	if schema == nil {
+		schema = map[string]any{}
+	}
+	return map[string]any{
+		"name":    name,
+		"payload": schema,
+	}
+}
+
+func streaming(v map[string]any, schema rpc.Schema) {
+	if schema.StreamArgs {
+		v[ExtStreamArgs] = true
+	}
+	if schema.StreamReplies {
+		v[ExtStreamReplies] = true
+	}
+}
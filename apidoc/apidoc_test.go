@@ -0,0 +1,60 @@
+package apidoc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+func testReflection() rpc.Reflection {
+	mux := rpc.NewRespondMux()
+	mux.Handle("users.get", rpc.WithSchema(rpc.NotFoundHandler(), rpc.Schema{
+		Args:  map[string]any{"type": "integer"},
+		Reply: map[string]any{"type": "string"},
+	}))
+	mux.Handle("logs.", rpc.WithSchema(rpc.NotFoundHandler(), rpc.Schema{
+		StreamReplies: true,
+	}))
+	return rpc.Reflection{Selectors: mux.Patterns(), Schemas: mux.Schemas()}
+}
+
+func TestOpenAPI(t *testing.T) {
+	doc := OpenAPI(Info{Title: "Test", Version: "1.0"}, testReflection())
+	b, err := json.Marshal(doc["paths"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"/logs/{selector}":{"post":{"operationId":"logs","parameters":[{"in":"path","name":"selector","required":true,"schema":{"type":"string"}}],` +
+		`"requestBody":{"content":{"application/json":{"schema":{}}}},` +
+		`"responses":{"200":{"content":{"application/json":{"schema":{}}},"description":"Reply"},` +
+		`"default":{"content":{"application/json":{"schema":{"type":"string"}}},"description":"Remote error"}},` +
+		`"x-qtalk-stream-replies":true}},` +
+		`"/users/get":{"post":{"operationId":"users.get",` +
+		`"requestBody":{"content":{"application/json":{"schema":{"type":"integer"}}}},` +
+		`"responses":{"200":{"content":{"application/json":{"schema":{"type":"string"}}},"description":"Reply"},` +
+		`"default":{"content":{"application/json":{"schema":{"type":"string"}}},"description":"Remote error"}}}}}`
+	if string(b) != want {
+		t.Fatalf("unexpected paths:\n%s", b)
+	}
+}
+
+func TestAsyncAPI(t *testing.T) {
+	doc := AsyncAPI(Info{Title: "Test", Version: "1.0"}, testReflection())
+	if doc["asyncapi"] != "2.6.0" {
+		t.Fatal("unexpected version:", doc["asyncapi"])
+	}
+	b, err := json.Marshal(doc["channels"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"/logs/":{"description":"Handles any selector beginning with /logs/",` +
+		`"publish":{"message":{"name":"args","payload":{}},"operationId":"logs"},` +
+		`"subscribe":{"message":{"name":"reply","payload":{}},"operationId":"logsReply"},` +
+		`"x-qtalk-stream-replies":true},` +
+		`"/users/get":{"publish":{"message":{"name":"args","payload":{"type":"integer"}},"operationId":"users.get"},` +
+		`"subscribe":{"message":{"name":"reply","payload":{"type":"string"}},"operationId":"users.getReply"}}}`
+	if string(b) != want {
+		t.Fatalf("unexpected channels:\n%s", b)
+	}
+}
@@ -0,0 +1,260 @@
+// Package bench provides reproducible end-to-end benchmarks of qtalk over
+// in-memory pipes, TCP loopback and TLS, so regressions in the mux, rpc
+// and codec packages can be detected and optimizations validated.
+//
+// The benchmarks are run with go test:
+//
+//	go test ./bench -bench . -benchmem
+//
+// Profiles of a single benchmark can be captured with the standard flags:
+//
+//	go test ./bench -bench 'Unary/tcp' -cpuprofile cpu.out -memprofile mem.out
+package bench
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// A Transport connects a pair of sessions for benchmarking.
+type Transport struct {
+	Name string
+	Pair func() (client, server mux.Session, err error)
+}
+
+// Transports are the transports benchmarks are run over.
+var Transports = []Transport{
+	{Name: "pipe", Pair: PipePair},
+	{Name: "tcp", Pair: TCPPair},
+	{Name: "tls", Pair: TLSPair},
+}
+
+// PipePair connects a pair of sessions with in-memory pipes.
+func PipePair() (client, server mux.Session, err error) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	server, _ = mux.DialIO(aw, ar)
+	client, _ = mux.DialIO(bw, br)
+	return client, server, nil
+}
+
+// TCPPair connects a pair of sessions over TCP loopback.
+func TCPPair() (client, server mux.Session, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return netPair(l, func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+}
+
+// TLSPair connects a pair of sessions over TLS on TCP loopback, using a
+// self-signed certificate generated once per process.
+func TLSPair() (client, server mux.Session, err error) {
+	config, err := tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return netPair(l, func(addr string) (net.Conn, error) {
+		return tls.Dial("tcp", addr, config)
+	})
+}
+
+func netPair(l net.Listener, dial func(addr string) (net.Conn, error)) (client, server mux.Session, err error) {
+	defer l.Close()
+	// the server session is started as soon as it is accepted since
+	// dialing TLS waits for the server to read the handshake
+	accepted := make(chan mux.Session, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- mux.New(conn)
+	}()
+	conn, err := dial(l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server, ok := <-accepted
+	if !ok {
+		conn.Close()
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return mux.New(conn), server, nil
+}
+
+var (
+	tlsOnce   sync.Once
+	tlsShared *tls.Config
+	tlsErr    error
+)
+
+func tlsConfig() (*tls.Config, error) {
+	tlsOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			tlsErr = err
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "qtalk bench"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IsCA:         true,
+
+			BasicConstraintsValid: true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			tlsErr = err
+			return
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			tlsErr = err
+			return
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(cert)
+		tlsShared = &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+			RootCAs:      pool,
+		}
+	})
+	return tlsShared, tlsErr
+}
+
+// Handler is the rpc handler served in benchmarks. The "echo" selector
+// returns its argument and the "discard" selector continues the call,
+// reading from the channel until EOF.
+func Handler() rpc.Handler {
+	m := rpc.NewRespondMux()
+	m.Handle("echo", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var v any
+		if err := c.Receive(&v); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(v)
+	}))
+	m.Handle("discard", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		c.Receive(nil)
+		ch, err := r.Continue()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, ch)
+		ch.Close()
+	}))
+	return m
+}
+
+// client connects a client to a server serving Handler over t.
+func client(b *testing.B, t Transport) *rpc.Client {
+	b.Helper()
+	csess, ssess, err := t.Pair()
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv := &rpc.Server{
+		Codec:   codec.JSONCodec{},
+		Handler: Handler(),
+	}
+	go srv.Respond(ssess, nil)
+	b.Cleanup(func() {
+		csess.Close()
+	})
+	return rpc.NewClient(csess, codec.JSONCodec{})
+}
+
+// Unary benchmarks the latency of unary JSON calls over t.
+func Unary(b *testing.B, t Transport) {
+	c := client(b, t)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out string
+		if _, err := c.Call(ctx, "echo", "Hello world", &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Stream benchmarks the throughput of writing chunkSize byte chunks to a
+// continued call over t.
+func Stream(b *testing.B, t Transport, chunkSize int) {
+	c := client(b, t)
+	resp, err := c.Call(context.Background(), "discard", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunk := make([]byte, chunkSize)
+	b.SetBytes(int64(chunkSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := resp.Channel.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := resp.Channel.CloseWrite(); err != nil {
+		b.Fatal(err)
+	}
+	// wait for the server to read everything and close
+	io.Copy(io.Discard, resp.Channel)
+}
+
+// Open benchmarks the rate of opening and closing channels over t.
+func Open(b *testing.B, t Transport) {
+	csess, ssess, err := t.Pair()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer csess.Close()
+	go func() {
+		for {
+			ch, err := ssess.Accept()
+			if err != nil {
+				return
+			}
+			ch.Close()
+		}
+	}()
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch, err := csess.Open(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ch.Close()
+	}
+}
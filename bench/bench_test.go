@@ -0,0 +1,59 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+func TestTransports(t *testing.T) {
+	for _, tr := range Transports {
+		t.Run(tr.Name, func(t *testing.T) {
+			csess, ssess, err := tr.Pair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer csess.Close()
+			srv := &rpc.Server{Codec: codec.JSONCodec{}, Handler: Handler()}
+			go srv.Respond(ssess, nil)
+
+			var out string
+			c := rpc.NewClient(csess, codec.JSONCodec{})
+			if _, err := c.Call(context.Background(), "echo", "Hello", &out); err != nil {
+				t.Fatal(err)
+			}
+			if out != "Hello" {
+				t.Fatalf("unexpected reply: %q", out)
+			}
+		})
+	}
+}
+
+func BenchmarkUnary(b *testing.B) {
+	for _, t := range Transports {
+		b.Run(t.Name, func(b *testing.B) {
+			Unary(b, t)
+		})
+	}
+}
+
+func BenchmarkStream(b *testing.B) {
+	for _, size := range []int{1 << 10, 32 << 10, 1 << 20} {
+		for _, t := range Transports {
+			b.Run(fmt.Sprintf("%s/%dKB", t.Name, size>>10), func(b *testing.B) {
+				Stream(b, t, size)
+			})
+		}
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	for _, t := range Transports {
+		b.Run(t.Name, func(b *testing.B) {
+			Open(b, t)
+		})
+	}
+}
@@ -0,0 +1,305 @@
+// Package broker relays qtalk sessions between peers that cannot reach each
+// other directly, such as devices behind NAT controlled by clients that also
+// cannot listen publicly.
+//
+// Peers dial out to a Broker and Register a name, then accept sessions of
+// clients from the returned Listener. Clients dial the same Broker and Dial a
+// registered name to get a session with that peer. The broker splices a
+// channel of the client with one it opens to the peer, and both ends run a
+// regular session over the spliced stream:
+//
+//	// peer
+//	sess, _ := mux.DialTCP("broker.example.com:4242")
+//	l, _ := broker.Register(ctx, sess, "device-1")
+//	srv.ServeMux(l)
+//
+//	// client
+//	sess, _ := mux.DialTCP("broker.example.com:4242")
+//	dev, _ := broker.Dial(ctx, sess, "device-1")
+//	client := rpc.NewClient(dev, codec.JSONCodec{})
+//
+// Use ServeTLS to have the broker terminate TLS for its peers and clients.
+// Clients can use DialDirect to connect to the peer directly when their
+// networks allow it, using the broker only to exchange addresses.
+//
+// The broker also tracks the presence of registered peers. Peers Announce
+// metadata for their name, and any session can List the online peers or
+// Watch them join, leave and update.
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Selectors handled by a Broker, and by peers for calls from the broker.
+// PunchSelector is handled by both.
+const (
+	RegisterSelector = "broker.register"
+	ConnectSelector  = "broker.connect"
+	PunchSelector    = "broker.punch"
+	SessionSelector  = "broker.session"
+	AnnounceSelector = "broker.announce"
+	ListSelector     = "broker.list"
+	WatchSelector    = "broker.watch"
+)
+
+// ErrNameTaken is returned when registering a name that is already
+// registered by another peer.
+var ErrNameTaken = errors.New("broker: name already registered")
+
+// ErrNoPeer is returned when connecting to a name no peer registered.
+var ErrNoPeer = errors.New("broker: no peer registered with name")
+
+// A Broker relays sessions between registered peers and clients. The zero
+// value is ready to use.
+type Broker struct {
+	// Authorize, if set, is called to allow a peer on sess to register
+	// name. Registering fails with the error it returns.
+	Authorize func(name string, sess mux.Session) error
+
+	// ErrorLog is used by the rpc.Server serving the broker selectors.
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	peers    map[string]*peer
+	watchers map[chan Event]struct{}
+}
+
+// peer is a registered peer and its presence.
+type peer struct {
+	client *rpc.Client
+	info   Peer
+}
+
+// Handler returns a handler for the broker selectors, for serving them with
+// an existing rpc.Server. It expects calls to use codec.JSONCodec.
+func (b *Broker) Handler() rpc.Handler {
+	m := rpc.NewRespondMux()
+	m.Handle(RegisterSelector, rpc.HandlerFunc(b.register))
+	m.Handle(ConnectSelector, rpc.HandlerFunc(b.connect))
+	m.Handle(PunchSelector, rpc.HandlerFunc(b.punch))
+	m.Handle(AnnounceSelector, rpc.HandlerFunc(b.announce))
+	m.Handle(ListSelector, rpc.HandlerFunc(b.list))
+	m.Handle(WatchSelector, rpc.HandlerFunc(b.watch))
+	return m
+}
+
+func (b *Broker) server() *rpc.Server {
+	return &rpc.Server{Handler: b.Handler(), Codec: codec.JSONCodec{}, ErrorLog: b.ErrorLog}
+}
+
+// ServeMux accepts sessions of peers and clients until the Listener is
+// closed, serving each in its own goroutine.
+func (b *Broker) ServeMux(l mux.Listener) error {
+	return b.server().ServeMux(l)
+}
+
+// Serve accepts connections of peers and clients until the Listener is
+// closed, serving each in its own goroutine.
+func (b *Broker) Serve(l net.Listener) error {
+	return b.server().Serve(l)
+}
+
+// ServeTLS is like Serve, but terminates TLS on the accepted connections
+// using config.
+func (b *Broker) ServeTLS(l net.Listener, config *tls.Config) error {
+	return b.Serve(tls.NewListener(l, config))
+}
+
+// Peers returns the sorted names of the registered peers.
+func (b *Broker) Peers() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.peers))
+	for name := range b.peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *Broker) register(r rpc.Responder, c *rpc.Call) {
+	var name string
+	if err := c.Receive(&name); err != nil {
+		r.Return(err)
+		return
+	}
+	sess := c.Caller.(*rpc.Client).Session
+	if b.Authorize != nil {
+		if err := b.Authorize(name, sess); err != nil {
+			r.Return(err)
+			return
+		}
+	}
+
+	b.mu.Lock()
+	if _, ok := b.peers[name]; ok {
+		b.mu.Unlock()
+		r.Return(fmt.Errorf("%w: %s", ErrNameTaken, name))
+		return
+	}
+	if b.peers == nil {
+		b.peers = make(map[string]*peer)
+	}
+	p := &peer{
+		client: rpc.NewClient(sess, codec.JSONCodec{}),
+		info:   Peer{Name: name, Since: time.Now()},
+	}
+	b.peers[name] = p
+	b.notify(Event{Type: PeerJoined, Peer: p.info})
+	b.mu.Unlock()
+
+	// the name is registered for as long as the session of the peer lasts
+	go func() {
+		sess.Wait()
+		b.mu.Lock()
+		if b.peers[name] == p {
+			delete(b.peers, name)
+			b.notify(Event{Type: PeerLeft, Peer: p.info})
+		}
+		b.mu.Unlock()
+	}()
+	r.Return()
+}
+
+// peer returns the client of the peer registered as name.
+func (b *Broker) peer(name string) (*rpc.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.peers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoPeer, name)
+	}
+	return p.client, nil
+}
+
+func (b *Broker) connect(r rpc.Responder, c *rpc.Call) {
+	var name string
+	if err := c.Receive(&name); err != nil {
+		r.Return(err)
+		return
+	}
+	peer, err := b.peer(name)
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	pch, err := peer.OpenStream(c.Context, SessionSelector, nil)
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	ch, err := r.Continue()
+	if err != nil {
+		pch.Close()
+		return
+	}
+	go mux.Splice(ch, pch.(mux.Channel))
+}
+
+// Register registers name with the broker on sess, returning a Listener of
+// the sessions of clients connecting to the name, relayed by the broker or
+// direct. The name is registered until sess is closed, which closing the
+// Listener does. The session should not be used otherwise, since calls by
+// the broker on it are served by the Listener.
+func Register(ctx context.Context, sess mux.Session, name string) (mux.Listener, error) {
+	client := rpc.NewClient(sess, codec.JSONCodec{})
+	if _, err := client.Call(ctx, RegisterSelector, name); err != nil {
+		return nil, err
+	}
+	l := &listener{
+		sess:     sess,
+		addr:     Addr(name),
+		sessions: make(chan mux.Session),
+		closed:   make(chan struct{}),
+	}
+	m := rpc.NewRespondMux()
+	m.Handle(SessionSelector, rpc.StreamHandler(func(ctx context.Context, rw io.ReadWriteCloser) error {
+		sess := mux.New(rw)
+		if !l.deliver(sess) {
+			return net.ErrClosed
+		}
+		// the stream is closed once the relayed session ends
+		sess.Wait()
+		return nil
+	}))
+	m.Handle(PunchSelector, rpc.HandlerFunc(l.punch))
+	go func() {
+		srv := &rpc.Server{Handler: m, Codec: codec.JSONCodec{}}
+		srv.Respond(sess, nil)
+		l.Close()
+	}()
+	return l, nil
+}
+
+// Dial connects to the peer registered as name with the broker on sess,
+// returning a session with the peer relayed by the broker. Any number of
+// peers can be dialed on the same broker session.
+func Dial(ctx context.Context, sess mux.Session, name string) (mux.Session, error) {
+	client := rpc.NewClient(sess, codec.JSONCodec{})
+	rw, err := client.OpenStream(ctx, ConnectSelector, name)
+	if err != nil {
+		return nil, err
+	}
+	return mux.New(rw), nil
+}
+
+// Addr is the address of a peer registered with a broker, which is its name.
+type Addr string
+
+func (a Addr) Network() string { return "broker" }
+func (a Addr) String() string  { return string(a) }
+
+type listener struct {
+	sess     mux.Session
+	addr     Addr
+	sessions chan mux.Session
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// deliver passes sess to Accept, closing it if the listener is closed.
+func (l *listener) deliver(sess mux.Session) bool {
+	select {
+	case l.sessions <- sess:
+		return true
+	case <-l.closed:
+		sess.Close()
+		return false
+	}
+}
+
+func (l *listener) Accept() (mux.Session, error) {
+	select {
+	case sess := <-l.sessions:
+		return sess, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.sess.Close()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,233 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+func fatal(err error, t *testing.T) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	ctx := context.Background()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+	b := &Broker{}
+	go b.Serve(l)
+
+	// the peer serves calls from clients connecting through the broker
+	psess, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	pl, err := Register(ctx, psess, "device")
+	fatal(err, t)
+	if pl.Addr().String() != "device" {
+		t.Fatal("unexpected listener address:", pl.Addr())
+	}
+	srv := &rpc.Server{
+		Codec: codec.JSONCodec{},
+		Handler: rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+			var s string
+			c.Receive(&s)
+			r.Return(strings.ToUpper(s))
+		}),
+	}
+	go srv.ServeMux(pl)
+
+	other, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	defer other.Close()
+	if _, err := Register(ctx, other, "device"); err == nil || !strings.Contains(err.Error(), ErrNameTaken.Error()) {
+		t.Fatal("unexpected error registering taken name:", err)
+	}
+
+	csess, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	defer csess.Close()
+	for i := 0; i < 2; i++ {
+		dev, err := Dial(ctx, csess, "device")
+		fatal(err, t)
+		var out string
+		_, err = rpc.NewClient(dev, codec.JSONCodec{}).Call(ctx, "upper", "hello", &out)
+		fatal(err, t)
+		if out != "HELLO" {
+			t.Fatal("unexpected reply:", out)
+		}
+		dev.Close()
+	}
+
+	if _, err := Dial(ctx, csess, "missing"); err == nil || !strings.Contains(err.Error(), ErrNoPeer.Error()) {
+		t.Fatal("unexpected error dialing missing peer:", err)
+	}
+
+	// closing the listener unregisters the peer
+	fatal(pl.Close(), t)
+	deadline := time.Now().Add(time.Second)
+	for len(b.Peers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("peer still registered:", b.Peers())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBrokerAuthorize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+	errDenied := errors.New("denied")
+	b := &Broker{Authorize: func(name string, sess mux.Session) error {
+		if name != "allowed" {
+			return errDenied
+		}
+		return nil
+	}}
+	go b.Serve(l)
+
+	sess, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	defer sess.Close()
+	if _, err := Register(context.Background(), sess, "other"); err != rpc.RemoteError(errDenied.Error()) {
+		t.Fatal("unexpected error:", err)
+	}
+	_, err = Register(context.Background(), sess, "allowed")
+	fatal(err, t)
+	if p := b.Peers(); len(p) != 1 || p[0] != "allowed" {
+		t.Fatal("unexpected peers:", p)
+	}
+}
+
+func TestBrokerDirect(t *testing.T) {
+	ctx := context.Background()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+	go (&Broker{}).Serve(l)
+
+	psess, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	pl, err := Register(ctx, psess, "device")
+	fatal(err, t)
+	defer pl.Close()
+	srv := &rpc.Server{
+		Codec: codec.JSONCodec{},
+		Handler: rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+			c.Receive(nil)
+			r.Return("pong")
+		}),
+	}
+	go srv.ServeMux(pl)
+
+	call := func(sess mux.Session) error {
+		var out string
+		_, err := rpc.NewClient(sess, codec.JSONCodec{}).Call(ctx, "ping", nil, &out)
+		if err == nil && out != "pong" {
+			t.Fatal("unexpected reply:", out)
+		}
+		return err
+	}
+
+	// a relayed session is used if there is no time to connect directly
+	csess, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	relayed, err := DialDirect(ctx, csess, "device", time.Nanosecond)
+	fatal(err, t)
+	fatal(call(relayed), t)
+
+	direct, err := DialDirect(ctx, csess, "device", 2*time.Second)
+	fatal(err, t)
+	defer direct.Close()
+	fatal(call(direct), t)
+
+	// only the direct session outlives the broker session
+	csess.Close()
+	fatal(call(direct), t)
+	if call(relayed) == nil {
+		t.Fatal("relayed session outlived the broker session")
+	}
+}
+
+func TestBrokerPresence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+	b := &Broker{}
+	go b.Serve(l)
+
+	psess, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	pl, err := Register(ctx, psess, "alice")
+	fatal(err, t)
+
+	csess, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	defer csess.Close()
+	peers, events, err := Watch(ctx, csess)
+	fatal(err, t)
+	if len(peers) != 1 || peers[0].Name != "alice" || peers[0].Since.IsZero() {
+		t.Fatal("unexpected peers:", peers)
+	}
+
+	next := func(typ EventType, name string) Event {
+		t.Helper()
+		select {
+		case ev, ok := <-events:
+			if !ok || ev.Type != typ || ev.Peer.Name != name {
+				t.Fatal("unexpected event:", ev, ok)
+			}
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event", typ, name)
+		}
+		return Event{}
+	}
+
+	if err := Announce(ctx, csess, "alice", map[string]string{"x": "y"}); err == nil || !strings.Contains(err.Error(), ErrNoPeer.Error()) {
+		t.Fatal("unexpected error announcing for another peer:", err)
+	}
+	fatal(Announce(ctx, psess, "alice", map[string]string{"status": "away"}), t)
+	if ev := next(PeerUpdated, "alice"); ev.Peer.Meta["status"] != "away" {
+		t.Fatal("unexpected metadata:", ev.Peer.Meta)
+	}
+
+	bsess, err := mux.DialTCP(l.Addr().String())
+	fatal(err, t)
+	bl, err := Register(ctx, bsess, "bob")
+	fatal(err, t)
+	next(PeerJoined, "bob")
+
+	peers, err = List(ctx, csess)
+	fatal(err, t)
+	if len(peers) != 2 || peers[0].Name != "alice" || peers[0].Meta["status"] != "away" || peers[1].Name != "bob" {
+		t.Fatal("unexpected peers:", peers)
+	}
+
+	fatal(bl.Close(), t)
+	next(PeerLeft, "bob")
+	fatal(pl.Close(), t)
+	next(PeerLeft, "alice")
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("unexpected event after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events not closed after cancel")
+	}
+}
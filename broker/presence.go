@@ -0,0 +1,208 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Peer describes the presence of a registered peer.
+type Peer struct {
+	Name string
+	// Meta is metadata announced by the peer, such as a display name or
+	// device type.
+	Meta map[string]string `json:",omitempty"`
+	// Since is when the peer registered.
+	Since time.Time
+}
+
+// EventType is the type of a presence Event.
+type EventType string
+
+// Presence event types.
+const (
+	PeerJoined  EventType = "join"
+	PeerLeft    EventType = "leave"
+	PeerUpdated EventType = "update"
+)
+
+// Event notifies watchers that a peer joined, left or announced new metadata.
+type Event struct {
+	Type EventType
+	Peer Peer
+}
+
+// watchBuffer is the number of events buffered for each watcher. Watchers
+// falling further behind are disconnected rather than blocking the broker.
+const watchBuffer = 64
+
+// AnnounceRequest is the argument of AnnounceSelector calls.
+type AnnounceRequest struct {
+	Name string
+	Meta map[string]string
+}
+
+// Online returns the presence of the registered peers, sorted by name.
+func (b *Broker) Online() []Peer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.online()
+}
+
+func (b *Broker) online() []Peer {
+	peers := make([]Peer, 0, len(b.peers))
+	for _, p := range b.peers {
+		peers = append(peers, p.info)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+// notify sends ev to the watchers, dropping those with a full buffer. It is
+// called with b.mu held.
+func (b *Broker) notify(ev Event) {
+	for w := range b.watchers {
+		select {
+		case w <- ev:
+		default:
+			delete(b.watchers, w)
+			close(w)
+		}
+	}
+}
+
+func (b *Broker) announce(r rpc.Responder, c *rpc.Call) {
+	var req AnnounceRequest
+	if err := c.Receive(&req); err != nil {
+		r.Return(err)
+		return
+	}
+	sess := c.Caller.(*rpc.Client).Session
+	b.mu.Lock()
+	p, ok := b.peers[req.Name]
+	if !ok || p.client.Session != sess {
+		b.mu.Unlock()
+		// only the peer registering a name can announce for it
+		r.Return(fmt.Errorf("%w: %s", ErrNoPeer, req.Name))
+		return
+	}
+	meta := make(map[string]string, len(req.Meta))
+	for k, v := range req.Meta {
+		meta[k] = v
+	}
+	p.info.Meta = meta
+	b.notify(Event{Type: PeerUpdated, Peer: p.info})
+	b.mu.Unlock()
+	r.Return()
+}
+
+func (b *Broker) list(r rpc.Responder, c *rpc.Call) {
+	c.Receive(nil)
+	r.Return(b.Online())
+}
+
+func (b *Broker) watch(r rpc.Responder, c *rpc.Call) {
+	c.Receive(nil)
+	events := make(chan Event, watchBuffer)
+	b.mu.Lock()
+	peers := b.online()
+	if b.watchers == nil {
+		b.watchers = make(map[chan Event]struct{})
+	}
+	b.watchers[events] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.watchers, events)
+		b.mu.Unlock()
+	}()
+
+	ch, err := r.Continue(peers)
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	// the watcher stops watching by closing the channel
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ch)
+		close(done)
+	}()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok || r.Send(ev) != nil {
+				return
+			}
+		case <-done:
+			return
+		case <-c.Context.Done():
+			return
+		}
+	}
+}
+
+// Announce sets the metadata of the peer registered as name by sess,
+// notifying watchers of the update.
+func Announce(ctx context.Context, sess mux.Session, name string, meta map[string]string) error {
+	client := rpc.NewClient(sess, codec.JSONCodec{})
+	_, err := client.Call(ctx, AnnounceSelector, AnnounceRequest{Name: name, Meta: meta})
+	return err
+}
+
+// List returns the presence of the peers registered with the broker on
+// sess, sorted by name.
+func List(ctx context.Context, sess mux.Session) ([]Peer, error) {
+	client := rpc.NewClient(sess, codec.JSONCodec{})
+	var peers []Peer
+	if _, err := client.Call(ctx, ListSelector, nil, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Watch returns the peers registered with the broker on sess and a channel
+// of the events that follow. The channel is closed when ctx is done, the
+// session ends or the watcher falls too far behind and is disconnected by
+// the broker.
+func Watch(ctx context.Context, sess mux.Session) ([]Peer, <-chan Event, error) {
+	client := rpc.NewClient(sess, codec.JSONCodec{})
+	var peers []Peer
+	resp, err := client.Call(ctx, WatchSelector, nil, &peers)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		resp.Channel.Close()
+	}()
+	go func() {
+		defer close(events)
+		defer close(done)
+		for {
+			var ev Event
+			if err := resp.Receive(&ev); err != nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return peers, events, nil
+}
@@ -0,0 +1,284 @@
+package broker
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// PunchRequest is the argument of PunchSelector calls, made by a client to
+// the broker and forwarded by the broker to the peer.
+type PunchRequest struct {
+	// Name is the name of the peer to connect to.
+	Name string
+
+	// Token is sent by the client on each connection it establishes, so
+	// the peer can tell them apart from unrelated connections.
+	Token string
+
+	// Candidates are the addresses the client listens on, to which the
+	// broker adds the addresses it sees the client connecting from.
+	Candidates []string
+
+	// Timeout is how long the client keeps trying to connect.
+	Timeout time.Duration
+}
+
+// PunchReply is the reply of PunchSelector calls, with the addresses the peer
+// listens on, to which the broker adds the addresses it sees the peer
+// connecting from.
+type PunchReply struct {
+	Candidates []string
+}
+
+// punchAck is sent by the peer on the connection it picked.
+const punchAck = 1
+
+func (b *Broker) punch(r rpc.Responder, c *rpc.Call) {
+	var req PunchRequest
+	if err := c.Receive(&req); err != nil {
+		r.Return(err)
+		return
+	}
+	peer, err := b.peer(req.Name)
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	req.Candidates = observed(c.Caller.(*rpc.Client).Session, req.Candidates)
+	var reply PunchReply
+	if _, err := peer.Call(c.Context, PunchSelector, req, &reply); err != nil {
+		r.Return(err)
+		return
+	}
+	reply.Candidates = observed(peer.Session, reply.Candidates)
+	r.Return(reply)
+}
+
+// observed adds the address sess is connected from with the ports of the
+// candidates, which reaches a listener behind a NAT that preserves ports or
+// reuses the mapping of previous connections.
+func observed(sess mux.Session, candidates []string) []string {
+	ra, ok := sess.(mux.RemoteAddrer)
+	if !ok {
+		return candidates
+	}
+	tcp, ok := ra.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return candidates
+	}
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		seen[c] = true
+	}
+	out := candidates
+	for _, c := range candidates {
+		_, port, err := net.SplitHostPort(c)
+		if err != nil {
+			continue
+		}
+		addr := net.JoinHostPort(tcp.IP.String(), port)
+		if !seen[addr] {
+			seen[addr] = true
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+func (l *listener) punch(r rpc.Responder, c *rpc.Call) {
+	var req PunchRequest
+	if err := c.Receive(&req); err != nil {
+		r.Return(err)
+		return
+	}
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		token := []byte(req.Token)
+		conn, err := connect(ctx, ln, req.Candidates, func(conn net.Conn) error {
+			b := make([]byte, len(token))
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return err
+			}
+			if subtle.ConstantTimeCompare(b, token) != 1 {
+				return errors.New("broker: invalid punch token")
+			}
+			return nil
+		}, func(conn net.Conn) error {
+			_, err := conn.Write([]byte{punchAck})
+			return err
+		})
+		if err == nil {
+			l.deliver(mux.New(conn))
+		}
+	}()
+	r.Return(PunchReply{Candidates: candidates(ln)})
+}
+
+// DialDirect is like Dial, but first tries to connect to the peer directly
+// for up to timeout. Candidate addresses are exchanged through the broker and
+// both sides connect to each other at the same time, which can open a path
+// through their NATs. It falls back to a relayed session if no direct
+// connection is established.
+func DialDirect(ctx context.Context, sess mux.Session, name string, timeout time.Duration) (mux.Session, error) {
+	if direct, err := dialDirect(ctx, sess, name, timeout); err == nil {
+		return direct, nil
+	}
+	return Dial(ctx, sess, name)
+}
+
+func dialDirect(ctx context.Context, sess mux.Session, name string, timeout time.Duration) (mux.Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var b [16]byte
+	crand.Read(b[:])
+	token := []byte(hex.EncodeToString(b[:]))
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	req := PunchRequest{
+		Name:       name,
+		Token:      string(token),
+		Candidates: candidates(ln),
+		Timeout:    timeout,
+	}
+	var reply PunchReply
+	client := rpc.NewClient(sess, codec.JSONCodec{})
+	if _, err := client.Call(ctx, PunchSelector, req, &reply); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	conn, err := connect(ctx, ln, reply.Candidates, func(conn net.Conn) error {
+		if _, err := conn.Write(token); err != nil {
+			return err
+		}
+		var ack [1]byte
+		if _, err := io.ReadFull(conn, ack[:]); err != nil {
+			return err
+		}
+		if ack[0] != punchAck {
+			return errors.New("broker: invalid punch ack")
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return mux.New(conn), nil
+}
+
+// candidates returns the addresses of the local interfaces with the port
+// of ln.
+func candidates(ln net.Listener) []string {
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	addrs, _ := net.InterfaceAddrs()
+	var out []string
+	for _, a := range addrs {
+		if ip, ok := a.(*net.IPNet); ok && !ip.IP.IsLinkLocalUnicast() {
+			out = append(out, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	return out
+}
+
+// connect accepts connections on ln while dialing each of addrs until ctx is
+// done, returning the first connection for which verify succeeds, after
+// confirm if set. Dials are retried, since the other side may not have
+// opened its NAT yet. The listener is closed when connect returns.
+func connect(ctx context.Context, ln net.Listener, addrs []string, verify, confirm func(net.Conn) error) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer ln.Close()
+
+	var mu sync.Mutex
+	var won net.Conn
+	done := make(chan net.Conn, 1)
+	try := func(conn net.Conn) {
+		// connections that did not win are closed once connect returns
+		go func() {
+			<-ctx.Done()
+			mu.Lock()
+			if won != conn {
+				conn.Close()
+			}
+			mu.Unlock()
+		}()
+		if dl, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(dl)
+		}
+		if verify(conn) != nil {
+			conn.Close()
+			return
+		}
+		mu.Lock()
+		first := won == nil
+		if first {
+			won = conn
+		}
+		mu.Unlock()
+		if !first || (confirm != nil && confirm(conn) != nil) {
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		done <- conn
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go try(conn)
+		}
+	}()
+	for _, addr := range addrs {
+		go func(addr string) {
+			var d net.Dialer
+			for {
+				conn, err := d.DialContext(ctx, "tcp", addr)
+				if err == nil {
+					try(conn)
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		}(addr)
+	}
+
+	select {
+	case conn := <-done:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
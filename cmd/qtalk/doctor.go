@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+	"github.com/roachadam/qtalk-go/talk"
+)
+
+// report prints the results of the checks of doctor as a table.
+type report struct {
+	w      *tabwriter.Writer
+	failed bool
+}
+
+func (r *report) add(check, status, format string, args ...any) {
+	if status == "FAIL" {
+		r.failed = true
+	}
+	fmt.Fprintf(r.w, "%s\t%s\t%s\n", check, status, fmt.Sprintf(format, args...))
+}
+
+// dialDoctor dials addr sending a session hello, which the standard dialers
+// do not, so the handshake can be checked. Socket options of tcp addresses
+// are ignored.
+func dialDoctor(scheme, addr string, timeout time.Duration) (mux.Session, error) {
+	config := &mux.SessionConfig{Features: mux.FeatureExtensions}
+	switch scheme {
+	case "tcp", "unix":
+		if scheme == "tcp" {
+			var err error
+			if addr, _, err = talk.ParseSocketOptions(addr); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := net.DialTimeout(scheme, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return mux.NewWithConfig(conn, config), nil
+	case "ws":
+		return mux.DialWSConfig(addr, &mux.WSConfig{Codecs: []string{"json"}})
+	default:
+		d, ok := talk.Dialers[scheme]
+		if !ok {
+			return nil, fmt.Errorf("transport '%s' not in available in Dialers", scheme)
+		}
+		return d(addr)
+	}
+}
+
+func doctorCmd(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout of each check")
+	count := fs.Int("count", 5, "number of round trips to measure")
+	size := fs.Int("size", 1<<20, "bytes to send to measure throughput")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: qtalk doctor [--timeout d] [--count n] [--size bytes] <url>")
+	}
+	u := parseURL(fs.Arg(0))
+
+	r := &report{w: tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)}
+	defer func() {
+		r.w.Flush()
+		if r.failed {
+			os.Exit(1)
+		}
+	}()
+
+	start := time.Now()
+	sess, err := dialDoctor(u.Scheme, u.Host, *timeout)
+	if err != nil {
+		r.add("dial", "FAIL", "%v", err)
+		return
+	}
+	defer sess.Close()
+	r.add("dial", "ok", "%s %s in %v", u.Scheme, u.Host, time.Since(start).Round(time.Microsecond))
+	client := rpc.NewClient(sess, codec.JSONCodec{})
+
+	call := func(selector string, args any) (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		start := time.Now()
+		_, err := client.Call(ctx, selector, args)
+		return time.Since(start), err
+	}
+
+	// the first call completes the hello exchange
+	first, err := call(rpc.HeartbeatSelector, nil)
+	var remote rpc.RemoteError
+	heartbeat := err == nil
+	if err != nil && !errors.As(err, &remote) {
+		r.add("handshake", "FAIL", "no reply to a call: %v", err)
+		return
+	}
+	var version uint32
+	var features mux.Features
+	if n, ok := sess.(mux.Negotiator); ok {
+		version, features = n.Protocol()
+	}
+	if version == 0 {
+		r.add("handshake", "warn", "peer sent no session hello, so no features were negotiated")
+	} else {
+		r.add("handshake", "ok", "protocol v%d, features %s", version, features)
+	}
+
+	if sp, ok := sess.(mux.Subprotocoler); ok && sp.Subprotocol() != "" {
+		r.add("codec", "ok", "json, subprotocol %s", sp.Subprotocol())
+	} else if u.Scheme == "ws" {
+		r.add("codec", "warn", "json, server selected no subprotocol")
+	} else {
+		r.add("codec", "ok", "json, replies decoded")
+	}
+
+	// selectors replying without reading their argument would fail the
+	// throughput check, so a handler known to read it is used
+	selector := rpc.ReflectSelector
+	if heartbeat {
+		selector = rpc.HeartbeatSelector
+	}
+	min, total := first, time.Duration(0)
+	for i := 0; i < *count; i++ {
+		d, err := call(selector, nil)
+		if err != nil && !errors.As(err, &remote) {
+			r.add("rtt", "FAIL", "%v", err)
+			return
+		}
+		total += d
+		if d < min {
+			min = d
+		}
+	}
+	if *count > 0 {
+		r.add("rtt", "ok", "min %v, avg %v over %d calls",
+			min.Round(time.Microsecond), (total / time.Duration(*count)).Round(time.Microsecond), *count)
+	}
+
+	switch {
+	case heartbeat:
+		r.add("keepalive", "ok", "%s responding", rpc.HeartbeatSelector)
+	case strings.Contains(err.Error(), "not found"):
+		r.add("keepalive", "warn", "no %s handler, so watchdogs cannot check the peer", rpc.HeartbeatSelector)
+	default:
+		r.add("keepalive", "FAIL", "%s failed: %v", rpc.HeartbeatSelector, err)
+	}
+
+	if *size > 0 {
+		d, err := call(selector, strings.Repeat("x", *size))
+		switch {
+		case errors.As(err, &remote) && selector != rpc.HeartbeatSelector:
+			r.add("throughput", "warn", "skipped, no %s or %s handler", rpc.HeartbeatSelector, rpc.ReflectSelector)
+		case err != nil:
+			r.add("throughput", "FAIL", "sending %d bytes: %v", *size, err)
+		default:
+			mib := float64(*size) / (1 << 20)
+			r.add("throughput", "ok", "%.1f MiB/s sending %d bytes", mib/d.Seconds(), *size)
+		}
+	}
+}
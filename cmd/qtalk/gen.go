@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/roachadam/qtalk-go/idl"
+)
+
+const genUsage = "usage: qtalk gen [--interface dir.Name | idl file] [--out file] [--pkg name] [--ts file]"
+
+func genCmd(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	iface := fs.String("interface", "", "generate from the Go interface `dir.Name`, like ./users.Service")
+	out := fs.String("out", "", "write generated Go source to `file`")
+	pkg := fs.String("pkg", "", "package name of generated Go source (default main, or the package of the interface)")
+	tsOut := fs.String("ts", "", "write generated TypeScript definitions to `file`")
+	fs.Parse(args)
+	if (*iface == "") == (fs.NArg() != 1) || fs.NArg() > 1 {
+		log.Fatal(genUsage)
+	}
+
+	var f *idl.File
+	var err error
+	if *iface != "" {
+		// the name follows the last dot, which may also begin a relative dir
+		i := strings.LastIndex(*iface, ".")
+		if i < 0 {
+			log.Fatal(genUsage)
+		}
+		dir := (*iface)[:i]
+		if dir == "" {
+			dir = "."
+		}
+		f, err = idl.ParseGo(dir, (*iface)[i+1:])
+	} else {
+		var in *os.File
+		in, err = os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer in.Close()
+		f, err = idl.Parse(fs.Arg(0), in)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out != "" {
+		// services declared in Go already have their types and server
+		// interface, so only clients are generated for them
+		gen := f.GenerateGo
+		name := *pkg
+		if *iface != "" {
+			gen = f.GenerateGoClient
+			if name == "" {
+				name = f.Package
+			}
+		}
+		if name == "" {
+			name = "main"
+		}
+		writeFile(*out, func(w io.Writer) error {
+			return gen(w, name)
+		})
+	}
+	if *tsOut != "" {
+		writeFile(*tsOut, f.GenerateTS)
+	}
+}
+
+func writeFile(path string, gen func(io.Writer) error) {
+	out, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := gen(out); err != nil {
+		out.Close()
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
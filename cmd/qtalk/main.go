@@ -5,38 +5,127 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/url"
+	"os"
+	"strings"
 
 	"github.com/progrium/clon-go"
 	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/command"
+	"github.com/roachadam/qtalk-go/rpc"
 	"github.com/roachadam/qtalk-go/talk"
 )
 
+const usage = `usage: qtalk <command> [arguments]
+
+commands:
+  call [--json arg] [--reply-schema file] <url> [args...]
+                               call the selector in the url path
+  serve [--exec dir] <url>     serve handlers on the url address
+  doctor <url>                 check the connection to the url address
+  gen [--interface dir.Name | idl file] [--out file] [--ts file]
+                               generate clients and TypeScript definitions
+`
+
 func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
 	flag.Parse()
 
-	cmd := flag.Arg(0)
-	// if cmd != "call" {
-	// 	log.Fatal("unknown command")
-	// 	return
-	// }
-	fmt.Println(cmd)
-	return
+	switch flag.Arg(0) {
+	case "call":
+		callCmd(flag.Args()[1:])
+	case "serve":
+		serveCmd(flag.Args()[1:])
+	case "doctor":
+		doctorCmd(flag.Args()[1:])
+	case "gen":
+		genCmd(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
 
-	u, err := url.Parse(flag.Arg(1))
+func parseURL(s string) *url.URL {
+	u, err := url.Parse(s)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if u.Scheme == "unix" {
+		// unix socket paths are in the url path
+		u.Host = u.Path
+		u.Path = ""
+	}
+	return u
+}
 
-	var args any
-	if len(flag.Args()) > 2 {
-		args, err = clon.Parse(flag.Args()[2:])
+// readJSON decodes a JSON value given inline, read from a file if prefixed
+// with @, or read from stdin if it is "-".
+func readJSON(arg string) (any, error) {
+	var b []byte
+	var err error
+	switch {
+	case arg == "-":
+		b, err = io.ReadAll(os.Stdin)
+	case strings.HasPrefix(arg, "@"):
+		b, err = os.ReadFile(strings.TrimPrefix(arg, "@"))
+	default:
+		b = []byte(arg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+	return v, nil
+}
+
+func callCmd(args []string) {
+	fs := flag.NewFlagSet("call", flag.ExitOnError)
+	jsonArg := fs.String("json", "", "pass the JSON value `arg` as arguments, read from a file if @file or stdin if -")
+	replySchema := fs.String("reply-schema", "", "validate the reply against the JSON Schema in `file`")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		log.Fatal("usage: qtalk call [--json arg] [--reply-schema file] <url> [args...]")
+	}
+
+	u := parseURL(fs.Arg(0))
+
+	var err error
+	var params any
+	switch {
+	case *jsonArg != "" && fs.NArg() > 1:
+		log.Fatal("--json cannot be used with CLON arguments")
+	case *jsonArg != "":
+		params, err = readJSON(*jsonArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case fs.NArg() > 1:
+		params, err = clon.Parse(fs.Args()[1:])
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	var schema map[string]any
+	if *replySchema != "" {
+		b, err := os.ReadFile(*replySchema)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &schema); err != nil {
+			log.Fatalf("invalid reply schema: %v", err)
+		}
+	}
+
 	peer, err := talk.Dial(u.Scheme, u.Host, codec.JSONCodec{})
 	if err != nil {
 		log.Fatal(err)
@@ -44,7 +133,7 @@ func main() {
 	defer peer.Close()
 
 	var ret any
-	_, err = peer.Call(context.Background(), u.Path, args, &ret)
+	_, err = peer.Call(context.Background(), u.Path, params, &ret)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -54,4 +143,41 @@ func main() {
 		log.Fatal(err)
 	}
 	fmt.Println(string(b))
+
+	if schema != nil {
+		if err := rpc.Validate(schema, ret); err != nil {
+			log.Fatalf("reply does not match schema: %v", err)
+		}
+	}
+}
+
+func serveCmd(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	execDir := fs.String("exec", "", "expose executables in `dir` as selectors")
+	stream := fs.Bool("stream", false, "stream output of executables")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: qtalk serve [--exec dir] <url>")
+	}
+	u := parseURL(fs.Arg(0))
+
+	mux := rpc.NewRespondMux()
+	if *execDir != "" {
+		h, err := command.DirHandler(*execDir, *stream)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux.Handle("", h)
+	}
+	mux.Handle(rpc.ReflectSelector, rpc.ReflectionHandler(mux))
+	mux.Handle(rpc.HeartbeatSelector, rpc.HeartbeatHandler())
+
+	l, err := talk.Listen(u.Scheme, u.Host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &rpc.Server{Handler: mux, Codec: codec.JSONCodec{}}
+	log.Fatal(srv.ServeMux(l))
 }
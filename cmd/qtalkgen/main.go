@@ -0,0 +1,59 @@
+// Command qtalkgen generates Go server interfaces, typed clients and
+// TypeScript definitions from a qtalk IDL file.
+//
+//	qtalkgen -go users_gen.go -pkg users -ts users.d.ts users.qtalk
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/roachadam/qtalk-go/idl"
+)
+
+func main() {
+	goOut := flag.String("go", "", "write generated Go source to `file`")
+	goPkg := flag.String("pkg", "main", "package name of generated Go source")
+	tsOut := flag.String("ts", "", "write generated TypeScript definitions to `file`")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal("usage: qtalkgen [-go file -pkg name] [-ts file] <idl file>")
+	}
+
+	in, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+
+	f, err := idl.Parse(flag.Arg(0), in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *goOut != "" {
+		writeFile(*goOut, func(out io.Writer) error {
+			return f.GenerateGo(out, *goPkg)
+		})
+	}
+	if *tsOut != "" {
+		writeFile(*tsOut, f.GenerateTS)
+	}
+}
+
+func writeFile(path string, gen func(io.Writer) error) {
+	out, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := gen(out); err != nil {
+		out.Close()
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
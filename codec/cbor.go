@@ -0,0 +1,1203 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CBORCodec provides a codec API for CBOR as specified by RFC 8949. Unlike
+// JSON, it keeps byte slices as bytes and integers as integers, so values
+// carrying binary payloads or numbers beyond the 53 bits of a float64 are
+// encoded compactly and decode to the values sent.
+//
+// Values are encoded like encoding/json lays them out: structs as maps keyed
+// by field name, using the "cbor" key of the field tag or else the "json"
+// key, with the same omitempty and "-" options and the fields of embedded
+// structs promoted. Types implementing encoding.TextMarshaler are encoded as
+// text strings, and decoded with encoding.TextUnmarshaler. Decoding
+// generically into an interface gives int64 for integers, or uint64 for
+// those above math.MaxInt64, float64 for floats, []byte, string, []any, and
+// map[string]any for maps keyed by text strings or map[any]any otherwise.
+// Tags are ignored when decoding, and items of indefinite length are
+// decoded but never encoded.
+type CBORCodec struct {
+	// Canonical makes encoders write the deterministic encoding of RFC 8949
+	// section 4.2.1, so equal values always encode to the same bytes: the
+	// keys of maps, including struct fields, are sorted by their encoding,
+	// and floats are written in the shortest form keeping their value.
+	// Decoding is unaffected.
+	Canonical bool
+
+	// DisallowUnknownFields makes decoding a map into a struct fail if it
+	// has a key matching no field of the struct, as for JSONCodec.
+	DisallowUnknownFields bool
+}
+
+// Encoder returns a CBOR encoder. It implements ResetEncoder.
+func (c CBORCodec) Encoder(w io.Writer) Encoder {
+	return &cborEncoder{w: w, canonical: c.Canonical}
+}
+
+// Decoder returns a CBOR decoder. It implements ResetDecoder.
+func (c CBORCodec) Decoder(r io.Reader) Decoder {
+	return &cborDecoder{r: bufio.NewReader(r), strict: c.DisallowUnknownFields}
+}
+
+// Unmarshal decodes a single CBOR value.
+func (c CBORCodec) Unmarshal(data []byte, v interface{}) error {
+	return unmarshalCBOR(data, v, c.DisallowUnknownFields)
+}
+
+// major types of the initial byte of data items
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// initial bytes of simple values and floats
+const (
+	cborFalse     = 0xf4
+	cborTrue      = 0xf5
+	cborNull      = 0xf6
+	cborUndefined = 0xf7
+	cborFloat16   = 0xf9
+	cborFloat32   = 0xfa
+	cborFloat64   = 0xfb
+	cborBreak     = 0xff
+)
+
+// cborIndefinite is the additional information of items of indefinite
+// length, ended by a break.
+const cborIndefinite = 31
+
+// maxCBORDepth limits the nesting of encoded and decoded values, as for
+// encoding/json, so cyclic values and hostile input fail instead of
+// exhausting the stack.
+const maxCBORDepth = 10000
+
+var errCBORDepth = errors.New("cbor: exceeded max depth")
+
+// maxPooledCBOR is the largest encoding buffer kept by an encoder between
+// values.
+const maxPooledCBOR = 1 << 16
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+type cborEncoder struct {
+	w         io.Writer
+	canonical bool
+	buf       []byte
+}
+
+func (e *cborEncoder) Reset(w io.Writer) {
+	e.w = w
+}
+
+func (e *cborEncoder) Encode(v interface{}) error {
+	s := cborEncodeState{canonical: e.canonical}
+	b, err := s.append(e.buf[:0], reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	if cap(b) <= maxPooledCBOR {
+		e.buf = b
+	}
+	_, err = e.w.Write(b)
+	return err
+}
+
+type cborEncodeState struct {
+	canonical bool
+	depth     int
+}
+
+// appendCBORHead appends the initial byte and argument of an item.
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, major|27), n)
+	}
+}
+
+func (s *cborEncodeState) append(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, cborNull), nil
+	}
+	if s.depth++; s.depth > maxCBORDepth {
+		return b, errCBORDepth
+	}
+	defer func() { s.depth-- }()
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(b, cborNull), nil
+		}
+		return s.append(b, v.Elem())
+	}
+	if m, ok := textMarshaler(v); ok {
+		text, err := m.MarshalText()
+		if err != nil {
+			return b, fmt.Errorf("cbor: marshaling %s: %w", v.Type(), err)
+		}
+		return append(appendCBORHead(b, cborText, uint64(len(text))), text...), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, cborTrue), nil
+		}
+		return append(b, cborFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n < 0 {
+			return appendCBORHead(b, cborNegInt, uint64(^n)), nil
+		}
+		return appendCBORHead(b, cborUint, uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendCBORHead(b, cborUint, v.Uint()), nil
+	case reflect.Float32:
+		if s.canonical {
+			return appendShortestFloat(b, v.Float()), nil
+		}
+		return binary.BigEndian.AppendUint32(append(b, cborFloat32), math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		if s.canonical {
+			return appendShortestFloat(b, v.Float()), nil
+		}
+		return binary.BigEndian.AppendUint64(append(b, cborFloat64), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return append(appendCBORHead(b, cborText, uint64(v.Len())), v.String()...), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(b, cborNull), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(appendCBORHead(b, cborBytes, uint64(v.Len())), v.Bytes()...), nil
+		}
+		return s.appendArray(b, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b = appendCBORHead(b, cborBytes, uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				b = append(b, byte(v.Index(i).Uint()))
+			}
+			return b, nil
+		}
+		return s.appendArray(b, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, cborNull), nil
+		}
+		return s.appendMap(b, v)
+	case reflect.Struct:
+		return s.appendStruct(b, v)
+	}
+	return b, fmt.Errorf("cbor: unsupported type %s", v.Type())
+}
+
+// textMarshaler returns the encoding.TextMarshaler of v, if its type or
+// the pointer to it when addressable implements it.
+func textMarshaler(v reflect.Value) (encoding.TextMarshaler, bool) {
+	if v.Type().Implements(textMarshalerType) {
+		return v.Interface().(encoding.TextMarshaler), true
+	}
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(textMarshalerType) {
+		return v.Addr().Interface().(encoding.TextMarshaler), true
+	}
+	return nil, false
+}
+
+func (s *cborEncodeState) appendArray(b []byte, v reflect.Value) ([]byte, error) {
+	b = appendCBORHead(b, cborArray, uint64(v.Len()))
+	var err error
+	for i := 0; i < v.Len(); i++ {
+		if b, err = s.append(b, v.Index(i)); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (s *cborEncodeState) appendMap(b []byte, v reflect.Value) ([]byte, error) {
+	b = appendCBORHead(b, cborMap, uint64(v.Len()))
+	var err error
+	iter := v.MapRange()
+	if !s.canonical {
+		for iter.Next() {
+			if b, err = s.append(b, iter.Key()); err != nil {
+				return b, err
+			}
+			if b, err = s.append(b, iter.Value()); err != nil {
+				return b, err
+			}
+		}
+		return b, nil
+	}
+
+	// entries are encoded apart to sort them by the encoding of their key
+	type entry struct{ key, value []byte }
+	entries := make([]entry, 0, v.Len())
+	var buf []byte
+	for iter.Next() {
+		start := len(buf)
+		if buf, err = s.append(buf, iter.Key()); err != nil {
+			return b, err
+		}
+		mid := len(buf)
+		if buf, err = s.append(buf, iter.Value()); err != nil {
+			return b, err
+		}
+		entries = append(entries, entry{buf[start:mid:mid], buf[mid:]})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	for _, e := range entries {
+		b = append(append(b, e.key...), e.value...)
+	}
+	return b, nil
+}
+
+func (s *cborEncodeState) appendStruct(b []byte, v reflect.Value) ([]byte, error) {
+	info := cborStructOf(v.Type())
+	fields := info.fields
+	if s.canonical {
+		fields = info.sorted
+	}
+	values := make([]reflect.Value, 0, len(fields))
+	included := make([]*cborField, 0, len(fields))
+	for i := range fields {
+		f := &fields[i]
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		values = append(values, fv)
+		included = append(included, f)
+	}
+	b = appendCBORHead(b, cborMap, uint64(len(included)))
+	var err error
+	for i, f := range included {
+		b = append(b, f.key...)
+		if b, err = s.append(b, values[i]); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// fieldByIndex returns the field of v at index, or false if it is in an
+// embedded struct behind a nil pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// appendShortestFloat appends f as the shortest of a half, single or
+// double precision float keeping its value, with NaN as a half precision
+// quiet NaN.
+func appendShortestFloat(b []byte, f float64) []byte {
+	if math.IsNaN(f) {
+		return append(b, cborFloat16, 0x7e, 0x00)
+	}
+	f32 := float32(f)
+	if float64(f32) != f {
+		return binary.BigEndian.AppendUint64(append(b, cborFloat64), math.Float64bits(f))
+	}
+	if h, ok := float16Bits(f32); ok {
+		return binary.BigEndian.AppendUint16(append(b, cborFloat16), h)
+	}
+	return binary.BigEndian.AppendUint32(append(b, cborFloat32), math.Float32bits(f32))
+}
+
+// float16Bits returns the half precision encoding of f, or false if it
+// cannot be represented exactly. f must not be NaN.
+func float16Bits(f float32) (uint16, bool) {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23) & 0xff
+	mant := bits & 0x7fffff
+	switch {
+	case exp == 0xff:
+		return sign | 0x7c00, true
+	case exp == 0 && mant == 0:
+		return sign, true
+	case exp == 0:
+		// single precision subnormals are too small
+		return 0, false
+	}
+	e := exp - 127 + 15
+	switch {
+	case e >= 31:
+		return 0, false
+	case e >= 1:
+		if mant&0x1fff != 0 {
+			return 0, false
+		}
+		return sign | uint16(e)<<10 | uint16(mant>>13), true
+	}
+	// half precision subnormals are multiples of 2^-24
+	shift := 126 - exp
+	mant |= 0x800000
+	if shift > 24 || mant&(1<<shift-1) != 0 {
+		return 0, false
+	}
+	return sign | uint16(mant>>shift), true
+}
+
+func float16ToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant != 0 {
+			return math.NaN()
+		}
+		f = math.Inf(1)
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// cborField is a field of a struct encoded as a map entry.
+type cborField struct {
+	name      string
+	key       []byte // the encoding of name
+	index     []int
+	omitEmpty bool
+}
+
+// cborStruct is the fields of a struct type, in the order of their
+// declaration and of their keys for canonical encoders.
+type cborStruct struct {
+	fields []cborField
+	sorted []cborField
+	byName map[string]*cborField
+}
+
+var cborStructs sync.Map // map[reflect.Type]*cborStruct
+
+func cborStructOf(t reflect.Type) *cborStruct {
+	if s, ok := cborStructs.Load(t); ok {
+		return s.(*cborStruct)
+	}
+	s := &cborStruct{byName: make(map[string]*cborField)}
+	s.fields = cborFields(t)
+	for i := range s.fields {
+		s.byName[s.fields[i].name] = &s.fields[i]
+	}
+	s.sorted = append([]cborField(nil), s.fields...)
+	sort.Slice(s.sorted, func(i, j int) bool {
+		return bytes.Compare(s.sorted[i].key, s.sorted[j].key) < 0
+	})
+	actual, _ := cborStructs.LoadOrStore(t, s)
+	return actual.(*cborStruct)
+}
+
+// lookup returns the field named name, falling back to a case-insensitive
+// match as encoding/json does.
+func (s *cborStruct) lookup(name string) *cborField {
+	if f, ok := s.byName[name]; ok {
+		return f
+	}
+	for i := range s.fields {
+		if strings.EqualFold(s.fields[i].name, name) {
+			return &s.fields[i]
+		}
+	}
+	return nil
+}
+
+// cborFields returns the fields of struct type t, promoting the fields of
+// embedded structs unless a shallower field has the same name. Fields
+// with the same name at the same depth are dropped.
+func cborFields(t reflect.Type) []cborField {
+	type candidate struct {
+		cborField
+		depth int
+	}
+	var candidates []candidate
+	var walk func(t reflect.Type, index []int, depth int)
+	walk = func(t reflect.Type, index []int, depth int) {
+		if depth > maxCBORDepth {
+			return
+		}
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("cbor")
+			if tag == "" {
+				tag = sf.Tag.Get("json")
+			}
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			fieldIndex := append(append([]int(nil), index...), i)
+			if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				walk(ft, fieldIndex, depth+1)
+				continue
+			}
+			if !sf.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			candidates = append(candidates, candidate{cborField{
+				name:      name,
+				key:       append(appendCBORHead(nil, cborText, uint64(len(name))), name...),
+				index:     fieldIndex,
+				omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+			}, depth})
+		}
+	}
+	walk(t, nil, 0)
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].name != candidates[j].name {
+			return candidates[i].name < candidates[j].name
+		}
+		return candidates[i].depth < candidates[j].depth
+	})
+	var fields []cborField
+	for i := 0; i < len(candidates); {
+		j := i + 1
+		for j < len(candidates) && candidates[j].name == candidates[i].name {
+			j++
+		}
+		if j == i+1 || candidates[i+1].depth > candidates[i].depth {
+			fields = append(fields, candidates[i].cborField)
+		}
+		i = j
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i].index, fields[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return fields
+}
+
+type cborDecoder struct {
+	r      *bufio.Reader
+	strict bool
+	buf    []byte
+}
+
+func (d *cborDecoder) Reset(r io.Reader) {
+	d.r.Reset(r)
+}
+
+// Decode reads a whole item before decoding it, so the next item is read
+// from its start even if decoding fails.
+func (d *cborDecoder) Decode(v interface{}) error {
+	data, err := readCBORItem(d.r, d.buf[:0], 0)
+	if err != nil {
+		if err == io.EOF && len(data) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if cap(data) <= maxPooledCBOR {
+		d.buf = data
+	}
+	return unmarshalCBOR(data, v, d.strict)
+}
+
+// readCBORItem appends the bytes of the next item read from r to b. It
+// returns io.EOF if r ends before the item.
+func readCBORItem(r *bufio.Reader, b []byte, depth int) ([]byte, error) {
+	if depth > maxCBORDepth {
+		return b, errCBORDepth
+	}
+	ib, err := r.ReadByte()
+	if err != nil {
+		return b, err
+	}
+	b = append(b, ib)
+	major, info := ib>>5, ib&0x1f
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		start := len(b)
+		b = append(b, make([]byte, size)...)
+		if _, err := io.ReadFull(r, b[start:]); err != nil {
+			return b, unexpectedEOF(err)
+		}
+		n = cborArgument(b[start:])
+	case info == cborIndefinite && major >= cborBytes && major <= cborMap:
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return b, unexpectedEOF(err)
+			}
+			if c == cborBreak {
+				return append(b, c), nil
+			}
+			r.UnreadByte()
+			items := 1
+			if major == cborMap {
+				items = 2
+			}
+			for i := 0; i < items; i++ {
+				if b, err = readCBORItem(r, b, depth+1); err != nil {
+					return b, unexpectedEOF(err)
+				}
+			}
+		}
+	default:
+		return b, fmt.Errorf("cbor: invalid initial byte 0x%02x", ib)
+	}
+
+	switch major {
+	case cborBytes, cborText:
+		// the data is read as it arrives, so a hostile length fails once
+		// the reader ends instead of allocating it up front
+		for n > 0 {
+			chunk := n
+			if chunk > maxPooledCBOR {
+				chunk = maxPooledCBOR
+			}
+			start := len(b)
+			b = append(b, make([]byte, chunk)...)
+			if _, err := io.ReadFull(r, b[start:]); err != nil {
+				return b, unexpectedEOF(err)
+			}
+			n -= chunk
+		}
+	case cborArray, cborMap:
+		if major == cborMap {
+			n *= 2
+		}
+		for ; n > 0; n-- {
+			if b, err = readCBORItem(r, b, depth+1); err != nil {
+				return b, unexpectedEOF(err)
+			}
+		}
+	case cborTag:
+		if b, err = readCBORItem(r, b, depth+1); err != nil {
+			return b, unexpectedEOF(err)
+		}
+	}
+	return b, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// cborArgument returns the big endian integer of b.
+func cborArgument(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+func unmarshalCBOR(data []byte, v interface{}, strict bool) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cbor: cannot decode into %T", v)
+	}
+	d := cborDecodeState{data: data, strict: strict}
+	if err := d.value(rv.Elem()); err != nil {
+		return err
+	}
+	if d.off != len(data) {
+		return errors.New("cbor: invalid data after top-level value")
+	}
+	return nil
+}
+
+// cborDecodeState decodes the items of data from off.
+type cborDecodeState struct {
+	data   []byte
+	off    int
+	strict bool
+	depth  int
+}
+
+// head reads the initial byte and argument of the next item.
+func (d *cborDecodeState) head() (major, info byte, n uint64, err error) {
+	if d.off >= len(d.data) {
+		return 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	ib := d.data[d.off]
+	d.off++
+	major, info = ib>>5, ib&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(d.data)-d.off < size {
+			return 0, 0, 0, io.ErrUnexpectedEOF
+		}
+		n = cborArgument(d.data[d.off : d.off+size])
+		d.off += size
+		return major, info, n, nil
+	case info == cborIndefinite && (major >= cborBytes && major <= cborMap || ib == cborBreak):
+		return major, info, 0, nil
+	}
+	return 0, 0, 0, fmt.Errorf("cbor: invalid initial byte 0x%02x", ib)
+}
+
+// atBreak consumes the break ending an item of indefinite length, if it is
+// next.
+func (d *cborDecodeState) atBreak() (bool, error) {
+	if d.off >= len(d.data) {
+		return false, io.ErrUnexpectedEOF
+	}
+	if d.data[d.off] == cborBreak {
+		d.off++
+		return true, nil
+	}
+	return false, nil
+}
+
+// count checks the number of items n an array or map can have in the
+// remaining data, each taking at least a byte.
+func (d *cborDecodeState) count(n uint64, per uint64) (int, error) {
+	if n > uint64(len(d.data)-d.off)/per {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+// chunks returns the data of a byte or text string, concatenating the
+// chunks of strings of indefinite length. The data may be part of d.data.
+func (d *cborDecodeState) chunks(major, info byte, n uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		if n > uint64(len(d.data)-d.off) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := d.data[d.off : d.off+int(n)]
+		d.off += int(n)
+		return b, nil
+	}
+	b := []byte{}
+	for {
+		done, err := d.atBreak()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return b, nil
+		}
+		m, info, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || info == cborIndefinite {
+			return nil, errors.New("cbor: invalid chunk of string of indefinite length")
+		}
+		chunk, err := d.chunks(m, info, n)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+}
+
+func (d *cborDecodeState) typeError(what string, t reflect.Type) error {
+	return fmt.Errorf("cbor: cannot decode %s into Go value of type %s", what, t)
+}
+
+// value decodes the next item into v.
+func (d *cborDecodeState) value(v reflect.Value) error {
+	if d.depth++; d.depth > maxCBORDepth {
+		return errCBORDepth
+	}
+	defer func() { d.depth-- }()
+	if d.off >= len(d.data) {
+		return io.ErrUnexpectedEOF
+	}
+
+	switch ib := d.data[d.off]; {
+	case ib == cborNull || ib == cborUndefined:
+		d.off++
+		switch v.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	case ib>>5 == cborTag:
+		if _, _, _, err := d.head(); err != nil {
+			return err
+		}
+		return d.value(v)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return d.typeError("value", v.Type())
+		}
+		g, err := d.generic()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(g))
+		return nil
+	}
+
+	major, info, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	if major == cborText && v.CanAddr() && reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		text, err := d.chunks(major, info, n)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(text)
+	}
+
+	switch major {
+	case cborUint:
+		return d.setUint(v, n)
+	case cborNegInt:
+		return d.setNegInt(v, n)
+	case cborBytes:
+		b, err := d.chunks(major, info, n)
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append(make([]byte, 0, len(b)), b...))
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			for i := 0; i < v.Len(); i++ {
+				var c byte
+				if i < len(b) {
+					c = b[i]
+				}
+				v.Index(i).SetUint(uint64(c))
+			}
+		default:
+			return d.typeError("byte string", v.Type())
+		}
+		return nil
+	case cborText:
+		b, err := d.chunks(major, info, n)
+		if err != nil {
+			return err
+		}
+		if v.Kind() != reflect.String {
+			return d.typeError("text string", v.Type())
+		}
+		v.SetString(string(b))
+		return nil
+	case cborArray:
+		return d.array(v, info, n)
+	case cborMap:
+		return d.mapping(v, info, n)
+	case cborSimple:
+		return d.simple(v, info, n)
+	}
+	return d.typeError("item", v.Type())
+}
+
+func (d *cborDecodeState) setUint(v reflect.Value, n uint64) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n > math.MaxInt64 || v.OverflowInt(int64(n)) {
+			return fmt.Errorf("cbor: integer %d overflows Go value of type %s", n, v.Type())
+		}
+		v.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.OverflowUint(n) {
+			return fmt.Errorf("cbor: integer %d overflows Go value of type %s", n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(n))
+	default:
+		return d.typeError("integer", v.Type())
+	}
+	return nil
+}
+
+// setNegInt sets v to the negative integer -1-n.
+func (d *cborDecodeState) setNegInt(v reflect.Value, n uint64) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n > math.MaxInt64 || v.OverflowInt(-1-int64(n)) {
+			return fmt.Errorf("cbor: integer -1-%d overflows Go value of type %s", n, v.Type())
+		}
+		v.SetInt(-1 - int64(n))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(-1 - float64(n))
+	default:
+		return d.typeError("negative integer", v.Type())
+	}
+	return nil
+}
+
+func (d *cborDecodeState) array(v reflect.Value, info byte, n uint64) error {
+	indefinite := info == cborIndefinite
+	size, err := d.count(n, 1)
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		if indefinite {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		} else {
+			v.Set(reflect.MakeSlice(v.Type(), size, size))
+		}
+	case reflect.Array:
+	default:
+		return d.typeError("array", v.Type())
+	}
+	for i := 0; indefinite || i < size; i++ {
+		if indefinite {
+			done, err := d.atBreak()
+			if err != nil {
+				return err
+			}
+			if done {
+				size = i
+				break
+			}
+			if v.Kind() == reflect.Slice {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+		}
+		if i >= v.Len() {
+			// arrays drop the items beyond their length
+			if err := d.value(reflect.New(v.Type().Elem()).Elem()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	if v.Kind() == reflect.Array {
+		for i := size; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	}
+	return nil
+}
+
+func (d *cborDecodeState) mapping(v reflect.Value, info byte, n uint64) error {
+	indefinite := info == cborIndefinite
+	size, err := d.count(n, 2)
+	if err != nil {
+		return err
+	}
+	var st *cborStruct
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), size))
+		}
+	case reflect.Struct:
+		st = cborStructOf(v.Type())
+	default:
+		return d.typeError("map", v.Type())
+	}
+	for i := 0; indefinite || i < size; i++ {
+		if indefinite {
+			done, err := d.atBreak()
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+		}
+		if st == nil {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.value(key); err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+			continue
+		}
+		var name string
+		if err := d.value(reflect.ValueOf(&name).Elem()); err != nil {
+			return err
+		}
+		f := st.lookup(name)
+		if f == nil {
+			if d.strict {
+				return fmt.Errorf("cbor: unknown field %q", name)
+			}
+			if _, err := d.generic(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.value(d.field(v, f.index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// field returns the field of struct v at index, allocating the embedded
+// structs it is in.
+func (d *cborDecodeState) field(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// float returns the value of a float item.
+func (d *cborDecodeState) float(info byte, n uint64) (float64, bool) {
+	switch info {
+	case 25:
+		return float16ToFloat64(uint16(n)), true
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), true
+	case 27:
+		return math.Float64frombits(n), true
+	}
+	return 0, false
+}
+
+func (d *cborDecodeState) simple(v reflect.Value, info byte, n uint64) error {
+	if f, ok := d.float(info, n); ok {
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return d.typeError("float", v.Type())
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	switch n {
+	case cborFalse & 0x1f, cborTrue & 0x1f:
+		if v.Kind() != reflect.Bool {
+			return d.typeError("bool", v.Type())
+		}
+		v.SetBool(n == cborTrue&0x1f)
+		return nil
+	}
+	return fmt.Errorf("cbor: unsupported simple value %d", n)
+}
+
+// generic decodes the next item into the Go value it is decoded as into an
+// empty interface.
+func (d *cborDecodeState) generic() (any, error) {
+	if d.depth++; d.depth > maxCBORDepth {
+		return nil, errCBORDepth
+	}
+	defer func() { d.depth-- }()
+
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case cborBytes:
+		b, err := d.chunks(major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		return append(make([]byte, 0, len(b)), b...), nil
+	case cborText:
+		b, err := d.chunks(major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case cborArray:
+		var items []any
+		err := d.items(info, n, 1, func() error {
+			item, err := d.generic()
+			items = append(items, item)
+			return err
+		})
+		if items == nil {
+			items = []any{}
+		}
+		return items, err
+	case cborMap:
+		var keys, values []any
+		textKeys := true
+		err := d.items(info, n, 2, func() error {
+			key, err := d.generic()
+			if err != nil {
+				return err
+			}
+			switch k := key.(type) {
+			case string:
+			case []byte:
+				// byte slices cannot be map keys
+				key, textKeys = string(k), false
+			default:
+				textKeys = false
+				if key != nil && !reflect.TypeOf(key).Comparable() {
+					return fmt.Errorf("cbor: invalid map key of type %T", key)
+				}
+			}
+			value, err := d.generic()
+			keys, values = append(keys, key), append(values, value)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if textKeys {
+			m := make(map[string]any, len(keys))
+			for i, k := range keys {
+				m[k.(string)] = values[i]
+			}
+			return m, nil
+		}
+		m := make(map[any]any, len(keys))
+		for i, k := range keys {
+			m[k] = values[i]
+		}
+		return m, nil
+	case cborTag:
+		return d.generic()
+	case cborSimple:
+		if f, ok := d.float(info, n); ok {
+			return f, nil
+		}
+		switch n {
+		case cborFalse & 0x1f:
+			return false, nil
+		case cborTrue & 0x1f:
+			return true, nil
+		case cborNull & 0x1f, cborUndefined & 0x1f:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", n)
+	}
+	return nil, fmt.Errorf("cbor: invalid major type %d", major)
+}
+
+// items calls item for each of the n items of an array, or pairs of items
+// of a map, of definite or indefinite length.
+func (d *cborDecodeState) items(info byte, n uint64, per uint64, item func() error) error {
+	if info != cborIndefinite {
+		size, err := d.count(n, per)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err := item(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		done, err := d.atBreak()
+		if err != nil || done {
+			return err
+		}
+		if err := item(); err != nil {
+			return err
+		}
+	}
+}
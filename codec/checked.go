@@ -0,0 +1,145 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Validator checks a value against a schema, such as one compiled from CUE
+// or JSON Schema. It is passed the value given to Encode, or the pointer
+// given to Decode after decoding into it. Validators report which field
+// failed with a FieldError, possibly wrapped in their own errors.
+type Validator func(v interface{}) error
+
+// FieldError reports the field of a value failing validation. Path is the
+// path of the field from the value, such as "user.emails[1]", or empty for
+// the value itself.
+type FieldError struct {
+	Path string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Field returns a FieldError for the field name of the value, prefixing the
+// path of err if it is a FieldError so validators of nested values can be
+// composed.
+func Field(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		path := name
+		switch {
+		case fe.Path == "":
+		case strings.HasPrefix(fe.Path, "["):
+			path += fe.Path
+		default:
+			path += "." + fe.Path
+		}
+		return &FieldError{Path: path, Err: fe.Err}
+	}
+	return &FieldError{Path: name, Err: err}
+}
+
+// ValidationError is returned by encoders and decoders of Checked codecs for
+// values failing validation. Op is "encode" or "decode".
+type ValidationError struct {
+	Op  string
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return "codec: " + e.Op + " validation failed: " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Checked returns a Codec validating the values encoded and decoded with
+// inner, so values drifting from the contract of the peers fail early and
+// name the field at fault. Values failing validation are not written when
+// encoding. When decoding, the value is decoded before it is validated.
+func Checked(inner Codec, validate Validator) Codec {
+	return &checkedCodec{inner: inner, validate: validate}
+}
+
+type checkedCodec struct {
+	inner    Codec
+	validate Validator
+}
+
+func (c *checkedCodec) check(op string, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	if err := c.validate(v); err != nil {
+		return &ValidationError{Op: op, Err: err}
+	}
+	return nil
+}
+
+func (c *checkedCodec) Encoder(w io.Writer) Encoder {
+	return &checkedEncoder{c: c, enc: c.inner.Encoder(w)}
+}
+
+func (c *checkedCodec) Decoder(r io.Reader) Decoder {
+	return &checkedDecoder{c: c, dec: c.inner.Decoder(r)}
+}
+
+// Unmarshal decodes with the Unmarshal method of the inner codec if it has
+// one, so wrapping a codec keeps framing codecs from creating decoders.
+func (c *checkedCodec) Unmarshal(data []byte, v interface{}) error {
+	var err error
+	if u, ok := c.inner.(Unmarshaler); ok {
+		err = u.Unmarshal(data, v)
+	} else {
+		err = c.inner.Decoder(bytes.NewReader(data)).Decode(v)
+	}
+	if err != nil {
+		return err
+	}
+	return c.check("decode", v)
+}
+
+func (c *checkedCodec) Buffered() bool {
+	b, ok := c.inner.(Buffered)
+	return ok && b.Buffered()
+}
+
+type checkedEncoder struct {
+	c   *checkedCodec
+	enc Encoder
+}
+
+func (e *checkedEncoder) Encode(v interface{}) error {
+	if err := e.c.check("encode", v); err != nil {
+		return err
+	}
+	return e.enc.Encode(v)
+}
+
+type checkedDecoder struct {
+	c   *checkedCodec
+	dec Decoder
+}
+
+func (d *checkedDecoder) Decode(v interface{}) error {
+	if err := d.dec.Decode(v); err != nil {
+		return err
+	}
+	return d.c.check("decode", v)
+}
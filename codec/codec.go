@@ -15,7 +15,40 @@ type Decoder interface {
 }
 
 // Codec returns an Encoder or Decoder given a Writer or Reader.
+//
+// An Encoder or Decoder belongs to the stream of its Writer or Reader, and
+// should be created once per stream and used for all of its values rather
+// than for each value:
+//
+//   - Encode writes the complete encoding of a value before returning, but
+//     encoders may depend on the values encoded before, such as to send type
+//     information once, so their values must be decoded by one Decoder in
+//     the order they were encoded.
+//   - Decoders may read ahead and buffer bytes beyond the value decoded, so
+//     bytes are lost if another Decoder or anything else reads the Reader
+//     afterwards.
+//
+// Encoders and Decoders are not safe for concurrent use. They can only be
+// used with another Writer or Reader if they implement ResetEncoder or
+// ResetDecoder, which Pool uses to reuse them.
 type Codec interface {
 	Encoder(w io.Writer) Encoder
 	Decoder(r io.Reader) Decoder
 }
+
+// Unmarshaler is an optional interface implemented by codecs that can decode
+// a value from its complete encoding. Framing codecs that have read a whole
+// value use it to avoid creating a Decoder for each value. Implementations
+// must not retain data after returning. Codecs that override the Decoder of
+// an embedded codec implementing Unmarshaler should override Unmarshal too.
+type Unmarshaler interface {
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Buffered is an optional interface implemented by codecs whose Decoder
+// needs the complete encoding of a value in memory. Framing codecs that
+// otherwise decode large values directly from their Reader read the whole
+// value first for codecs returning true.
+type Buffered interface {
+	Buffered() bool
+}
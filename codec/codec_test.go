@@ -2,7 +2,15 @@ package codec
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testData struct {
@@ -30,3 +38,331 @@ func TestJSONCodec(t *testing.T) {
 		t.Fatal("unexpected data:", data)
 	}
 }
+
+func TestCanonicalJSON(t *testing.T) {
+	type inner struct {
+		Z string `json:"z"`
+		A []any  `json:"a"`
+	}
+	type outer struct {
+		B     inner          `json:"b"`
+		A     map[string]int `json:"a"`
+		Float float64        `json:"float"`
+		HTML  string         `json:"html"`
+	}
+	v := outer{
+		B:     inner{Z: "z", A: []any{map[string]any{"y": 1, "x": 2}, 1.5}},
+		A:     map[string]int{"d": 1, "c": 2},
+		Float: 1e21,
+		HTML:  "<a&b>",
+	}
+	want := `{"a":{"c":2,"d":1},"b":{"a":[{"x":2,"y":1},1.5],"z":"z"},"float":1e+21,"html":"<a&b>"}`
+
+	var buf bytes.Buffer
+	c := JSONCodec{Canonical: true}
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		if err := c.Encoder(&buf).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want {
+			t.Fatalf("unexpected encoding:\n%s\nwant\n%s", buf.String(), want)
+		}
+	}
+
+	// equal values of different types encode the same
+	generic := map[string]any{
+		"html":  "<a&b>",
+		"float": 1e21,
+		"b":     map[string]any{"z": "z", "a": []any{map[string]int{"x": 2, "y": 1}, 1.5}},
+		"a":     map[string]any{"d": 1, "c": 2},
+	}
+	b, err := CanonicalJSON(generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Fatalf("unexpected encoding of generic value:\n%s", b)
+	}
+
+	var out outer
+	if err := c.Decoder(&buf).Decode(&out); err != nil || out.HTML != v.HTML {
+		t.Fatal("unexpected decoded value:", out, err)
+	}
+}
+
+func TestChecked(t *testing.T) {
+	type user struct {
+		Name   string
+		Emails []string
+	}
+	validateEmails := func(emails []string) error {
+		for i, e := range emails {
+			if !strings.Contains(e, "@") {
+				return Field(fmt.Sprintf("[%d]", i), errors.New("invalid email"))
+			}
+		}
+		return nil
+	}
+	validate := func(v interface{}) error {
+		var u user
+		switch v := v.(type) {
+		case user:
+			u = v
+		case *user:
+			u = *v
+		default:
+			return nil
+		}
+		if u.Name == "" {
+			return Field("name", errors.New("required"))
+		}
+		return Field("emails", validateEmails(u.Emails))
+	}
+	c := Checked(JSONCodec{}, validate)
+
+	var buf bytes.Buffer
+	err := c.Encoder(&buf).Encode(user{Name: "jo", Emails: []string{"jo@example.com", "jo"}})
+	var fe *FieldError
+	var ve *ValidationError
+	if !errors.As(err, &fe) || fe.Path != "emails[1]" || !errors.As(err, &ve) || ve.Op != "encode" {
+		t.Fatal("unexpected error:", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatal("invalid value was written")
+	}
+
+	if err := (JSONCodec{}).Encoder(&buf).Encode(user{Emails: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+	var u user
+	err = c.Decoder(&buf).Decode(&u)
+	if !errors.As(err, &fe) || fe.Path != "name" || !errors.As(err, &ve) || ve.Op != "decode" {
+		t.Fatal("unexpected error:", err)
+	}
+	err = c.(Unmarshaler).Unmarshal(data, &u)
+	if !errors.As(err, &fe) || fe.Path != "name" {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := c.(Unmarshaler).Unmarshal([]byte(`{"Name":"jo"}`), &u); err != nil || u.Name != "jo" {
+		t.Fatal("unexpected result:", u, err)
+	}
+}
+
+func TestJSONDisallowUnknownFields(t *testing.T) {
+	type point struct{ X, Y int }
+	c := JSONCodec{DisallowUnknownFields: true}
+	data := []byte(`{"X":1,"Y":2,"Z":3}`)
+
+	var p point
+	if err := c.Decoder(bytes.NewReader(data)).Decode(&p); err == nil || !strings.Contains(err.Error(), `"Z"`) {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := c.Unmarshal(data, &p); err == nil || !strings.Contains(err.Error(), `"Z"`) {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := c.Unmarshal([]byte(`{"X":1} {}`), &p); err == nil {
+		t.Fatal("expected an error for trailing data")
+	}
+
+	// generic values have no unknown fields
+	var generic map[string]int
+	if err := c.Unmarshal(data, &generic); err != nil || generic["Z"] != 3 {
+		t.Fatal("unexpected result:", generic, err)
+	}
+	if err := (JSONCodec{}).Unmarshal(data, &p); err != nil || p.Y != 2 {
+		t.Fatal("unexpected result:", p, err)
+	}
+}
+
+func TestCBOR(t *testing.T) {
+	type inner struct {
+		Z string `cbor:"z"`
+		A int    `json:"a,omitempty"`
+	}
+	type outer struct {
+		inner
+		Bytes []byte
+		Skip  int `cbor:"-"`
+	}
+	// vectors of RFC 8949 appendix A
+	for _, tt := range []struct {
+		v    any
+		want string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{1000, "1903e8"},
+		{1000000000000, "1b000000e8d4a51000"},
+		{uint64(18446744073709551615), "1bffffffffffffffff"},
+		{-1, "20"},
+		{-1000, "3903e7"},
+		{int64(math.MinInt64), "3b7fffffffffffffff"},
+		{0.0, "f90000"},
+		{math.Copysign(0, -1), "f98000"},
+		{1.5, "f93e00"},
+		{65504.0, "f97bff"},
+		{100000.0, "fa47c35000"},
+		{3.4028234663852886e+38, "fa7f7fffff"},
+		{1.1, "fb3ff199999999999a"},
+		{5.960464477539063e-8, "f90001"},
+		{0.00006103515625, "f90400"},
+		{-4.0, "f9c400"},
+		{math.Inf(1), "f97c00"},
+		{math.NaN(), "f97e00"},
+		{float32(0.5), "f93800"},
+		{false, "f4"},
+		{nil, "f6"},
+		{"", "60"},
+		{"IETF", "6449455446"},
+		{"ü", "62c3bc"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{[]byte(nil), "f6"},
+		{[]int{}, "80"},
+		{[]any{1, []int{2, 3}}, "8201820203"},
+		{map[string]any{"b": []int{2, 3}, "a": 1}, "a26161016162820203"},
+		{map[int]string{10: "", -1: "", 100: ""}, "a30a60186460" + "2060"},
+		{outer{inner: inner{Z: "z"}, Bytes: []byte{0}}, "a2617a617a65427974657341" + "00"},
+	} {
+		var buf bytes.Buffer
+		if err := (CBORCodec{Canonical: true}).Encoder(&buf).Encode(tt.v); err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(buf.Bytes()); got != tt.want {
+			t.Errorf("encoding %#v: got %s, want %s", tt.v, got, tt.want)
+		}
+	}
+
+	// floats keep their precision unless canonical
+	var buf bytes.Buffer
+	if err := (CBORCodec{}).Encoder(&buf).Encode([]any{1.5, float32(1.5)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(buf.Bytes()), "82fb3ff8000000000000fa3fc00000"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCBORDecode(t *testing.T) {
+	c := CBORCodec{}
+	for _, tt := range []struct {
+		data string
+		want any
+	}{
+		{"1bffffffffffffffff", uint64(18446744073709551615)},
+		{"3903e7", int64(-1000)},
+		{"f93c00", 1.0},
+		{"f90001", 5.960464477539063e-8},
+		{"fa47c35000", 100000.0},
+		// indefinite lengths
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9f018202039f0405ffff", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"bf61610161629f0203ffff", map[string]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		// tags are ignored
+		{"c11a514b67b0", int64(1363896240)},
+	} {
+		data, _ := hex.DecodeString(tt.data)
+		var v any
+		if err := c.Unmarshal(data, &v); err != nil {
+			t.Fatalf("decoding %s: %v", tt.data, err)
+		}
+		if !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("decoding %s: got %#v, want %#v", tt.data, v, tt.want)
+		}
+	}
+
+	var tm time.Time
+	data, _ := hex.DecodeString("c074323031332d30332d32315432303a30343a30305a")
+	if err := c.Unmarshal(data, &tm); err != nil || tm.Unix() != 1363896240 {
+		t.Fatal("unexpected result:", tm, err)
+	}
+
+	for _, tt := range []struct {
+		data string
+		v    any
+	}{
+		{"190100", new(uint8)},
+		{"20", new(uint)},
+		{"6161", new(int)},
+		{"1a0000", new(int)},
+		{"9b00000000ffffffff", new([]int)},
+		{"5f6161ff", new([]byte)},
+		{"0000", new(int)},
+		{"a1617a00", &struct{ Z string }{}},
+		{"a0", nil},
+	} {
+		data, _ := hex.DecodeString(tt.data)
+		if err := c.Unmarshal(data, tt.v); err == nil {
+			t.Errorf("decoding %s into %T: expected an error", tt.data, tt.v)
+		}
+	}
+
+	// the decoder reads whole items, so a value failing to decode is
+	// skipped
+	data, _ = hex.DecodeString("a1617a00" + "a1617a6161")
+	dec := c.Decoder(bytes.NewReader(data))
+	var p struct{ Z string }
+	if err := dec.Decode(&p); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := dec.Decode(&p); err != nil || p.Z != "a" {
+		t.Fatal("unexpected result:", p, err)
+	}
+	if err := dec.Decode(&p); err != io.EOF {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := c.Decoder(bytes.NewReader(data[:2])).Decode(&p); err != io.ErrUnexpectedEOF {
+		t.Fatal("unexpected error:", err)
+	}
+
+	nested := bytes.Repeat([]byte{0x81}, maxCBORDepth+1)
+	if err := c.Decoder(bytes.NewReader(append(nested, 0))).Decode(new(any)); err == nil {
+		t.Fatal("expected an error for deep nesting")
+	}
+
+	data, _ = hex.DecodeString("a2617a616161590a")
+	strict := CBORCodec{DisallowUnknownFields: true}
+	if err := strict.Unmarshal(data, &p); err == nil || !strings.Contains(err.Error(), `"Y"`) {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := c.Unmarshal(data, &p); err != nil || p.Z != "a" {
+		t.Fatal("unexpected result:", p, err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	for _, c := range []Codec{JSONCodec{}, JSONCodec{Canonical: true}} {
+		p := NewPool(c)
+		var first, second bytes.Buffer
+		enc := p.Encoder(&first)
+		if err := enc.Encode("first"); err != nil {
+			t.Fatal(err)
+		}
+		p.PutEncoder(enc)
+
+		// encoders are reset to write to the new writer only
+		reused := p.Encoder(&second)
+		if err := reused.Encode("second"); err != nil {
+			t.Fatal(err)
+		}
+		p.PutEncoder(reused)
+		if !strings.HasPrefix(first.String(), `"first"`) || !strings.HasPrefix(second.String(), `"second"`) {
+			t.Fatalf("unexpected encodings %q and %q", first.String(), second.String())
+		}
+
+		// decoders that cannot be reset are created as usual
+		for _, buf := range []*bytes.Buffer{&first, &second} {
+			want := strings.TrimSpace(buf.String())
+			dec := p.Decoder(buf)
+			var out string
+			if err := dec.Decode(&out); err != nil || `"`+out+`"` != want {
+				t.Fatalf("decoded %q, expected %s: %v", out, want, err)
+			}
+			p.PutDecoder(dec)
+		}
+	}
+}
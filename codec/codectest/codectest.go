@@ -0,0 +1,266 @@
+// Package codectest provides a conformance test for implementations of
+// codec.Codec, checking they round-trip the values rpc and fn send.
+package codectest
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+)
+
+// header is shaped like the headers rpc sends before its values.
+type header struct {
+	Selector string
+	Error    *string
+	Continue bool
+	Args     []int
+}
+
+type nested struct {
+	Name     string
+	Labels   map[string]string
+	Children []nested
+	Data     []byte
+}
+
+var errMessage = "boom"
+
+// values are the values checked to round-trip, each decoded into a new
+// value of its own type.
+var values = []struct {
+	name string
+	v    interface{}
+}{
+	{"int", -42},
+	{"int64", int64(math.MaxInt64)},
+	{"uint64", uint64(math.MaxUint64)},
+	{"float64", 3.25},
+	{"zero", 0},
+	{"bool", true},
+	{"string", "héllo, 世界\n\"quoted\""},
+	{"empty string", ""},
+	{"bytes", []byte{0, 1, 2, 0xfe, 0xff}},
+	{"empty bytes", []byte{}},
+	{"slice", []int{1, 2, 3}},
+	{"empty slice", []string{}},
+	{"map", map[string]int{"a": 1, "b": 2}},
+	{"nested map", map[string]map[string][]int{"a": {"b": {1, 2}}, "c": {}}},
+	{"header", header{Selector: "/users/get", Args: []int{1}}},
+	{"header with error", header{Error: &errMessage, Continue: true}},
+	{"struct", nested{
+		Name:     "root",
+		Labels:   map[string]string{"k": "v"},
+		Children: []nested{{Name: "child", Data: []byte("data")}},
+	}},
+}
+
+// TestCodec checks that c round-trips the values rpc and fn encode and
+// decode, and that it behaves as they expect:
+//
+//   - values of numbers, strings, byte slices, slices, maps and structs
+//     round-trip into values of their type, alone or in a sequence of values
+//     encoded by one Encoder and decoded by one Decoder
+//   - nil decodes into pointers, byte slices and interfaces as nil
+//   - values decode generically into interfaces, as fn decodes arguments
+//   - values of several megabytes round-trip
+//   - the optional codec.Unmarshaler, codec.ResetEncoder and
+//     codec.ResetDecoder interfaces agree with Encoder and Decoder
+func TestCodec(t *testing.T, c codec.Codec) {
+	t.Helper()
+	t.Run("Values", func(t *testing.T) {
+		for _, tt := range values {
+			roundTrip(t, c, tt.name, tt.v)
+		}
+	})
+	t.Run("Sequence", func(t *testing.T) { testSequence(t, c) })
+	t.Run("Nil", func(t *testing.T) { testNil(t, c) })
+	t.Run("Generic", func(t *testing.T) { testGeneric(t, c) })
+	t.Run("Huge", func(t *testing.T) { testHuge(t, c) })
+	t.Run("Unmarshal", func(t *testing.T) { testUnmarshal(t, c) })
+	t.Run("Reset", func(t *testing.T) { testReset(t, c) })
+}
+
+func encode(t *testing.T, c codec.Codec, v interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := c.Encoder(&buf).Encode(v); err != nil {
+		t.Fatalf("encoding %T: %v", v, err)
+	}
+	return buf.Bytes()
+}
+
+// decodeAs decodes data into a new value of the type of v.
+func decodeAs(c codec.Codec, data []byte, v interface{}) (interface{}, error) {
+	out := reflect.New(reflect.TypeOf(v))
+	err := c.Decoder(bytes.NewReader(data)).Decode(out.Interface())
+	return out.Elem().Interface(), err
+}
+
+func roundTrip(t *testing.T, c codec.Codec, name string, v interface{}) {
+	t.Helper()
+	out, err := decodeAs(c, encode(t, c, v), v)
+	if err != nil {
+		t.Errorf("%s: decoding: %v", name, err)
+		return
+	}
+	if !reflect.DeepEqual(out, v) {
+		t.Errorf("%s: decoded %#v, expected %#v", name, out, v)
+	}
+}
+
+func testSequence(t *testing.T, c codec.Codec) {
+	var buf bytes.Buffer
+	enc := c.Encoder(&buf)
+	for _, tt := range values {
+		if err := enc.Encode(tt.v); err != nil {
+			t.Fatalf("%s: encoding: %v", tt.name, err)
+		}
+		if err := enc.Encode(nil); err != nil {
+			t.Fatalf("encoding nil after %s: %v", tt.name, err)
+		}
+	}
+	dec := c.Decoder(&buf)
+	for _, tt := range values {
+		out := reflect.New(reflect.TypeOf(tt.v))
+		if err := dec.Decode(out.Interface()); err != nil {
+			t.Fatalf("%s: decoding: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(out.Elem().Interface(), tt.v) {
+			t.Errorf("%s: decoded %#v, expected %#v", tt.name, out.Elem().Interface(), tt.v)
+		}
+		// rpc discards unwanted values by decoding into a byte slice
+		var discard []byte
+		if err := dec.Decode(&discard); err != nil {
+			t.Fatalf("decoding nil after %s: %v", tt.name, err)
+		}
+	}
+}
+
+func testNil(t *testing.T, c codec.Codec) {
+	data := encode(t, c, nil)
+	b := []byte("not nil")
+	if err := c.Decoder(bytes.NewReader(data)).Decode(&b); err != nil || b != nil {
+		t.Errorf("nil decoded into byte slice as %q: %v", b, err)
+	}
+	var v interface{} = "not nil"
+	if err := c.Decoder(bytes.NewReader(data)).Decode(&v); err != nil || v != nil {
+		t.Errorf("nil decoded into interface as %#v: %v", v, err)
+	}
+	p := &header{}
+	if err := c.Decoder(bytes.NewReader(data)).Decode(&p); err != nil || p != nil {
+		t.Errorf("nil decoded into pointer as %#v: %v", p, err)
+	}
+	out, err := decodeAs(c, encode(t, c, header{}), header{})
+	if err != nil || out.(header).Error != nil {
+		t.Errorf("nil field decoded as %#v: %v", out, err)
+	}
+}
+
+func testGeneric(t *testing.T, c codec.Codec) {
+	for _, tt := range []struct {
+		v    interface{}
+		kind []reflect.Kind
+	}{
+		{42, []reflect.Kind{reflect.Int, reflect.Int64, reflect.Uint64, reflect.Float64}},
+		{2.5, []reflect.Kind{reflect.Float32, reflect.Float64}},
+		{"s", []reflect.Kind{reflect.String}},
+		{true, []reflect.Kind{reflect.Bool}},
+		{[]interface{}{1, "a"}, []reflect.Kind{reflect.Slice}},
+		{map[string]int{"a": 1}, []reflect.Kind{reflect.Map}},
+		{header{Selector: "s"}, []reflect.Kind{reflect.Map}},
+	} {
+		var out interface{}
+		if err := c.Decoder(bytes.NewReader(encode(t, c, tt.v))).Decode(&out); err != nil {
+			t.Errorf("%#v: decoding generically: %v", tt.v, err)
+			continue
+		}
+		ok := false
+		for _, k := range tt.kind {
+			ok = ok || out != nil && reflect.TypeOf(out).Kind() == k
+		}
+		if !ok {
+			t.Errorf("%#v decoded generically as %T, expected one of %v", tt.v, out, tt.kind)
+		}
+	}
+}
+
+func testHuge(t *testing.T, c codec.Codec) {
+	const size = 8 << 20
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	roundTrip(t, c, "huge bytes", b)
+	roundTrip(t, c, "huge string", strings.Repeat("qtalk ", size/6))
+	m := make(map[string]int, 10000)
+	for i := 0; i < 10000; i++ {
+		m[fmt.Sprintf("key%d", i)] = i
+	}
+	roundTrip(t, c, "huge map", m)
+}
+
+func testUnmarshal(t *testing.T, c codec.Codec) {
+	u, ok := c.(codec.Unmarshaler)
+	if !ok {
+		t.Skip("codec does not implement codec.Unmarshaler")
+	}
+	for _, tt := range values {
+		data := encode(t, c, tt.v)
+		out := reflect.New(reflect.TypeOf(tt.v))
+		if err := u.Unmarshal(data, out.Interface()); err != nil {
+			t.Errorf("%s: unmarshaling: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(out.Elem().Interface(), tt.v) {
+			t.Errorf("%s: unmarshaled %#v, expected %#v", tt.name, out.Elem().Interface(), tt.v)
+		}
+		// Unmarshal must not retain data
+		for i := range data {
+			data[i] = 0
+		}
+		if !reflect.DeepEqual(out.Elem().Interface(), tt.v) {
+			t.Errorf("%s: unmarshaled value changed with the data", tt.name)
+		}
+	}
+}
+
+func testReset(t *testing.T, c codec.Codec) {
+	var first, second bytes.Buffer
+	enc := c.Encoder(&first)
+	if renc, ok := enc.(codec.ResetEncoder); ok {
+		for _, tt := range values {
+			first.Reset()
+			second.Reset()
+			if err := renc.Encode(tt.v); err != nil {
+				t.Fatalf("%s: encoding: %v", tt.name, err)
+			}
+			// the encoding after a reset stands alone
+			renc.Reset(&second)
+			if err := renc.Encode(tt.v); err != nil {
+				t.Fatalf("%s: encoding after reset: %v", tt.name, err)
+			}
+			if out, err := decodeAs(c, second.Bytes(), tt.v); err != nil || !reflect.DeepEqual(out, tt.v) {
+				t.Errorf("%s: decoded %#v after reset: %v", tt.name, out, err)
+			}
+			renc.Reset(&first)
+		}
+	}
+	data := encode(t, c, "first")
+	dec := c.Decoder(bytes.NewReader(append(data, data...)))
+	if rdec, ok := dec.(codec.ResetDecoder); ok {
+		var s string
+		if err := rdec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		// bytes buffered from the first reader are discarded
+		rdec.Reset(bytes.NewReader(encode(t, c, "second")))
+		if err := rdec.Decode(&s); err != nil || s != "second" {
+			t.Errorf("decoded %q after reset: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package codectest
+
+import (
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+)
+
+func TestJSONCodec(t *testing.T) {
+	TestCodec(t, codec.JSONCodec{})
+}
+
+func TestCanonicalJSONCodec(t *testing.T) {
+	TestCodec(t, codec.JSONCodec{Canonical: true})
+}
+
+func TestCheckedCodec(t *testing.T) {
+	TestCodec(t, codec.Checked(codec.JSONCodec{}, func(interface{}) error { return nil }))
+}
+
+func TestCBORCodec(t *testing.T) {
+	TestCodec(t, codec.CBORCodec{})
+}
+
+func TestCanonicalCBORCodec(t *testing.T) {
+	TestCodec(t, codec.CBORCodec{Canonical: true})
+}
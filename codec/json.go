@@ -1,19 +1,128 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 )
 
 // JSONCodec provides a codec API for the standard library JSON encoder and decoder.
-type JSONCodec struct{}
+type JSONCodec struct {
+	// Canonical makes encoders write the canonical encoding of values, so
+	// equal values always encode to the same bytes, such as for signing them
+	// or caching them by their hash. Decoding is unaffected.
+	Canonical bool
 
-// Encoder returns a JSON encoder
+	// DisallowUnknownFields makes decoding an object into a struct fail if
+	// the object has a key matching no field of the struct, so peers
+	// drifting apart on the fields of a contract are caught by tests
+	// instead of the fields being ignored. RPC headers are decoded with
+	// the codec too, so peers using it should be of the same version.
+	DisallowUnknownFields bool
+}
+
+// Encoder returns a JSON encoder. It implements ResetEncoder.
 func (c JSONCodec) Encoder(w io.Writer) Encoder {
-	return json.NewEncoder(w)
+	if c.Canonical {
+		return &canonicalEncoder{w}
+	}
+	enc := &jsonEncoder{}
+	enc.w.w = w
+	enc.enc = json.NewEncoder(&enc.w)
+	return enc
 }
 
 // Decoder returns a JSON decoder
 func (c JSONCodec) Decoder(r io.Reader) Decoder {
-	return json.NewDecoder(r)
+	dec := json.NewDecoder(r)
+	if c.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	return dec
+}
+
+// Unmarshal decodes a single JSON value
+func (c JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	if !c.DisallowUnknownFields {
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	// like json.Unmarshal, the data must be a single value
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("json: invalid data after top-level value")
+	}
+	return nil
+}
+
+// jsonEncoder is a json.Encoder that can be reset, which is possible as
+// json.Encoder writes each value as it is encoded and keeps no state besides
+// its options.
+type jsonEncoder struct {
+	w   resetWriter
+	enc *json.Encoder
+}
+
+func (e *jsonEncoder) Encode(v interface{}) error {
+	return e.enc.Encode(v)
+}
+
+func (e *jsonEncoder) Reset(w io.Writer) {
+	e.w.w = w
+}
+
+type resetWriter struct {
+	w io.Writer
+}
+
+func (w *resetWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+type canonicalEncoder struct {
+	w io.Writer
+}
+
+func (e *canonicalEncoder) Reset(w io.Writer) {
+	e.w = w
+}
+
+func (e *canonicalEncoder) Encode(v interface{}) error {
+	b, err := CanonicalJSON(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
+
+// CanonicalJSON returns the canonical JSON encoding of v. It is encoded as
+// by json.Marshal, but with the keys of all objects, including struct
+// fields, sorted by their bytes, without escaping HTML characters and
+// without insignificant whitespace. Numbers keep the shortest form
+// json.Marshal writes them in.
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// decoding generically sorts struct fields like map keys when encoded
+	// again, and numbers are kept as written
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
 }
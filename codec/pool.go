@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"io"
+	"sync"
+)
+
+// ResetEncoder is implemented by Encoders that can be reused to write to
+// another Writer. Reset discards any state of the values encoded before, as
+// if the Encoder was newly created for w.
+type ResetEncoder interface {
+	Encoder
+	Reset(w io.Writer)
+}
+
+// ResetDecoder is implemented by Decoders that can be reused to read from
+// another Reader. Reset discards any state and buffered bytes, as if the
+// Decoder was newly created for r.
+type ResetDecoder interface {
+	Decoder
+	Reset(r io.Reader)
+}
+
+// Pool caches the Encoders and Decoders of a codec to reuse them for other
+// streams, such as for encoding and decoding many short lived values. Only
+// Encoders and Decoders implementing ResetEncoder or ResetDecoder are
+// pooled, others are created as usual. A Pool is safe for concurrent use.
+type Pool struct {
+	codec Codec
+	enc   sync.Pool
+	dec   sync.Pool
+}
+
+// NewPool returns a Pool for c.
+func NewPool(c Codec) *Pool {
+	return &Pool{codec: c}
+}
+
+// Encoder returns an Encoder writing to w, reused from the pool if possible.
+func (p *Pool) Encoder(w io.Writer) Encoder {
+	if enc, ok := p.enc.Get().(ResetEncoder); ok {
+		enc.Reset(w)
+		return enc
+	}
+	return p.codec.Encoder(w)
+}
+
+// Decoder returns a Decoder reading from r, reused from the pool if possible.
+func (p *Pool) Decoder(r io.Reader) Decoder {
+	if dec, ok := p.dec.Get().(ResetDecoder); ok {
+		dec.Reset(r)
+		return dec
+	}
+	return p.codec.Decoder(r)
+}
+
+// PutEncoder returns enc to the pool once it is no longer used. Its Writer
+// is released so the pool does not keep it alive.
+func (p *Pool) PutEncoder(enc Encoder) {
+	if enc, ok := enc.(ResetEncoder); ok {
+		enc.Reset(nil)
+		p.enc.Put(enc)
+	}
+}
+
+// PutDecoder returns dec to the pool once it is no longer used. Bytes it has
+// buffered are discarded.
+func (p *Pool) PutDecoder(dec Decoder) {
+	if dec, ok := dec.(ResetDecoder); ok {
+		dec.Reset(nil)
+		p.dec.Put(dec)
+	}
+}
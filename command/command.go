@@ -0,0 +1,207 @@
+// Package command provides RPC handlers that execute configured commands,
+// passing call arguments as command arguments and replying with the output
+// and exit code.
+package command
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Command describes an executable exposed by Handler.
+type Command struct {
+	// Path is the command to run. It is resolved with exec.LookPath.
+	Path string
+
+	// Args are fixed arguments placed before any call arguments.
+	Args []string
+
+	// Dir is the working directory of the command. If empty, the
+	// current directory is used.
+	Dir string
+
+	// Env is the environment of the command. If nil, the current
+	// process environment is used.
+	Env []string
+
+	// Stream will Continue the call and send Output values as the command
+	// writes to stdout and stderr instead of buffering them in the Result.
+	Stream bool
+}
+
+// Result is the reply of a command handler. When streaming, it is the last
+// value sent and only ExitCode is set.
+type Result struct {
+	Stdout   string `json:",omitempty"`
+	Stderr   string `json:",omitempty"`
+	ExitCode int
+}
+
+// Output is a chunk of output sent by a streaming command handler.
+// Name is either "stdout" or "stderr".
+type Output struct {
+	Name string
+	Data string
+}
+
+// Handler returns a handler that runs cmd for each call. The call argument can
+// be nil, a single value or an array of values, which are formatted with
+// fmt.Sprint and appended to the command arguments. The command is killed if
+// the call context is done.
+//
+// A non-zero exit code is not a remote error, it is part of the Result. An
+// error is returned if the command could not be started.
+func Handler(cmd Command) rpc.Handler {
+	return rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var params any
+		if err := c.Receive(&params); err != nil {
+			r.Return(fmt.Errorf("command: args: %w", err))
+			return
+		}
+
+		args := append([]string{}, cmd.Args...)
+		switch p := params.(type) {
+		case nil:
+		case []any:
+			for _, arg := range p {
+				args = append(args, fmt.Sprint(arg))
+			}
+		default:
+			args = append(args, fmt.Sprint(p))
+		}
+
+		ec := exec.CommandContext(c.Context, cmd.Path, args...)
+		ec.Dir = cmd.Dir
+		ec.Env = cmd.Env
+
+		if !cmd.Stream {
+			var stdout, stderr bytes.Buffer
+			ec.Stdout = &stdout
+			ec.Stderr = &stderr
+			code, err := exitCode(ec.Run())
+			if err != nil {
+				r.Return(err)
+				return
+			}
+			r.Return(Result{
+				Stdout:   stdout.String(),
+				Stderr:   stderr.String(),
+				ExitCode: code,
+			})
+			return
+		}
+
+		stdout, err := ec.StdoutPipe()
+		if err != nil {
+			r.Return(err)
+			return
+		}
+		stderr, err := ec.StderrPipe()
+		if err != nil {
+			r.Return(err)
+			return
+		}
+		if err := ec.Start(); err != nil {
+			r.Return(err)
+			return
+		}
+		ch, err := r.Continue(nil)
+		if err != nil {
+			ec.Process.Kill()
+			ec.Wait()
+			return
+		}
+		defer ch.Close()
+
+		// pipes must be fully read before calling Wait
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		wg.Add(2)
+		for name, pipe := range map[string]io.Reader{"stdout": stdout, "stderr": stderr} {
+			go func(w io.Writer, pipe io.Reader) {
+				io.Copy(w, pipe)
+				wg.Done()
+			}(&outputWriter{name: name, mu: &mu, r: r}, pipe)
+		}
+		wg.Wait()
+
+		code, _ := exitCode(ec.Wait())
+		r.Send(Result{ExitCode: code})
+	})
+}
+
+// exitCode returns the exit code for the error of running a command, or
+// the error if the command did not run to exit.
+func exitCode(err error) (int, error) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// outputWriter sends writes as Output values, serializing sends from
+// stdout and stderr.
+type outputWriter struct {
+	name string
+	mu   *sync.Mutex
+	r    rpc.Responder
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.r.Send(Output{Name: w.name, Data: string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// DirHandler returns a RespondMux with a handler for each executable file in
+// dir, registered by file name without extension. Subdirectories and other
+// files are ignored. Stream is set on each Command.
+func DirHandler(dir string, stream bool) (*rpc.RespondMux, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	mux := rpc.NewRespondMux()
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		if !isExecutable(info) {
+			continue
+		}
+		path, err := filepath.Abs(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		mux.Handle(name, Handler(Command{Path: path, Stream: stream}))
+	}
+	return mux, nil
+}
+
+func isExecutable(info os.FileInfo) bool {
+	if filepath.Ext(info.Name()) == ".exe" {
+		return true
+	}
+	return info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
@@ -0,0 +1,114 @@
+package command
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/rpc/rpctest"
+)
+
+func requireSh(t *testing.T) string {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	return sh
+}
+
+func TestHandler(t *testing.T) {
+	sh := requireSh(t)
+	ctx := context.Background()
+
+	t.Run("unary", func(t *testing.T) {
+		client, _ := rpctest.NewPair(Handler(Command{
+			Path: sh,
+			Args: []string{"-c", `echo "$0 $1"; echo oops >&2; exit 3`},
+		}), codec.JSONCodec{})
+		defer client.Close()
+
+		var ret Result
+		if _, err := client.Call(ctx, "", []any{"hello", "world"}, &ret); err != nil {
+			t.Fatal(err)
+		}
+		if ret.Stdout != "hello world\n" || ret.Stderr != "oops\n" || ret.ExitCode != 3 {
+			t.Fatalf("unexpected result: %#v", ret)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		client, _ := rpctest.NewPair(Handler(Command{
+			Path:   sh,
+			Args:   []string{"-c", `echo "$0"`},
+			Stream: true,
+		}), codec.JSONCodec{})
+		defer client.Close()
+
+		resp, err := client.Call(ctx, "", "hello", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Continue {
+			t.Fatal("expected continue")
+		}
+		var out Output
+		if err := resp.Receive(&out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Name != "stdout" || out.Data != "hello\n" {
+			t.Fatalf("unexpected output: %#v", out)
+		}
+		var ret Result
+		if err := resp.Receive(&ret); err != nil {
+			t.Fatal(err)
+		}
+		if ret.ExitCode != 0 {
+			t.Fatalf("unexpected result: %#v", ret)
+		}
+	})
+
+	t.Run("start error", func(t *testing.T) {
+		client, _ := rpctest.NewPair(Handler(Command{
+			Path: filepath.Join(t.TempDir(), "missing"),
+		}), codec.JSONCodec{})
+		defer client.Close()
+
+		if _, err := client.Call(ctx, "", nil, nil); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestDirHandler(t *testing.T) {
+	requireSh(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "greet.sh"), []byte("#!/bin/sh\necho \"hello $1\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not executable"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux, err := DirHandler(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := mux.Patterns(); len(p) != 1 || p[0] != "/greet" {
+		t.Fatal("unexpected patterns:", p)
+	}
+
+	client, _ := rpctest.NewPair(mux, codec.JSONCodec{})
+	defer client.Close()
+
+	var ret Result
+	if _, err := client.Call(context.Background(), "greet", "world", &ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret.Stdout != "hello world\n" {
+		t.Fatalf("unexpected result: %#v", ret)
+	}
+}
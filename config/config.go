@@ -0,0 +1,170 @@
+// Package config reloads the policies of a server at runtime. A Store loads
+// a Config of limits, access rules, rate limits and routing weights from a
+// Provider, such as a file, an environment variable or a selector of a
+// configuration service, and its middlewares apply the current Config to
+// every call:
+//
+//	store := &config.Store{
+//		Provider: config.File("/etc/qtalk/server.json"),
+//		Interval: 30 * time.Second,
+//		Identity: func(c *rpc.Call) string {
+//			return srv.Tags(c.Caller.(*rpc.Client).Session)["tenant"]
+//		},
+//	}
+//	if err := store.Reload(ctx); err != nil {
+//		log.Fatal(err)
+//	}
+//	go store.Run(ctx)
+//
+//	mux := rpc.NewRespondMux()
+//	mux.Handle("/", store.Handler(api))
+//	mux.Handle("users.", store.Router(map[string]*rpc.Client{"stable": stable, "canary": canary}))
+//
+// Each call reads a single snapshot of the Config, so a reload applies to
+// calls started after it and never mixes the policies of two Configs.
+// Invalid Configs are rejected and the previous one stays in place.
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Config is the runtime configuration of a server. Maps keyed by pattern use
+// the selector patterns of rpc.RespondMux, where the most specific pattern
+// matching a selector applies to it.
+type Config struct {
+	// ACL holds the access rules by pattern. Selectors matching no rule
+	// are allowed.
+	ACL map[string]Rule `json:",omitempty"`
+
+	// RateLimits holds the rate limits by pattern.
+	RateLimits map[string]RateLimit `json:",omitempty"`
+
+	// MaxInFlight holds the number of calls that can run at once by
+	// pattern. Calls beyond it fail with rpc.ErrBusy.
+	MaxInFlight map[string]int `json:",omitempty"`
+
+	// Quotas holds the quotas by identity, applied with Store.Quota. The
+	// quota of the identity "*" applies to identities without one.
+	Quotas map[string]rpc.Quota `json:",omitempty"`
+
+	// Routes holds the backend weights of Store.Router by pattern, keyed by
+	// backend name.
+	Routes map[string]map[string]int `json:",omitempty"`
+}
+
+// Rule controls which identities can call the selectors matching its
+// pattern. The identity "*" matches every identity, including the empty one.
+type Rule struct {
+	// Allow, if not empty, lists the only identities allowed.
+	Allow []string `json:",omitempty"`
+	// Deny lists identities denied even if they are allowed.
+	Deny []string `json:",omitempty"`
+}
+
+// allows returns whether the rule allows identity.
+func (r Rule) allows(identity string) bool {
+	if contains(r.Deny, identity) {
+		return false
+	}
+	return len(r.Allow) == 0 || contains(r.Allow, identity)
+}
+
+func contains(identities []string, identity string) bool {
+	for _, id := range identities {
+		if id == identity || id == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit limits the rate of calls to the selectors matching its pattern
+// with a token bucket.
+type RateLimit struct {
+	// PerSecond is the rate the bucket refills at.
+	PerSecond float64
+	// Burst is the size of the bucket. If zero, it holds one second of
+	// calls, and at least one.
+	Burst int `json:",omitempty"`
+	// PerIdentity gives each identity its own bucket instead of sharing
+	// one among all callers.
+	PerIdentity bool `json:",omitempty"`
+}
+
+// Validate reports the first invalid pattern or value of c.
+func (c *Config) Validate() error {
+	_, err := compile(c)
+	return err
+}
+
+// Parse decodes a Config from JSON, rejecting unknown fields so typos in
+// hand written files are not silently ignored.
+func Parse(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return &c, nil
+}
+
+// Provider loads the current Config from a source.
+type Provider interface {
+	Load(ctx context.Context) (*Config, error)
+}
+
+// ProviderFunc is an adapter to allow the use of ordinary functions as
+// Providers.
+type ProviderFunc func(ctx context.Context) (*Config, error)
+
+// Load calls f(ctx).
+func (f ProviderFunc) Load(ctx context.Context) (*Config, error) {
+	return f(ctx)
+}
+
+// File returns a Provider reading a JSON Config from the file at path.
+func File(path string) Provider {
+	return ProviderFunc(func(ctx context.Context) (*Config, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return Parse(data)
+	})
+}
+
+// ErrNoConfig is returned by the Provider of Env if the variable is not set.
+var ErrNoConfig = errors.New("config: no configuration")
+
+// Env returns a Provider reading a JSON Config from the environment
+// variable name.
+func Env(name string) Provider {
+	return ProviderFunc(func(ctx context.Context) (*Config, error) {
+		data, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not set", ErrNoConfig, name)
+		}
+		return Parse([]byte(data))
+	})
+}
+
+// Remote returns a Provider calling selector on c, which replies with the
+// Config, so the servers of a fleet can share a configuration service.
+func Remote(c rpc.Caller, selector string) Provider {
+	return ProviderFunc(func(ctx context.Context) (*Config, error) {
+		var cfg Config
+		if _, err := c.Call(ctx, selector, nil, &cfg); err != nil {
+			return nil, err
+		}
+		return &cfg, nil
+	})
+}
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/rpc"
+	"github.com/roachadam/qtalk-go/rpc/rpctest"
+)
+
+func fatal(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreHandler(t *testing.T) {
+	ctx := context.Background()
+	identity := "alice"
+	store := &Store{Identity: func(c *rpc.Call) string { return identity }}
+	var changes []*Config
+	store.Subscribe(func(old, new *Config) {
+		changes = append(changes, old, new)
+	})
+
+	mux := rpc.NewRespondMux()
+	mux.Handle("/", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		r.Return("ok")
+	}))
+	client, _ := rpctest.NewPair(store.Handler(mux), codec.JSONCodec{})
+	defer client.Close()
+
+	call := func(selector string) error {
+		_, err := client.Call(ctx, selector, nil, nil)
+		return err
+	}
+	// no policies before the first config
+	fatal(t, call("admin.reset"))
+
+	first := &Config{
+		ACL:        map[string]Rule{"admin.": {Allow: []string{"root"}}},
+		RateLimits: map[string]RateLimit{"search": {PerSecond: 0.001, Burst: 1}},
+	}
+	fatal(t, store.Set(first))
+	if err := call("admin.reset"); err == nil || !strings.Contains(err.Error(), ErrDenied.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fatal(t, call("users.get"))
+	fatal(t, call("search"))
+	if err := call("search"); err == nil || !strings.Contains(err.Error(), ErrRateLimited.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	identity = "root"
+	fatal(t, call("admin.reset"))
+
+	// an equal config keeps the state and notifies nobody
+	fatal(t, store.Set(&Config{
+		ACL:        map[string]Rule{"admin.": {Allow: []string{"root"}}},
+		RateLimits: map[string]RateLimit{"search": {PerSecond: 0.001, Burst: 1}},
+	}))
+	if err := call("search"); err == nil {
+		t.Fatal("expected rate limit")
+	}
+
+	second := &Config{ACL: map[string]Rule{"admin.reset": {Deny: []string{"*"}}}}
+	fatal(t, store.Set(second))
+	fatal(t, call("search"))
+	if err := call("admin.reset"); err == nil {
+		t.Fatal("expected denial")
+	}
+	fatal(t, call("admin.status"))
+
+	if len(changes) != 4 || changes[0] != nil || changes[1] != first || changes[2] != first || changes[3] != second {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	if store.Current() != second {
+		t.Fatal("unexpected current config")
+	}
+
+	if err := store.Set(&Config{RateLimits: map[string]RateLimit{"x": {}}}); err == nil {
+		t.Fatal("expected invalid config")
+	}
+	if err := store.Set(&Config{ACL: map[string]Rule{"x.": {}, "x/": {}}}); err == nil {
+		t.Fatal("expected duplicate pattern")
+	}
+	if store.Current() != second {
+		t.Fatal("invalid config was applied")
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	ctx := context.Background()
+	store := &Store{}
+	fatal(t, store.Set(&Config{MaxInFlight: map[string]int{"slow": 1}}))
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := store.Handler(rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		close(started)
+		<-release
+		r.Return()
+	}))
+	// a pair per caller, since calls of a pair can't run concurrently
+	first, _ := rpctest.NewPair(handler, codec.JSONCodec{})
+	defer first.Close()
+	second, _ := rpctest.NewPair(handler, codec.JSONCodec{})
+	defer second.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := first.Call(ctx, "slow", nil, nil)
+		done <- err
+	}()
+	<-started
+	_, err := second.Call(ctx, "slow", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), rpc.ErrBusy.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(release)
+	fatal(t, <-done)
+}
+
+func TestRouter(t *testing.T) {
+	ctx := context.Background()
+	backend := func(name string) *rpc.Client {
+		client, _ := rpctest.NewPair(rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+			r.Return(name)
+		}), codec.JSONCodec{})
+		return client
+	}
+	a, b := backend("a"), backend("b")
+	defer a.Close()
+	defer b.Close()
+
+	store := &Store{}
+	client, _ := rpctest.NewPair(store.Router(map[string]*rpc.Client{"a": a, "b": b}), codec.JSONCodec{})
+	defer client.Close()
+
+	call := func(selector string) (string, error) {
+		var name string
+		_, err := client.Call(ctx, selector, nil, &name)
+		return name, err
+	}
+	if _, err := call("users.get"); err == nil {
+		t.Fatal("expected no backend")
+	}
+
+	fatal(t, store.Set(&Config{Routes: map[string]map[string]int{
+		"users.": {"a": 1, "b": 0},
+	}}))
+	for i := 0; i < 5; i++ {
+		name, err := call("users.get")
+		fatal(t, err)
+		if name != "a" {
+			t.Fatalf("routed to %q", name)
+		}
+	}
+	if _, err := call("other"); err == nil || !strings.Contains(err.Error(), rpc.ErrNoBackend.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fatal(t, store.Set(&Config{Routes: map[string]map[string]int{
+		"users.": {"a": 0, "b": 1, "missing": 5},
+	}}))
+	for i := 0; i < 5; i++ {
+		name, err := call("users.get")
+		fatal(t, err)
+		if name != "b" {
+			t.Fatalf("routed to %q", name)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	store := &Store{}
+	if q := store.Quota("alice"); q != (rpc.Quota{}) {
+		t.Fatalf("unexpected quota: %+v", q)
+	}
+	fatal(t, store.Set(&Config{Quotas: map[string]rpc.Quota{
+		"alice": {Calls: 10},
+		"*":     {Calls: 1},
+	}}))
+	if q := store.Quota("alice"); q.Calls != 10 {
+		t.Fatalf("unexpected quota: %+v", q)
+	}
+	if q := store.Quota("bob"); q.Calls != 1 {
+		t.Fatalf("unexpected quota: %+v", q)
+	}
+}
+
+func TestProviders(t *testing.T) {
+	ctx := context.Background()
+	const data = `{"ACL": {"admin.": {"Allow": ["root"]}}}`
+	check := func(cfg *Config, err error) {
+		t.Helper()
+		fatal(t, err)
+		if rule := cfg.ACL["admin."]; len(rule.Allow) != 1 || rule.Allow[0] != "root" {
+			t.Fatalf("unexpected config: %+v", cfg)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	fatal(t, os.WriteFile(path, []byte(data), 0o644))
+	check(File(path).Load(ctx))
+
+	t.Setenv("QTALK_TEST_CONFIG", data)
+	check(Env("QTALK_TEST_CONFIG").Load(ctx))
+	if _, err := Env("QTALK_TEST_MISSING").Load(ctx); !errors.Is(err, ErrNoConfig) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg, err := Parse([]byte(data))
+	fatal(t, err)
+	client, _ := rpctest.NewPair(rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		r.Return(cfg)
+	}), codec.JSONCodec{})
+	defer client.Close()
+	check(Remote(client, "config.get").Load(ctx))
+
+	if _, err := Parse([]byte(`{"ACLs": {}}`)); err == nil {
+		t.Fatal("expected unknown field error")
+	}
+
+	store := &Store{Provider: File(path)}
+	fatal(t, store.Reload(ctx))
+	check(store.Current(), nil)
+	fatal(t, os.WriteFile(path, []byte(`{"RateLimits": {"x": {"PerSecond": -1}}}`), 0o644))
+	if err := store.Reload(ctx); err == nil {
+		t.Fatal("expected invalid config")
+	}
+	check(store.Current(), nil)
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// snapshot is a compiled Config. Its entries are registered by pattern in
+// a RespondMux per policy, so selectors match them like they match
+// handlers.
+type snapshot struct {
+	cfg *Config
+
+	acl, rate, inflight, routes *rpc.RespondMux
+	entries                     []*entry
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*bucket
+}
+
+// entry is the policy of a pattern. Only the fields of the policy of its
+// mux are set.
+type entry struct {
+	rule    Rule
+	limit   RateLimit
+	max     int
+	running atomic.Int64
+	weights map[string]int
+}
+
+// RespondRPC makes entries handlers that can be registered in a RespondMux.
+// They are only matched, never called.
+func (e *entry) RespondRPC(r rpc.Responder, c *rpc.Call) {}
+
+type bucketKey struct {
+	entry    *entry
+	identity string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func compile(cfg *Config) (snap *snapshot, err error) {
+	for pattern, v := range cfg.RateLimits {
+		if v.PerSecond <= 0 || v.Burst < 0 {
+			return nil, fmt.Errorf("config: invalid rate limit of %q", pattern)
+		}
+	}
+	for pattern, n := range cfg.MaxInFlight {
+		if n <= 0 {
+			return nil, fmt.Errorf("config: invalid max in flight of %q", pattern)
+		}
+	}
+	for pattern, backends := range cfg.Routes {
+		for name, w := range backends {
+			if w < 0 {
+				return nil, fmt.Errorf("config: negative weight of backend %q of %q", name, pattern)
+			}
+		}
+	}
+	defer func() {
+		// RespondMux panics on patterns that are the same once normalized,
+		// such as "users." and "users/"
+		if v := recover(); v != nil {
+			snap, err = nil, fmt.Errorf("config: %v", v)
+		}
+	}()
+	snap = &snapshot{
+		cfg:      cfg,
+		acl:      rpc.NewRespondMux(),
+		rate:     rpc.NewRespondMux(),
+		inflight: rpc.NewRespondMux(),
+		routes:   rpc.NewRespondMux(),
+		buckets:  make(map[bucketKey]*bucket),
+	}
+	add := func(m *rpc.RespondMux, pattern string, e *entry) {
+		m.Handle(pattern, e)
+		snap.entries = append(snap.entries, e)
+	}
+	for pattern, rule := range cfg.ACL {
+		add(snap.acl, pattern, &entry{rule: rule})
+	}
+	for pattern, limit := range cfg.RateLimits {
+		add(snap.rate, pattern, &entry{limit: limit})
+	}
+	for pattern, n := range cfg.MaxInFlight {
+		add(snap.inflight, pattern, &entry{max: n})
+	}
+	for pattern, weights := range cfg.Routes {
+		if weights == nil {
+			weights = map[string]int{}
+		}
+		add(snap.routes, pattern, &entry{weights: weights})
+	}
+	return snap, nil
+}
+
+// match returns the entry of m for selector, or nil if there is none.
+func (s *snapshot) match(m *rpc.RespondMux, selector string) *entry {
+	h, _ := m.Match(selector)
+	e, _ := h.(*entry)
+	return e
+}
+
+// take takes a token from the bucket of identity for the rate limit of e,
+// returning false if it is empty.
+func (s *snapshot) take(e *entry, identity string) bool {
+	key := bucketKey{entry: e}
+	if e.limit.PerIdentity {
+		key.identity = identity
+	}
+	burst := float64(e.limit.Burst)
+	if burst == 0 {
+		burst = math.Max(1, e.limit.PerSecond)
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*e.limit.PerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,295 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// DefaultInterval is the Interval of a Store if it is zero.
+const DefaultInterval = time.Minute
+
+var (
+	// ErrDenied is returned to callers denied by the ACL of the Config.
+	ErrDenied = errors.New("config: access denied")
+
+	// ErrRateLimited is returned to callers beyond the RateLimits of the
+	// Config.
+	ErrRateLimited = errors.New("config: rate limit exceeded")
+)
+
+// Store holds the current Config of a server, loaded from its Provider by
+// Reload or Run, and applies it to calls with the handlers it returns.
+// Before the first Config is loaded the handlers apply no policies.
+type Store struct {
+	Provider Provider
+
+	// Interval is how often Run reloads the Config. If zero,
+	// DefaultInterval is used.
+	Interval time.Duration
+
+	// Identity returns the identity of the caller that ACL rules, rate
+	// limits and sticky routing apply to. If nil, every caller has the
+	// empty identity.
+	Identity func(c *rpc.Call) string
+
+	// ErrorLog specifies an optional logger for errors reloading the
+	// Config in Run. If nil, logging is done via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	cur atomic.Pointer[snapshot]
+
+	mu     sync.Mutex // serializes updates and notifications
+	subs   map[int]func(old, new *Config)
+	nextID int
+}
+
+// Current returns the current Config, or nil if none is loaded. It must not
+// be modified.
+func (s *Store) Current() *Config {
+	if snap := s.cur.Load(); snap != nil {
+		return snap.cfg
+	}
+	return nil
+}
+
+// Subscribe registers fn to be notified of every change of the Config,
+// with old being nil for the first one, and returns a function removing
+// it. Notifications are made in order from the goroutine updating the
+// Config after the handlers apply it, so fn must not update the Store.
+func (s *Store) Subscribe(fn func(old, new *Config)) (cancel func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[int]func(old, new *Config))
+	}
+	id := s.nextID
+	s.nextID++
+	s.subs[id] = fn
+	return func() {
+		s.mu.Lock()
+		delete(s.subs, id)
+		s.mu.Unlock()
+	}
+}
+
+// Reload loads the Config from the Provider and Sets it.
+func (s *Store) Reload(ctx context.Context) error {
+	cfg, err := s.Provider.Load(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Set(cfg)
+}
+
+// Set makes cfg the current Config, so calls started afterwards apply it,
+// and notifies the subscribers. An invalid cfg is rejected with the error
+// of its Validate method, and a cfg equal to the current one is ignored so
+// reloading an unchanged source keeps the state of rate limits. cfg must
+// not be modified afterwards.
+func (s *Store) Set(cfg *Config) error {
+	snap, err := compile(cfg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var old *Config
+	if prev := s.cur.Load(); prev != nil {
+		if reflect.DeepEqual(prev.cfg, cfg) {
+			return nil
+		}
+		old = prev.cfg
+	}
+	s.cur.Store(snap)
+	for _, fn := range s.subs {
+		fn(old, cfg)
+	}
+	return nil
+}
+
+// Run reloads the Config every Interval until ctx is done, logging the
+// errors, and returns the error of ctx.
+func (s *Store) Run(ctx context.Context) error {
+	interval := s.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if err := s.Reload(ctx); err != nil && ctx.Err() == nil {
+				s.logf("config: reload: %v", err)
+			}
+		}
+	}
+}
+
+// Quota returns the quota of identity in the current Config, falling back
+// to the quota of "*". It can be used as the Quota of an rpc.Accountant.
+func (s *Store) Quota(identity string) rpc.Quota {
+	cfg := s.Current()
+	if cfg == nil {
+		return rpc.Quota{}
+	}
+	if q, ok := cfg.Quotas[identity]; ok {
+		return q
+	}
+	return cfg.Quotas["*"]
+}
+
+func (s *Store) identity(c *rpc.Call) string {
+	if s.Identity == nil {
+		return ""
+	}
+	return s.Identity(c)
+}
+
+func (s *Store) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// matcher is implemented by handlers like rpc.RespondMux that are
+// registered as submuxes.
+type matcher interface {
+	Match(selector string) (h rpc.Handler, pattern string)
+}
+
+// Handler returns a handler applying the ACL, RateLimits and MaxInFlight of
+// the current Config to the calls of h, failing the calls they do not
+// allow without invoking h. A handler with a Match method like a
+// RespondMux keeps being registered as a submux.
+func (s *Store) Handler(h rpc.Handler) rpc.Handler {
+	ph := &policyHandler{Handler: h, s: s}
+	if m, ok := h.(matcher); ok {
+		return &policyMatcher{policyHandler: ph, m: m}
+	}
+	return ph
+}
+
+type policyHandler struct {
+	rpc.Handler
+	s *Store
+}
+
+// policyMatcher is the policyHandler of a submux.
+type policyMatcher struct {
+	*policyHandler
+	m matcher
+}
+
+func (h *policyMatcher) Match(selector string) (rpc.Handler, string) {
+	sub, pattern := h.m.Match(selector)
+	if sub == nil {
+		return nil, ""
+	}
+	return &policyHandler{Handler: sub, s: h.s}, pattern
+}
+
+func (h *policyHandler) RespondRPC(r rpc.Responder, c *rpc.Call) {
+	snap := h.s.cur.Load()
+	if snap == nil {
+		h.Handler.RespondRPC(r, c)
+		return
+	}
+	identity := h.s.identity(c)
+	if e := snap.match(snap.acl, c.Selector); e != nil && !e.rule.allows(identity) {
+		r.Return(fmt.Errorf("%w: %s", ErrDenied, c.Selector))
+		return
+	}
+	if e := snap.match(snap.rate, c.Selector); e != nil && !snap.take(e, identity) {
+		r.Return(fmt.Errorf("%w: %s", ErrRateLimited, c.Selector))
+		return
+	}
+	if e := snap.match(snap.inflight, c.Selector); e != nil {
+		if e.running.Add(1) > int64(e.max) {
+			e.running.Add(-1)
+			r.Return(rpc.ErrBusy)
+			return
+		}
+		defer e.running.Add(-1)
+	}
+	h.Handler.RespondRPC(r, c)
+}
+
+// Router returns a handler proxying each call to one of the backends, chosen
+// by the weights of the Routes of the current Config like an
+// rpc.WeightedProxy, sticking to backends by the identity of the caller.
+// Backends named in the Config but not in backends are ignored, and calls
+// matching no route fail with rpc.ErrNoBackend.
+func (s *Store) Router(backends map[string]*rpc.Client) rpc.Handler {
+	return &router{s: s, backends: backends}
+}
+
+type router struct {
+	s        *Store
+	backends map[string]*rpc.Client
+	table    atomic.Pointer[routeTable]
+}
+
+// routeTable holds the proxies of the routes of a snapshot.
+type routeTable struct {
+	snap    *snapshot
+	proxies map[*entry]*rpc.WeightedProxy
+}
+
+var noRoute = &rpc.WeightedProxy{}
+
+func (rt *router) RespondRPC(r rpc.Responder, c *rpc.Call) {
+	snap := rt.s.cur.Load()
+	if snap == nil {
+		noRoute.RespondRPC(r, c)
+		return
+	}
+	t := rt.table.Load()
+	if t == nil || t.snap != snap {
+		// racing calls may build the table of a snapshot more than once,
+		// which is harmless since the tables are the same
+		t = rt.build(snap)
+		rt.table.Store(t)
+	}
+	p := noRoute
+	if e := snap.match(snap.routes, c.Selector); e != nil {
+		p = t.proxies[e]
+	}
+	p.RespondRPC(r, c)
+}
+
+func (rt *router) build(snap *snapshot) *routeTable {
+	t := &routeTable{snap: snap, proxies: make(map[*entry]*rpc.WeightedProxy)}
+	for _, e := range snap.entries {
+		if e.weights == nil {
+			continue
+		}
+		p := &rpc.WeightedProxy{Identity: rt.s.Identity}
+		names := make([]string, 0, len(e.weights))
+		for name := range e.weights {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if client, ok := rt.backends[name]; ok {
+				p.Backends = append(p.Backends, rpc.Backend{Client: client, Weight: e.weights[name], Name: name})
+			}
+		}
+		t.proxies[e] = p
+	}
+	return t
+}
@@ -0,0 +1,148 @@
+package fn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// ErrUnauthorized is returned to callers of methods requiring authorization
+// with MethodBuilder.Authz when the Builder has no Authorizer.
+var ErrUnauthorized = errors.New("fn: unauthorized")
+
+// Builder registers the methods of a value as handlers like HandlerFrom,
+// with options declared per method. It is created with New:
+//
+//	h := fn.New(svc).
+//		Authorizer(checkRole).
+//		Method("Get").Timeout(5 * time.Second).Authz("admin").Done().
+//		Method("List").Name("list").Done().
+//		Handler()
+type Builder struct {
+	rcvr      any
+	methods   map[string]*MethodBuilder
+	authorize func(c *rpc.Call, requirement string) error
+	strict    bool
+}
+
+// New returns a Builder for the methods of v, which must be a struct or a
+// pointer to one.
+func New(v any) *Builder {
+	if reflect.Indirect(reflect.ValueOf(v)).Kind() != reflect.Struct {
+		panic("must be struct")
+	}
+	return &Builder{rcvr: v, methods: make(map[string]*MethodBuilder)}
+}
+
+// Authorizer sets the function checking the requirements of methods
+// declared with MethodBuilder.Authz, such as by looking up the tags of the
+// session of the call. An error it returns is returned to the caller
+// without calling the method.
+func (b *Builder) Authorizer(fn func(c *rpc.Call, requirement string) error) *Builder {
+	b.authorize = fn
+	return b
+}
+
+// Strict makes the handler use strict mode, returning an
+// InvalidArgumentError to calls with arguments that do not fit the
+// parameters of the method, as with CallStrict.
+func (b *Builder) Strict() *Builder {
+	b.strict = true
+	return b
+}
+
+// Method returns the builder of the options of the named method. It panics
+// if the value has no such method.
+func (b *Builder) Method(name string) *MethodBuilder {
+	if _, ok := reflect.TypeOf(b.rcvr).MethodByName(name); !ok {
+		panic(fmt.Sprintf("fn: no method %s", name))
+	}
+	m, ok := b.methods[name]
+	if !ok {
+		m = &MethodBuilder{b: b}
+		b.methods[name] = m
+	}
+	return m
+}
+
+// Handler returns a handler for the methods of the value with their
+// options, registered like HandlerFrom does.
+func (b *Builder) Handler() rpc.Handler {
+	return fromMethodsWith(b.rcvr, reflect.TypeOf(b.rcvr), b.strict, func(name string, h rpc.Handler) (string, rpc.Handler) {
+		m, ok := b.methods[name]
+		if !ok {
+			return name, h
+		}
+		if m.name != "" {
+			name = m.name
+		}
+		return name, m.wrap(h)
+	})
+}
+
+// MethodBuilder declares the options of a method of a Builder.
+type MethodBuilder struct {
+	b       *Builder
+	name    string
+	timeout time.Duration
+	authz   []string
+}
+
+// Name registers the method with selector instead of its method name.
+func (m *MethodBuilder) Name(selector string) *MethodBuilder {
+	m.name = selector
+	return m
+}
+
+// Timeout sets a timeout on the Context of calls to the method, which
+// bounds receiving the arguments and is seen by methods taking the Call.
+func (m *MethodBuilder) Timeout(d time.Duration) *MethodBuilder {
+	m.timeout = d
+	return m
+}
+
+// Authz requires calls to the method to pass the requirements with the
+// Authorizer of the Builder. Calls are rejected with ErrUnauthorized if it
+// has none.
+func (m *MethodBuilder) Authz(requirements ...string) *MethodBuilder {
+	m.authz = append(m.authz, requirements...)
+	return m
+}
+
+// Done returns the Builder to declare further methods.
+func (m *MethodBuilder) Done() *Builder {
+	return m.b
+}
+
+// wrap returns h applying the options to calls.
+func (m *MethodBuilder) wrap(h rpc.Handler) rpc.Handler {
+	if m.timeout == 0 && len(m.authz) == 0 {
+		return h
+	}
+	return rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		for _, req := range m.authz {
+			err := ErrUnauthorized
+			if m.b.authorize != nil {
+				err = m.b.authorize(c, req)
+			}
+			if err != nil {
+				r.Return(err)
+				return
+			}
+		}
+		if m.timeout > 0 {
+			ctx := c.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			var cancel context.CancelFunc
+			c.Context, cancel = context.WithTimeout(ctx, m.timeout)
+			defer cancel()
+		}
+		h.RespondRPC(r, c)
+	})
+}
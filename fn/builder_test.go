@@ -0,0 +1,70 @@
+package fn
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/rpc"
+	"github.com/roachadam/qtalk-go/rpc/rpctest"
+)
+
+type builderService struct{}
+
+func (builderService) Get(key string) string {
+	return "value of " + key
+}
+
+func (builderService) Deadline(c *rpc.Call) bool {
+	_, ok := c.Context.Deadline()
+	return ok
+}
+
+func (builderService) Secret() string {
+	return "secret"
+}
+
+func TestBuilder(t *testing.T) {
+	h := New(builderService{}).
+		Authorizer(func(c *rpc.Call, requirement string) error {
+			if requirement != "reader" {
+				return errors.New("forbidden")
+			}
+			return nil
+		}).
+		Method("Get").Name("get").Authz("reader").Done().
+		Method("Deadline").Timeout(time.Second).Done().
+		Method("Secret").Authz("admin").Done().
+		Handler()
+	client, _ := rpctest.NewPair(h, codec.JSONCodec{})
+	defer client.Close()
+	ctx := context.Background()
+
+	var s string
+	_, err := client.Call(ctx, "get", Args{"a"}, &s)
+	if err != nil || s != "value of a" {
+		t.Fatalf("unexpected reply %q and error %v", s, err)
+	}
+	if _, err := client.Call(ctx, "Get", Args{"a"}, &s); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	var ok bool
+	if _, err := client.Call(ctx, "Deadline", nil, &ok); err != nil || !ok {
+		t.Fatalf("expected deadline, got %v and error %v", ok, err)
+	}
+
+	if _, err := client.Call(ctx, "Secret", nil, &s); err == nil || !strings.Contains(err.Error(), "forbidden") {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+
+	h = New(builderService{}).Method("Secret").Authz("admin").Done().Handler()
+	client, _ = rpctest.NewPair(h, codec.JSONCodec{})
+	defer client.Close()
+	if _, err := client.Call(ctx, "Secret", nil, &s); err == nil || !strings.Contains(err.Error(), ErrUnauthorized.Error()) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+}
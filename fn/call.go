@@ -1,14 +1,21 @@
 package fn
 
 import (
+	"encoding/base64"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
 )
 
 var errorInterface = reflect.TypeOf((*error)(nil)).Elem()
 
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
 // Call wraps invoking a function via reflection, converting the arguments with
 // ArgsTo and the returns with ParseReturn.
 func Call(fn any, args []any) (_ []any, err error) {
@@ -34,39 +41,106 @@ func ArgsTo(fntyp reflect.Type, args []any) ([]reflect.Value, error) {
 	}
 	fnParams := make([]reflect.Value, len(args))
 	for idx, param := range args {
-		switch fntyp.In(idx).Kind() {
-		case reflect.Struct:
-			// decode to struct type using mapstructure
-			arg := reflect.New(fntyp.In(idx))
-			if err := mapstructure.Decode(param, arg.Interface()); err != nil {
-				return nil, fmt.Errorf("fn: mapstructure: %s", err.Error())
-			}
-			fnParams[idx] = ensureType(arg.Elem(), fntyp.In(idx))
-		case reflect.Slice:
-			rv := reflect.ValueOf(param)
-			// decode slice of structs to struct type using mapstructure
-			if fntyp.In(idx).Elem().Kind() == reflect.Struct {
-				nv := reflect.MakeSlice(fntyp.In(idx), rv.Len(), rv.Len())
-				for i := 0; i < rv.Len(); i++ {
-					ref := reflect.New(nv.Index(i).Type())
-					if err := mapstructure.Decode(rv.Index(i).Interface(), ref.Interface()); err != nil {
-						return nil, fmt.Errorf("fn: mapstructure: %s", err.Error())
-					}
-					nv.Index(i).Set(reflect.Indirect(ref))
-				}
-				rv = nv
-			}
-			fnParams[idx] = rv
-		case reflect.Int:
-			// if int is expected cast the float64 (assumes json-like encoding)
-			fnParams[idx] = ensureType(reflect.ValueOf(int(param.(float64))), fntyp.In(idx))
-		default:
-			fnParams[idx] = ensureType(reflect.ValueOf(param), fntyp.In(idx))
+		arg, err := argTo(param, fntyp.In(idx), false)
+		if err != nil {
+			return nil, err
 		}
+		fnParams[idx] = arg
 	}
 	return fnParams, nil
 }
 
+// argTo converts an argument into a value of type typ. Pointer parameters
+// are nil for a nil argument, and otherwise point to the argument converted
+// to the element type. If strict, arguments of the wrong shape return an
+// error describing the problem instead of panicking, and struct arguments
+// with unknown fields are rejected.
+func argTo(param any, typ reflect.Type, strict bool) (reflect.Value, error) {
+	if strict {
+		if err := checkArg(param, typ); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+	if str, ok := param.(string); ok && typ == durationType {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("fn: %s", err.Error())
+		}
+		return reflect.ValueOf(d), nil
+	}
+	switch typ.Kind() {
+	case reflect.Pointer:
+		if param == nil {
+			return reflect.Zero(typ), nil
+		}
+		if reflect.TypeOf(param).AssignableTo(typ) {
+			return reflect.ValueOf(param), nil
+		}
+		elem, err := argTo(param, typ.Elem(), strict)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(typ.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+	case reflect.Interface:
+		if param == nil {
+			return reflect.Zero(typ), nil
+		}
+		return ensureType(reflect.ValueOf(param), typ), nil
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		// decode composite values using mapstructure, unless the
+		// value already has the expected type
+		if param != nil && reflect.TypeOf(param).AssignableTo(typ) {
+			return reflect.ValueOf(param), nil
+		}
+		return decodeArg(param, typ, strict)
+	case reflect.Int:
+		// if int is expected cast the float64 of json-like encodings, while
+		// codecs decoding integers as such convert below
+		if f, ok := param.(float64); ok {
+			return ensureType(reflect.ValueOf(int(f)), typ), nil
+		}
+		return ensureType(reflect.ValueOf(param), typ), nil
+	default:
+		return ensureType(reflect.ValueOf(param), typ), nil
+	}
+}
+
+// decodeArg decodes a generically decoded value into a value of type typ
+// using mapstructure. Strings are decoded into byte slices as base64, the
+// form they are encoded in by JSON, into times as RFC 3339, and into
+// durations as parsed by time.ParseDuration, like "5s". If strict, unknown
+// struct fields are an error.
+func decodeArg(param any, typ reflect.Type, strict bool) (reflect.Value, error) {
+	arg := reflect.New(typ)
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:      arg.Interface(),
+		ErrorUnused: strict,
+		DecodeHook: func(from, to reflect.Type, data any) (any, error) {
+			if from.Kind() != reflect.String {
+				return data, nil
+			}
+			switch {
+			case to.Kind() == reflect.Slice && to.Elem().Kind() == reflect.Uint8:
+				return base64.StdEncoding.DecodeString(data.(string))
+			case to == timeType:
+				return time.Parse(time.RFC3339Nano, data.(string))
+			case to == durationType:
+				return time.ParseDuration(data.(string))
+			}
+			return data, nil
+		},
+	})
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if err := dec.Decode(param); err != nil {
+		return reflect.Value{}, fmt.Errorf("fn: mapstructure: %s", err.Error())
+	}
+	return arg.Elem(), nil
+}
+
 // ParseReturn splits the results of reflect.Call() into the values, and
 // possibly an error.
 // If the last value is a non-nil error, this will return `nil, err`.
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func fatal(err error, t *testing.T) {
@@ -63,6 +64,94 @@ func TestCallArgStructSlice(t *testing.T) {
 	}
 }
 
+func TestCallArgGeneric(t *testing.T) {
+	// values as decoded from JSON
+	ret, err := Call(func(ids []int, b []byte, m map[string][]int) (int, string) {
+		sum := 0
+		for _, id := range append(ids, m["more"]...) {
+			sum += id
+		}
+		return sum, string(b)
+	}, []any{[]any{1.0, 2.0}, "aGk=", map[string]any{"more": []any{3.0}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []any{6, "hi"}
+	if !reflect.DeepEqual(expected, ret) {
+		t.Errorf("expected %#v, got %#v", expected, ret)
+	}
+}
+
+func TestCallArgTime(t *testing.T) {
+	type options struct {
+		After   time.Time
+		Timeout time.Duration
+	}
+	ret, err := Call(func(at time.Time, d time.Duration, opts options, raw time.Duration) string {
+		return fmt.Sprint(at.UTC().Format(time.RFC3339), " ", d, " ", opts.After.Year(), " ", opts.Timeout, " ", raw)
+	}, []any{
+		"2024-05-01T12:30:00+02:00",
+		"1m30s",
+		map[string]any{"After": "2025-01-01T00:00:00.5Z", "Timeout": "5s"},
+		float64(time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []any{"2024-05-01T10:30:00Z 1m30s 2025 5s 1ms"}
+	if !reflect.DeepEqual(expected, ret) {
+		t.Errorf("expected %#v, got %#v", expected, ret)
+	}
+
+	if _, err := Call(func(d time.Duration) {}, []any{"soon"}); err == nil {
+		t.Fatalf("expected an error for an invalid duration")
+	}
+	if _, err := Call(func(t time.Time) {}, []any{"today"}); err == nil {
+		t.Fatalf("expected an error for an invalid time")
+	}
+}
+
+func TestCallArgPointer(t *testing.T) {
+	type options struct {
+		Limit int
+		Sub   *struct{ Name string }
+	}
+	describe := func(opts *options, n *int, name *string, v any) string {
+		s := "nil"
+		if opts != nil {
+			s = fmt.Sprint(opts.Limit)
+			if opts.Sub != nil {
+				s += " " + opts.Sub.Name
+			}
+		}
+		if n != nil {
+			s += fmt.Sprint(" ", *n)
+		}
+		if name != nil {
+			s += " " + *name
+		}
+		return fmt.Sprint(s, " ", v)
+	}
+	for _, tt := range []struct {
+		name     string
+		args     []any
+		expected string
+	}{
+		{"null", []any{nil, nil, nil, nil}, "nil <nil>"},
+		{"values", []any{map[string]any{"Limit": 3.0}, 2.0, "a", "b"}, "3 2 a b"},
+		{"nested", []any{map[string]any{"Sub": map[string]any{"Name": "x"}}, nil, nil, 1.0}, "0 x 1"},
+		{"typed", []any{&options{Limit: 5}, nil, nil, nil}, "5 <nil>"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ret, err := Call(describe, tt.args)
+			fatal(err, t)
+			if !reflect.DeepEqual([]any{tt.expected}, ret) {
+				t.Errorf("expected %q, got %#v", tt.expected, ret)
+			}
+		})
+	}
+}
+
 func TestParseReturn(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -31,7 +31,9 @@ import (
 // a single value which can be an error, or two values where one value is an error.
 // In the latter case, the value is returned if the error is nil, otherwise just the
 // error is returned. Handlers based on functions that return more than two values will
-// simply ignore the remaining values.
+// simply ignore the remaining values. Functions returning a Stream, with or
+// without an error, reply with its value and then stream values to the
+// caller.
 //
 // Structs that implement the Handler interface will be added as a catch-all handler
 // along with their individual methods. This lets you implement dynamic methods.
@@ -39,10 +41,10 @@ func HandlerFrom[T any](v T) rpc.Handler {
 	rv := reflect.Indirect(reflect.ValueOf(v))
 	switch rv.Type().Kind() {
 	case reflect.Func:
-		return fromFunc(reflect.ValueOf(v))
+		return fromFunc(reflect.ValueOf(v), false)
 	case reflect.Struct:
 		t := reflect.TypeOf((*T)(nil)).Elem()
-		return fromMethods(v, t)
+		return fromMethodsWith(v, t, false, registerMethod)
 	default:
 		panic("must be func or struct")
 	}
@@ -55,7 +57,14 @@ type Args []any
 
 var handlerFuncType = reflect.TypeOf((*rpc.HandlerFunc)(nil)).Elem()
 
-func fromMethods(rcvr interface{}, t reflect.Type) rpc.Handler {
+// registerMethod registers the handler of a method as is.
+func registerMethod(name string, h rpc.Handler) (string, rpc.Handler) {
+	return name, h
+}
+
+// fromMethodsWith returns a RespondMux registering the handler of each
+// method with the selector and handler returned by register.
+func fromMethodsWith(rcvr interface{}, t reflect.Type, strict bool, register func(name string, h rpc.Handler) (string, rpc.Handler)) rpc.Handler {
 	// If `t` is an interface, `Convert()` wraps the value with that interface
 	// type. This makes sure that the Method(i) indexes match for getting both the
 	// name and implementation.
@@ -67,9 +76,9 @@ func fromMethods(rcvr interface{}, t reflect.Type) rpc.Handler {
 		if m.CanConvert(handlerFuncType) {
 			h = m.Convert(handlerFuncType).Interface().(rpc.HandlerFunc)
 		} else {
-			h = fromFunc(m)
+			h = fromFunc(m, strict)
 		}
-		mux.Handle(t.Method(i).Name, h)
+		mux.Handle(register(t.Method(i).Name, h))
 	}
 	h, ok := rcvr.(rpc.Handler)
 	if ok {
@@ -80,7 +89,8 @@ func fromMethods(rcvr interface{}, t reflect.Type) rpc.Handler {
 
 var callRef = reflect.TypeOf((*rpc.Call)(nil))
 
-func fromFunc(fn reflect.Value) rpc.Handler {
+// fromFunc returns a handler calling fn, in strict mode if strict.
+func fromFunc(fn reflect.Value, strict bool) rpc.Handler {
 	fntyp := fn.Type()
 	// if the last argument in fn is an rpc.Call, add our call to fnParams
 	expectsCallParam := fntyp.NumIn() > 0 && fntyp.In(fntyp.NumIn()-1) == callRef
@@ -94,17 +104,31 @@ func fromFunc(fn reflect.Value) rpc.Handler {
 
 		var params []any
 		if err := c.Receive(&params); err != nil {
+			if strict {
+				r.Return(&InvalidArgumentError{Index: -1, Reason: err.Error()})
+				return
+			}
 			r.Return(fmt.Errorf("fn: args: %s", err.Error()))
 			return
 		}
 		if expectsCallParam {
 			params = append(params, c)
 		}
-		ret, err := Call(fn.Interface(), params)
+		call := Call
+		if strict {
+			call = CallStrict
+		}
+		ret, err := call(fn.Interface(), params)
 		if err != nil {
 			r.Return(err)
 			return
 		}
+		if len(ret) == 1 {
+			if s, ok := ret[0].(*Stream); ok && s != nil {
+				s.respond(r)
+				return
+			}
+		}
 		r.Return(ret...)
 	})
 }
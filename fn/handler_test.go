@@ -1,9 +1,11 @@
 package fn
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 
@@ -48,6 +50,21 @@ func TestHandlerFromFunc(t *testing.T) {
 		}
 	})
 
+	t.Run("cbor integer and bytes args", func(t *testing.T) {
+		client, _ := rpctest.NewPair(HandlerFrom(func(a int, b uint64, c []byte) []byte {
+			return append(c, byte(a), byte(b>>56))
+		}), codec.CBORCodec{})
+		defer client.Close()
+
+		var ret []byte
+		if _, err := client.Call(context.Background(), "", Args{2, uint64(1 << 63), []byte{1}}, &ret); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ret, []byte{1, 2, 0x80}) {
+			t.Fatalf("unexpected return value: %v", ret)
+		}
+	})
+
 	t.Run("defined type arg and return", func(t *testing.T) {
 		client, _ := rpctest.NewPair(HandlerFrom(func(a id) id {
 			return a
@@ -173,6 +190,39 @@ func TestHandlerFromFunc(t *testing.T) {
 		}
 	})
 
+	t.Run("return stream", func(t *testing.T) {
+		client, _ := rpctest.NewPair(HandlerFrom(func(n int) (*Stream, error) {
+			return NewStream("counting", func(send func(v any) error) error {
+				for i := 0; i < n; i++ {
+					if err := send(i); err != nil {
+						return err
+					}
+				}
+				return nil
+			}), nil
+		}), codec.JSONCodec{})
+		defer client.Close()
+
+		var reply string
+		resp, err := client.Call(context.Background(), "", Args{3}, &reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != "counting" || !resp.Continue {
+			t.Fatalf("unexpected reply: %q", reply)
+		}
+		var got []int
+		for {
+			var v int
+			if err = resp.ReceiveStream(&v); err != nil {
+				break
+			}
+			got = append(got, v)
+		}
+		if err != io.EOF || fmt.Sprint(got) != "[0 1 2]" {
+			t.Fatalf("received %v and %v", got, err)
+		}
+	})
 }
 
 type mockMethods struct{}
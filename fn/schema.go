@@ -0,0 +1,55 @@
+package fn
+
+import (
+	"reflect"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Schema returns an rpc.Schema describing calls to the handler HandlerFrom
+// returns for the function fn. Args are described as an array of the function
+// parameters, not including a final Call pointer parameter, and the reply by
+// the return values that are not errors. It can be used with rpc.WithSchema
+// to validate and publish function handlers.
+func Schema(fn any) rpc.Schema {
+	fntyp := reflect.TypeOf(fn)
+	if fntyp == nil || fntyp.Kind() != reflect.Func {
+		panic("must be func")
+	}
+
+	var params []any
+	for i := 0; i < fntyp.NumIn(); i++ {
+		if i == fntyp.NumIn()-1 && fntyp.In(i) == callRef {
+			break
+		}
+		params = append(params, rpc.SchemaOf(reflect.Zero(fntyp.In(i)).Interface()))
+	}
+	s := rpc.Schema{
+		Args: map[string]any{
+			"type":        "array",
+			"prefixItems": params,
+			"minItems":    len(params),
+			"maxItems":    len(params),
+		},
+	}
+
+	var returns []any
+	for i := 0; i < fntyp.NumOut(); i++ {
+		if fntyp.Out(i) != errorInterface {
+			returns = append(returns, rpc.SchemaOf(reflect.Zero(fntyp.Out(i)).Interface()))
+		}
+	}
+	switch len(returns) {
+	case 0:
+	case 1:
+		s.Reply = returns[0].(map[string]any)
+	default:
+		s.Reply = map[string]any{
+			"type":        "array",
+			"prefixItems": returns,
+			"minItems":    len(returns),
+			"maxItems":    len(returns),
+		}
+	}
+	return s
+}
@@ -0,0 +1,37 @@
+package fn
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/rpc"
+	"github.com/roachadam/qtalk-go/rpc/rpctest"
+)
+
+func TestSchema(t *testing.T) {
+	add := func(a, b int, c *rpc.Call) (int, error) {
+		return a + b, nil
+	}
+	s := Schema(add)
+	if len(s.Args["prefixItems"].([]any)) != 2 || s.Reply["type"] != "integer" {
+		t.Fatalf("unexpected schema: %v", s)
+	}
+
+	client, _ := rpctest.NewPair(rpc.WithSchema(HandlerFrom(add), s), codec.JSONCodec{})
+	defer client.Close()
+
+	var sum int
+	_, err := client.Call(context.Background(), "", Args{2, 3}, &sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 5 {
+		t.Fatal("unexpected sum:", sum)
+	}
+	_, err = client.Call(context.Background(), "", Args{2, "3"}, &sum)
+	if err == nil || !strings.Contains(err.Error(), "/1: expected integer") {
+		t.Fatal("unexpected error:", err)
+	}
+}
@@ -0,0 +1,35 @@
+package fn
+
+import (
+	"fmt"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Stream is returned by functions of HandlerFrom handlers to reply with an
+// initial value and then stream values to the caller, which receives them
+// with rpc.Response.ReceiveStream. It is created with NewStream.
+type Stream struct {
+	reply   any
+	produce func(send func(v any) error) error
+}
+
+// NewStream returns a Stream replying with reply, which can be nil, then
+// calling produce with a function sending values to the caller. The stream
+// ends with the status of the error produce returns, as with
+// rpc.StreamReplies. A panic in produce fails the stream like an error.
+func NewStream(reply any, produce func(send func(v any) error) error) *Stream {
+	return &Stream{reply: reply, produce: produce}
+}
+
+// respond continues the call with the stream.
+func (s *Stream) respond(r rpc.Responder) error {
+	return rpc.StreamReplies(r, func(send func(v any) error) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %s [%s]", p, identifyPanic())
+			}
+		}()
+		return s.produce(send)
+	}, s.reply)
+}
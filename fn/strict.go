@@ -0,0 +1,165 @@
+package fn
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// CodeInvalidArgument is the code of an InvalidArgumentError.
+const CodeInvalidArgument = "invalid_argument"
+
+// invalidArgumentPrefix begins the text of every InvalidArgumentError, so
+// callers can recognize them in a RemoteError.
+const invalidArgumentPrefix = "fn: invalid argument"
+
+// InvalidArgumentError is returned in strict mode for arguments that do not
+// fit the parameters of the function called, which is a bug of the caller
+// rather than of the handler. Callers receive it as a RemoteError, which
+// IsInvalidArgument recognizes.
+type InvalidArgumentError struct {
+	// Index is the index of the argument at fault, or -1 if the arguments
+	// as a whole are, such as when there are too many.
+	Index  int
+	Reason string
+}
+
+func (e *InvalidArgumentError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("%ss: %s", invalidArgumentPrefix, e.Reason)
+	}
+	return fmt.Sprintf("%s %d: %s", invalidArgumentPrefix, e.Index, e.Reason)
+}
+
+// Code returns CodeInvalidArgument.
+func (e *InvalidArgumentError) Code() string {
+	return CodeInvalidArgument
+}
+
+// IsInvalidArgument reports whether err is an InvalidArgumentError, or a
+// RemoteError returned by a strict handler for one.
+func IsInvalidArgument(err error) bool {
+	var ie *InvalidArgumentError
+	if errors.As(err, &ie) {
+		return true
+	}
+	var re rpc.RemoteError
+	return errors.As(err, &re) && strings.HasPrefix(string(re), invalidArgumentPrefix)
+}
+
+// StrictHandlerFrom is HandlerFrom in strict mode, where calls with
+// arguments that do not fit the parameters of the function are returned an
+// InvalidArgumentError, as with CallStrict.
+func StrictHandlerFrom[T any](v T) rpc.Handler {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	switch rv.Type().Kind() {
+	case reflect.Func:
+		return fromFunc(reflect.ValueOf(v), true)
+	case reflect.Struct:
+		t := reflect.TypeOf((*T)(nil)).Elem()
+		return fromMethodsWith(v, t, true, registerMethod)
+	default:
+		panic("must be func or struct")
+	}
+}
+
+// CallStrict is Call in strict mode: the wrong number of arguments,
+// arguments that cannot be converted to the parameter types, and struct
+// arguments with unknown or mistyped fields return an InvalidArgumentError
+// without calling the function. Panics of the function are still returned
+// as other errors.
+func CallStrict(fn any, args []any) (_ []any, err error) {
+	fnval := reflect.ValueOf(fn)
+	fnParams, err := argsToStrict(fnval.Type(), args)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %s [%s]", p, identifyPanic())
+		}
+	}()
+	return ParseReturn(fnval.Call(fnParams))
+}
+
+// argsToStrict is ArgsTo in strict mode.
+func argsToStrict(fntyp reflect.Type, args []any) ([]reflect.Value, error) {
+	if len(args) != fntyp.NumIn() {
+		return nil, &InvalidArgumentError{
+			Index:  -1,
+			Reason: fmt.Sprintf("expected %d params, got %d", fntyp.NumIn(), len(args)),
+		}
+	}
+	fnParams := make([]reflect.Value, len(args))
+	for idx, param := range args {
+		arg, err := strictArgTo(param, fntyp.In(idx))
+		if err != nil {
+			return nil, &InvalidArgumentError{Index: idx, Reason: err.Error()}
+		}
+		fnParams[idx] = arg
+	}
+	return fnParams, nil
+}
+
+// strictArgTo is argTo in strict mode, also turning any panic converting
+// the argument into an error.
+func strictArgTo(param any, typ reflect.Type) (_ reflect.Value, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	v, err := argTo(param, typ, true)
+	if err != nil {
+		err = errors.New(strings.TrimPrefix(strings.TrimPrefix(err.Error(), "fn: mapstructure: "), "fn: "))
+	}
+	return v, err
+}
+
+// checkArg checks that an argument has a shape argTo can convert to typ,
+// leaving composite types to be checked when decoding them.
+func checkArg(param any, typ reflect.Type) error {
+	if param == nil {
+		switch typ.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			return nil
+		}
+		return fmt.Errorf("expected %s, got null", typ)
+	}
+	pt := reflect.TypeOf(param)
+	if pt.AssignableTo(typ) {
+		return nil
+	}
+	switch typ.Kind() {
+	case reflect.Pointer, reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		return nil
+	case reflect.Interface:
+		if !pt.Implements(typ) {
+			return fmt.Errorf("expected %s, got %s", typ, pt)
+		}
+	case reflect.Int:
+		switch pt.Kind() {
+		case reflect.Float32, reflect.Float64:
+			if f := reflect.ValueOf(param).Float(); f != math.Trunc(f) {
+				return fmt.Errorf("expected %s, got %v", typ, f)
+			}
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			return fmt.Errorf("expected %s, got %s", typ, pt)
+		}
+	default:
+		if typ == durationType && pt.Kind() == reflect.String {
+			return nil
+		}
+		// numbers convert to strings as runes, which is never intended
+		if !pt.ConvertibleTo(typ) || (pt.Kind() == reflect.String) != (typ.Kind() == reflect.String) {
+			return fmt.Errorf("expected %s, got %s", typ, pt)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package fn
+
+import (
+	"context"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/rpc/rpctest"
+)
+
+func TestCallStrict(t *testing.T) {
+	type options struct{ Limit int }
+	f := func(n int, name string, opts options, p *options) int {
+		return n + opts.Limit
+	}
+	for _, tt := range []struct {
+		name  string
+		args  []any
+		index int
+	}{
+		{"too many", []any{1.0, "a", nil, nil, nil}, -1},
+		{"string for int", []any{"1", "a", map[string]any{}, nil}, 0},
+		{"fraction for int", []any{1.5, "a", map[string]any{}, nil}, 0},
+		{"number for string", []any{1.0, 2.0, map[string]any{}, nil}, 1},
+		{"null struct", []any{1.0, "a", nil, nil}, 2},
+		{"unknown field", []any{1.0, "a", map[string]any{"Limt": 1.0}, nil}, 2},
+		{"mistyped field", []any{1.0, "a", map[string]any{"Limit": "many"}, nil}, 2},
+		{"pointer field", []any{1.0, "a", map[string]any{}, map[string]any{"Other": 1.0}}, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CallStrict(f, tt.args)
+			ie, ok := err.(*InvalidArgumentError)
+			if !ok || ie.Index != tt.index || !IsInvalidArgument(err) {
+				t.Fatalf("expected invalid argument %d, got %v", tt.index, err)
+			}
+		})
+	}
+
+	ret, err := CallStrict(f, []any{1.0, "a", map[string]any{"Limit": 2.0}, nil})
+	fatal(err, t)
+	if ret[0] != 3 {
+		t.Fatalf("unexpected return: %v", ret)
+	}
+
+	_, err = CallStrict(func() { panic("bug") }, nil)
+	if err == nil || IsInvalidArgument(err) {
+		t.Fatalf("expected a panic error, got %v", err)
+	}
+}
+
+func TestStrictHandlerFrom(t *testing.T) {
+	client, _ := rpctest.NewPair(StrictHandlerFrom(func(a, b int) int {
+		return a + b
+	}), codec.JSONCodec{})
+	defer client.Close()
+
+	var sum int
+	_, err := client.Call(context.Background(), "", Args{2, "3"}, &sum)
+	if !IsInvalidArgument(err) {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+	_, err = client.Call(context.Background(), "", "2 and 3", &sum)
+	if !IsInvalidArgument(err) {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+	_, err = client.Call(context.Background(), "", Args{2, 3}, &sum)
+	fatal(err, t)
+	if sum != 5 {
+		t.Fatalf("unexpected sum: %d", sum)
+	}
+}
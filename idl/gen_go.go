@@ -0,0 +1,140 @@
+package idl
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"strings"
+)
+
+// GenerateGo writes Go source for package pkg declaring the file types as
+// structs and, for each service, a server interface, a constructor for an
+// rpc.Handler using fn.HandlerFrom, and a typed client.
+func (f *File) GenerateGo(w io.Writer, pkg string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by qtalkgen. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	if len(f.Services) > 0 {
+		fmt.Fprintf(&buf, "import (\n\t\"context\"\n\n\t\"github.com/roachadam/qtalk-go/fn\"\n\t\"github.com/roachadam/qtalk-go/rpc\"\n)\n\n")
+	}
+
+	for _, t := range f.Types {
+		writeGoDoc(&buf, t.Doc)
+		fmt.Fprintf(&buf, "type %s struct {\n", t.Name)
+		for _, field := range t.Fields {
+			fmt.Fprintf(&buf, "\t%s %s\n", exported(field.Name), goType(field.Type))
+		}
+		fmt.Fprintf(&buf, "}\n\n")
+	}
+
+	for _, s := range f.Services {
+		writeGoDoc(&buf, s.Doc)
+		fmt.Fprintf(&buf, "type %sServer interface {\n", s.Name)
+		for _, m := range s.Methods {
+			writeGoDoc(&buf, m.Doc)
+			fmt.Fprintf(&buf, "\t%s(%s) %s\n", m.Name, goParams(m.Params), goResults(m.Result))
+		}
+		fmt.Fprintf(&buf, "}\n\n")
+
+		fmt.Fprintf(&buf, "// New%[1]sHandler returns a handler exposing the methods of %[1]sServer.\n", s.Name)
+		fmt.Fprintf(&buf, "func New%[1]sHandler(srv %[1]sServer) rpc.Handler {\n\treturn fn.HandlerFrom[%[1]sServer](srv)\n}\n\n", s.Name)
+
+		writeGoClient(&buf, s)
+	}
+
+	return writeGoSource(w, buf.Bytes())
+}
+
+// GenerateGoClient writes Go source for package pkg declaring only the
+// typed client of each service, for services declared in Go, such as by
+// ParseGo, whose package declares the types they use.
+func (f *File) GenerateGoClient(w io.Writer, pkg string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by qtalkgen. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	if len(f.Services) > 0 {
+		fmt.Fprintf(&buf, "import (\n\t\"context\"\n\n\t\"github.com/roachadam/qtalk-go/fn\"\n\t\"github.com/roachadam/qtalk-go/rpc\"\n)\n\n")
+	}
+	for _, s := range f.Services {
+		writeGoClient(&buf, s)
+	}
+	return writeGoSource(w, buf.Bytes())
+}
+
+// writeGoClient writes the typed client of a service.
+func writeGoClient(buf *bytes.Buffer, s *Service) {
+	fmt.Fprintf(buf, "// %[1]sClient calls %[1]s methods using Caller. If the handler is\n// not mounted at the root, Prefix is prepended to selectors (e.g. \"users.\").\n", s.Name)
+	fmt.Fprintf(buf, "type %sClient struct {\n\tCaller rpc.Caller\n\tPrefix string\n}\n\n", s.Name)
+	for _, m := range s.Methods {
+		writeGoDoc(buf, m.Doc)
+		params := goParams(m.Params)
+		if params != "" {
+			params = ", " + params
+		}
+		var args []string
+		for _, p := range m.Params {
+			args = append(args, p.Name)
+		}
+		fmt.Fprintf(buf, "func (c *%sClient) %s(ctx context.Context%s) %s {\n", s.Name, m.Name, params, goResults(m.Result))
+		if m.Result == nil {
+			fmt.Fprintf(buf, "\t_, err := c.Caller.Call(ctx, c.Prefix+%q, fn.Args{%s}, nil)\n\treturn err\n}\n\n", m.Name, strings.Join(args, ", "))
+			continue
+		}
+		fmt.Fprintf(buf, "\tvar ret %s\n", goType(*m.Result))
+		fmt.Fprintf(buf, "\t_, err := c.Caller.Call(ctx, c.Prefix+%q, fn.Args{%s}, &ret)\n\treturn ret, err\n}\n\n", m.Name, strings.Join(args, ", "))
+	}
+}
+
+// writeGoSource writes formatted generated source.
+func writeGoSource(w io.Writer, src []byte) error {
+	src, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("idl: formatting generated go: %w", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+func writeGoDoc(w io.Writer, doc string) {
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		fmt.Fprintf(w, "// %s\n", line)
+	}
+}
+
+func goParams(params []*Field) string {
+	var out []string
+	for _, p := range params {
+		out = append(out, p.Name+" "+goType(p.Type))
+	}
+	return strings.Join(out, ", ")
+}
+
+func goResults(result *TypeRef) string {
+	if result == nil {
+		return "error"
+	}
+	return fmt.Sprintf("(%s, error)", goType(*result))
+}
+
+func goType(ref TypeRef) string {
+	switch {
+	case ref.Elem != nil:
+		return "[]" + goType(*ref.Elem)
+	case ref.Value != nil:
+		return "map[string]" + goType(*ref.Value)
+	}
+	switch ref.Name {
+	case "float":
+		return "float64"
+	case "bytes":
+		return "[]byte"
+	default:
+		return ref.Name
+	}
+}
+
+func exported(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,81 @@
+package idl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// GenerateTS writes TypeScript definitions for use with qtalk.js, declaring
+// an interface for each type and an interface of async methods for each
+// service, with field names matching the Go generated structs.
+func (f *File) GenerateTS(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by qtalkgen. DO NOT EDIT.\n\n")
+
+	for _, t := range f.Types {
+		writeTSDoc(&buf, "", t.Doc)
+		fmt.Fprintf(&buf, "export interface %s {\n", t.Name)
+		for _, field := range t.Fields {
+			fmt.Fprintf(&buf, "  %s: %s;\n", exported(field.Name), tsType(field.Type))
+		}
+		fmt.Fprintf(&buf, "}\n\n")
+	}
+
+	for _, s := range f.Services {
+		writeTSDoc(&buf, "", s.Doc)
+		fmt.Fprintf(&buf, "export interface %s {\n", s.Name)
+		for _, m := range s.Methods {
+			writeTSDoc(&buf, "  ", m.Doc)
+			var params []string
+			for _, p := range m.Params {
+				params = append(params, p.Name+": "+tsType(p.Type))
+			}
+			result := "void"
+			if m.Result != nil {
+				result = tsType(*m.Result)
+			}
+			fmt.Fprintf(&buf, "  %s(%s): Promise<%s>;\n", m.Name, strings.Join(params, ", "), result)
+		}
+		fmt.Fprintf(&buf, "}\n\n")
+	}
+
+	_, err := w.Write(bytes.TrimRight(buf.Bytes(), "\n"))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func writeTSDoc(w io.Writer, indent, doc string) {
+	if doc == "" {
+		return
+	}
+	fmt.Fprintf(w, "%s/**\n", indent)
+	for _, line := range strings.Split(doc, "\n") {
+		fmt.Fprintf(w, "%s * %s\n", indent, line)
+	}
+	fmt.Fprintf(w, "%s */\n", indent)
+}
+
+func tsType(ref TypeRef) string {
+	switch {
+	case ref.Elem != nil:
+		return tsType(*ref.Elem) + "[]"
+	case ref.Value != nil:
+		return fmt.Sprintf("{ [key: string]: %s }", tsType(*ref.Value))
+	}
+	switch ref.Name {
+	case "int", "float":
+		return "number"
+	case "bool":
+		return "boolean"
+	case "bytes":
+		// byte slices are base64 strings in JSON
+		return "string"
+	default:
+		return ref.Name
+	}
+}
@@ -0,0 +1,314 @@
+// Package idl implements a minimal interface definition language for qtalk
+// services and generators for Go and TypeScript code from it.
+//
+// A definition file declares types and services using Go-like syntax:
+//
+//	// User is a user account.
+//	type User {
+//		ID   int
+//		Name string
+//		Tags []string
+//	}
+//
+//	service Users {
+//		Get(id int) User
+//		List() []User
+//		Delete(id int)
+//	}
+//
+// Builtin types are bool, int, float, string, bytes and any. Types can be
+// composed as slices ([]T) or string keyed maps (map[string]T), and may refer
+// to declared types.
+package idl
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/scanner"
+)
+
+// File is a parsed definition file.
+type File struct {
+	Types    []*Type
+	Services []*Service
+
+	// Package is the name of the Go package a File returned by ParseGo
+	// was parsed from.
+	Package string
+}
+
+// Type is a declared struct type.
+type Type struct {
+	Name   string
+	Doc    string
+	Fields []*Field
+}
+
+// Field is a named and typed struct field or method parameter.
+type Field struct {
+	Name string
+	Type TypeRef
+}
+
+// Service is a declared set of methods.
+type Service struct {
+	Name    string
+	Doc     string
+	Methods []*Method
+}
+
+// Method is a service method. Result is nil for methods without a return value.
+type Method struct {
+	Name   string
+	Doc    string
+	Params []*Field
+	Result *TypeRef
+}
+
+// TypeRef refers to a builtin or declared type. Exactly one of Name, Elem
+// (for slices) or Value (for maps) is set.
+type TypeRef struct {
+	Name  string
+	Elem  *TypeRef
+	Value *TypeRef
+}
+
+var builtins = map[string]bool{
+	"bool":   true,
+	"int":    true,
+	"float":  true,
+	"string": true,
+	"bytes":  true,
+	"any":    true,
+}
+
+// Parse reads a definition file from r. The name is used in error positions.
+func Parse(name string, r io.Reader) (*File, error) {
+	p := &parser{}
+	p.s.Init(r)
+	p.s.Filename = name
+	p.s.Mode = scanner.ScanIdents | scanner.ScanComments
+	p.s.Error = func(s *scanner.Scanner, msg string) {
+		p.errorf("%s", msg)
+	}
+	f, err := p.parseFile()
+	if err != nil {
+		return nil, err
+	}
+	return f, f.check()
+}
+
+type parser struct {
+	s   scanner.Scanner
+	tok rune
+	doc []string
+}
+
+type parseError struct{ error }
+
+func (p *parser) errorf(format string, args ...any) {
+	panic(parseError{fmt.Errorf("idl: %s: %s", p.s.Position, fmt.Sprintf(format, args...))})
+}
+
+// next advances to the next token, collecting line comments as docs.
+func (p *parser) next() {
+	for {
+		p.tok = p.s.Scan()
+		if p.tok != scanner.Comment {
+			return
+		}
+		text := p.s.TokenText()
+		if strings.HasPrefix(text, "//") {
+			p.doc = append(p.doc, strings.TrimSpace(strings.TrimPrefix(text, "//")))
+		}
+	}
+}
+
+// takeDoc returns and resets the collected comments.
+func (p *parser) takeDoc() string {
+	doc := strings.Join(p.doc, "\n")
+	p.doc = nil
+	return doc
+}
+
+func (p *parser) expect(tok rune) {
+	if p.tok != tok {
+		p.errorf("expected %s, got %s", scanner.TokenString(tok), p.s.TokenText())
+	}
+	p.next()
+}
+
+func (p *parser) ident() string {
+	if p.tok != scanner.Ident {
+		p.errorf("expected identifier, got %s", p.s.TokenText())
+	}
+	name := p.s.TokenText()
+	p.next()
+	return name
+}
+
+func (p *parser) parseFile() (f *File, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			err = perr.error
+		}
+	}()
+	f = &File{}
+	p.next()
+	for p.tok != scanner.EOF {
+		doc := p.takeDoc()
+		switch kw := p.ident(); kw {
+		case "type":
+			t := &Type{Name: p.ident(), Doc: doc}
+			p.expect('{')
+			for p.tok != '}' {
+				p.takeDoc()
+				t.Fields = append(t.Fields, &Field{Name: p.ident(), Type: p.parseType()})
+			}
+			p.expect('}')
+			f.Types = append(f.Types, t)
+		case "service":
+			s := &Service{Name: p.ident(), Doc: doc}
+			p.expect('{')
+			for p.tok != '}' {
+				s.Methods = append(s.Methods, p.parseMethod())
+			}
+			p.expect('}')
+			p.takeDoc()
+			f.Services = append(f.Services, s)
+		default:
+			p.errorf("unexpected %q, expected type or service", kw)
+		}
+	}
+	return f, nil
+}
+
+func (p *parser) parseMethod() *Method {
+	line := p.s.Position.Line
+	m := &Method{Doc: p.takeDoc(), Name: p.ident()}
+	p.expect('(')
+	for p.tok != ')' {
+		if len(m.Params) > 0 {
+			p.expect(',')
+		}
+		m.Params = append(m.Params, &Field{Name: p.ident(), Type: p.parseType()})
+	}
+	// a result type must begin on the same line as the method
+	if p.expect(')'); p.tok != '}' && p.s.Position.Line == line {
+		t := p.parseType()
+		m.Result = &t
+	}
+	return m
+}
+
+func (p *parser) parseType() TypeRef {
+	switch {
+	case p.tok == '[':
+		p.next()
+		p.expect(']')
+		elem := p.parseType()
+		return TypeRef{Elem: &elem}
+	case p.tok == scanner.Ident && p.s.TokenText() == "map":
+		p.next()
+		p.expect('[')
+		if key := p.ident(); key != "string" {
+			p.errorf("map keys must be string, got %s", key)
+		}
+		p.expect(']')
+		value := p.parseType()
+		return TypeRef{Value: &value}
+	default:
+		return TypeRef{Name: p.ident()}
+	}
+}
+
+// check ensures all referenced types are declared or builtin and names are unique.
+func (f *File) check() error {
+	declared := make(map[string]bool)
+	for _, t := range f.Types {
+		if declared[t.Name] || builtins[t.Name] {
+			return fmt.Errorf("idl: type %s declared more than once", t.Name)
+		}
+		declared[t.Name] = true
+		if err := unique("field", t.Name, len(t.Fields), func(i int) string {
+			return exported(t.Fields[i].Name)
+		}); err != nil {
+			return err
+		}
+	}
+	// services generate types named after them, which must not collide
+	// with declared types or those of other services
+	generated := make(map[string]bool)
+	for _, s := range f.Services {
+		for _, name := range []string{s.Name, s.Name + "Server", s.Name + "Client", "New" + s.Name + "Handler"} {
+			if declared[name] || generated[name] {
+				return fmt.Errorf("idl: service %s conflicts with name %s", s.Name, name)
+			}
+			generated[name] = true
+		}
+		if err := unique("method", s.Name, len(s.Methods), func(i int) string {
+			return s.Methods[i].Name
+		}); err != nil {
+			return err
+		}
+		for _, m := range s.Methods {
+			if err := unique("parameter", s.Name+"."+m.Name, len(m.Params), func(i int) string {
+				return m.Params[i].Name
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	var checkRef func(ref TypeRef) error
+	checkRef = func(ref TypeRef) error {
+		switch {
+		case ref.Elem != nil:
+			return checkRef(*ref.Elem)
+		case ref.Value != nil:
+			return checkRef(*ref.Value)
+		case !builtins[ref.Name] && !declared[ref.Name]:
+			return fmt.Errorf("idl: undeclared type %s", ref.Name)
+		}
+		return nil
+	}
+	for _, t := range f.Types {
+		for _, field := range t.Fields {
+			if err := checkRef(field.Type); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range f.Services {
+		for _, m := range s.Methods {
+			for _, param := range m.Params {
+				if err := checkRef(param.Type); err != nil {
+					return err
+				}
+			}
+			if m.Result != nil {
+				if err := checkRef(*m.Result); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// unique returns an error if any of the n names returned by name for the
+// members of the named declaration are the same.
+func unique(kind, decl string, n int, name func(i int) string) error {
+	seen := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		if seen[name(i)] {
+			return fmt.Errorf("idl: %s %s of %s declared more than once", kind, name(i), decl)
+		}
+		seen[name(i)] = true
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package idl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testIDL = `
+// User is a user account.
+type User {
+	ID    int
+	name  string
+	Tags  []string
+	Attrs map[string]any
+}
+
+// Users manages user accounts.
+service Users {
+	// Get returns a user by ID.
+	Get(id int) User
+	List(offset int, limit int) []User
+	Delete(id int)
+}
+`
+
+func TestParse(t *testing.T) {
+	f, err := Parse("test.qtalk", strings.NewReader(testIDL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Types) != 1 || len(f.Types[0].Fields) != 4 {
+		t.Fatalf("unexpected types: %#v", f.Types)
+	}
+	if f.Types[0].Doc != "User is a user account." {
+		t.Fatalf("unexpected doc: %q", f.Types[0].Doc)
+	}
+	if len(f.Services) != 1 || len(f.Services[0].Methods) != 3 {
+		t.Fatalf("unexpected services: %#v", f.Services)
+	}
+	m := f.Services[0].Methods
+	if m[0].Doc != "Get returns a user by ID." || m[0].Result == nil || m[0].Result.Name != "User" {
+		t.Fatalf("unexpected method: %#v", m[0])
+	}
+	if len(m[1].Params) != 2 || m[1].Result.Elem == nil {
+		t.Fatalf("unexpected method: %#v", m[1])
+	}
+	if m[2].Result != nil {
+		t.Fatalf("unexpected method result: %#v", m[2].Result)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"type User { ID Missing }",
+		"service Users { Get(id int }",
+		"type Foo {} type Foo {}",
+		"type Foo { M map[int]string }",
+		"func Foo()",
+		"type Foo { a int A int }",
+		"service Foo {} service Foo {}",
+		"type Foo {} service Foo {}",
+		"type FooClient {} service Foo {}",
+		"service Foo { Get() Get() }",
+		"service Foo { Get(a int, a int) }",
+	} {
+		if _, err := Parse("test.qtalk", strings.NewReader(src)); err == nil {
+			t.Errorf("expected error parsing: %s", src)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	f, err := Parse("test.qtalk", strings.NewReader(testIDL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gosrc bytes.Buffer
+	if err := f.GenerateGo(&gosrc, "users"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"package users",
+		"Name  string",
+		"Attrs map[string]any",
+		"Get(id int) (User, error)",
+		"Delete(id int) error",
+		"func NewUsersHandler(srv UsersServer) rpc.Handler",
+		"func (c *UsersClient) List(ctx context.Context, offset int, limit int) ([]User, error)",
+	} {
+		if !strings.Contains(gosrc.String(), s) {
+			t.Errorf("generated go missing %q:\n%s", s, gosrc.String())
+		}
+	}
+
+	var ts bytes.Buffer
+	if err := f.GenerateTS(&ts); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"export interface User {",
+		"Tags: string[];",
+		"Attrs: { [key: string]: any };",
+		"Get(id: number): Promise<User>;",
+		"Delete(id: number): Promise<void>;",
+	} {
+		if !strings.Contains(ts.String(), s) {
+			t.Errorf("generated ts missing %q:\n%s", s, ts.String())
+		}
+	}
+}
+
+// TestGenerateGolden checks the generated code of the gentest package, which
+// has its own test making calls through it, is up to date.
+func TestGenerateGolden(t *testing.T) {
+	src, err := os.Open("internal/gentest/gentest.qtalk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	f, err := Parse("gentest.qtalk", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gosrc bytes.Buffer
+	if err := f.GenerateGo(&gosrc, "gentest"); err != nil {
+		t.Fatal(err)
+	}
+	golden, err := os.ReadFile("internal/gentest/gentest_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gosrc.Bytes(), golden) {
+		t.Fatal("internal/gentest is out of date, run go generate ./idl/...")
+	}
+}
+
+const testGoSource = `package users
+
+import "github.com/roachadam/qtalk-go/rpc"
+
+type id int64
+
+// User is a user account.
+type User struct {
+	ID     id
+	Name   string
+	Avatar []byte
+	Tags   []string
+	Attrs  map[string]any
+	Boss   *User
+	secret string
+}
+
+// Service manages user accounts.
+type Service interface {
+	// Get returns a user by ID.
+	Get(id id) (*User, error)
+	List(offset, limit int, c *rpc.Call) []User
+	Delete(id int) error
+	Ping()
+}
+`
+
+func TestParseGo(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "users.go"), []byte(testGoSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ParseGo(dir, "Service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Package != "users" || len(f.Types) != 1 || len(f.Types[0].Fields) != 6 || f.Types[0].Doc != "User is a user account." {
+		t.Fatalf("unexpected file: %#v %#v", f, f.Types)
+	}
+	m := f.Services[0].Methods
+	if len(m) != 4 || m[0].Doc != "Get returns a user by ID." || m[0].Result.Name != "User" ||
+		len(m[1].Params) != 2 || m[1].Result.Elem == nil || m[2].Result != nil || m[3].Result != nil {
+		t.Fatalf("unexpected methods: %#v", m)
+	}
+
+	var gosrc bytes.Buffer
+	if err := f.GenerateGoClient(&gosrc, f.Package); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"package users",
+		"type ServiceClient struct",
+		"func (c *ServiceClient) Get(ctx context.Context, id int) (User, error)",
+		"func (c *ServiceClient) List(ctx context.Context, offset int, limit int) ([]User, error)",
+	} {
+		if !strings.Contains(gosrc.String(), s) {
+			t.Errorf("generated go missing %q:\n%s", s, gosrc.String())
+		}
+	}
+	if strings.Contains(gosrc.String(), "type User struct") {
+		t.Errorf("generated go declares types:\n%s", gosrc.String())
+	}
+
+	for _, src := range []string{
+		"package users\ntype Service interface { Get() (int, int, error) }",
+		"package users\nimport \"time\"\ntype Service interface { Get() time.Time }",
+		"package users\ntype Service struct{}",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "users.go"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseGo(dir, "Service"); err == nil {
+			t.Errorf("expected error parsing: %s", src)
+		}
+	}
+}
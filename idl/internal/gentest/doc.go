@@ -0,0 +1,5 @@
+// Package gentest is code generated from gentest.qtalk, checked by the idl
+// tests to compile and work when served with fn.HandlerFrom.
+package gentest
+
+//go:generate go run ../../../cmd/qtalkgen -go gentest_gen.go -pkg gentest gentest.qtalk
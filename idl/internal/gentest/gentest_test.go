@@ -0,0 +1,77 @@
+package gentest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/rpc/rpctest"
+)
+
+type store struct{}
+
+func (store) Sum(ids []int) (int, error) {
+	sum := 0
+	for _, id := range ids {
+		sum += id
+	}
+	return sum, nil
+}
+
+func (store) Echo(b []byte) ([]byte, error) { return b, nil }
+
+func (store) Put(item Item) (Item, error) {
+	item.ID++
+	return item, nil
+}
+
+func (store) Index(items []Item) (map[string]Item, error) {
+	index := make(map[string]Item)
+	for _, item := range items {
+		index[item.Name] = item
+	}
+	return index, nil
+}
+
+func (s store) Count(items map[string][]int) (int, error) {
+	n := 0
+	for _, ids := range items {
+		n += len(ids)
+	}
+	return n, nil
+}
+
+func (store) Reset() error { return nil }
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client, _ := rpctest.NewPair(NewStoreHandler(store{}), codec.JSONCodec{})
+	defer client.Close()
+	c := &StoreClient{Caller: client}
+
+	sum, err := c.Sum(ctx, []int{1, 2, 3})
+	if err != nil || sum != 6 {
+		t.Fatalf("Sum = %d, %v", sum, err)
+	}
+	b, err := c.Echo(ctx, []byte("hello"))
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("Echo = %q, %v", b, err)
+	}
+	item := Item{ID: 1, Name: "a", Data: []byte{1, 2}, Attrs: map[string]float64{"x": 1.5}}
+	put, err := c.Put(ctx, item)
+	if err != nil || put.ID != 2 || !reflect.DeepEqual(put.Data, item.Data) || put.Attrs["x"] != 1.5 {
+		t.Fatalf("Put = %#v, %v", put, err)
+	}
+	index, err := c.Index(ctx, []Item{item})
+	if err != nil || !reflect.DeepEqual(index["a"], item) {
+		t.Fatalf("Index = %#v, %v", index, err)
+	}
+	n, err := c.Count(ctx, map[string][]int{"a": {1, 2}, "b": {3}})
+	if err != nil || n != 3 {
+		t.Fatalf("Count = %d, %v", n, err)
+	}
+	if err := c.Reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,227 @@
+package idl
+
+import (
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ParseGo returns a File declaring a service for the interface named name
+// of the Go package in dir, for generating stubs from Go declarations instead
+// of a definition file. Struct types of the package used by the methods are
+// declared as types with their exported fields. Methods can take a final
+// *rpc.Call parameter, which is left out, and return nothing, a value, an
+// error, or a value and an error, as functions exposed with fn.HandlerFrom.
+// The Package of the File is set to the name of the package.
+func ParseGo(dir, name string) (*File, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("idl: %w", err)
+	}
+	fset := token.NewFileSet()
+	var pkgs []string
+	files := make(map[string][]*ast.File)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".go") || strings.HasSuffix(e.Name(), "_test.go") {
+			continue
+		}
+		file, err := goparser.ParseFile(fset, filepath.Join(dir, e.Name()), nil, goparser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("idl: %w", err)
+		}
+		pkg := file.Name.Name
+		if files[pkg] == nil {
+			pkgs = append(pkgs, pkg)
+		}
+		files[pkg] = append(files[pkg], file)
+	}
+	for _, pkg := range pkgs {
+		g := &goSource{decls: make(map[string]*ast.TypeSpec), declared: make(map[string]bool)}
+		for _, file := range files[pkg] {
+			for _, decl := range file.Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gd.Specs {
+					ts := spec.(*ast.TypeSpec)
+					if ts.Doc == nil && len(gd.Specs) == 1 {
+						ts.Doc = gd.Doc
+					}
+					g.decls[ts.Name.Name] = ts
+				}
+			}
+		}
+		ts, ok := g.decls[name]
+		if !ok {
+			continue
+		}
+		iface, ok := ts.Type.(*ast.InterfaceType)
+		if !ok {
+			return nil, fmt.Errorf("idl: %s is not an interface", name)
+		}
+		s := &Service{Name: name, Doc: docText(ts.Doc)}
+		for _, field := range iface.Methods.List {
+			if len(field.Names) == 0 {
+				return nil, fmt.Errorf("idl: %s: embedded interfaces are not supported", name)
+			}
+			if !field.Names[0].IsExported() {
+				continue
+			}
+			m, err := g.method(field.Names[0].Name, field.Type.(*ast.FuncType))
+			if err != nil {
+				return nil, fmt.Errorf("idl: %s.%s: %w", name, field.Names[0].Name, err)
+			}
+			m.Doc = docText(field.Doc)
+			s.Methods = append(s.Methods, m)
+		}
+		g.file.Package = pkg
+		g.file.Services = []*Service{s}
+		return &g.file, g.file.check()
+	}
+	return nil, fmt.Errorf("idl: no type %s in %s", name, dir)
+}
+
+// goSource converts declarations of a Go package.
+type goSource struct {
+	decls    map[string]*ast.TypeSpec
+	declared map[string]bool
+	file     File
+}
+
+func (g *goSource) method(name string, ft *ast.FuncType) (*Method, error) {
+	m := &Method{Name: name}
+	params := ft.Params.List
+	if n := len(params); n > 0 && isCallParam(params[n-1].Type) {
+		params = params[:n-1]
+	}
+	for _, p := range params {
+		ref, err := g.typeRef(p.Type)
+		if err != nil {
+			return nil, err
+		}
+		if len(p.Names) == 0 {
+			m.Params = append(m.Params, &Field{Name: fmt.Sprintf("arg%d", len(m.Params)), Type: ref})
+		}
+		for _, n := range p.Names {
+			m.Params = append(m.Params, &Field{Name: n.Name, Type: ref})
+		}
+	}
+	var results []ast.Expr
+	if ft.Results != nil {
+		for _, r := range ft.Results.List {
+			for i := 0; i < len(r.Names) || i == 0; i++ {
+				results = append(results, r.Type)
+			}
+		}
+	}
+	if n := len(results); n > 0 && isIdent(results[n-1], "error") {
+		results = results[:n-1]
+	}
+	switch len(results) {
+	case 0:
+	case 1:
+		ref, err := g.typeRef(results[0])
+		if err != nil {
+			return nil, err
+		}
+		m.Result = &ref
+	default:
+		return nil, fmt.Errorf("more than one result value")
+	}
+	return m, nil
+}
+
+// typeRef converts a Go type, declaring the struct types it refers to.
+func (g *goSource) typeRef(expr ast.Expr) (TypeRef, error) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "bool", "string", "any":
+			return TypeRef{Name: t.Name}, nil
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+			return TypeRef{Name: "int"}, nil
+		case "float32", "float64":
+			return TypeRef{Name: "float"}, nil
+		}
+		ts, ok := g.decls[t.Name]
+		if !ok {
+			return TypeRef{}, fmt.Errorf("unsupported type %s", t.Name)
+		}
+		st, ok := ts.Type.(*ast.StructType)
+		if !ok {
+			return g.typeRef(ts.Type)
+		}
+		if !g.declared[t.Name] {
+			g.declared[t.Name] = true
+			if err := g.declare(t.Name, st, docText(ts.Doc)); err != nil {
+				return TypeRef{}, err
+			}
+		}
+		return TypeRef{Name: t.Name}, nil
+	case *ast.StarExpr:
+		return g.typeRef(t.X)
+	case *ast.InterfaceType:
+		if len(t.Methods.List) == 0 {
+			return TypeRef{Name: "any"}, nil
+		}
+	case *ast.ArrayType:
+		if t.Len != nil {
+			break
+		}
+		if isIdent(t.Elt, "byte") || isIdent(t.Elt, "uint8") {
+			return TypeRef{Name: "bytes"}, nil
+		}
+		elem, err := g.typeRef(t.Elt)
+		return TypeRef{Elem: &elem}, err
+	case *ast.MapType:
+		if !isIdent(t.Key, "string") {
+			return TypeRef{}, fmt.Errorf("map keys must be string")
+		}
+		value, err := g.typeRef(t.Value)
+		return TypeRef{Value: &value}, err
+	}
+	return TypeRef{}, fmt.Errorf("unsupported type %T", expr)
+}
+
+// declare adds a type for a struct with its exported fields.
+func (g *goSource) declare(name string, st *ast.StructType, doc string) error {
+	t := &Type{Name: name, Doc: doc}
+	g.file.Types = append(g.file.Types, t)
+	for _, field := range st.Fields.List {
+		for _, n := range field.Names {
+			if !n.IsExported() {
+				continue
+			}
+			ref, err := g.typeRef(field.Type)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", name, n.Name, err)
+			}
+			t.Fields = append(t.Fields, &Field{Name: n.Name, Type: ref})
+		}
+	}
+	return nil
+}
+
+// isCallParam reports whether expr is *rpc.Call.
+func isCallParam(expr ast.Expr) bool {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	return ok && isIdent(sel.X, "rpc") && sel.Sel.Name == "Call"
+}
+
+func isIdent(expr ast.Expr, name string) bool {
+	id, ok := expr.(*ast.Ident)
+	return ok && id.Name == name
+}
+
+func docText(cg *ast.CommentGroup) string {
+	return strings.TrimSpace(cg.Text())
+}
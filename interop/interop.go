@@ -0,0 +1,328 @@
+// Package interop defines canonical encodings of qmux frames and RPC values
+// used to check wire compatibility with other qtalk implementations such as
+// qtalk.js. The encodings are kept as golden files under testdata, one
+// directory per Compat mode, so other implementations can assert they read
+// and write identical bytes.
+//
+// The wire format of the upstream progrium/qtalk-go implementation, which
+// qtalk.js follows, is the subset selected by CompatUpstream: the channel
+// frames, and call and response headers without the fields added since.
+// Everything beyond it is only sent once negotiated, so sessions keep to it
+// with peers that never send a session hello:
+//
+//   - hello, compressed data, open reject, extension and close error frames,
+//     and compact frame headers, which need a session hello
+//   - the Args of call headers and the empty frame ending streamed
+//     arguments, which need mux.FeatureCallArgs
+//   - the Chain of call headers, which is only sent by calls made in
+//     handling another call, and ignored by upstream decoders
+//
+// CheckUpstreamFrames checks a recorded session keeps to the format.
+package interop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux/frame"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Compat selects known divergences of other implementations from the
+// encodings produced by this package.
+type Compat uint8
+
+// CompatNone produces encodings identical to this implementation.
+const CompatNone Compat = 0
+
+const (
+	// CompatJS produces JSON values without the trailing newline that
+	// encoding/json writes, matching JSON.stringify in qtalk.js.
+	CompatJS Compat = 1 << iota
+
+	// CompatUpstream limits the cases to the wire format of the upstream
+	// implementation, whose decoders check the values, so fields it
+	// does not know fail them.
+	CompatUpstream
+)
+
+// Dir returns the golden file directory name for the mode.
+func (c Compat) Dir() string {
+	dir := "go"
+	if c&CompatJS != 0 {
+		dir = "js"
+	}
+	if c&CompatUpstream != 0 {
+		dir += "-upstream"
+	}
+	return dir
+}
+
+// Case is a canonical value and its encoding.
+type Case struct {
+	Name string
+
+	// Bytes is the canonical encoding of the value.
+	Bytes []byte
+
+	// Check decodes b and returns an error if it does not decode to the
+	// value of the case.
+	Check func(b []byte) error
+}
+
+// Cases returns the canonical cases encoded for the given mode.
+func Cases(c Compat) ([]Case, error) {
+	var cd codec.Codec = codec.JSONCodec{}
+	if c&CompatJS != 0 {
+		cd = jsCodec{}
+	}
+	upstream := c&CompatUpstream != 0
+	var cases []Case
+	for _, f := range frameCases {
+		if upstream && !upstreamFrame(f.msg) {
+			continue
+		}
+		cases = append(cases, frameCase(f.name, f.msg))
+	}
+	for _, v := range valueCases {
+		if upstream && v.upstream == nil {
+			continue
+		}
+		vc, err := valueCase(cd, v.name, v.value)
+		if err != nil {
+			return nil, err
+		}
+		if upstream {
+			vc.Check = upstreamCheck(v.upstream)
+		}
+		cases = append(cases, vc)
+	}
+	if !upstream {
+		cases = append(cases, endFrameCase)
+	}
+	return cases, nil
+}
+
+// endFrameCase is the empty frame ending streamed arguments, sent after the
+// values of a call header with Args -1 when mux.FeatureCallArgs is
+// negotiated.
+var endFrameCase = Case{
+	Name:  "rpc_endframe",
+	Bytes: []byte{0, 0, 0, 0},
+	Check: func(b []byte) error {
+		framer := &rpc.FrameCodec{Codec: codec.JSONCodec{}}
+		var v any
+		if err := framer.Decoder(bytes.NewReader(b)).Decode(&v); err != io.EOF {
+			return fmt.Errorf("decoded %v, expected end of stream", err)
+		}
+		return nil
+	},
+}
+
+var frameCases = []struct {
+	name string
+	msg  frame.Message
+}{
+	{"frame_open", frame.OpenMessage{SenderID: 1, WindowSize: 1 << 30, MaxPacketSize: 1 << 24}},
+	{"frame_openconfirm", frame.OpenConfirmMessage{ChannelID: 1, SenderID: 2, WindowSize: 1 << 30, MaxPacketSize: 1 << 24}},
+	{"frame_openfailure", frame.OpenFailureMessage{ChannelID: 1}},
+	{"frame_openreject", frame.OpenRejectMessage{ChannelID: 1, Reason: 1}},
+	{"frame_windowadjust", frame.WindowAdjustMessage{ChannelID: 1, AdditionalBytes: 1024}},
+	{"frame_data", frame.DataMessage{ChannelID: 1, Length: 11, Data: []byte("Hello world")}},
+	{"frame_eof", frame.EOFMessage{ChannelID: 1}},
+	{"frame_close", frame.CloseMessage{ChannelID: 1}},
+	{"frame_hello", frame.HelloMessage{Version: 1, Features: 1}},
+	{"frame_extension", frame.ExtensionMessage{ExtensionID: 1, Length: 5, Data: []byte("Hello")}},
+}
+
+var errMsg = "not found: /missing"
+
+// upstreamCallHeader and upstreamResponseHeader are the headers of the
+// upstream implementation.
+type upstreamCallHeader struct {
+	Selector string
+}
+
+type upstreamResponseHeader struct {
+	Error    *string
+	Continue bool
+}
+
+var valueCases = []struct {
+	name  string
+	value any
+
+	// upstream is the value decoded by the upstream implementation, or
+	// nil if the case is not in its format
+	upstream any
+}{
+	{"rpc_callheader", rpc.CallHeader{Selector: "/echo"}, upstreamCallHeader{Selector: "/echo"}},
+	{"rpc_callheader_args", rpc.CallHeader{Selector: "/echo", Args: 1}, nil},
+	{"rpc_callheader_stream", rpc.CallHeader{Selector: "/echo", Args: -1}, nil},
+	{"rpc_args", []any{"Hello world", 42.0, true, nil}, []any{"Hello world", 42.0, true, nil}},
+	{"rpc_responseheader", rpc.ResponseHeader{}, upstreamResponseHeader{}},
+	{"rpc_responseheader_continue", rpc.ResponseHeader{Continue: true}, upstreamResponseHeader{Continue: true}},
+	{"rpc_responseheader_error", rpc.ResponseHeader{Error: &errMsg}, upstreamResponseHeader{Error: &errMsg}},
+	{"rpc_reply", map[string]any{"Name": "qtalk", "Tags": []any{"a", "b"}}, map[string]any{"Name": "qtalk", "Tags": []any{"a", "b"}}},
+}
+
+// upstreamFrame returns whether msg is a frame of the upstream format.
+func upstreamFrame(msg frame.Message) bool {
+	switch msg.(type) {
+	case frame.OpenMessage, *frame.OpenMessage,
+		frame.OpenConfirmMessage, *frame.OpenConfirmMessage,
+		frame.OpenFailureMessage, *frame.OpenFailureMessage,
+		frame.WindowAdjustMessage, *frame.WindowAdjustMessage,
+		frame.DataMessage, *frame.DataMessage,
+		frame.EOFMessage, *frame.EOFMessage,
+		frame.CloseMessage, *frame.CloseMessage:
+		return true
+	}
+	return false
+}
+
+// upstreamCheck returns the Check of a case decoding to the upstream value
+// v, with fields upstream does not know failing it.
+func upstreamCheck(v any) func(b []byte) error {
+	return func(b []byte) error {
+		framer := &rpc.FrameCodec{Codec: codec.JSONCodec{DisallowUnknownFields: true}}
+		out := reflect.New(reflect.TypeOf(v))
+		if err := framer.Decoder(bytes.NewReader(b)).Decode(out.Interface()); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(out.Elem().Interface(), v) {
+			return fmt.Errorf("decoded %#v, expected %#v", out.Elem().Interface(), v)
+		}
+		return nil
+	}
+}
+
+// CheckUpstreamFrames reads the frames sent by one side of a session from r
+// until it ends, and returns an error for the first frame outside the
+// upstream format.
+func CheckUpstreamFrames(r io.Reader) error {
+	dec := frame.NewDecoder(r)
+	for {
+		msg, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("interop: %w", err)
+		}
+		if !upstreamFrame(msg) {
+			return fmt.Errorf("interop: %s is not in the upstream format", msg)
+		}
+	}
+}
+
+func frameCase(name string, msg frame.Message) Case {
+	return Case{
+		Name:  name,
+		Bytes: msg.Bytes(),
+		Check: func(b []byte) error {
+			m, err := frame.NewDecoder(bytes.NewReader(b)).Decode()
+			if err != nil {
+				return err
+			}
+			if m.String() != msg.String() {
+				return fmt.Errorf("decoded %s, expected %s", m, msg)
+			}
+			return nil
+		},
+	}
+}
+
+func valueCase(cd codec.Codec, name string, v any) (Case, error) {
+	framer := &rpc.FrameCodec{Codec: cd}
+	var buf bytes.Buffer
+	if err := framer.Encoder(&buf).Encode(v); err != nil {
+		return Case{}, err
+	}
+	return Case{
+		Name:  name,
+		Bytes: buf.Bytes(),
+		Check: func(b []byte) error {
+			// decoding always uses the standard codec, since it
+			// must accept what every mode produces
+			framer := &rpc.FrameCodec{Codec: codec.JSONCodec{}}
+			out := reflect.New(reflect.TypeOf(v))
+			if err := framer.Decoder(bytes.NewReader(b)).Decode(out.Interface()); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(out.Elem().Interface(), v) {
+				return fmt.Errorf("decoded %#v, expected %#v", out.Elem().Interface(), v)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// WriteGolden writes the cases for the mode as <name>.bin files into the
+// mode directory under dir.
+func WriteGolden(dir string, c Compat) error {
+	cases, err := Cases(c)
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(dir, c.Dir())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, tc := range cases {
+		if err := os.WriteFile(filepath.Join(dir, tc.Name+".bin"), tc.Bytes, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckGolden compares the cases for the mode against the golden files
+// under dir, and checks each golden file decodes to the case value.
+func CheckGolden(dir string, c Compat) error {
+	cases, err := Cases(c)
+	if err != nil {
+		return err
+	}
+	for _, tc := range cases {
+		golden, err := os.ReadFile(filepath.Join(dir, c.Dir(), tc.Name+".bin"))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(golden, tc.Bytes) {
+			return fmt.Errorf("interop: %s/%s: encoding %q differs from golden %q", c.Dir(), tc.Name, tc.Bytes, golden)
+		}
+		if err := tc.Check(golden); err != nil {
+			return fmt.Errorf("interop: %s/%s: %w", c.Dir(), tc.Name, err)
+		}
+	}
+	return nil
+}
+
+// jsCodec encodes JSON like JSON.stringify, without a trailing newline.
+type jsCodec struct {
+	codec.JSONCodec
+}
+
+func (jsCodec) Encoder(w io.Writer) codec.Encoder {
+	return &jsEncoder{w: w}
+}
+
+type jsEncoder struct {
+	w io.Writer
+}
+
+func (e *jsEncoder) Encode(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
@@ -0,0 +1,124 @@
+package interop
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/mux/frame"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestGolden(t *testing.T) {
+	for _, c := range []Compat{CompatNone, CompatJS, CompatUpstream, CompatUpstream | CompatJS} {
+		if *update {
+			if err := WriteGolden("testdata", c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := CheckGolden("testdata", c); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// recordConn is one end of a transport, recording the frames it reads.
+type recordConn struct {
+	io.Reader
+	*io.PipeWriter
+	r *io.PipeReader
+}
+
+func newRecordConn(r *io.PipeReader, w *io.PipeWriter, record *bytes.Buffer) *recordConn {
+	return &recordConn{Reader: io.TeeReader(r, record), PipeWriter: w, r: r}
+}
+
+func (c *recordConn) Close() error {
+	c.PipeWriter.Close()
+	return c.r.Close()
+}
+
+func TestUpstreamSession(t *testing.T) {
+	// sessions without a config never send a hello, so they keep to the
+	// upstream format whatever they do
+	var sentA, sentB bytes.Buffer
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA := mux.New(newRecordConn(ar, aw, &sentB))
+	sessB := mux.New(newRecordConn(br, bw, &sentA))
+
+	m := rpc.NewRespondMux()
+	m.Handle("echo", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var v any
+		c.Receive(&v)
+		r.Return(v)
+	}))
+	m.Handle("stream", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		c.Receive(nil)
+		rpc.StreamReplies(r, func(send func(v any) error) error {
+			return send("Hello")
+		})
+	}))
+	srv := &rpc.Server{Codec: codec.JSONCodec{}, Handler: m}
+	go srv.Respond(sessA, nil)
+
+	ctx := context.Background()
+	client := rpc.NewClient(sessB, codec.JSONCodec{})
+	var reply string
+	if _, err := client.Call(ctx, "echo", "Hello", &reply); err != nil {
+		t.Fatal(err)
+	}
+	args := make(chan any, 1)
+	args <- "Hello"
+	close(args)
+	if _, err := client.Call(ctx, "echo", args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Call(ctx, "stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		err = resp.ReceiveStream(&reply)
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+
+	sessB.Close()
+	sessA.Wait()
+	sessB.Wait()
+	if err := CheckUpstreamFrames(&sentA); err != nil {
+		t.Fatal("server side:", err)
+	}
+	if err := CheckUpstreamFrames(&sentB); err != nil {
+		t.Fatal("client side:", err)
+	}
+}
+
+func TestUpstreamDivergence(t *testing.T) {
+	hello := frame.HelloMessage{Version: 1, Features: 1}
+	if err := CheckUpstreamFrames(bytes.NewReader(hello.Bytes())); err == nil {
+		t.Fatal("expected hello frame to fail the upstream format")
+	}
+	cases, err := Cases(CompatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := upstreamCheck(upstreamCallHeader{Selector: "/echo"})
+	for _, c := range cases {
+		if c.Name == "rpc_callheader_args" {
+			if err := check(c.Bytes); err == nil {
+				t.Fatal("expected call header args to fail the upstream format")
+			}
+			return
+		}
+	}
+	t.Fatal("missing call header args case")
+}
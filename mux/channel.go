@@ -1,10 +1,11 @@
 package mux
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/roachadam/qtalk-go/mux/frame"
 )
@@ -29,6 +30,67 @@ type Channel interface {
 	CloseWrite() error
 }
 
+// RemoteIDer is implemented by channels knowing the ID the peer uses for
+// them, which includes the channels of sessions created by this package.
+type RemoteIDer interface {
+	// RemoteID returns the ID the peer uses for the channel, so the peers
+	// can log the same channel by its IDs.
+	RemoteID() uint32
+}
+
+// ReadDeadliner is implemented by channels supporting read deadlines, which
+// includes the channels of sessions created by this package.
+type ReadDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ErrorCloser is implemented by channels that can be closed with an error
+// for the peer, which includes the channels of sessions created by this
+// package.
+type ErrorCloser interface {
+	// CloseWithError closes the channel like Close, making reads of the
+	// peer return a *ChannelError with code and msg instead of io.EOF
+	// once they have read the data sent before, so it can tell a failure
+	// from the end of the data. Peers that did not advertise
+	// FeatureCloseErrors see a regular close.
+	CloseWithError(code uint32, msg string) error
+}
+
+// ChannelError is returned by reads of a channel the peer closed with
+// ErrorCloser.CloseWithError.
+type ChannelError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *ChannelError) Error() string {
+	return fmt.Sprintf("qmux: channel closed by peer with error %d: %s", e.Code, e.Message)
+}
+
+// CloseNotifier is implemented by channels notifying once they are closed,
+// which includes the channels of sessions created by this package.
+type CloseNotifier interface {
+	// OnClose registers f to be called in its own goroutine once the
+	// channel is closed, which is when the peer closed it or confirmed a
+	// local close, or the session ended. If the channel already is closed,
+	// f is called right away. It lets producers writing to a channel stop
+	// without waiting for a write to fail.
+	OnClose(f func())
+}
+
+// BandwidthLimiter is implemented by channels supporting bandwidth limits,
+// which includes the channels of sessions created by this package.
+type BandwidthLimiter interface {
+	SetRateLimit(bytesPerSec, burst int)
+}
+
+// ReadBufferLimiter is implemented by channels supporting a limit on the
+// data they hold until it is read, which includes the channels of sessions
+// created by this package.
+type ReadBufferLimiter interface {
+	SetReadBuffer(bytes int)
+}
+
 // channel is an implementation of the Channel interface that works
 // with the session class.
 type channel struct {
@@ -52,15 +114,23 @@ type channel struct {
 	// Pending internal channel messages.
 	msg chan frame.Message
 
+	// established is set by the session loop once the channel is open,
+	// to report its close to SessionConfig.OnChannelClose.
+	established bool
+
 	sentEOF bool
 
 	// thread-safe data
 	remoteWin window
 	pending   *buffer
 
-	// windowMu protects myWindow, the flow-control window.
-	windowMu sync.Mutex
-	myWindow uint32
+	// windowMu protects myWindow, the flow-control window, along with
+	// unread, the data received but not yet read, and readBuffer, the
+	// limit for both together.
+	windowMu   sync.Mutex
+	myWindow   uint32
+	unread     uint32
+	readBuffer uint32
 
 	// writeMu serializes calls to session.conn.Write() and
 	// protects sentClose and packetPool. This mutex must be
@@ -71,6 +141,15 @@ type channel struct {
 
 	// packet buffer for writing
 	packetBuf []byte
+
+	// optional bandwidth limits for each direction
+	readLimit  atomic.Pointer[rateLimiter]
+	writeLimit atomic.Pointer[rateLimiter]
+
+	// closeMu protects closed and onClose, the callbacks of OnClose
+	closeMu sync.Mutex
+	closed  bool
+	onClose []func()
 }
 
 // ID returns the unique identifier of this channel
@@ -79,6 +158,10 @@ func (ch *channel) ID() uint32 {
 	return ch.localId
 }
 
+func (ch *channel) RemoteID() uint32 {
+	return ch.remoteId
+}
+
 // CloseWrite signals the end of sending data.
 // The other side may still send data
 func (ch *channel) CloseWrite() error {
@@ -88,10 +171,93 @@ func (ch *channel) CloseWrite() error {
 }
 
 // Close signals end of channel use. No data may be sent after this
-// call.
+// call, and writes blocked waiting for window return io.EOF.
 func (ch *channel) Close() error {
-	return ch.send(frame.CloseMessage{
+	err := ch.send(frame.CloseMessage{
 		ChannelID: ch.remoteId})
+	ch.remoteWin.close()
+	return err
+}
+
+// CloseWithError closes the channel with an error for the peer.
+func (ch *channel) CloseWithError(code uint32, msg string) error {
+	var err error
+	if _, features := ch.session.Protocol(); features.Has(FeatureCloseErrors) {
+		err = ch.send(frame.CloseErrorMessage{
+			ChannelID: ch.remoteId,
+			Code:      code,
+			Length:    uint32(len(msg)),
+			Data:      []byte(msg),
+		})
+	} else {
+		err = ch.send(frame.CloseMessage{
+			ChannelID: ch.remoteId})
+	}
+	ch.remoteWin.close()
+	return err
+}
+
+// OnClose calls f once the channel is closed.
+func (ch *channel) OnClose(f func()) {
+	ch.closeMu.Lock()
+	closed := ch.closed
+	if !closed {
+		ch.onClose = append(ch.onClose, f)
+	}
+	ch.closeMu.Unlock()
+	if closed {
+		go f()
+	}
+}
+
+// SetReadDeadline sets the deadline for future Read calls and any
+// currently-blocked Read call. Reads past the deadline return
+// os.ErrDeadlineExceeded. A zero value for t means Read will not time out.
+func (ch *channel) SetReadDeadline(t time.Time) error {
+	ch.pending.setDeadline(t)
+	return nil
+}
+
+// SetRateLimit limits reads and writes on the channel to bytesPerSec each,
+// allowing bursts of up to burst bytes. If burst is not positive, bytesPerSec
+// is used as the burst. A bytesPerSec that is not positive removes the limits.
+// Limiting reads delays window adjustments, which also slows the remote writer.
+func (ch *channel) SetRateLimit(bytesPerSec, burst int) {
+	if bytesPerSec <= 0 {
+		ch.readLimit.Store(nil)
+		ch.writeLimit.Store(nil)
+		return
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	ch.readLimit.Store(newRateLimiter(bytesPerSec, burst))
+	ch.writeLimit.Store(newRateLimiter(bytesPerSec, burst))
+}
+
+// SetReadBuffer limits the data received on the channel but not yet read to
+// bytes, giving backpressure to the peer when reads are slow. Window
+// adjustments are withheld while the limit is exceeded, which may be for a
+// while after lowering it, since data the peer was already allowed to send
+// may still arrive. A limit that is not positive restores the default of the
+// session.
+func (ch *channel) SetReadBuffer(bytes int) {
+	if bytes <= 0 {
+		bytes = ch.session.config.ReadBuffer
+	}
+	ch.windowMu.Lock()
+	ch.readBuffer = readBufferSize(bytes)
+	ch.windowMu.Unlock()
+	// a raised limit is granted right away
+	ch.adjustWindow(0)
+}
+
+// readBufferSize returns the window for a read buffer limit.
+func readBufferSize(bytes int) uint32 {
+	if bytes <= 0 || bytes > channelWindowSize {
+		return channelWindowSize
+	}
+	return uint32(bytes)
 }
 
 // Write writes len(data) bytes to the channel.
@@ -102,13 +268,22 @@ func (ch *channel) Write(data []byte) (n int, err error) {
 
 	for len(data) > 0 {
 		space := min(ch.maxRemotePayload, len(data))
-		if space, err = ch.remoteWin.reserve(space); err != nil {
+		limit := ch.writeLimit.Load()
+		if limit != nil {
+			space = min(space, limit.burst)
+		}
+		if space, err = ch.reserve(space); err != nil {
 			return n, err
 		}
 
 		toSend := data[:space]
+		if limit != nil {
+			limit.wait(len(toSend))
+		}
 
-		if err = ch.session.enc.Encode(frame.DataMessage{
+		// sent under writeMu, so no data follows a close of the channel
+		// whose ID the peer may already be reusing
+		if err = ch.send(frame.DataMessage{
 			ChannelID: ch.remoteId,
 			Length:    uint32(len(toSend)),
 			Data:      toSend,
@@ -123,10 +298,44 @@ func (ch *channel) Write(data []byte) (n int, err error) {
 	return n, err
 }
 
+// reserve reserves window to write, logging and reporting a stall if it has
+// to wait.
+func (ch *channel) reserve(space uint32) (uint32, error) {
+	config := &ch.session.config
+	watch := ch.session.events != nil || config.StallTimeout > 0 ||
+		(config.StallThreshold > 0 && config.OnStall != nil)
+	if !watch || ch.remoteWin.available() > 0 {
+		return ch.remoteWin.reserve(space, 0)
+	}
+	ch.event(EventWindowStall, "")
+	if config.StallThreshold > 0 && config.OnStall != nil {
+		t := time.AfterFunc(config.StallThreshold, func() { config.OnStall(ch) })
+		defer t.Stop()
+	}
+	start := time.Now()
+	space, err := ch.remoteWin.reserve(space, config.StallTimeout)
+	switch err {
+	case nil:
+		ch.event(EventWindowResume, time.Since(start).String())
+	case ErrWindowStalled:
+		ch.event(EventWindowTimeout, "")
+	}
+	return space, err
+}
+
 // Read reads up to len(data) bytes from the channel.
 func (c *channel) Read(data []byte) (n int, err error) {
+	limit := c.readLimit.Load()
+	if limit != nil && len(data) > limit.burst {
+		data = data[:limit.burst]
+	}
+
 	n, err = c.pending.Read(data)
 
+	if n > 0 && limit != nil {
+		limit.wait(n)
+	}
+
 	if n > 0 {
 		err = c.adjustWindow(uint32(n))
 		// sendWindowAdjust can return io.EOF if the remote
@@ -140,8 +349,9 @@ func (c *channel) Read(data []byte) (n int, err error) {
 	return n, err
 }
 
-// sends writes a message frame. If the message is a channel close, it updates
-// sentClose. This method takes the lock c.writeMu.
+// sends writes a message frame, or returns io.EOF once the channel was
+// closed. If the message is a channel close, it updates sentClose. This method
+// takes the lock c.writeMu.
 func (ch *channel) send(msg frame.Message) error {
 	ch.writeMu.Lock()
 	defer ch.writeMu.Unlock()
@@ -150,26 +360,44 @@ func (ch *channel) send(msg frame.Message) error {
 		return io.EOF
 	}
 
-	if _, ok := msg.(frame.CloseMessage); ok {
+	switch msg.(type) {
+	case frame.CloseMessage, frame.CloseErrorMessage:
 		ch.sentClose = true
 	}
 
 	return ch.session.enc.Encode(msg)
 }
 
+// adjustWindow grants the peer window for n bytes that were read, as far
+// as the read buffer limit allows.
 func (c *channel) adjustWindow(n uint32) error {
 	c.windowMu.Lock()
+	c.unread -= n
 	// Since myWindow is managed on our side, and can never exceed
-	// the initial window setting, we don't worry about overflow.
-	c.myWindow += uint32(n)
+	// the read buffer limit, we don't worry about overflow.
+	var grant uint32
+	if used := c.myWindow + c.unread; used < c.readBuffer {
+		grant = c.readBuffer - used
+		c.myWindow += grant
+	}
 	c.windowMu.Unlock()
+	if grant == 0 {
+		return nil
+	}
 	return c.send(frame.WindowAdjustMessage{
 		ChannelID:       c.remoteId,
-		AdditionalBytes: uint32(n),
+		AdditionalBytes: grant,
 	})
 }
 
 func (c *channel) close() {
+	if c.established {
+		c.established = false
+		c.event(EventClose, "")
+		if f := c.session.config.OnChannelClose; f != nil {
+			f(c, c.direction == channelInbound)
+		}
+	}
 	c.pending.eof()
 	close(c.msg)
 	c.writeMu.Lock()
@@ -179,6 +407,15 @@ func (c *channel) close() {
 	c.writeMu.Unlock()
 	// Unblock writers.
 	c.remoteWin.close()
+
+	c.closeMu.Lock()
+	c.closed = true
+	onClose := c.onClose
+	c.onClose = nil
+	c.closeMu.Unlock()
+	for _, f := range onClose {
+		go f()
+	}
 }
 
 // responseMessageReceived is called when a success or failure message is
@@ -186,7 +423,7 @@ func (c *channel) close() {
 // given channel.
 func (ch *channel) responseMessageReceived() error {
 	if ch.direction == channelInbound {
-		return errors.New("qmux: channel response message received on inbound channel")
+		return protocolError("qmux: channel response message received on inbound channel")
 	}
 	return nil
 }
@@ -204,13 +441,25 @@ func (ch *channel) handle(msg frame.Message) error {
 		ch.close()
 		return nil
 
+	case *frame.CloseErrorMessage:
+		if _, features := ch.session.Protocol(); !features.Has(FeatureCloseErrors) {
+			return protocolError("qmux: unexpected close error frame")
+		}
+		ch.pending.fail(&ChannelError{Code: m.Code, Message: string(m.Data)})
+		ch.send(frame.CloseMessage{
+			ChannelID: ch.remoteId,
+		})
+		ch.session.chans.remove(ch.localId)
+		ch.close()
+		return nil
+
 	case *frame.EOFMessage:
 		ch.pending.eof()
 		return nil
 
 	case *frame.WindowAdjustMessage:
 		if !ch.remoteWin.add(m.AdditionalBytes) {
-			return fmt.Errorf("qmux: invalid window update for %d bytes", m.AdditionalBytes)
+			return protocolError("qmux: invalid window update for %d bytes", m.AdditionalBytes)
 		}
 		return nil
 
@@ -219,11 +468,12 @@ func (ch *channel) handle(msg frame.Message) error {
 			return err
 		}
 		if m.MaxPacketSize < minPacketLength || m.MaxPacketSize > maxPacketLength {
-			return fmt.Errorf("qmux: invalid MaxPacketSize %d from peer", m.MaxPacketSize)
+			return protocolError("qmux: invalid MaxPacketSize %d from peer", m.MaxPacketSize)
 		}
 		ch.remoteId = m.SenderID
 		ch.maxRemotePayload = m.MaxPacketSize
 		ch.remoteWin.add(m.WindowSize)
+		ch.session.established(ch)
 		ch.msg <- m
 		return nil
 
@@ -235,28 +485,37 @@ func (ch *channel) handle(msg frame.Message) error {
 		ch.msg <- m
 		return nil
 
+	case *frame.OpenRejectMessage:
+		if err := ch.responseMessageReceived(); err != nil {
+			return err
+		}
+		ch.session.chans.remove(m.ChannelID)
+		ch.msg <- m
+		return nil
+
 	default:
-		return fmt.Errorf("qmux: invalid channel message %v", msg)
+		return protocolError("qmux: invalid channel message %v", msg)
 	}
 }
 
 func (ch *channel) handleData(msg *frame.DataMessage) error {
 	if msg.Length > ch.maxIncomingPayload {
 		// TODO(hanwen): should send Disconnect?
-		return errors.New("qmux: incoming packet exceeds maximum payload size")
+		return protocolError("qmux: incoming packet exceeds maximum payload size")
 	}
 
 	if msg.Length != uint32(len(msg.Data)) {
-		return errors.New("qmux: wrong packet length")
+		return protocolError("qmux: wrong packet length")
 	}
 
 	ch.windowMu.Lock()
 	if ch.myWindow < msg.Length {
 		ch.windowMu.Unlock()
 		// TODO(hanwen): should send Disconnect with reason?
-		return errors.New("qmux: remote side wrote too much")
+		return protocolError("qmux: remote side wrote too much")
 	}
 	ch.myWindow -= msg.Length
+	ch.unread += msg.Length
 	ch.windowMu.Unlock()
 
 	ch.pending.write(msg.Data)
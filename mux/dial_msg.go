@@ -0,0 +1,95 @@
+package mux
+
+import (
+	"io"
+	"sync"
+)
+
+// MessageTransport carries a session over a message broker such as MQTT or
+// NATS, so peers that can only reach the broker can still talk. Each frame
+// written by the session is sent as one message with the publish function,
+// and messages received from the peer are passed to Deliver:
+//
+//	// NATS, with the peer publishing on dev.1.rx and subscribing to dev.1.tx
+//	t := mux.NewMessageTransport(func(msg []byte) error {
+//		return nc.Publish("dev.1.tx", msg)
+//	})
+//	sub, _ := nc.Subscribe("dev.1.rx", func(m *nats.Msg) { t.Deliver(m.Data) })
+//	sess := mux.New(t)
+//
+//	// MQTT using QoS 2
+//	t := mux.NewMessageTransport(func(msg []byte) error {
+//		return c.Publish("dev/1/tx", 2, false, msg).Error()
+//	})
+//	c.Subscribe("dev/1/rx", 2, func(_ mqtt.Client, m mqtt.Message) { t.Deliver(m.Payload()) })
+//
+// The broker must deliver the messages of each direction once and in order,
+// since a lost, duplicated or reordered frame breaks the session.
+type MessageTransport struct {
+	publish func(msg []byte) error
+	buf     *buffer
+
+	mu     sync.Mutex
+	closed bool
+	eof    bool
+}
+
+// NewMessageTransport returns a MessageTransport sending messages with
+// publish. Messages are copied before publish is called, so it can keep
+// them after returning.
+func NewMessageTransport(publish func(msg []byte) error) *MessageTransport {
+	return &MessageTransport{publish: publish, buf: newBuffer()}
+}
+
+// Deliver passes a message received from the peer to the session. It copies
+// msg and does not block, so it can be called from subscription callbacks.
+// An empty message is sent by the peer closing its transport, and ends the
+// messages read by the session. Messages delivered after that are dropped.
+func (t *MessageTransport) Deliver(msg []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.eof {
+		return
+	}
+	if len(msg) == 0 {
+		t.eof = true
+		t.buf.eof()
+		return
+	}
+	t.buf.write(append([]byte(nil), msg...))
+}
+
+func (t *MessageTransport) Read(p []byte) (int, error) {
+	return t.buf.Read(p)
+}
+
+// Write publishes p as a single message.
+func (t *MessageTransport) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := t.publish(append([]byte(nil), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close publishes an empty message to tell the peer the session ended, and
+// ends the messages read by the session. It does not unsubscribe from the
+// broker.
+func (t *MessageTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if !t.eof {
+		t.eof = true
+		t.buf.eof()
+	}
+	return t.publish(nil)
+}
@@ -1,6 +1,7 @@
 package mux
 
 import (
+	"crypto/tls"
 	"net"
 )
 
@@ -21,3 +22,12 @@ func DialTCP(addr string) (Session, error) {
 func DialUnix(path string) (Session, error) {
 	return dialNet("unix", path)
 }
+
+// DialTLS establishes a mux session via TLS connection using config.
+func DialTLS(addr string, config *tls.Config) (Session, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
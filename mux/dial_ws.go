@@ -1,7 +1,11 @@
 package mux
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"net"
+	"net/http"
 
 	"golang.org/x/net/websocket"
 )
@@ -10,10 +14,71 @@ import (
 // The address must be a host and port. Opening a WebSocket
 // connection at a particular path is not supported.
 func DialWS(addr string) (Session, error) {
-	ws, err := websocket.Dial(fmt.Sprintf("ws://%s/", addr), "", fmt.Sprintf("http://%s/", addr))
+	return DialWSConfig(addr, nil)
+}
+
+// DialWSConfig establishes a mux session via WebSocket connection like
+// DialWS, negotiating a subprotocol with the optional config. The session
+// reports the subprotocol selected by the server with its Subprotocol
+// method.
+func DialWSConfig(addr string, config *WSConfig) (Session, error) {
+	if config == nil {
+		config = &WSConfig{}
+	}
+	origin := config.Origin
+	if origin == "" {
+		origin = fmt.Sprintf("http://%s/", addr)
+	}
+	wsConfig, err := websocket.NewConfig(fmt.Sprintf("ws://%s/", addr), origin)
+	if err != nil {
+		return nil, err
+	}
+	wsConfig.Protocol = config.offers()
+
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	// the websocket package keeps the offered subprotocols if the server
+	// selects none, so the response header is read from a copy
+	hc := &handshakeConn{Conn: conn}
+	ws, err := websocket.NewClient(wsConfig, hc)
+	if err != nil {
+		conn.Close()
+		return nil, &websocket.DialError{Config: wsConfig, Err: err}
+	}
+	subprotocol := hc.subprotocol()
+	if subprotocol == "" && config.RequireSubprotocol {
+		ws.Close()
+		return nil, ErrWSSubprotocol
+	}
 	ws.PayloadType = websocket.BinaryFrame
-	return New(ws), nil
+	return New(&wsConn{Conn: ws, subprotocol: subprotocol}), nil
+}
+
+// handshakeConn copies what is read from a connection until the handshake
+// response has been parsed.
+type handshakeConn struct {
+	net.Conn
+	buf  bytes.Buffer
+	done bool
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done {
+		c.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// subprotocol stops copying and returns the subprotocol of the response.
+func (c *handshakeConn) subprotocol() string {
+	c.done = true
+	resp, err := http.ReadResponse(bufio.NewReader(&c.buf), nil)
+	c.buf = bytes.Buffer{}
+	if err != nil {
+		return ""
+	}
+	return resp.Header.Get("Sec-WebSocket-Protocol")
 }
@@ -0,0 +1,166 @@
+package mux
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventKind is the kind of an Event.
+type EventKind int
+
+const (
+	// EventOpen is a channel being established.
+	EventOpen EventKind = iota + 1
+	// EventOpenFailed is an open of either side failing, with the reason
+	// as Detail.
+	EventOpenFailed
+	// EventClose is a channel closed by both sides or by the end of the
+	// session.
+	EventClose
+	// EventWindowStall is a write waiting for the peer to grant window,
+	// which happens when it does not read the channel fast enough.
+	EventWindowStall
+	// EventWindowResume is a stalled write resuming, with the time it
+	// waited as Detail.
+	EventWindowResume
+	// EventGoAway is a go away sent or received, as Detail.
+	EventGoAway
+	// EventSessionEnd is the end of the session, with the error as Detail.
+	EventSessionEnd
+	// EventWindowTimeout is a stalled write failing after
+	// SessionConfig.StallTimeout.
+	EventWindowTimeout
+)
+
+var eventKindNames = []string{
+	EventOpen:          "open",
+	EventOpenFailed:    "open-failed",
+	EventClose:         "close",
+	EventWindowStall:   "window-stall",
+	EventWindowResume:  "window-resume",
+	EventGoAway:        "go-away",
+	EventSessionEnd:    "session-end",
+	EventWindowTimeout: "window-timeout",
+}
+
+func (k EventKind) String() string {
+	if k > 0 && int(k) < len(eventKindNames) {
+		return eventKindNames[k]
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// MarshalText encodes the kind as its name.
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes a kind from its name.
+func (k *EventKind) UnmarshalText(text []byte) error {
+	for i, name := range eventKindNames {
+		if i > 0 && name == string(text) {
+			*k = EventKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("qmux: unknown event kind %q", text)
+}
+
+// Event is an entry of the event log of a session, enabled with
+// SessionConfig.EventLog.
+type Event struct {
+	Time time.Time
+	Kind EventKind
+	// Channel is the local ID of the channel of the event, and Inbound
+	// whether it was opened by the peer. Opens of the peer failing before
+	// a channel was created have the ID of the peer channel. They are zero
+	// for session events.
+	Channel uint32 `json:",omitempty"`
+	Inbound bool   `json:",omitempty"`
+	Detail  string `json:",omitempty"`
+}
+
+func (e Event) String() string {
+	s := e.Time.Format(time.RFC3339Nano) + " " + e.Kind.String()
+	switch e.Kind {
+	case EventGoAway, EventSessionEnd:
+	default:
+		dir := "outbound"
+		if e.Inbound {
+			dir = "inbound"
+		}
+		s += fmt.Sprintf(" %s channel %d", dir, e.Channel)
+	}
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	return s
+}
+
+// EventLogger is implemented by sessions keeping a log of recent events,
+// which includes sessions created by this package.
+type EventLogger interface {
+	// Events returns the events in the log, oldest first, or nil if the
+	// log is not enabled with SessionConfig.EventLog.
+	Events() []Event
+}
+
+func (s *session) Events() []Event {
+	if s.events == nil {
+		return nil
+	}
+	return s.events.all()
+}
+
+// eventRing keeps the most recent events in a fixed size buffer.
+type eventRing struct {
+	mu   sync.Mutex
+	buf  []Event
+	next int
+	full bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{buf: make([]Event, size)}
+}
+
+func (r *eventRing) add(e Event) {
+	r.mu.Lock()
+	r.buf[r.next] = e
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+func (r *eventRing) all() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Event(nil), r.buf[:r.next]...)
+	}
+	return append(append([]Event(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+// event logs an event of the session, if the log is enabled.
+func (s *session) event(kind EventKind, detail string) {
+	if s.events != nil {
+		s.events.add(Event{Time: time.Now(), Kind: kind, Detail: detail})
+	}
+}
+
+// event logs an event of the channel, if the log is enabled.
+func (ch *channel) event(kind EventKind, detail string) {
+	if events := ch.session.events; events != nil {
+		events.add(Event{
+			Time:    time.Now(),
+			Kind:    kind,
+			Channel: ch.localId,
+			Inbound: ch.direction == channelInbound,
+			Detail:  detail,
+		})
+	}
+}
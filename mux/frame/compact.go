@@ -0,0 +1,257 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Compact headers encode the message fields as uvarints instead of fixed
+// four byte integers, and can omit the channel ID when it is the same as
+// the previous compact frame. Compact frames use their own range of message
+// types so they can be mixed with regular frames:
+//
+//	0b11IXXXXX where XXXXX is the regular message type minus msgChannelOpen
+//	and I is set if the channel ID is implied by the previous compact frame.
+const (
+	compactMask     = 0xC0
+	compactImplicit = 0x20
+	compactTypeMask = 0x1F
+)
+
+func isCompact(msgNum byte) bool {
+	return msgNum&compactMask == compactMask
+}
+
+// messageType returns the regular message type of msg.
+func messageType(msg Message) byte {
+	switch msg.(type) {
+	case OpenMessage, *OpenMessage:
+		return msgChannelOpen
+	case OpenConfirmMessage, *OpenConfirmMessage:
+		return msgChannelOpenConfirm
+	case OpenFailureMessage, *OpenFailureMessage:
+		return msgChannelOpenFailure
+	case OpenRejectMessage, *OpenRejectMessage:
+		return msgChannelOpenReject
+	case WindowAdjustMessage, *WindowAdjustMessage:
+		return msgChannelWindowAdjust
+	case DataMessage, *DataMessage:
+		return msgChannelData
+	case EOFMessage, *EOFMessage:
+		return msgChannelEOF
+	case CloseMessage, *CloseMessage:
+		return msgChannelClose
+	case CloseErrorMessage, *CloseErrorMessage:
+		return msgChannelCloseError
+	case HelloMessage, *HelloMessage:
+		return msgSessionHello
+	case ExtensionMessage, *ExtensionMessage:
+		return msgSessionExtension
+	default:
+		return 0
+	}
+}
+
+// compactState tracks the channel of the last compact frame in a stream.
+type compactState struct {
+	channel uint32
+	hasLast bool
+}
+
+// implicit returns whether channelID can be omitted and updates the
+// state to the given channel.
+func (s *compactState) implicit(channelID uint32) bool {
+	same := s.hasLast && s.channel == channelID
+	s.channel, s.hasLast = channelID, true
+	return same
+}
+
+// compactHeader appends msg to b using a compact header. The data of data
+// messages is returned separately to be written after the header as is.
+func (s *compactState) compactHeader(b []byte, msgType byte, msg Message) (header, data []byte) {
+	switch m := msg.(type) {
+	case *OpenMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *OpenConfirmMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *OpenFailureMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *OpenRejectMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *WindowAdjustMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *DataMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *EOFMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *CloseMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *CloseErrorMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *HelloMessage:
+		return s.compactHeader(b, msgType, *m)
+	case *ExtensionMessage:
+		return s.compactHeader(b, msgType, *m)
+	}
+	header = append(b, compactMask|(msgType-msgChannelOpen))
+	switch m := msg.(type) {
+	case OpenMessage:
+		header = appendUint32(header, m.SenderID, m.WindowSize, m.MaxPacketSize)
+	case OpenConfirmMessage:
+		header = s.appendChannel(header, m.ChannelID)
+		header = appendUint32(header, m.SenderID, m.WindowSize, m.MaxPacketSize)
+	case OpenFailureMessage:
+		header = s.appendChannel(header, m.ChannelID)
+	case OpenRejectMessage:
+		header = s.appendChannel(header, m.ChannelID)
+		header = appendUint32(header, m.Reason)
+	case WindowAdjustMessage:
+		header = s.appendChannel(header, m.ChannelID)
+		header = appendUint32(header, m.AdditionalBytes)
+	case DataMessage:
+		header = s.appendChannel(header, m.ChannelID)
+		header = appendUint32(header, m.Length)
+		data = m.Data
+	case EOFMessage:
+		header = s.appendChannel(header, m.ChannelID)
+	case CloseMessage:
+		header = s.appendChannel(header, m.ChannelID)
+	case CloseErrorMessage:
+		header = s.appendChannel(header, m.ChannelID)
+		header = appendUint32(header, m.Code, m.Length)
+		data = m.Data
+	case HelloMessage:
+		header = appendUint32(header, m.Version, m.Features, m.DictID)
+	case ExtensionMessage:
+		header = appendUint32(header, m.ExtensionID, m.Length)
+		data = m.Data
+	}
+	return header, data
+}
+
+// appendChannel appends channelID to a compact header, or marks it as
+// implicit if it is the channel of the previous compact frame.
+func (s *compactState) appendChannel(header []byte, channelID uint32) []byte {
+	if s.implicit(channelID) {
+		header[0] |= compactImplicit
+		return header
+	}
+	return binary.AppendUvarint(header, uint64(channelID))
+}
+
+func appendUint32(b []byte, vs ...uint32) []byte {
+	for _, v := range vs {
+		b = binary.AppendUvarint(b, uint64(v))
+	}
+	return b
+}
+
+// byteReader reads single bytes from a reader without buffering, to
+// avoid reading beyond the current frame.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(b.r, b.buf[:])
+	return b.buf[0], err
+}
+
+// decodeCompact reads the fields of a compact frame into msg. Data for
+// data messages is allocated and read after the header.
+func (s *compactState) decodeCompact(r io.Reader, msgNum byte, msg Message) error {
+	br := &byteReader{r: r}
+	var err error
+	switch m := msg.(type) {
+	case *OpenMessage:
+		err = readUint32s(br, &m.SenderID, &m.WindowSize, &m.MaxPacketSize)
+	case *OpenConfirmMessage:
+		if m.ChannelID, err = s.readChannel(br, msgNum); err == nil {
+			err = readUint32s(br, &m.SenderID, &m.WindowSize, &m.MaxPacketSize)
+		}
+	case *OpenFailureMessage:
+		m.ChannelID, err = s.readChannel(br, msgNum)
+	case *OpenRejectMessage:
+		if m.ChannelID, err = s.readChannel(br, msgNum); err == nil {
+			m.Reason, err = readUint32(br)
+		}
+	case *WindowAdjustMessage:
+		if m.ChannelID, err = s.readChannel(br, msgNum); err == nil {
+			m.AdditionalBytes, err = readUint32(br)
+		}
+	case *DataMessage:
+		if m.ChannelID, err = s.readChannel(br, msgNum); err == nil {
+			if m.Length, err = readUint32(br); err == nil {
+				m.Data, err = readData(r, m.Length)
+			}
+		}
+	case *EOFMessage:
+		m.ChannelID, err = s.readChannel(br, msgNum)
+	case *CloseMessage:
+		m.ChannelID, err = s.readChannel(br, msgNum)
+	case *CloseErrorMessage:
+		if m.ChannelID, err = s.readChannel(br, msgNum); err == nil {
+			if err = readUint32s(br, &m.Code, &m.Length); err == nil {
+				m.Data, err = readData(r, m.Length)
+			}
+		}
+	case *HelloMessage:
+		err = readUint32s(br, &m.Version, &m.Features, &m.DictID)
+	case *ExtensionMessage:
+		if err = readUint32s(br, &m.ExtensionID, &m.Length); err == nil {
+			m.Data, err = readData(r, m.Length)
+		}
+	}
+	return err
+}
+
+// readChannel reads the channel ID of a compact frame, using the channel of
+// the previous compact frame if it is implicit.
+func (s *compactState) readChannel(br io.ByteReader, msgNum byte) (uint32, error) {
+	if msgNum&compactImplicit != 0 {
+		if !s.hasLast {
+			return 0, errors.New("qtalk: implicit channel without previous frame")
+		}
+		return s.channel, nil
+	}
+	v, err := readUint32(br)
+	if err != nil {
+		return 0, err
+	}
+	s.implicit(v)
+	return v, nil
+}
+
+func readData(r io.Reader, length uint32) ([]byte, error) {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readUint32s(br io.ByteReader, vs ...*uint32) (err error) {
+	for _, v := range vs {
+		if *v, err = readUint32(br); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readUint32(br io.ByteReader) (uint32, error) {
+	v, err := binary.ReadUvarint(br)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxUint32 {
+		return 0, errors.New("qtalk: compact field overflows uint32")
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,85 @@
+package frame
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// minCompressLength is the smallest data payload worth compressing.
+const minCompressLength = 64
+
+// DictID returns the identifier of a compression dictionary used to
+// check both peers use the same dictionary. A nil dictionary is 0.
+func DictID(dict []byte) uint32 {
+	if len(dict) == 0 {
+		return 0
+	}
+	return crc32.ChecksumIEEE(dict)
+}
+
+// compressor deflates data payloads, each independently so any frame
+// can be decoded without state from previous frames.
+type compressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newCompressor(dict []byte) *compressor {
+	c := &compressor{}
+	// only fails for invalid levels
+	c.w, _ = flate.NewWriterDict(&c.buf, flate.BestSpeed, dict)
+	return c
+}
+
+// compress returns the deflated data, or nil if compressing does not
+// reduce its size.
+func (c *compressor) compress(data []byte) []byte {
+	if len(data) < minCompressLength {
+		return nil
+	}
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+	if _, err := c.w.Write(data); err != nil {
+		return nil
+	}
+	if err := c.w.Close(); err != nil {
+		return nil
+	}
+	if c.buf.Len() >= len(data) {
+		return nil
+	}
+	return c.buf.Bytes()
+}
+
+// decompressor inflates compressed data payloads.
+type decompressor struct {
+	dict  []byte
+	r     io.ReadCloser
+	limit uint32
+}
+
+func newDecompressor(dict []byte, limit uint32) *decompressor {
+	return &decompressor{
+		dict:  dict,
+		r:     flate.NewReaderDict(bytes.NewReader(nil), dict),
+		limit: limit,
+	}
+}
+
+// decompress returns the inflated data, failing if it is larger than the limit.
+func (d *decompressor) decompress(data []byte) ([]byte, error) {
+	if err := d.r.(flate.Resetter).Reset(bytes.NewReader(data), d.dict); err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(d.r, int64(d.limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(out)) > d.limit {
+		return nil, errors.New("qtalk: decompressed data exceeds limit")
+	}
+	return out, nil
+}
@@ -14,6 +14,10 @@ import (
 type Decoder struct {
 	r io.Reader
 	sync.Mutex
+
+	decompressor *decompressor
+	compact      compactState
+	buf          [16]byte
 }
 
 func NewDecoder(r io.Reader) *Decoder {
@@ -34,32 +38,60 @@ func (dec *Decoder) Decode() (Message, error) {
 		return nil, err
 	}
 
+	header := msgNum[0]
+	if isCompact(header) {
+		msgNum[0] = msgChannelOpen + header&compactTypeMask
+	}
+
+	// compressed data is decoded as a data message with inflated data
+	compressed := msgNum[0] == msgChannelCompressedData && dec.decompressor != nil
+	if compressed {
+		msgNum[0] = msgChannelData
+	}
+
 	var msg Message
 	msg, err = messageFrom(msgNum)
 	if err != nil {
 		return nil, err
 	}
 
-	if msgNum[0] == msgChannelData {
-		var data struct {
-			ChannelID uint32
-			Length    uint32
+	if isCompact(header) {
+		if err := dec.compact.decodeCompact(dec.r, header, msg); err != nil {
+			return nil, err
 		}
-		if err := binary.Read(dec.r, binary.BigEndian, &data); err != nil {
+	} else if dataMsg, ok := msg.(*DataMessage); ok {
+		dataMsg.ChannelID, dataMsg.Length, dataMsg.Data, err = dec.readPayload()
+		if err != nil {
 			return nil, err
 		}
-		dataMsg := msg.(*DataMessage)
-		dataMsg.ChannelID = data.ChannelID
-		dataMsg.Length = data.Length
-		dataMsg.Data = make([]byte, data.Length)
-		_, err := io.ReadFull(dec.r, dataMsg.Data)
+	} else if extMsg, ok := msg.(*ExtensionMessage); ok {
+		extMsg.ExtensionID, extMsg.Length, extMsg.Data, err = dec.readPayload()
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		if err := binary.Read(dec.r, binary.BigEndian, msg); err != nil {
+	} else if closeMsg, ok := msg.(*CloseErrorMessage); ok {
+		header := dec.buf[:12]
+		if _, err := io.ReadFull(dec.r, header); err != nil {
+			return nil, err
+		}
+		closeMsg.ChannelID = binary.BigEndian.Uint32(header[0:4])
+		closeMsg.Code = binary.BigEndian.Uint32(header[4:8])
+		closeMsg.Length = binary.BigEndian.Uint32(header[8:12])
+		closeMsg.Data = make([]byte, closeMsg.Length)
+		if _, err := io.ReadFull(dec.r, closeMsg.Data); err != nil {
+			return nil, err
+		}
+	} else if err := dec.readFields(msg); err != nil {
+		return nil, err
+	}
+
+	if compressed {
+		dataMsg := msg.(*DataMessage)
+		dataMsg.Data, err = dec.decompressor.decompress(dataMsg.Data)
+		if err != nil {
 			return nil, err
 		}
+		dataMsg.Length = uint32(len(dataMsg.Data))
 	}
 
 	if Debug != nil {
@@ -69,7 +101,76 @@ func (dec *Decoder) Decode() (Message, error) {
 	return msg, nil
 }
 
+// EnableCompression makes the decoder accept compressed data messages
+// using the optional preset dictionary, refusing any that decompress
+// to more than limit bytes.
+func (dec *Decoder) EnableCompression(dict []byte, limit uint32) {
+	dec.Lock()
+	defer dec.Unlock()
+	dec.decompressor = newDecompressor(dict, limit)
+}
+
+// readPayload reads the fields of data and extension messages, which are
+// an ID and a length followed by that many bytes.
+func (dec *Decoder) readPayload() (id, length uint32, data []byte, err error) {
+	header := dec.buf[:8]
+	if _, err = io.ReadFull(dec.r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	id = binary.BigEndian.Uint32(header[0:4])
+	length = binary.BigEndian.Uint32(header[4:8])
+	data = make([]byte, length)
+	if _, err = io.ReadFull(dec.r, data); err != nil {
+		return 0, 0, nil, err
+	}
+	return id, length, data, nil
+}
+
+// readFields reads the fixed size fields of messages without a payload.
+func (dec *Decoder) readFields(msg Message) error {
+	var n int
+	switch msg.(type) {
+	case *OpenMessage, *HelloMessage:
+		n = 3
+	case *OpenConfirmMessage:
+		n = 4
+	case *WindowAdjustMessage, *OpenRejectMessage:
+		n = 2
+	case *OpenFailureMessage, *EOFMessage, *CloseMessage:
+		n = 1
+	}
+	b := dec.buf[:4*n]
+	if _, err := io.ReadFull(dec.r, b); err != nil {
+		return err
+	}
+	field := func(i int) uint32 {
+		return binary.BigEndian.Uint32(b[4*i:])
+	}
+	switch m := msg.(type) {
+	case *OpenMessage:
+		m.SenderID, m.WindowSize, m.MaxPacketSize = field(0), field(1), field(2)
+	case *OpenConfirmMessage:
+		m.ChannelID, m.SenderID, m.WindowSize, m.MaxPacketSize = field(0), field(1), field(2), field(3)
+	case *OpenFailureMessage:
+		m.ChannelID = field(0)
+	case *OpenRejectMessage:
+		m.ChannelID, m.Reason = field(0), field(1)
+	case *WindowAdjustMessage:
+		m.ChannelID, m.AdditionalBytes = field(0), field(1)
+	case *EOFMessage:
+		m.ChannelID = field(0)
+	case *CloseMessage:
+		m.ChannelID = field(0)
+	case *HelloMessage:
+		m.Version, m.Features, m.DictID = field(0), field(1), field(2)
+	}
+	return nil
+}
+
 func messageFrom(num [1]byte) (Message, error) {
+	if num[0] >= msgExtensionFirst && num[0] <= msgExtensionLast {
+		return new(ExtensionMessage), nil
+	}
 	switch num[0] {
 	case msgChannelOpen:
 		return new(OpenMessage), nil
@@ -79,12 +180,18 @@ func messageFrom(num [1]byte) (Message, error) {
 		return new(OpenConfirmMessage), nil
 	case msgChannelOpenFailure:
 		return new(OpenFailureMessage), nil
+	case msgChannelOpenReject:
+		return new(OpenRejectMessage), nil
 	case msgChannelWindowAdjust:
 		return new(WindowAdjustMessage), nil
 	case msgChannelEOF:
 		return new(EOFMessage), nil
 	case msgChannelClose:
 		return new(CloseMessage), nil
+	case msgChannelCloseError:
+		return new(CloseErrorMessage), nil
+	case msgSessionHello:
+		return new(HelloMessage), nil
 	default:
 		return nil, fmt.Errorf("qtalk: unexpected message type %d", num[0])
 	}
@@ -3,6 +3,7 @@ package frame
 import (
 	"fmt"
 	"io"
+	"net"
 	"sync"
 )
 
@@ -10,10 +11,23 @@ import (
 type Encoder struct {
 	w io.Writer
 	sync.Mutex
+
+	// vectored is set when writes of net.Buffers use writev
+	vectored bool
+	// buf is reused to encode packets, as writers don't retain them
+	buf []byte
+
+	compressor *compressor
+	compact    *compactState
 }
 
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{w: w}
+	enc := &Encoder{w: w}
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		enc.vectored = true
+	}
+	return enc
 }
 
 func (enc *Encoder) Encode(msg Message) error {
@@ -24,6 +38,75 @@ func (enc *Encoder) Encode(msg Message) error {
 		fmt.Fprintln(Debug, "<<ENC", msg)
 	}
 
-	_, err := enc.w.Write(msg.Bytes())
+	header, data := enc.packet(msg)
+	if !enc.vectored || len(data) < vectoredWriteLength {
+		packet := append(header, data...)
+		_, err := enc.w.Write(packet)
+		if cap(packet) <= maxBufferedPacket {
+			enc.buf = packet[:0]
+		}
+		return err
+	}
+	// large payloads are written along with their header without copying
+	// them into a packet using writev. Other writers get a single write, as
+	// transports like websockets would send each write as a message.
+	bufs := net.Buffers{header, data}
+	_, err := bufs.WriteTo(enc.w)
 	return err
 }
+
+// vectoredWriteLength is the payload length from which data messages are
+// written without copying them after their header.
+const vectoredWriteLength = 4096
+
+// maxBufferedPacket is the largest packet buffer kept for reuse.
+const maxBufferedPacket = 1 << 16
+
+// packetAppender is implemented by messages with fixed size fields.
+type packetAppender interface {
+	appendTo(b []byte) []byte
+}
+
+// packet returns the header and payload to write for msg, using the enabled
+// compression and header encoding. Only data messages have a payload. The
+// header is encoded in the reused buffer of the encoder.
+func (enc *Encoder) packet(msg Message) (header, data []byte) {
+	msgType := messageType(msg)
+	if data, ok := msg.(DataMessage); ok && enc.compressor != nil {
+		if compressed := enc.compressor.compress(data.Data); compressed != nil {
+			msgType = msgChannelCompressedData
+			msg = DataMessage{
+				ChannelID: data.ChannelID,
+				Length:    uint32(len(compressed)),
+				Data:      compressed,
+			}
+		}
+	}
+	if enc.compact != nil && msgType != 0 {
+		return enc.compact.compactHeader(enc.buf[:0], msgType, msg)
+	}
+	switch m := msg.(type) {
+	case DataMessage:
+		return m.appendHeader(enc.buf[:0], msgType), m.Data
+	case packetAppender:
+		return m.appendTo(enc.buf[:0]), nil
+	}
+	return msg.Bytes(), nil
+}
+
+// EnableCompression makes the encoder compress data messages using the
+// optional preset dictionary. It should only be enabled when the peer
+// decoder has compression enabled with the same dictionary.
+func (enc *Encoder) EnableCompression(dict []byte) {
+	enc.Lock()
+	defer enc.Unlock()
+	enc.compressor = newCompressor(dict)
+}
+
+// EnableCompactHeaders makes the encoder use compact message headers.
+// It should only be enabled when the peer decoder supports them.
+func (enc *Encoder) EnableCompactHeaders() {
+	enc.Lock()
+	defer enc.Unlock()
+	enc.compact = &compactState{}
+}
@@ -2,6 +2,8 @@ package frame
 
 import (
 	"bytes"
+	"io"
+	"net"
 	"testing"
 )
 
@@ -60,6 +62,14 @@ func TestEncodeDecode(t *testing.T) {
 			id: 20,
 			ok: true,
 		},
+		{
+			in: OpenRejectMessage{
+				ChannelID: 20,
+				Reason:    1,
+			},
+			id: 20,
+			ok: true,
+		},
 		{
 			in: WindowAdjustMessage{
 				ChannelID:       20,
@@ -68,6 +78,25 @@ func TestEncodeDecode(t *testing.T) {
 			id: 20,
 			ok: true,
 		},
+		{
+			in: ExtensionMessage{
+				ExtensionID: 7,
+				Length:      5,
+				Data:        []byte("Hello"),
+			},
+			id: 0,
+			ok: false,
+		},
+		{
+			in: CloseErrorMessage{
+				ChannelID: 10,
+				Code:      3,
+				Length:    4,
+				Data:      []byte("fail"),
+			},
+			id: 10,
+			ok: true,
+		},
 	}
 	for _, test := range tests {
 		var buf bytes.Buffer
@@ -90,6 +119,166 @@ func TestEncodeDecode(t *testing.T) {
 		if m.String() == "" {
 			t.Fatal("empty string representation")
 		}
+		if m.String() != test.in.String() {
+			t.Fatalf("decoded %s, expected %s", m, test.in)
+		}
+	}
+
+}
+
+func TestEncodeDecodeCompressed(t *testing.T) {
+	dict := []byte("Hello world")
+	data := bytes.Repeat([]byte("Hello world "), 100)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EnableCompression(dict)
+	if err := enc.Encode(DataMessage{
+		ChannelID: 10,
+		Length:    uint32(len(data)),
+		Data:      data,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(data) {
+		t.Fatalf("data was not compressed: %d bytes", buf.Len())
+	}
+
+	dec := NewDecoder(&buf)
+	dec.EnableCompression(dict, 1<<20)
+	m, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := m.(*DataMessage)
+	if !ok {
+		t.Fatalf("unexpected message: %v", m)
+	}
+	if msg.ChannelID != 10 || msg.Length != uint32(len(data)) || !bytes.Equal(msg.Data, data) {
+		t.Fatalf("unexpected data message: %v", msg)
+	}
+
+	buf.Reset()
+	enc.Encode(DataMessage{ChannelID: 10, Length: uint32(len(data)), Data: data})
+	dec = NewDecoder(&buf)
+	dec.EnableCompression(dict, 100)
+	if _, err := dec.Decode(); err == nil {
+		t.Fatal("expected error decompressing beyond limit")
+	}
+}
+
+func TestEncodeDecodeCompact(t *testing.T) {
+	msgs := []Message{
+		OpenMessage{SenderID: 1, WindowSize: 1 << 30, MaxPacketSize: 1 << 24},
+		OpenConfirmMessage{ChannelID: 300, SenderID: 1, WindowSize: 1 << 30, MaxPacketSize: 1 << 24},
+		DataMessage{ChannelID: 300, Length: 5, Data: []byte("Hello")},
+		DataMessage{ChannelID: 300, Length: 5, Data: []byte("world")},
+		WindowAdjustMessage{ChannelID: 2, AdditionalBytes: 10},
+		ExtensionMessage{ExtensionID: 7, Length: 5, Data: []byte("Hello")},
+		EOFMessage{ChannelID: 2},
+		CloseMessage{ChannelID: 300},
+		OpenFailureMessage{ChannelID: 300},
+		OpenRejectMessage{ChannelID: 300, Reason: 1},
+		CloseErrorMessage{ChannelID: 300, Code: 3, Length: 4, Data: []byte("fail")},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EnableCompactHeaders()
+	var regular int
+	for _, msg := range msgs {
+		regular += len(msg.Bytes())
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() >= regular {
+		t.Fatalf("compact encoding is %d bytes, regular is %d", buf.Len(), regular)
+	}
+	// mix in a regular frame
+	buf.Write(EOFMessage{ChannelID: 7}.Bytes())
+	msgs = append(msgs, EOFMessage{ChannelID: 7})
+
+	dec := NewDecoder(&buf)
+	for _, msg := range msgs {
+		m, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.String() != msg.String() {
+			t.Fatalf("decoded %s, expected %s", m, msg)
+		}
+		if data, ok := m.(*DataMessage); ok && !bytes.Equal(data.Data, msg.(DataMessage).Data) {
+			t.Fatalf("unexpected data: %q", data.Data)
+		}
+		if ext, ok := m.(*ExtensionMessage); ok && !bytes.Equal(ext.Data, msg.(ExtensionMessage).Data) {
+			t.Fatalf("unexpected extension data: %q", ext.Data)
+		}
+	}
+
+	if _, err := NewDecoder(bytes.NewReader([]byte{compactMask | compactImplicit | 5})).Decode(); err == nil {
+		t.Fatal("expected error for implicit channel without previous frame")
+	}
+}
+
+// writeRecorder records each write made to it without copying.
+type writeRecorder struct {
+	writes [][]byte
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, p)
+	return len(p), nil
+}
+
+func TestEncodeLargeData(t *testing.T) {
+	data := bytes.Repeat([]byte("qtalk"), vectoredWriteLength)
+	msg := DataMessage{ChannelID: 10, Length: uint32(len(data)), Data: data}
+
+	var w writeRecorder
+	if err := NewEncoder(&w).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.writes) != 1 || !bytes.Equal(w.writes[0], msg.Bytes()) {
+		t.Fatal("expected a single write of the packet to non-socket writers")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		NewEncoder(conn).Encode(msg)
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m, err := NewDecoder(conn).Decode()
+	if err != nil {
+		t.Fatal(err)
 	}
+	if !bytes.Equal(m.(*DataMessage).Data, data) {
+		t.Fatal("unexpected data from vectored write")
+	}
+}
 
+func BenchmarkEncodeLargeData(b *testing.B) {
+	data := make([]byte, 1<<24)
+	msg := DataMessage{ChannelID: 10, Length: uint32(len(data)), Data: data}
+	enc := NewEncoder(io.Discard)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
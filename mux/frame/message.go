@@ -1,5 +1,7 @@
 package frame
 
+import "encoding/binary"
+
 const (
 	msgChannelOpen = iota + 100
 	msgChannelOpenConfirm
@@ -8,6 +10,23 @@ const (
 	msgChannelData
 	msgChannelEOF
 	msgChannelClose
+	msgSessionHello
+	msgChannelCompressedData
+	msgChannelOpenReject
+)
+
+// Message types from msgExtensionFirst to msgExtensionLast are reserved for
+// extension frames, which all have the layout of ExtensionMessage.
+const (
+	msgExtensionFirst = 110
+	msgExtensionLast  = 127
+
+	msgSessionExtension = msgExtensionFirst
+)
+
+// Message types after the extension range.
+const (
+	msgChannelCloseError = iota + msgExtensionLast + 1
 )
 
 type Message interface {
@@ -15,3 +34,12 @@ type Message interface {
 	String() string
 	Bytes() []byte
 }
+
+// appendPacket appends a message of the given type with fixed size fields.
+func appendPacket(b []byte, msgType byte, fields ...uint32) []byte {
+	b = append(b, msgType)
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint32(b, f)
+	}
+	return b
+}
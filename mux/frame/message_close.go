@@ -1,10 +1,6 @@
 package frame
 
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-)
+import "fmt"
 
 type CloseMessage struct {
 	ChannelID uint32
@@ -19,8 +15,9 @@ func (msg CloseMessage) Channel() (uint32, bool) {
 }
 
 func (msg CloseMessage) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(msgChannelClose)
-	binary.Write(buf, binary.BigEndian, msg)
-	return buf.Bytes()
+	return msg.appendTo(nil)
+}
+
+func (msg CloseMessage) appendTo(b []byte) []byte {
+	return appendPacket(b, msgChannelClose, msg.ChannelID)
 }
@@ -0,0 +1,31 @@
+package frame
+
+import "fmt"
+
+// CloseErrorMessage closes a channel like CloseMessage, giving an
+// application defined error code and message for the close. It is not part
+// of the base qmux protocol, so it must only be sent to peers known to
+// support it.
+type CloseErrorMessage struct {
+	ChannelID uint32
+	Code      uint32
+	Length    uint32
+	Data      []byte
+}
+
+func (msg CloseErrorMessage) String() string {
+	return fmt.Sprintf("{CloseErrorMessage ChannelID:%d Code:%d Length:%d Data:%q}",
+		msg.ChannelID, msg.Code, msg.Length, msg.Data)
+}
+
+func (msg CloseErrorMessage) Channel() (uint32, bool) {
+	return msg.ChannelID, true
+}
+
+func (msg CloseErrorMessage) Bytes() []byte {
+	return msg.appendTo(make([]byte, 0, 13+len(msg.Data)))
+}
+
+func (msg CloseErrorMessage) appendTo(b []byte) []byte {
+	return append(appendPacket(b, msgChannelCloseError, msg.ChannelID, msg.Code, msg.Length), msg.Data...)
+}
@@ -1,9 +1,6 @@
 package frame
 
-import (
-	"encoding/binary"
-	"fmt"
-)
+import "fmt"
 
 type DataMessage struct {
 	ChannelID uint32
@@ -21,9 +18,17 @@ func (msg DataMessage) Channel() (uint32, bool) {
 }
 
 func (msg DataMessage) Bytes() []byte {
-	packet := make([]byte, 9)
-	packet[0] = msgChannelData
-	binary.BigEndian.PutUint32(packet[1:5], msg.ChannelID)
-	binary.BigEndian.PutUint32(packet[5:9], msg.Length)
-	return append(packet, msg.Data...)
+	return msg.appendTo(make([]byte, 0, 9+len(msg.Data)), msgChannelData)
+}
+
+// appendTo appends the message encoded with the given message type,
+// allowing it to be used for compressed data.
+func (msg DataMessage) appendTo(b []byte, msgType byte) []byte {
+	return append(msg.appendHeader(b, msgType), msg.Data...)
+}
+
+// appendHeader appends the header of the message encoded with the given
+// message type.
+func (msg DataMessage) appendHeader(b []byte, msgType byte) []byte {
+	return appendPacket(b, msgType, msg.ChannelID, msg.Length)
 }
@@ -1,10 +1,6 @@
 package frame
 
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-)
+import "fmt"
 
 type EOFMessage struct {
 	ChannelID uint32
@@ -19,8 +15,9 @@ func (msg EOFMessage) Channel() (uint32, bool) {
 }
 
 func (msg EOFMessage) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(msgChannelEOF)
-	binary.Write(buf, binary.BigEndian, msg)
-	return buf.Bytes()
+	return msg.appendTo(nil)
+}
+
+func (msg EOFMessage) appendTo(b []byte) []byte {
+	return appendPacket(b, msgChannelEOF, msg.ChannelID)
 }
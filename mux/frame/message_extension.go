@@ -0,0 +1,32 @@
+package frame
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ExtensionMessage carries an application defined payload for the
+// extension with the given ID. It is not part of the base qmux protocol,
+// so it must only be sent to peers known to support it.
+type ExtensionMessage struct {
+	ExtensionID uint32
+	Length      uint32
+	Data        []byte
+}
+
+func (msg ExtensionMessage) String() string {
+	return fmt.Sprintf("{ExtensionMessage ExtensionID:%d Length:%d Data: ... }",
+		msg.ExtensionID, msg.Length)
+}
+
+func (msg ExtensionMessage) Channel() (uint32, bool) {
+	return 0, false
+}
+
+func (msg ExtensionMessage) Bytes() []byte {
+	packet := make([]byte, 9, 9+len(msg.Data))
+	packet[0] = msgSessionExtension
+	binary.BigEndian.PutUint32(packet[1:5], msg.ExtensionID)
+	binary.BigEndian.PutUint32(packet[5:9], msg.Length)
+	return append(packet, msg.Data...)
+}
@@ -0,0 +1,29 @@
+package frame
+
+import "fmt"
+
+// HelloMessage is exchanged at the start of a session by peers that
+// negotiate optional protocol features. It is not part of the base
+// qmux protocol, so it must only be sent to peers known to support it.
+type HelloMessage struct {
+	Version  uint32
+	Features uint32
+	DictID   uint32
+}
+
+func (msg HelloMessage) String() string {
+	return fmt.Sprintf("{HelloMessage Version:%d Features:%#x DictID:%#x}",
+		msg.Version, msg.Features, msg.DictID)
+}
+
+func (msg HelloMessage) Channel() (uint32, bool) {
+	return 0, false
+}
+
+func (msg HelloMessage) Bytes() []byte {
+	return msg.appendTo(nil)
+}
+
+func (msg HelloMessage) appendTo(b []byte) []byte {
+	return appendPacket(b, msgSessionHello, msg.Version, msg.Features, msg.DictID)
+}
@@ -1,10 +1,6 @@
 package frame
 
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-)
+import "fmt"
 
 type OpenMessage struct {
 	SenderID      uint32
@@ -22,8 +18,9 @@ func (msg OpenMessage) Channel() (uint32, bool) {
 }
 
 func (msg OpenMessage) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(msgChannelOpen)
-	binary.Write(buf, binary.BigEndian, msg)
-	return buf.Bytes()
+	return msg.appendTo(nil)
+}
+
+func (msg OpenMessage) appendTo(b []byte) []byte {
+	return appendPacket(b, msgChannelOpen, msg.SenderID, msg.WindowSize, msg.MaxPacketSize)
 }
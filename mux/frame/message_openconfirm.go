@@ -1,10 +1,6 @@
 package frame
 
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-)
+import "fmt"
 
 type OpenConfirmMessage struct {
 	ChannelID     uint32
@@ -23,8 +19,9 @@ func (msg OpenConfirmMessage) Channel() (uint32, bool) {
 }
 
 func (msg OpenConfirmMessage) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(msgChannelOpenConfirm)
-	binary.Write(buf, binary.BigEndian, msg)
-	return buf.Bytes()
+	return msg.appendTo(nil)
+}
+
+func (msg OpenConfirmMessage) appendTo(b []byte) []byte {
+	return appendPacket(b, msgChannelOpenConfirm, msg.ChannelID, msg.SenderID, msg.WindowSize, msg.MaxPacketSize)
 }
@@ -1,10 +1,6 @@
 package frame
 
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-)
+import "fmt"
 
 type OpenFailureMessage struct {
 	ChannelID uint32
@@ -19,8 +15,9 @@ func (msg OpenFailureMessage) Channel() (uint32, bool) {
 }
 
 func (msg OpenFailureMessage) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(msgChannelOpenFailure)
-	binary.Write(buf, binary.BigEndian, msg)
-	return buf.Bytes()
+	return msg.appendTo(nil)
+}
+
+func (msg OpenFailureMessage) appendTo(b []byte) []byte {
+	return appendPacket(b, msgChannelOpenFailure, msg.ChannelID)
 }
@@ -0,0 +1,27 @@
+package frame
+
+import "fmt"
+
+// OpenRejectMessage fails a channel open like OpenFailureMessage, giving a
+// reason code for the failure. It is not part of the base qmux protocol, so
+// it must only be sent to peers known to support it.
+type OpenRejectMessage struct {
+	ChannelID uint32
+	Reason    uint32
+}
+
+func (msg OpenRejectMessage) String() string {
+	return fmt.Sprintf("{OpenRejectMessage ChannelID:%d Reason:%d}", msg.ChannelID, msg.Reason)
+}
+
+func (msg OpenRejectMessage) Channel() (uint32, bool) {
+	return msg.ChannelID, true
+}
+
+func (msg OpenRejectMessage) Bytes() []byte {
+	return msg.appendTo(nil)
+}
+
+func (msg OpenRejectMessage) appendTo(b []byte) []byte {
+	return appendPacket(b, msgChannelOpenReject, msg.ChannelID, msg.Reason)
+}
@@ -1,10 +1,6 @@
 package frame
 
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-)
+import "fmt"
 
 type WindowAdjustMessage struct {
 	ChannelID       uint32
@@ -21,8 +17,9 @@ func (msg WindowAdjustMessage) Channel() (uint32, bool) {
 }
 
 func (msg WindowAdjustMessage) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(msgChannelWindowAdjust)
-	binary.Write(buf, binary.BigEndian, msg)
-	return buf.Bytes()
+	return msg.appendTo(nil)
+}
+
+func (msg WindowAdjustMessage) appendTo(b []byte) []byte {
+	return appendPacket(b, msgChannelWindowAdjust, msg.ChannelID, msg.AdditionalBytes)
 }
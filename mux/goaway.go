@@ -0,0 +1,96 @@
+package mux
+
+import (
+	"errors"
+
+	"github.com/roachadam/qtalk-go/mux/frame"
+)
+
+// extensionReserved is the first extension ID used by the protocol itself.
+// Frames with reserved IDs are not passed to extension handlers.
+const extensionReserved = 0xFFFFFF00
+
+const (
+	extGoAway = extensionReserved + iota
+	extGoAwayAck
+)
+
+// ErrGoAway is returned by Open once the peer drained the session with
+// GoAwayer.GoAway. A new session should be established for further
+// channels.
+var ErrGoAway = errors.New("qmux: session going away")
+
+// ErrGoAwayUnsupported is returned by GoAway when the peer did not
+// advertise FeatureGoAway.
+var ErrGoAwayUnsupported = errors.New("qmux: go away not negotiated")
+
+// GoAwayer is implemented by sessions that can be drained, which includes
+// sessions created by this package.
+type GoAwayer interface {
+	// GoAway tells the peer to stop opening channels, such as when a
+	// server is restarting, so it can move to a new session. The peer
+	// acknowledges once it will send no more opens, after which Accept
+	// returns the channels opened before and then io.EOF. Open channels
+	// are not affected, and the session stays up until it is closed.
+	//
+	// It returns ErrGoAwayUnsupported unless both sides advertised
+	// FeatureGoAway in the session hello, which is sent when SessionConfig
+	// has any features enabled.
+	GoAway() error
+}
+
+// GoAway sends a go away to the peer.
+func (s *session) GoAway() error {
+	if _, features := s.Protocol(); !features.Has(FeatureGoAway) {
+		return ErrGoAwayUnsupported
+	}
+	s.goAwayMu.Lock()
+	sent := s.sentGoAway
+	s.sentGoAway = true
+	s.goAwayMu.Unlock()
+	if sent {
+		return nil
+	}
+	s.event(EventGoAway, "sent")
+	return s.enc.Encode(frame.ExtensionMessage{ExtensionID: extGoAway})
+}
+
+// handleGoAway stops opens and acks the go away of the peer. It waits for
+// opens being sent in a goroutine, so the session loop can keep reading.
+func (s *session) handleGoAway() {
+	go func() {
+		s.goAwayMu.Lock()
+		gone := s.goneAway
+		s.goneAway = true
+		s.goAwayMu.Unlock()
+		if gone {
+			return
+		}
+		s.event(EventGoAway, "received")
+		if f := s.config.OnGoAway; f != nil {
+			f()
+		}
+		// errors will surface from the transport in the session loop
+		s.enc.Encode(frame.ExtensionMessage{ExtensionID: extGoAwayAck})
+	}()
+}
+
+// handleGoAwayAck ends Accept, since the peer sent its last open before the
+// ack.
+func (s *session) handleGoAwayAck() {
+	s.goAwayMu.Lock()
+	defer s.goAwayMu.Unlock()
+	if s.sentGoAway && !s.isDrained() {
+		close(s.drained)
+	}
+}
+
+// isDrained returns whether the peer acked our go away.
+func (s *session) isDrained() bool {
+	select {
+	case <-s.drained:
+		return true
+	default:
+		return false
+	}
+}
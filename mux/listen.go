@@ -1,6 +1,9 @@
 package mux
 
-import "net"
+import (
+	"net"
+	"sync"
+)
 
 // A Listener is similar to a net.Listener but returns connections wrapped as mux sessions.
 type Listener interface {
@@ -14,3 +17,44 @@ type Listener interface {
 	// Addr returns the listener's network address if available.
 	Addr() net.Addr
 }
+
+// Limit returns a Listener that accepts at most n sessions from l at a time.
+// Once n accepted sessions are open, Accept blocks until one of them ends.
+func Limit(l Listener, n int) Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+type limitListener struct {
+	Listener
+	sem chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *limitListener) Accept() (Session, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	sess, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	go func() {
+		sess.Wait()
+		<-l.sem
+	}()
+	return sess, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
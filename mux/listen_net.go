@@ -1,6 +1,7 @@
 package mux
 
 import (
+	"crypto/tls"
 	"net"
 )
 
@@ -32,6 +33,22 @@ func ListenerFrom(l net.Listener) Listener {
 	return &netListener{Listener: l}
 }
 
+// TLS returns a Listener of sessions over TLS connections accepted by l,
+// terminating TLS using config.
+func TLS(l net.Listener, config *tls.Config) Listener {
+	return ListenerFrom(tls.NewListener(l, config))
+}
+
+// ListenTLS creates a TCP listener at the given address, terminating TLS
+// using config.
+func ListenTLS(addr string, config *tls.Config) (Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return TLS(l, config), nil
+}
+
 // ListenTCP creates a TCP listener at the given address.
 func ListenTCP(addr string) (Listener, error) {
 	l, err := net.Listen("tcp", addr)
@@ -0,0 +1,187 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocol returns a net.Listener whose connections begin with a PROXY
+// protocol v1 or v2 header, as sent by load balancers like HAProxy and AWS
+// NLB, and report the client address the header describes as RemoteAddr.
+// Sessions of the connections report it from their RemoteAddr method:
+//
+//	l, _ := net.Listen("tcp", ":4242")
+//	srv.ServeMux(mux.ListenerFrom(mux.ProxyProtocol(l)))
+//
+// The header is read on the first Read or RemoteAddr call so slow clients do
+// not hold up Accept. Connections without a valid header fail to read.
+// Headers with the LOCAL command or an UNKNOWN or unsupported address
+// family keep the address of the connection.
+func ProxyProtocol(l net.Listener) net.Listener {
+	return &proxyListener{Listener: l}
+}
+
+// proxyHeaderTimeout is how long a connection has to send its header.
+const proxyHeaderTimeout = 10 * time.Second
+
+var errProxyHeader = errors.New("mux: invalid PROXY protocol header")
+
+var proxySignatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once sync.Once
+	addr net.Addr
+	err  error
+}
+
+// init reads the header once.
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.addr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("%w: %v", errProxyHeader, c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.addr != nil {
+		return c.addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header, returning the source address it
+// describes, or nil if it has none to use.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// the first byte tells the versions apart without waiting for more
+	// bytes than a connection without a header may send
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxySignatureV2[0]:
+		sig, err := r.Peek(len(proxySignatureV2))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(sig, proxySignatureV2) {
+			return nil, errors.New("bad v2 signature")
+		}
+		r.Discard(len(proxySignatureV2))
+		return readProxyHeaderV2(r)
+	case 'P':
+		return readProxyHeaderV1(r)
+	default:
+		return nil, errors.New("missing header")
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// the header of v1 is at most 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long")
+	}
+	if !bytes.HasPrefix(line, []byte("PROXY ")) {
+		return nil, errors.New("bad v1 signature")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", hdr[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch cmd := hdr[0] & 0xF; cmd {
+	case 0:
+		// LOCAL, such as health checks of the proxy itself
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported command %d", cmd)
+	}
+	family, transport := hdr[1]>>4, hdr[1]&0xF
+	var ipLen int
+	switch family {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.New("v2 address block too short")
+	}
+	ip := net.IP(body[:ipLen])
+	port := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	if transport == 2 {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
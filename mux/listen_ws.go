@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync"
 
 	"golang.org/x/net/websocket"
 )
@@ -12,21 +13,24 @@ import (
 type wsListener struct {
 	net.Listener
 	accepted chan Session
+	closed   chan struct{}
+	once     sync.Once
 }
 
 // Accept waits for and returns the next connected session to the listener.
 func (l *wsListener) Accept() (Session, error) {
-	sess, ok := <-l.accepted
-	if !ok {
+	select {
+	case sess := <-l.accepted:
+		return sess, nil
+	case <-l.closed:
 		return nil, io.EOF
 	}
-	return sess, nil
 }
 
 // Close closes the listener.
 // Any blocked Accept operations will be unblocked and return errors.
 func (l *wsListener) Close() error {
-	close(l.accepted)
+	l.once.Do(func() { close(l.closed) })
 	return l.Listener.Close()
 }
 
@@ -36,6 +40,23 @@ func (l *wsListener) Addr() net.Addr {
 
 // ListenWS takes a TCP address and returns a Listener for a HTTP+WebSocket server listening on the given address.
 func ListenWS(addr string) (Listener, error) {
+	return ListenWSConfig(addr, nil)
+}
+
+// ListenWSConfig returns a Listener for a HTTP+WebSocket server like
+// ListenWS, checking the origin of handshakes and selecting a subprotocol
+// with the optional config. Rejected handshakes fail with 403 Forbidden.
+// Sessions report the selected subprotocol with their Subprotocol method,
+// such as to pick the codec of a browser peer:
+//
+//	l, _ := mux.ListenWSConfig(":8080", &mux.WSConfig{
+//		Codecs:      []string{"json"},
+//		CheckOrigin: mux.AllowOrigins("https://app.example.com"),
+//	})
+func ListenWSConfig(addr string, config *WSConfig) (Listener, error) {
+	if config == nil {
+		config = &WSConfig{}
+	}
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
@@ -43,16 +64,27 @@ func ListenWS(addr string) (Listener, error) {
 	wsl := &wsListener{
 		Listener: l,
 		accepted: make(chan Session),
+		closed:   make(chan struct{}),
 	}
 	srv := &http.Server{
 		Addr: addr,
-		Handler: websocket.Handler(func(ws *websocket.Conn) {
-			ws.PayloadType = websocket.BinaryFrame
-			sess := New(ws)
-			defer sess.Close()
-			wsl.accepted <- sess
-			sess.Wait()
-		}),
+		Handler: websocket.Server{
+			Handshake: config.handshake,
+			Handler: func(ws *websocket.Conn) {
+				ws.PayloadType = websocket.BinaryFrame
+				var subprotocol string
+				if p := ws.Config().Protocol; len(p) > 0 {
+					subprotocol = p[0]
+				}
+				sess := New(&wsConn{Conn: ws, subprotocol: subprotocol})
+				defer sess.Close()
+				select {
+				case wsl.accepted <- sess:
+					sess.Wait()
+				case <-wsl.closed:
+				}
+			},
+		},
 	}
 	go srv.Serve(l)
 	return wsl, nil
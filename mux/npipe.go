@@ -0,0 +1,39 @@
+package mux
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNamedPipeUnsupported is returned by DialNamedPipe and ListenNamedPipe on
+// platforms other than Windows.
+var ErrNamedPipeUnsupported = errors.New("qmux: named pipes are only supported on windows")
+
+// NamedPipeConfig configures a named pipe listener.
+type NamedPipeConfig struct {
+	// SecurityDescriptor, if set, controls which users can connect to
+	// the pipe, in the SDDL format, such as "D:P(A;;GA;;;AU)" to allow
+	// authenticated users. If empty, the default descriptor of the
+	// process applies, which gives read access to everyone and full
+	// access to administrators, LocalSystem and the owner. Remote clients
+	// are always rejected.
+	SecurityDescriptor string
+
+	// BufferSize is the size of the input and output buffers of each pipe
+	// instance. If zero, it is 64KB.
+	BufferSize int
+}
+
+// pipePath returns the path of the named pipe name, which can be a bare name
+// or a full path like \\.\pipe\name.
+func pipePath(name string) string {
+	if strings.HasPrefix(name, `\\`) {
+		return name
+	}
+	return `\\.\pipe\` + strings.TrimLeft(name, `\/`)
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package mux
+
+// DialNamedPipe establishes a mux session via Windows named pipe.
+func DialNamedPipe(name string) (Session, error) {
+	return nil, ErrNamedPipeUnsupported
+}
+
+// ListenNamedPipe creates a Windows named pipe listener with the given
+// name, which can be a bare name or a full path like \\.\pipe\name, using
+// the optional config.
+func ListenNamedPipe(name string, config *NamedPipeConfig) (Listener, error) {
+	return nil, ErrNamedPipeUnsupported
+}
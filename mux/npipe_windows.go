@@ -0,0 +1,376 @@
+//go:build windows
+
+package mux
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+	modadvapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procCreateNamedPipeW    = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = modkernel32.NewProc("ConnectNamedPipe")
+	procWaitNamedPipeW      = modkernel32.NewProc("WaitNamedPipeW")
+	procCreateEventW        = modkernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = modkernel32.NewProc("GetOverlappedResult")
+
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = modadvapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x80000
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	sddlRevision1             = 1
+
+	errorPipeBusy      = syscall.Errno(231)
+	errorNoData        = syscall.Errno(232)
+	errorPipeConnected = syscall.Errno(535)
+	errorSemTimeout    = syscall.Errno(121)
+
+	// pipeDialTimeout is how long DialNamedPipe waits for a busy pipe to
+	// have an instance available.
+	pipeDialTimeout = 5 * time.Second
+)
+
+// DialNamedPipe establishes a mux session via Windows named pipe. The name
+// can be a bare name or a full path like \\.\pipe\name.
+func DialNamedPipe(name string) (Session, error) {
+	conn, err := dialPipe(pipePath(name))
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+func dialPipe(path string) (*pipeConn, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(pipeDialTimeout)
+	for {
+		h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+			syscall.OPEN_EXISTING, syscall.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return newPipeConn(h, path)
+		}
+		if err != errorPipeBusy {
+			return nil, &os.PathError{Op: "dial", Path: path, Err: err}
+		}
+		// every instance is connected until the listener accepts again
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, &os.PathError{Op: "dial", Path: path, Err: errorSemTimeout}
+		}
+		procWaitNamedPipeW.Call(uintptr(unsafe.Pointer(p)), uintptr(wait.Milliseconds()))
+	}
+}
+
+// ListenNamedPipe creates a Windows named pipe listener with the given
+// name, which can be a bare name or a full path like \\.\pipe\name, using
+// the optional config. It fails if the pipe already exists.
+func ListenNamedPipe(name string, config *NamedPipeConfig) (Listener, error) {
+	l := &pipeListener{path: pipePath(name), bufSize: 64 << 10}
+	if config != nil {
+		if config.BufferSize > 0 {
+			l.bufSize = config.BufferSize
+		}
+		if config.SecurityDescriptor != "" {
+			sd, err := securityDescriptor(config.SecurityDescriptor)
+			if err != nil {
+				return nil, err
+			}
+			l.sd = sd
+			l.sa = &syscall.SecurityAttributes{SecurityDescriptor: sd}
+			l.sa.Length = uint32(unsafe.Sizeof(*l.sa))
+		}
+	}
+	h, err := l.create(true)
+	if err != nil {
+		l.free()
+		return nil, err
+	}
+	l.next = h
+	return l, nil
+}
+
+func securityDescriptor(sddl string) (uintptr, error) {
+	p, err := syscall.UTF16PtrFromString(sddl)
+	if err != nil {
+		return 0, err
+	}
+	var sd uintptr
+	r, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(
+		uintptr(unsafe.Pointer(p)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r == 0 {
+		return 0, os.NewSyscallError("ConvertStringSecurityDescriptorToSecurityDescriptor", err)
+	}
+	return sd, nil
+}
+
+// pipeListener accepts connections on instances of a named pipe. An instance
+// is created ahead of each Accept so clients can connect in between.
+type pipeListener struct {
+	path    string
+	bufSize int
+	sd      uintptr
+	sa      *syscall.SecurityAttributes
+
+	mu        sync.Mutex
+	next      syscall.Handle // the instance to accept on, or 0
+	accepting syscall.Handle // the instance Accept is waiting on, or 0
+	closed    bool
+}
+
+func (l *pipeListener) create(first bool) (syscall.Handle, error) {
+	p, err := syscall.UTF16PtrFromString(l.path)
+	if err != nil {
+		return 0, err
+	}
+	mode := uint32(pipeAccessDuplex | syscall.FILE_FLAG_OVERLAPPED)
+	if first {
+		// fail instead of joining a pipe of another process
+		mode |= fileFlagFirstPipeInstance
+	}
+	r, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(p)), uintptr(mode),
+		pipeRejectRemoteClients, pipeUnlimitedInstances, uintptr(l.bufSize), uintptr(l.bufSize),
+		0, uintptr(unsafe.Pointer(l.sa)))
+	if syscall.Handle(r) == syscall.InvalidHandle {
+		return 0, &os.PathError{Op: "listen", Path: l.path, Err: err}
+	}
+	return syscall.Handle(r), nil
+}
+
+// Accept waits for and returns the next connected session to the listener.
+func (l *pipeListener) Accept() (Session, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	h := l.next
+	l.next = 0
+	if h == 0 {
+		var err error
+		if h, err = l.create(false); err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+	}
+	l.accepting = h
+	l.mu.Unlock()
+
+	err := overlapped(h, func(o *syscall.Overlapped) error {
+		r, _, err := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(o)))
+		if r != 0 || err == errorPipeConnected {
+			return nil
+		}
+		if err == errorNoData {
+			// the client already disconnected
+			return nil
+		}
+		return err
+	})
+
+	l.mu.Lock()
+	l.accepting = 0
+	closed := l.closed
+	if err == nil && !closed {
+		// ready the next instance before returning the connected one
+		l.next, err = l.create(false)
+	}
+	l.mu.Unlock()
+	if closed {
+		syscall.CloseHandle(h)
+		return nil, net.ErrClosed
+	}
+	if err != nil {
+		syscall.CloseHandle(h)
+		return nil, &os.PathError{Op: "accept", Path: l.path, Err: err}
+	}
+	conn, err := newPipeConn(h, l.path)
+	if err != nil {
+		syscall.CloseHandle(h)
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// Close closes the listener.
+// Any blocked Accept operations will be unblocked and return errors.
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.accepting != 0 {
+		syscall.CancelIoEx(l.accepting, nil)
+		// Accept may not have started waiting yet, so also connect to
+		// the instance, which completes the wait once it starts
+		if p, err := syscall.UTF16PtrFromString(l.path); err == nil {
+			if h, err := syscall.CreateFile(p, syscall.GENERIC_READ, 0, nil, syscall.OPEN_EXISTING, 0, 0); err == nil {
+				syscall.CloseHandle(h)
+			}
+		}
+	}
+	if l.next != 0 {
+		syscall.CloseHandle(l.next)
+		l.next = 0
+	}
+	l.free()
+	return nil
+}
+
+// free frees the security descriptor. Instances keep their own copy.
+func (l *pipeListener) free() {
+	if l.sd != 0 {
+		syscall.LocalFree(syscall.Handle(l.sd))
+		l.sd = 0
+	}
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.path)
+}
+
+// pipeConn is a connected pipe instance using overlapped I/O, so reads and
+// writes don't wait on each other like synchronous I/O on a handle does.
+type pipeConn struct {
+	h    syscall.Handle
+	path string
+
+	rmu, wmu sync.Mutex
+	rev, wev syscall.Handle
+
+	// I/O holds mu for reading so Close can wait for it to be cancelled
+	mu     sync.RWMutex
+	closed atomic.Bool
+}
+
+func newPipeConn(h syscall.Handle, path string) (*pipeConn, error) {
+	c := &pipeConn{h: h, path: path}
+	var err error
+	if c.rev, err = createEvent(); err != nil {
+		syscall.CloseHandle(h)
+		return nil, err
+	}
+	if c.wev, err = createEvent(); err != nil {
+		syscall.CloseHandle(c.rev)
+		syscall.CloseHandle(h)
+		return nil, err
+	}
+	return c, nil
+}
+
+func createEvent() (syscall.Handle, error) {
+	// manual reset, so the event stays signaled for GetOverlappedResult
+	r, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if r == 0 {
+		return 0, os.NewSyscallError("CreateEvent", err)
+	}
+	return syscall.Handle(r), nil
+}
+
+// overlapped runs an overlapped operation on h with a new event, waiting
+// for it to complete.
+func overlapped(h syscall.Handle, op func(o *syscall.Overlapped) error) error {
+	ev, err := createEvent()
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(ev)
+	_, err = overlappedEvent(h, ev, op)
+	return err
+}
+
+func overlappedEvent(h, ev syscall.Handle, op func(o *syscall.Overlapped) error) (uint32, error) {
+	o := &syscall.Overlapped{HEvent: ev}
+	if err := op(o); err != nil && err != syscall.ERROR_IO_PENDING {
+		return 0, err
+	}
+	var n uint32
+	r, _, err := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(o)), uintptr(unsafe.Pointer(&n)), 1)
+	if r == 0 {
+		return n, err
+	}
+	return n, nil
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := overlappedEvent(c.h, c.rev, func(o *syscall.Overlapped) error {
+		return syscall.ReadFile(c.h, b, nil, o)
+	})
+	switch {
+	case err == syscall.ERROR_BROKEN_PIPE:
+		return int(n), io.EOF
+	case err == syscall.ERROR_OPERATION_ABORTED && c.closed.Load():
+		return int(n), net.ErrClosed
+	case err != nil:
+		return int(n), &os.PathError{Op: "read", Path: c.path, Err: err}
+	}
+	return int(n), nil
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	written := 0
+	for written < len(b) {
+		if c.closed.Load() {
+			return written, net.ErrClosed
+		}
+		n, err := overlappedEvent(c.h, c.wev, func(o *syscall.Overlapped) error {
+			return syscall.WriteFile(c.h, b[written:], nil, o)
+		})
+		written += int(n)
+		if err != nil {
+			if err == syscall.ERROR_OPERATION_ABORTED && c.closed.Load() {
+				return written, net.ErrClosed
+			}
+			return written, &os.PathError{Op: "write", Path: c.path, Err: err}
+		}
+	}
+	return written, nil
+}
+
+// Close cancels pending I/O and closes the pipe.
+func (c *pipeConn) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+	// cancel until the I/O in progress returns, since an operation may
+	// have started after a cancellation
+	for !c.mu.TryLock() {
+		syscall.CancelIoEx(c.h, nil)
+		time.Sleep(time.Millisecond)
+	}
+	defer c.mu.Unlock()
+	syscall.CloseHandle(c.rev)
+	syscall.CloseHandle(c.wev)
+	return syscall.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr(c.path) }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr(c.path) }
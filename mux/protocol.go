@@ -0,0 +1,107 @@
+package mux
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion is the protocol version sent in the session hello.
+// Peers use the lower of their versions.
+const ProtocolVersion = 1
+
+// Features is a bitmask of optional protocol features advertised in the
+// session hello. A feature is only used on a session if both peers
+// advertise it, so new features can roll out without breaking old peers.
+type Features uint32
+
+const (
+	// FeatureCompression is per-frame compression of channel data,
+	// advertised with SessionConfig.Compression.
+	FeatureCompression Features = 1 << iota
+
+	// FeatureCompactHeaders is compact frame headers, advertised with
+	// SessionConfig.CompactHeaders.
+	FeatureCompactHeaders
+
+	// reserved for liveness checks between peers
+	_
+
+	// FeatureHalfClose is closing the write side of a channel while still
+	// reading from it. Sessions in this package always advertise it.
+	FeatureHalfClose
+
+	// reserved for cancelling in-flight calls on the remote side
+	_
+
+	// FeatureExtensions is extension frames sent with
+	// Extender.SendExtension. Sessions in this package always advertise it.
+	FeatureExtensions
+
+	// FeatureCallArgs is the number of arguments in rpc call headers, with
+	// streamed arguments ending in an empty frame. Sessions in this package
+	// always advertise it.
+	FeatureCallArgs
+
+	// FeatureOpenReasons is giving the reason a channel open failed, such
+	// as ErrServerBusy. Sessions in this package always advertise it.
+	FeatureOpenReasons
+
+	// FeatureGoAway is draining a session with GoAwayer.GoAway. Sessions
+	// in this package always advertise it.
+	FeatureGoAway
+
+	// FeatureCloseErrors is closing a channel with an error for the peer
+	// using ErrorCloser.CloseWithError. Sessions in this package always
+	// advertise it.
+	FeatureCloseErrors
+
+	// FeatureSingleChannel is carrying all channels of the session on a
+	// single channel, for peers only able to handle one, advertised with
+	// SessionConfig.SingleChannel. The first channel opened, by either
+	// side, is the carrier, within which the data, EOF and close frames of
+	// the carried channels are framed as on the session. A frame with a
+	// new channel ID opens a channel, without an open or window frames.
+	// The peer that opened the carrier uses IDs below 1<<31 and the other
+	// IDs with that bit set. Each side opens its next channel once the
+	// last one it opened was closed by both sides, so calls are made one at
+	// a time, but accepts channels opened by the peer at any time.
+	FeatureSingleChannel
+)
+
+// builtinFeatures are advertised in every hello sent by this package.
+const builtinFeatures = FeatureHalfClose | FeatureExtensions | FeatureCallArgs | FeatureOpenReasons | FeatureGoAway | FeatureCloseErrors
+
+// featureNames are the names of the features by bit, empty for reserved bits.
+var featureNames = []string{
+	"compression",
+	"compact-headers",
+	"",
+	"half-close",
+	"",
+	"extensions",
+	"call-args",
+	"open-reasons",
+	"go-away",
+	"close-errors",
+	"single-channel",
+}
+
+// Has returns whether all the features in f2 are set in f.
+func (f Features) Has(f2 Features) bool {
+	return f&f2 == f2
+}
+
+// String returns the names of the features joined by "|".
+func (f Features) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if name != "" && f.Has(1<<i) {
+			names = append(names, name)
+			f &^= 1 << i
+		}
+	}
+	if f != 0 || len(names) == 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(f)))
+	}
+	return strings.Join(names, "|")
+}
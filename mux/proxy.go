@@ -25,11 +25,13 @@ func Proxy(dst, src Session) error {
 			a.Close()
 			return err
 		}
-		go proxy(a, b)
+		go Splice(a, b)
 	}
 }
 
-func proxy(a, b Channel) {
+// Splice copies data between a and b in both directions, closing each for
+// writing once the other is done sending, and closes both once done.
+func Splice(a, b Channel) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -2,9 +2,14 @@ package mux
 
 import (
 	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -27,8 +32,169 @@ const (
 	chanSize = 16
 )
 
+// SessionConfig configures optional session behavior. The zero value
+// gives a session compatible with any qmux peer.
+type SessionConfig struct {
+	// Compression enables per-frame deflate compression of channel data,
+	// which is used only if the peer also enables it with the same
+	// CompressionDict. It is transparent to channel users.
+	//
+	// Enabling it makes the session send a hello frame when it starts,
+	// which peers without hello support will reject, so it should only be
+	// enabled when the peer is known to support it.
+	Compression bool
+
+	// CompressionDict is an optional preset dictionary of data expected to
+	// be common in channel data, improving compression of small frames.
+	CompressionDict []byte
+
+	// CompactHeaders enables frame headers using varint fields and implicit
+	// channel IDs for consecutive frames on the same channel, which reduces
+	// overhead for small messages. Like Compression, it is only used if the
+	// peer also enables it and makes the session send a hello frame.
+	CompactHeaders bool
+
+	// Features are additional features to advertise, for capabilities
+	// implemented above the session by the application. Like Compression,
+	// advertising any feature makes the session send a hello frame. Use
+	// Negotiator.Protocol to check which features the peer also
+	// advertised.
+	Features Features
+
+	// OpenRetry, if set, makes Open retry opens rejected by the peer, which
+	// happens when it does not accept channels fast enough, waiting between
+	// attempts as configured instead of returning ErrOpenRejected.
+	OpenRetry *Backoff
+
+	// OpenTimeout limits how long each attempt of Open waits for the peer
+	// to confirm or reject the channel, making it return ErrOpenTimeout.
+	// If zero, Open waits until its context is done.
+	OpenTimeout time.Duration
+
+	// AcceptQueue is the number of channels opened by the peer that can
+	// wait to be returned by Accept. Once it is full, further opens wait
+	// for up to AcceptTimeout, which defaults to 30 seconds, holding up
+	// the session until they are accepted or rejected.
+	AcceptQueue   int
+	AcceptTimeout time.Duration
+
+	// RejectBusy makes opens by the peer fail immediately when the accept
+	// queue is full, instead of waiting for AcceptTimeout. The peer's Open
+	// returns ErrServerBusy if both sides advertised FeatureOpenReasons.
+	RejectBusy bool
+
+	// ReadBuffer limits the data each channel holds once received until it
+	// is read, by granting the peer only enough window to fill it. It can
+	// be changed for a channel using ReadBufferLimiter. If zero, channels
+	// buffer up to the protocol window of about 1GB.
+	ReadBuffer int
+
+	// OnChannelOpen and OnChannelClose, if set, are called when a channel
+	// is established and once it is closed by both sides or the session
+	// ends, with whether the channel was opened by the peer. They are
+	// called from the session loop, so they should not block.
+	OnChannelOpen  func(ch Channel, inbound bool)
+	OnChannelClose func(ch Channel, inbound bool)
+
+	// OnGoAway, if set, is called when the peer drains the session with
+	// GoAwayer.GoAway, so reconnect logic can establish a replacement
+	// session before this one ends. Open fails with ErrGoAway from when it
+	// is called.
+	OnGoAway func()
+
+	// StallThreshold, if positive, is how long a write waits for the peer
+	// to grant window before it is considered stalled, which happens when
+	// the peer stops reading the channel. OnStall, if set, is called with
+	// the channel once a write has waited that long, from the goroutine of
+	// a timer, so stalls can be logged or counted instead of hanging
+	// silently.
+	StallThreshold time.Duration
+	OnStall        func(ch Channel)
+
+	// StallTimeout, if positive, makes writes waiting for window longer
+	// than it return ErrWindowStalled. The data before the stall was
+	// written, and the channel can still be used or closed.
+	StallTimeout time.Duration
+
+	// EventLog, if positive, is the number of recent events the session
+	// keeps in memory, such as channel opens, closes and window stalls,
+	// which EventLogger returns to help debug stuck channels.
+	EventLog int
+
+	// SingleChannel advertises FeatureSingleChannel, for peers that can
+	// only handle one channel. If the peer advertises it too, the channels
+	// opened and accepted are carried on a single channel of the session
+	// without opening a channel for each, and Open waits until the last
+	// channel it opened was closed by both sides. Otherwise channels are
+	// opened as usual, so it can be set to serve both kinds of peers. Like
+	// Compression, it makes the session send a hello frame, and Open waits
+	// for the hello of the peer. Each side thus has one opened channel at
+	// a time, so an rpc handler can call back the side calling it, but a
+	// call made by a side within a call it made itself waits forever.
+	//
+	// Carried channels have no window of their own, so one holding
+	// ReadBuffer bytes not yet read holds up the others. OpenTimeout,
+	// OnChannelOpen, OnChannelClose and the event log apply to the carrier
+	// channel only.
+	SingleChannel bool
+}
+
+// Backoff configures retries with exponentially increasing delays.
+type Backoff struct {
+	// Attempts is the maximum number of attempts including the first, or
+	// zero to retry until the context of the operation is done.
+	Attempts int
+
+	// Min and Max bound the delay between attempts, which starts at Min and
+	// doubles after each attempt, with up to half of it randomized to spread
+	// out retries. They default to 10ms and 1s.
+	Min, Max time.Duration
+}
+
+// delay returns the delay after the given failed attempt, starting at 1.
+func (b *Backoff) delay(attempt int) time.Duration {
+	lo, hi := b.Min, b.Max
+	if lo <= 0 {
+		lo = 10 * time.Millisecond
+	}
+	if hi <= 0 {
+		hi = time.Second
+	}
+	d := lo
+	for i := 1; i < attempt && d < hi; i++ {
+		d *= 2
+	}
+	if d > hi {
+		d = hi
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// features returns the features enabled by the config.
+func (c *SessionConfig) features() Features {
+	f := c.Features
+	if c.Compression {
+		f |= FeatureCompression
+	}
+	if c.CompactHeaders {
+		f |= FeatureCompactHeaders
+	}
+	if c.SingleChannel {
+		f |= FeatureSingleChannel
+	}
+	return f
+}
+
+func (c *SessionConfig) hello() frame.HelloMessage {
+	return frame.HelloMessage{
+		Version:  ProtocolVersion,
+		Features: uint32(c.features() | builtinFeatures),
+		DictID:   frame.DictID(c.CompressionDict),
+	}
+}
+
 var (
-	// timeout for queuing a new channel to be `Accept`ed
+	// default timeout for queuing a new channel to be `Accept`ed
 	// use a `var` so that this can be overridden in tests
 	openTimeout = 30 * time.Second
 )
@@ -41,37 +207,292 @@ type Session interface {
 	Wait() error
 }
 
+// ErrOpenRejected is returned by Open when the peer rejected the channel,
+// typically because it was not accepting channels fast enough.
+var ErrOpenRejected = errors.New("qmux: channel open failed on remote side")
+
+// ErrOpenTimeout is returned by Open when the peer did not respond to an
+// open within SessionConfig.OpenTimeout.
+var ErrOpenTimeout = errors.New("qmux: timed out waiting for channel open")
+
+// ErrServerBusy is returned by Open when the peer rejected the channel
+// because it was not accepting channels, if it gave a reason. It wraps
+// ErrOpenRejected, so opens failing with it are retried with OpenRetry.
+var ErrServerBusy = fmt.Errorf("%w: server busy", ErrOpenRejected)
+
+// ErrWindowStalled is returned by the Write method of channels waiting for
+// window longer than SessionConfig.StallTimeout.
+var ErrWindowStalled = errors.New("qmux: write stalled waiting for window")
+
+// Reasons sent in frame.OpenRejectMessage.
+const (
+	rejectBusy = 1
+)
+
+// Errors wrapped by the error returned from Session.Wait, so reconnect logic
+// can decide whether to redial, back off or give up.
+var (
+	// ErrProtocol is wrapped when the peer sent an invalid frame or
+	// otherwise violated the protocol. Reconnecting to the same peer is
+	// unlikely to help.
+	ErrProtocol = errors.New("qmux: protocol error")
+
+	// ErrTransportClosed is wrapped when reading from or writing to the
+	// transport failed, including after the session was closed locally.
+	ErrTransportClosed = errors.New("qmux: transport closed")
+
+	// ErrKeepaliveTimeout is wrapped when the transport timed out, such as
+	// when TCP keepalives or a deadline set on the connection expired,
+	// meaning the peer or the network stopped responding.
+	ErrKeepaliveTimeout = errors.New("qmux: keepalive timeout")
+)
+
+// sessionError is an error ending a session. It matches its kind with
+// errors.Is and unwraps to its cause.
+type sessionError struct {
+	kind error
+	err  error
+}
+
+func (e *sessionError) Error() string        { return e.err.Error() }
+func (e *sessionError) Unwrap() error        { return e.err }
+func (e *sessionError) Is(target error) bool { return target == e.kind }
+
+func protocolError(format string, args ...any) error {
+	return &sessionError{kind: ErrProtocol, err: fmt.Errorf(format, args...)}
+}
+
+// waitError classifies the error ending the session loop.
+func waitError(err error) error {
+	var serr *sessionError
+	if err == io.EOF || errors.As(err, &serr) {
+		return err
+	}
+	var netErr net.Error
+	if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return &sessionError{kind: ErrKeepaliveTimeout, err: err}
+	}
+	return &sessionError{kind: ErrTransportClosed, err: err}
+}
+
+// transportReader records the error reading from the transport, to tell
+// it apart from errors decoding frames.
+type transportReader struct {
+	io.Reader
+	err error
+}
+
+func (r *transportReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// ErrExtensionsUnsupported is returned by SendExtension when extension
+// frames have not been negotiated with the peer.
+var ErrExtensionsUnsupported = errors.New("qmux: extension frames not negotiated")
+
 type session struct {
+	id    string
 	t     io.ReadWriteCloser
 	chans chanList
 
 	enc *frame.Encoder
 	dec *frame.Decoder
+	r   transportReader
 
 	inbox chan Channel
 
 	errCond *sync.Cond
 	err     error
 	closeCh chan bool
+
+	config SessionConfig
+
+	// protects helloSent, remoteHello, version and features
+	helloMu     sync.Mutex
+	helloSent   bool
+	remoteHello *frame.HelloMessage
+	version     uint32
+	features    Features
+
+	extMu      sync.RWMutex
+	extensions map[uint32]func(payload []byte)
+
+	// opens hold goAwayMu for reading so none is sent after the ack of a
+	// go away, which holds it for writing
+	goAwayMu   sync.RWMutex
+	goneAway   bool // the peer sent a go away
+	sentGoAway bool
+	drained    chan struct{} // closed once the peer acked our go away
+
+	events *eventRing // nil unless SessionConfig.EventLog is set
+
+	single *singleChannel // nil unless SessionConfig.SingleChannel is set
 }
 
-// NewSession returns a session that runs over the given transport.
+// New returns a session that runs over the given transport.
 func New(t io.ReadWriteCloser) Session {
+	return NewWithConfig(t, nil)
+}
+
+// NewWithConfig returns a session that runs over the given transport
+// using the optional config. A nil config is the same as using New.
+func NewWithConfig(t io.ReadWriteCloser, config *SessionConfig) Session {
 	if t == nil {
 		return nil
 	}
 	s := &session{
+		id:      newSessionID(),
 		t:       t,
 		enc:     frame.NewEncoder(t),
-		dec:     frame.NewDecoder(t),
-		inbox:   make(chan Channel),
 		errCond: sync.NewCond(new(sync.Mutex)),
 		closeCh: make(chan bool, 1),
+		drained: make(chan struct{}),
+	}
+	s.r.Reader = t
+	s.dec = frame.NewDecoder(&s.r)
+	if config != nil {
+		s.config = *config
+	}
+	s.inbox = make(chan Channel, s.config.AcceptQueue)
+	if s.config.EventLog > 0 {
+		s.events = newEventRing(s.config.EventLog)
+	}
+	if s.config.SingleChannel {
+		s.single = newSingleChannel(s)
+	}
+	if s.config.Compression {
+		s.dec.EnableCompression(s.config.CompressionDict, channelMaxPacket)
+	}
+	if s.config.features() != 0 {
+		s.sendHello()
 	}
 	go s.loop()
 	return s
 }
 
+func newSessionID() string {
+	var b [8]byte
+	crand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Identifier is implemented by sessions with an identifier, which includes
+// sessions created by this package.
+type Identifier interface {
+	// ID returns a random identifier of the session, for correlating log
+	// entries of its channels and calls. It is local to this side of the
+	// session.
+	ID() string
+}
+
+// ID returns the random identifier of the session.
+func (s *session) ID() string {
+	return s.id
+}
+
+// RemoteAddrer is implemented by sessions able to report the network address
+// of the peer, which includes sessions created by this package.
+type RemoteAddrer interface {
+	// RemoteAddr returns the address of the peer, or nil if the transport
+	// of the session has no address.
+	RemoteAddr() net.Addr
+}
+
+func (s *session) RemoteAddr() net.Addr {
+	if c, ok := s.t.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+// sendHello sends the session hello as the first frame. The write happens
+// in a goroutine since the transport may block until the peer reads, but the
+// encoder lock is taken first so no other frame can be written before it.
+func (s *session) sendHello() {
+	s.helloMu.Lock()
+	s.helloSent = true
+	s.helloMu.Unlock()
+
+	hello := s.config.hello()
+	s.enc.Lock()
+	go func() {
+		defer s.enc.Unlock()
+		// errors will surface from the transport in the session loop
+		s.t.Write(hello.Bytes())
+	}()
+}
+
+// Negotiator is implemented by sessions negotiating a protocol version and
+// features with the peer in a session hello, which includes sessions
+// created by this package.
+type Negotiator interface {
+	// Protocol returns the protocol version and features negotiated with
+	// the peer in the session hello, or zero values if no hello has
+	// been exchanged. Since the hello is the first frame sent by either
+	// side, negotiation is complete once a channel has been opened or
+	// accepted.
+	Protocol() (version uint32, features Features)
+}
+
+func (s *session) Protocol() (version uint32, features Features) {
+	s.helloMu.Lock()
+	defer s.helloMu.Unlock()
+	return s.version, s.features
+}
+
+// Extender is implemented by sessions exchanging extension frames, which
+// includes sessions created by this package.
+type Extender interface {
+	// HandleExtension registers the handler for extension frames with the
+	// given ID, replacing any previous handler. A nil handler removes it.
+	// Handlers are called from the session read loop so they should not
+	// block. Extension frames without a handler are dropped.
+	HandleExtension(id uint32, handler func(payload []byte))
+
+	// SendExtension sends an extension frame with the given ID and payload
+	// to the peer. It returns ErrExtensionsUnsupported unless both sides
+	// advertised FeatureExtensions in the session hello, which is sent when
+	// SessionConfig has any features enabled. IDs from 0xFFFFFF00 are
+	// reserved for the protocol.
+	SendExtension(id uint32, payload []byte) error
+}
+
+// HandleExtension registers the handler for extension frames with the given ID.
+func (s *session) HandleExtension(id uint32, handler func(payload []byte)) {
+	s.extMu.Lock()
+	defer s.extMu.Unlock()
+	if handler == nil {
+		delete(s.extensions, id)
+		return
+	}
+	if s.extensions == nil {
+		s.extensions = make(map[uint32]func(payload []byte))
+	}
+	s.extensions[id] = handler
+}
+
+// SendExtension sends an extension frame to the peer.
+func (s *session) SendExtension(id uint32, payload []byte) error {
+	if _, features := s.Protocol(); !features.Has(FeatureExtensions) {
+		return ErrExtensionsUnsupported
+	}
+	if id >= extensionReserved {
+		return fmt.Errorf("qmux: extension ID %#x is reserved", id)
+	}
+	if len(payload) > channelMaxPacket {
+		return fmt.Errorf("qmux: extension payload of %d bytes exceeds %d", len(payload), channelMaxPacket)
+	}
+	return s.enc.Encode(frame.ExtensionMessage{
+		ExtensionID: id,
+		Length:      uint32(len(payload)),
+		Data:        payload,
+	})
+}
+
 // Close closes the underlying transport.
 func (s *session) Close() error {
 	s.t.Close()
@@ -79,7 +500,9 @@ func (s *session) Close() error {
 }
 
 // Wait blocks until the transport has shut down, and returns the
-// error causing the shutdown.
+// error causing the shutdown, which is io.EOF if the peer closed the
+// transport and otherwise wraps ErrProtocol, ErrTransportClosed or
+// ErrKeepaliveTimeout along with its cause.
 func (s *session) Wait() error {
 	s.errCond.L.Lock()
 	defer s.errCond.L.Unlock()
@@ -91,32 +514,102 @@ func (s *session) Wait() error {
 
 // Accept waits for and returns the next incoming channel.
 func (s *session) Accept() (Channel, error) {
+	var carried chan Channel
+	if s.single != nil {
+		carried = s.single.inbox
+	}
 	select {
 	case ch := <-s.inbox:
 		return ch, nil
+	case ch := <-carried:
+		return ch, nil
 	case <-s.closeCh:
 		return nil, io.EOF
+	case <-s.drained:
+		// the channels opened before the ack of a go away are queued
+		select {
+		case ch := <-s.inbox:
+			return ch, nil
+		case ch := <-carried:
+			return ch, nil
+		default:
+			return nil, io.EOF
+		}
 	}
 }
 
-// Open establishes a new channel with the other end.
+// Open establishes a new channel with the other end, retrying rejected
+// opens if configured with OpenRetry, or opens a carried channel if the
+// session carries its channels on a single channel.
 func (s *session) Open(ctx context.Context) (Channel, error) {
+	if s.single != nil {
+		single, err := s.single.negotiated(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if single {
+			return s.single.open(ctx)
+		}
+	}
+	return s.openRetry(ctx)
+}
+
+// openRetry opens a channel of the session, retrying rejected opens if
+// configured with OpenRetry.
+func (s *session) openRetry(ctx context.Context) (Channel, error) {
+	retry := s.config.OpenRetry
+	for attempt := 1; ; attempt++ {
+		ch, err := s.open(ctx)
+		if !errors.Is(err, ErrOpenRejected) || retry == nil || (retry.Attempts > 0 && attempt >= retry.Attempts) {
+			return ch, err
+		}
+		t := time.NewTimer(retry.delay(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (s *session) open(ctx context.Context) (Channel, error) {
+	s.goAwayMu.RLock()
+	if s.goneAway {
+		s.goAwayMu.RUnlock()
+		return nil, ErrGoAway
+	}
 	ch := s.newChannel(channelOutbound)
 	ch.maxIncomingPayload = channelMaxPacket
 
-	if err := s.enc.Encode(frame.OpenMessage{
+	err := s.enc.Encode(frame.OpenMessage{
 		WindowSize:    ch.myWindow,
 		MaxPacketSize: ch.maxIncomingPayload,
 		SenderID:      ch.localId,
-	}); err != nil {
+	})
+	s.goAwayMu.RUnlock()
+	if err != nil {
 		return nil, err
 	}
 
+	var timeout <-chan time.Time
+	if s.config.OpenTimeout > 0 {
+		t := time.NewTimer(s.config.OpenTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
 	var m frame.Message
 
 	select {
 	case <-ctx.Done():
+		s.abandon(ch)
+		ch.event(EventOpenFailed, ctx.Err().Error())
 		return nil, ctx.Err()
+	case <-timeout:
+		s.abandon(ch)
+		ch.event(EventOpenFailed, ErrOpenTimeout.Error())
+		return nil, ErrOpenTimeout
 	case m = <-ch.msg:
 		if m == nil {
 			// channel was closed before open got a response,
@@ -129,22 +622,40 @@ func (s *session) Open(ctx context.Context) (Channel, error) {
 	case *frame.OpenConfirmMessage:
 		return ch, nil
 	case *frame.OpenFailureMessage:
-		return nil, fmt.Errorf("qmux: channel open failed on remote side")
+		err = ErrOpenRejected
+	case *frame.OpenRejectMessage:
+		err = ErrOpenRejected
+		if msg.Reason == rejectBusy {
+			err = ErrServerBusy
+		}
 	default:
 		return nil, fmt.Errorf("qmux: unexpected packet in response to channel open: %v", msg)
 	}
+	ch.event(EventOpenFailed, err.Error())
+	return nil, err
+}
+
+// abandon cleans up a channel Open stopped waiting for, closing it if the
+// peer confirms it later.
+func (s *session) abandon(ch *channel) {
+	go func() {
+		if _, ok := (<-ch.msg).(*frame.OpenConfirmMessage); ok {
+			ch.Close()
+		}
+	}()
 }
 
 func (s *session) newChannel(direction channelDirection) *channel {
 	ch := &channel{
-		remoteWin: window{Cond: sync.NewCond(new(sync.Mutex))},
-		myWindow:  channelWindowSize,
-		pending:   newBuffer(),
-		direction: direction,
-		msg:       make(chan frame.Message, chanSize),
-		session:   s,
-		packetBuf: make([]byte, 0),
+		remoteWin:  window{Cond: sync.NewCond(new(sync.Mutex))},
+		readBuffer: readBufferSize(s.config.ReadBuffer),
+		pending:    newBuffer(),
+		direction:  direction,
+		msg:        make(chan frame.Message, chanSize),
+		session:    s,
+		packetBuf:  make([]byte, 0),
 	}
+	ch.myWindow = ch.readBuffer
 	ch.localId = s.chans.add(ch)
 	return ch
 }
@@ -160,12 +671,16 @@ func (s *session) loop() {
 	for _, ch := range s.chans.dropAll() {
 		ch.close()
 	}
+	if s.single != nil {
+		s.single.end()
+	}
+	s.event(EventSessionEnd, err.Error())
 
 	s.t.Close()
 	s.closeCh <- true
 
 	s.errCond.L.Lock()
-	s.err = err
+	s.err = waitError(err)
 	s.errCond.Broadcast()
 	s.errCond.L.Unlock()
 }
@@ -177,9 +692,20 @@ func (s *session) onePacket() error {
 
 	msg, err = s.dec.Decode()
 	if err != nil {
+		if s.r.err == nil {
+			// the transport is fine but the frame is not
+			return &sessionError{kind: ErrProtocol, err: err}
+		}
 		return err
 	}
 
+	switch m := msg.(type) {
+	case *frame.HelloMessage:
+		return s.handleHello(m)
+	case *frame.ExtensionMessage:
+		return s.handleExtension(m)
+	}
+
 	id, isChan := msg.Channel()
 	if !isChan {
 		return s.handleOpen(msg.(*frame.OpenMessage))
@@ -187,15 +713,86 @@ func (s *session) onePacket() error {
 
 	ch := s.chans.getChan(id)
 	if ch == nil {
-		return fmt.Errorf("qmux: invalid channel %d", id)
+		return protocolError("qmux: invalid channel %d", id)
 	}
 
 	return ch.handle(msg)
 }
 
+// handleHello replies with our own hello if not yet sent and enables
+// features supported by both sides.
+func (s *session) handleHello(msg *frame.HelloMessage) error {
+	if msg.Version < 1 {
+		return protocolError("qmux: unsupported protocol version %d", msg.Version)
+	}
+	hello := s.config.hello()
+	features := Features(hello.Features & msg.Features)
+	if msg.DictID != hello.DictID {
+		features &^= FeatureCompression
+	}
+
+	s.helloMu.Lock()
+	if s.remoteHello != nil {
+		s.helloMu.Unlock()
+		return protocolError("qmux: unexpected hello")
+	}
+	s.remoteHello = msg
+	s.version = min(msg.Version, ProtocolVersion)
+	s.features = features
+	sent := s.helloSent
+	s.helloSent = true
+	s.helloMu.Unlock()
+
+	if !sent {
+		if err := s.enc.Encode(hello); err != nil {
+			return err
+		}
+	}
+
+	if features.Has(FeatureCompression) {
+		s.enc.EnableCompression(s.config.CompressionDict)
+	}
+	if features.Has(FeatureCompactHeaders) {
+		s.enc.EnableCompactHeaders()
+	}
+	if s.single != nil {
+		s.single.helloDone()
+	}
+	return nil
+}
+
+// handleExtension calls the handler registered for the extension, if any.
+func (s *session) handleExtension(msg *frame.ExtensionMessage) error {
+	if _, features := s.Protocol(); !features.Has(FeatureExtensions) {
+		return protocolError("qmux: unexpected extension frame")
+	}
+	switch msg.ExtensionID {
+	case extGoAway:
+		s.handleGoAway()
+		return nil
+	case extGoAwayAck:
+		s.handleGoAwayAck()
+		return nil
+	}
+	s.extMu.RLock()
+	handler := s.extensions[msg.ExtensionID]
+	s.extMu.RUnlock()
+	if handler != nil {
+		handler(msg.Data)
+	}
+	return nil
+}
+
 // handleChannelOpen schedules a channel to be Accept()ed.
 func (s *session) handleOpen(msg *frame.OpenMessage) error {
-	if msg.MaxPacketSize < minPacketLength || msg.MaxPacketSize > maxPacketLength {
+	if msg.MaxPacketSize < minPacketLength || msg.MaxPacketSize > maxPacketLength || s.isDrained() {
+		if s.events != nil {
+			reason := "going away"
+			if !s.isDrained() {
+				reason = fmt.Sprintf("invalid MaxPacketSize %d", msg.MaxPacketSize)
+			}
+			s.events.add(Event{Time: time.Now(), Kind: EventOpenFailed, Channel: msg.SenderID, Inbound: true, Detail: reason})
+		}
 		return s.enc.Encode(frame.OpenFailureMessage{
 			ChannelID: msg.SenderID,
 		})
@@ -204,21 +801,76 @@ func (s *session) handleOpen(msg *frame.OpenMessage) error {
 	c := s.newChannel(channelInbound)
 	c.remoteId = msg.SenderID
 	c.maxRemotePayload = msg.MaxPacketSize
-	c.remoteWin.add(msg.WindowSize)
 	c.maxIncomingPayload = channelMaxPacket
-	t := time.NewTimer(openTimeout)
-	defer t.Stop()
+	// Accept can return the channel before the confirm is sent, so frames
+	// of the channel are held up until then: writes by having no window and
+	// other frames by holding writeMu.
+	c.writeMu.Lock()
+	msgConfirm := frame.OpenConfirmMessage{
+		ChannelID:     c.remoteId,
+		SenderID:      c.localId,
+		WindowSize:    c.myWindow,
+		MaxPacketSize: c.maxIncomingPayload,
+	}
+	confirm := func() error {
+		s.established(c)
+		err := s.enc.Encode(msgConfirm)
+		c.remoteWin.add(msg.WindowSize)
+		c.writeMu.Unlock()
+		return err
+	}
+	if _, features := s.Protocol(); s.single != nil && features.Has(FeatureSingleChannel) {
+		// carriers are not returned by Accept
+		err := confirm()
+		s.single.carry(c, false)
+		return err
+	}
+	// only start the timeout when Accept isn't already waiting and the
+	// queue is full
 	select {
 	case s.inbox <- c:
-		return s.enc.Encode(frame.OpenConfirmMessage{
-			ChannelID:     c.remoteId,
-			SenderID:      c.localId,
-			WindowSize:    c.myWindow,
-			MaxPacketSize: c.maxIncomingPayload,
-		})
-	case <-t.C:
-		return s.enc.Encode(frame.OpenFailureMessage{
-			ChannelID: msg.SenderID,
+		return confirm()
+	default:
+	}
+	if !s.config.RejectBusy {
+		timeout := s.config.AcceptTimeout
+		if timeout <= 0 {
+			timeout = openTimeout
+		}
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case s.inbox <- c:
+			return confirm()
+		case <-t.C:
+		}
+	}
+	c.writeMu.Unlock()
+	// the peer may retry, so don't leave the channel behind
+	s.chans.remove(c.localId)
+	c.event(EventOpenFailed, "accept queue full")
+	return s.reject(msg.SenderID, rejectBusy)
+}
+
+// established marks a channel as open, calling OnChannelOpen.
+func (s *session) established(ch *channel) {
+	ch.established = true
+	ch.event(EventOpen, "")
+	if f := s.config.OnChannelOpen; f != nil {
+		f(ch, ch.direction == channelInbound)
+	}
+}
+
+// reject fails the open of the peer channel with the reason, if the peer
+// supports open reasons.
+func (s *session) reject(channelID uint32, reason uint32) error {
+	if _, features := s.Protocol(); features.Has(FeatureOpenReasons) {
+		return s.enc.Encode(frame.OpenRejectMessage{
+			ChannelID: channelID,
+			Reason:    reason,
 		})
 	}
+	return s.enc.Encode(frame.OpenFailureMessage{
+		ChannelID: channelID,
+	})
 }
@@ -4,10 +4,17 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/roachadam/qtalk-go/mux/frame"
 )
 
 func init() {
@@ -147,6 +154,181 @@ func TestSessionOpenServerTimeout(t *testing.T) {
 	fatal(sess.Close(), t)
 }
 
+func TestSessionOpenRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	defer conn.Close()
+	sconn, err := l.Accept()
+	fatal(err, t)
+	defer sconn.Close()
+
+	server := New(sconn)
+	defer server.Close()
+	client := NewWithConfig(conn, &SessionConfig{
+		OpenRetry: &Backoff{Attempts: 2, Min: time.Millisecond},
+	})
+	defer client.Close()
+
+	// the first attempt times out waiting for Accept on the server
+	start := time.Now()
+	_, err = client.Open(context.Background())
+	if !errors.Is(err, ErrOpenRejected) {
+		t.Fatalf("expected ErrOpenRejected, got: %v", err)
+	}
+	if d := time.Since(start); d < 2*openTimeout {
+		t.Fatalf("open failed after %s, expected 2 attempts", d)
+	}
+
+	go func() {
+		time.Sleep(openTimeout + openTimeout/2)
+		server.Accept()
+	}()
+	_, err = client.Open(context.Background())
+	fatal(err, t)
+}
+
+func TestSessionOpenTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	defer conn.Close()
+	sconn, err := l.Accept()
+	fatal(err, t)
+	defer sconn.Close()
+
+	server := NewWithConfig(sconn, &SessionConfig{AcceptTimeout: time.Hour})
+	defer server.Close()
+	client := NewWithConfig(conn, &SessionConfig{OpenTimeout: 20 * time.Millisecond})
+	defer client.Close()
+
+	_, err = client.Open(context.Background())
+	if err != ErrOpenTimeout {
+		t.Fatalf("expected ErrOpenTimeout, got: %v", err)
+	}
+
+	// the abandoned channel is closed once the server accepts it
+	ch, err := server.Accept()
+	fatal(err, t)
+	if _, err := ch.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF reading abandoned channel, got: %v", err)
+	}
+}
+
+func TestSessionAcceptQueue(t *testing.T) {
+	for _, reasons := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		fatal(err, t)
+		defer l.Close()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		fatal(err, t)
+		defer conn.Close()
+		sconn, err := l.Accept()
+		fatal(err, t)
+		defer sconn.Close()
+
+		server := NewWithConfig(sconn, &SessionConfig{
+			AcceptQueue:   2,
+			AcceptTimeout: time.Hour,
+			RejectBusy:    true,
+		})
+		defer server.Close()
+		var config *SessionConfig
+		if reasons {
+			// any feature makes the client send a hello
+			config = &SessionConfig{Features: FeatureOpenReasons}
+		}
+		client := NewWithConfig(conn, config)
+		defer client.Close()
+
+		ctx := context.Background()
+		for i := 0; i < 2; i++ {
+			_, err := client.Open(ctx)
+			fatal(err, t)
+		}
+		_, err = client.Open(ctx)
+		if reasons && err != ErrServerBusy {
+			t.Fatalf("expected ErrServerBusy, got: %v", err)
+		}
+		if !reasons && err != ErrOpenRejected {
+			t.Fatalf("expected ErrOpenRejected without reasons, got: %v", err)
+		}
+
+		_, err = server.Accept()
+		fatal(err, t)
+		_, err = client.Open(ctx)
+		fatal(err, t)
+	}
+}
+
+func TestSessionChannelCallbacks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	defer conn.Close()
+	sconn, err := l.Accept()
+	fatal(err, t)
+	defer sconn.Close()
+
+	events := make(chan string, 4)
+	config := func(side string) *SessionConfig {
+		return &SessionConfig{
+			AcceptQueue: 1,
+			OnChannelOpen: func(ch Channel, inbound bool) {
+				events <- fmt.Sprintf("%s open %v", side, inbound)
+			},
+			OnChannelClose: func(ch Channel, inbound bool) {
+				events <- fmt.Sprintf("%s close %v", side, inbound)
+			},
+		}
+	}
+	server := NewWithConfig(sconn, config("server"))
+	defer server.Close()
+	client := NewWithConfig(conn, config("client"))
+	defer client.Close()
+
+	ch, err := client.Open(context.Background())
+	fatal(err, t)
+	_, err = server.Accept()
+	fatal(err, t)
+	fatal(ch.Close(), t)
+
+	got := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		select {
+		case e := <-events:
+			got[e] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for events, got %v", got)
+		}
+	}
+	for _, e := range []string{"client open false", "server open true", "client close false", "server close true"} {
+		if !got[e] {
+			t.Fatalf("missing event %q in %v", e, got)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := &Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		want *= time.Millisecond
+		if d := b.delay(attempt + 1); d < want/2 || d > want {
+			t.Errorf("delay(%d) = %s; want between %s and %s", attempt+1, d, want/2, want)
+		}
+	}
+}
+
 func TestSessionWait(t *testing.T) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	fatal(err, t)
@@ -161,7 +343,781 @@ func TestSessionWait(t *testing.T) {
 	// wait should return immediately since the connection was closed
 	err = sess.Wait()
 	var netErr net.Error
-	if !errors.As(err, &netErr) {
+	if !errors.As(err, &netErr) || !errors.Is(err, ErrTransportClosed) {
 		t.Fatalf("expected a network error, but got: %v", err)
 	}
 }
+
+func TestSessionWaitErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	for _, tt := range []struct {
+		name string
+		peer func(conn, sconn net.Conn)
+		want error
+	}{
+		{"peer closed", func(conn, sconn net.Conn) {
+			sconn.Close()
+		}, io.EOF},
+		{"invalid frame", func(conn, sconn net.Conn) {
+			sconn.Write([]byte{99})
+		}, ErrProtocol},
+		{"invalid channel", func(conn, sconn net.Conn) {
+			sconn.Write(frame.EOFMessage{ChannelID: 42}.Bytes())
+		}, ErrProtocol},
+		{"timeout", func(conn, sconn net.Conn) {
+			conn.SetReadDeadline(time.Now())
+		}, ErrKeepaliveTimeout},
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		fatal(err, t)
+		sconn, err := l.Accept()
+		fatal(err, t)
+
+		sess := New(conn)
+		tt.peer(conn, sconn)
+		if err := sess.Wait(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got: %v", tt.name, tt.want, err)
+		}
+		sconn.Close()
+	}
+}
+
+func TestChannelReadDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		fatal(err, t)
+		sess := New(conn)
+		defer sess.Close()
+		ch, err := sess.Accept()
+		fatal(err, t)
+		defer ch.Close()
+		sess.Wait()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	defer conn.Close()
+
+	sess := New(conn)
+	defer sess.Close()
+
+	ch, err := sess.Open(context.Background())
+	fatal(err, t)
+
+	fatal(ch.(ReadDeadliner).SetReadDeadline(time.Now().Add(20*time.Millisecond)), t)
+	_, err = ch.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, but got: %v", err)
+	}
+}
+
+func TestChannelRateLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	received := make(chan int)
+	go func() {
+		conn, err := l.Accept()
+		fatal(err, t)
+		sess := New(conn)
+		defer sess.Close()
+		ch, err := sess.Accept()
+		fatal(err, t)
+		b, _ := ioutil.ReadAll(ch)
+		received <- len(b)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	defer conn.Close()
+
+	sess := New(conn)
+	defer sess.Close()
+
+	ch, err := sess.Open(context.Background())
+	fatal(err, t)
+
+	// 50KB at 100KB/s with a 10KB burst takes at least 400ms
+	ch.(BandwidthLimiter).SetRateLimit(100*1024, 10*1024)
+	start := time.Now()
+	_, err = ch.Write(make([]byte, 50*1024))
+	fatal(err, t)
+	fatal(ch.CloseWrite(), t)
+	if n := <-received; n != 50*1024 {
+		t.Fatalf("unexpected bytes received: %d", n)
+	}
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Fatalf("write was not limited, took %s", d)
+	}
+}
+
+func TestChannelReadBuffer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	defer conn.Close()
+	sconn, err := l.Accept()
+	fatal(err, t)
+	defer sconn.Close()
+
+	server := NewWithConfig(sconn, &SessionConfig{ReadBuffer: 1024, AcceptQueue: 1})
+	defer server.Close()
+	client := New(conn)
+	defer client.Close()
+
+	write := func(ch Channel, n int) chan error {
+		written := make(chan error, 1)
+		go func() {
+			_, err := ch.Write(make([]byte, n))
+			written <- err
+		}()
+		return written
+	}
+
+	ch, err := client.Open(context.Background())
+	fatal(err, t)
+	sch, err := server.Accept()
+	fatal(err, t)
+
+	// the writer is held up until the server reads
+	written := write(ch, 4096)
+	select {
+	case err := <-written:
+		t.Fatalf("write past read buffer returned: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = io.ReadFull(sch, make([]byte, 4096))
+	fatal(err, t)
+	fatal(<-written, t)
+
+	// raising the limit of the channel grants the window right away
+	sch.(ReadBufferLimiter).SetReadBuffer(8192)
+	select {
+	case err := <-write(ch, 4096):
+		fatal(err, t)
+	case <-time.After(time.Second):
+		t.Fatal("write was held up after raising the read buffer")
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.written, int64(len(p)))
+	return c.Conn.Write(p)
+}
+
+func TestSessionCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello world "), 10000)
+
+	for _, tt := range []struct {
+		name       string
+		configA    *SessionConfig
+		configB    *SessionConfig
+		compressed bool
+	}{
+		{"both enabled", &SessionConfig{Compression: true}, &SessionConfig{Compression: true}, true},
+		{"one enabled", &SessionConfig{Compression: true}, nil, false},
+		{"dictionary mismatch", &SessionConfig{Compression: true, CompressionDict: []byte("Hello")}, &SessionConfig{Compression: true}, false},
+		{"with compact headers", &SessionConfig{Compression: true, CompactHeaders: true}, &SessionConfig{Compression: true, CompactHeaders: true}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			connA, connB := net.Pipe()
+			counter := &countingConn{Conn: connA}
+			sessA := NewWithConfig(counter, tt.configA)
+			sessB := NewWithConfig(connB, tt.configB)
+			defer sessA.Close()
+			defer sessB.Close()
+
+			received := make(chan []byte)
+			go func() {
+				ch, err := sessB.Accept()
+				fatal(err, t)
+				b, err := ioutil.ReadAll(ch)
+				fatal(err, t)
+				received <- b
+			}()
+
+			ch, err := sessA.Open(context.Background())
+			fatal(err, t)
+			_, err = ch.Write(data)
+			fatal(err, t)
+			fatal(ch.CloseWrite(), t)
+
+			if !bytes.Equal(<-received, data) {
+				t.Fatal("unexpected data received")
+			}
+			written := atomic.LoadInt64(&counter.written)
+			if compressed := written < int64(len(data)); compressed != tt.compressed {
+				t.Fatalf("expected compressed %v, wrote %d bytes for %d bytes of data", tt.compressed, written, len(data))
+			}
+		})
+	}
+}
+
+func TestSessionCompactHeaders(t *testing.T) {
+	connA, connB := net.Pipe()
+	counter := &countingConn{Conn: connA}
+	sessA := NewWithConfig(counter, &SessionConfig{CompactHeaders: true})
+	sessB := NewWithConfig(connB, &SessionConfig{CompactHeaders: true})
+	defer sessA.Close()
+	defer sessB.Close()
+
+	received := make(chan int)
+	go func() {
+		ch, err := sessB.Accept()
+		fatal(err, t)
+		b, err := ioutil.ReadAll(ch)
+		fatal(err, t)
+		received <- len(b)
+	}()
+
+	ch, err := sessA.Open(context.Background())
+	fatal(err, t)
+	// hello and open frames are written before compact headers are enabled
+	before := atomic.LoadInt64(&counter.written)
+	for i := 0; i < 100; i++ {
+		_, err = ch.Write([]byte("x"))
+		fatal(err, t)
+	}
+	fatal(ch.CloseWrite(), t)
+	if n := <-received; n != 100 {
+		t.Fatalf("unexpected bytes received: %d", n)
+	}
+	// each single byte write is a data frame of a type byte, an implicit
+	// channel, a one byte length, and the data byte
+	if written := atomic.LoadInt64(&counter.written) - before; written > 100*3+10 {
+		t.Fatalf("compact headers not used, wrote %d bytes", written)
+	}
+}
+
+func TestSessionProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		configA  *SessionConfig
+		configB  *SessionConfig
+		version  uint32
+		features Features
+	}{
+		{"no hello", nil, nil, 0, 0},
+		{"one side", &SessionConfig{Features: 1 << 20}, nil, ProtocolVersion, builtinFeatures},
+		{"common features",
+			&SessionConfig{Features: 1<<20 | 1<<21},
+			&SessionConfig{Features: 1 << 21, CompactHeaders: true},
+			ProtocolVersion, builtinFeatures | 1<<21},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			connA, connB := net.Pipe()
+			sessA := NewWithConfig(connA, tt.configA)
+			sessB := NewWithConfig(connB, tt.configB)
+			defer sessA.Close()
+			defer sessB.Close()
+
+			accepted := make(chan struct{})
+			go func() {
+				_, err := sessB.Accept()
+				fatal(err, t)
+				close(accepted)
+			}()
+			_, err := sessA.Open(context.Background())
+			fatal(err, t)
+			<-accepted
+
+			for _, sess := range []Session{sessA, sessB} {
+				version, features := sess.(Negotiator).Protocol()
+				if version != tt.version || features != tt.features {
+					t.Fatalf("negotiated version %d and features %s, expected %d and %s",
+						version, features, tt.version, tt.features)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionSingleChannel(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		configB *SessionConfig
+		opens   int64
+	}{
+		{"both sides", &SessionConfig{SingleChannel: true}, 1},
+		{"one side", nil, 7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opens int64
+			count := func(Channel, bool) { atomic.AddInt64(&opens, 1) }
+			// both loops write at once, which net.Pipe cannot buffer
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			fatal(err, t)
+			defer l.Close()
+			connA, err := net.Dial("tcp", l.Addr().String())
+			fatal(err, t)
+			connB, err := l.Accept()
+			fatal(err, t)
+			sessA := NewWithConfig(connA, &SessionConfig{SingleChannel: true, OnChannelOpen: count})
+			sessB := NewWithConfig(connB, tt.configB)
+			defer sessA.Close()
+			defer sessB.Close()
+
+			echo := func(sess Session) {
+				for {
+					ch, err := sess.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						io.Copy(ch, ch)
+						ch.Close()
+					}()
+				}
+			}
+			go echo(sessA)
+			go echo(sessB)
+
+			// concurrent opens of each side, which are carried one at a
+			// time once a carrier was opened
+			errs := make(chan error, 6)
+			ch, err := sessA.Open(context.Background())
+			fatal(err, t)
+			ch.Close()
+			for i := 0; i < 6; i++ {
+				sess := sessA
+				if i%2 == 1 {
+					sess = sessB
+				}
+				go func(i int) {
+					ch, err := sess.Open(context.Background())
+					if err != nil {
+						errs <- err
+						return
+					}
+					msg := bytes.Repeat([]byte{byte(i)}, 100000)
+					go func() {
+						ch.Write(msg)
+						ch.CloseWrite()
+					}()
+					b, err := io.ReadAll(ch)
+					if err == nil && !bytes.Equal(b, msg) {
+						err = fmt.Errorf("echoed %d bytes, expected %d", len(b), len(msg))
+					}
+					ch.Close()
+					errs <- err
+				}(i)
+			}
+			for i := 0; i < 6; i++ {
+				fatal(<-errs, t)
+			}
+			if n := atomic.LoadInt64(&opens); n != tt.opens {
+				t.Fatalf("opened %d channels of the session, expected %d", n, tt.opens)
+			}
+		})
+	}
+}
+
+func TestSessionSingleChannelFrames(t *testing.T) {
+	connA, connB := net.Pipe()
+	sess := NewWithConfig(connA, &SessionConfig{SingleChannel: true})
+	defer sess.Close()
+	defer connB.Close()
+
+	// a peer handling a single channel, frame by frame: the carrier is
+	// opened after the hello and carries frames of the session
+	enc, dec := frame.NewEncoder(connB), frame.NewDecoder(connB)
+	go func() {
+		enc.Encode(frame.HelloMessage{Version: 1, Features: uint32(FeatureSingleChannel)})
+		enc.Encode(frame.OpenMessage{SenderID: 7, WindowSize: 1 << 20, MaxPacketSize: 1 << 16})
+	}()
+	received := make(chan frame.Message, 16)
+	go func() {
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- msg
+		}
+	}()
+	next := func() frame.Message {
+		t.Helper()
+		for msg := range received {
+			if _, ok := msg.(*frame.WindowAdjustMessage); !ok {
+				return msg
+			}
+		}
+		t.Fatal("session ended")
+		return nil
+	}
+	if _, ok := next().(*frame.HelloMessage); !ok {
+		t.Fatal("expected a hello")
+	}
+	confirm, ok := next().(*frame.OpenConfirmMessage)
+	if !ok || confirm.ChannelID != 7 {
+		t.Fatalf("expected a confirm of the carrier, got %v", confirm)
+	}
+	var carrier bytes.Buffer
+	carried := frame.NewEncoder(&carrier)
+	carried.Encode(frame.DataMessage{ChannelID: 1, Length: 4, Data: []byte("ping")})
+	carried.Encode(frame.EOFMessage{ChannelID: 1})
+	go enc.Encode(frame.DataMessage{ChannelID: confirm.SenderID, Length: uint32(carrier.Len()), Data: carrier.Bytes()})
+
+	ch, err := sess.Accept()
+	fatal(err, t)
+	if ch.ID() != 1 {
+		t.Fatalf("accepted carried channel %d, expected 1", ch.ID())
+	}
+	b, err := io.ReadAll(ch)
+	fatal(err, t)
+	if string(b) != "ping" {
+		t.Fatalf("unexpected data: %q", b)
+	}
+	go func() {
+		ch.Write([]byte("pong"))
+		ch.Close()
+	}()
+
+	var frames bytes.Buffer
+	// a data frame of 4 bytes and a close frame
+	for frames.Len() < 13+5 {
+		data, ok := next().(*frame.DataMessage)
+		if !ok || data.ChannelID != 7 {
+			t.Fatalf("expected data of the carrier, got %v", data)
+		}
+		frames.Write(data.Data)
+	}
+	carriedDec := frame.NewDecoder(&frames)
+	for _, want := range []frame.Message{
+		&frame.DataMessage{ChannelID: 1, Length: 4, Data: []byte("pong")},
+		&frame.CloseMessage{ChannelID: 1},
+	} {
+		msg, err := carriedDec.Decode()
+		fatal(err, t)
+		if msg.String() != want.String() {
+			t.Fatalf("carried %v, expected %v", msg, want)
+		}
+	}
+}
+
+func TestFeaturesString(t *testing.T) {
+	for f, s := range map[Features]string{
+		0:                                    "0x0",
+		FeatureCompression:                   "compression",
+		FeatureHalfClose | FeatureExtensions: "half-close|extensions",
+		FeatureCompression | 1<<2 | 1<<20:    "compression|0x100004",
+	} {
+		if f.String() != s {
+			t.Fatalf("got %q, expected %q", f.String(), s)
+		}
+	}
+}
+
+func TestSessionExtensions(t *testing.T) {
+	connA, connB := net.Pipe()
+	sessA := NewWithConfig(connA, &SessionConfig{Features: FeatureExtensions})
+	sessB := New(connB)
+	defer sessA.Close()
+	defer sessB.Close()
+
+	received := make(chan string, 1)
+	sessB.(Extender).HandleExtension(7, func(payload []byte) {
+		received <- string(payload)
+	})
+
+	// the hello exchange completes before the channel is opened
+	go sessB.Accept()
+	_, err := sessA.Open(context.Background())
+	fatal(err, t)
+
+	// dropped without a handler
+	fatal(sessA.(Extender).SendExtension(8, []byte("ignored")), t)
+	fatal(sessA.(Extender).SendExtension(7, []byte("Hello")), t)
+	if got := <-received; got != "Hello" {
+		t.Fatalf("unexpected payload: %q", got)
+	}
+
+	connC, connD := net.Pipe()
+	sessC, sessD := New(connC), New(connD)
+	defer sessC.Close()
+	defer sessD.Close()
+	if err := sessC.(Extender).SendExtension(7, nil); err != ErrExtensionsUnsupported {
+		t.Fatalf("expected ErrExtensionsUnsupported, got %v", err)
+	}
+}
+
+func TestSessionGoAway(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	sconn, err := l.Accept()
+	fatal(err, t)
+
+	goneAway := make(chan struct{})
+	client := NewWithConfig(conn, &SessionConfig{OnGoAway: func() { close(goneAway) }})
+	server := NewWithConfig(sconn, &SessionConfig{Features: FeatureGoAway, AcceptQueue: 1})
+	defer client.Close()
+	defer server.Close()
+
+	_, err = client.Open(context.Background())
+	fatal(err, t)
+	_, err = server.Accept()
+	fatal(err, t)
+	// opened before the go away is acked, so it is still accepted
+	_, err = client.Open(context.Background())
+	fatal(err, t)
+
+	fatal(server.(GoAwayer).GoAway(), t)
+	<-goneAway
+	if _, err := client.Open(context.Background()); err != ErrGoAway {
+		t.Fatalf("expected ErrGoAway, got %v", err)
+	}
+	_, err = server.Accept()
+	fatal(err, t)
+	if _, err := server.Accept(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// the peer can still open channels
+	go client.Accept()
+	_, err = server.Open(context.Background())
+	fatal(err, t)
+
+	c1, c2 := net.Pipe()
+	sessC, sessD := New(c1), New(c2)
+	defer sessC.Close()
+	defer sessD.Close()
+	if err := sessC.(GoAwayer).GoAway(); err != ErrGoAwayUnsupported {
+		t.Fatalf("expected ErrGoAwayUnsupported, got %v", err)
+	}
+}
+
+func TestChannelCloseWithError(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config *SessionConfig
+		err    error
+	}{
+		{"close errors", &SessionConfig{Features: FeatureCloseErrors}, &ChannelError{Code: 3, Message: "disk full"}},
+		{"no hello", nil, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			connA, connB := net.Pipe()
+			sessA := NewWithConfig(connA, tt.config)
+			sessB := New(connB)
+			defer sessA.Close()
+			defer sessB.Close()
+
+			go func() {
+				ch, err := sessB.Accept()
+				if err != nil {
+					return
+				}
+				ch.Write([]byte("partial"))
+				ch.(ErrorCloser).CloseWithError(3, "disk full")
+			}()
+			ch, err := sessA.Open(context.Background())
+			fatal(err, t)
+			defer ch.Close()
+
+			b, err := io.ReadAll(ch)
+			if string(b) != "partial" {
+				t.Fatalf("unexpected data: %q", b)
+			}
+			if tt.err == nil {
+				fatal(err, t)
+				return
+			}
+			var cerr *ChannelError
+			if !errors.As(err, &cerr) || *cerr != *tt.err.(*ChannelError) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			// reads keep failing with the error
+			if _, err := ch.Read(make([]byte, 1)); err != cerr {
+				t.Fatalf("expected %v, got %v", cerr, err)
+			}
+		})
+	}
+}
+
+func TestChannelOnClose(t *testing.T) {
+	connA, connB := net.Pipe()
+	sessA := New(connA)
+	sessB := New(connB)
+	defer sessA.Close()
+	defer sessB.Close()
+
+	remote := make(chan Channel)
+	go func() {
+		for {
+			ch, err := sessB.Accept()
+			if err != nil {
+				close(remote)
+				return
+			}
+			remote <- ch
+		}
+	}()
+	open := func() (Channel, chan struct{}) {
+		ch, err := sessA.Open(context.Background())
+		fatal(err, t)
+		closed := make(chan struct{})
+		ch.(CloseNotifier).OnClose(func() { close(closed) })
+		return ch, closed
+	}
+	wait := func(closed chan struct{}, what string) {
+		t.Helper()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatalf("not notified of %s", what)
+		}
+	}
+
+	ch, closed := open()
+	(<-remote).Close()
+	wait(closed, "the peer closing")
+
+	// callbacks registered once closed are called right away
+	done := make(chan struct{})
+	ch.(CloseNotifier).OnClose(func() { close(done) })
+	wait(done, "an earlier close")
+
+	ch, closed = open()
+	peer := <-remote
+	ch.Close()
+	wait(closed, "a confirmed close")
+	peer.Close()
+
+	_, closed = open()
+	<-remote
+	sessB.Close()
+	wait(closed, "the session ending")
+}
+
+func TestSessionEvents(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	sconn, err := l.Accept()
+	fatal(err, t)
+
+	server := NewWithConfig(sconn, &SessionConfig{ReadBuffer: 1024, AcceptQueue: 1})
+	client := NewWithConfig(conn, &SessionConfig{EventLog: 64})
+	defer server.Close()
+
+	ch, err := client.Open(context.Background())
+	fatal(err, t)
+	sch, err := server.Accept()
+	fatal(err, t)
+	written := make(chan error, 1)
+	go func() {
+		_, err := ch.Write(make([]byte, 2048))
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, err = io.ReadFull(sch, make([]byte, 2048))
+	fatal(err, t)
+	fatal(<-written, t)
+	fatal(ch.Close(), t)
+	fatal(sch.Close(), t)
+	fatal(client.Close(), t)
+	client.Wait()
+
+	var kinds []string
+	for _, e := range client.(EventLogger).Events() {
+		if e.Channel != ch.ID() || e.Inbound {
+			t.Fatalf("unexpected event %v", e)
+		}
+		kinds = append(kinds, e.Kind.String())
+	}
+	if got := strings.Join(kinds, " "); got != "open window-stall window-resume close session-end" {
+		t.Fatalf("unexpected events %s", got)
+	}
+	if server.(EventLogger).Events() != nil {
+		t.Fatal("expected no events without a log")
+	}
+
+	// the oldest events are dropped once the log is full
+	r := newEventRing(3)
+	for i := 0; i < 5; i++ {
+		r.add(Event{Channel: uint32(i)})
+	}
+	if events := r.all(); len(events) != 3 || events[0].Channel != 2 || events[2].Channel != 4 {
+		t.Fatalf("unexpected ring events %v", events)
+	}
+
+	text, err := EventWindowStall.MarshalText()
+	fatal(err, t)
+	var kind EventKind
+	fatal(kind.UnmarshalText(text), t)
+	if kind != EventWindowStall {
+		t.Fatalf("decoded %v", kind)
+	}
+}
+
+func TestChannelStall(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(err, t)
+	sconn, err := l.Accept()
+	fatal(err, t)
+
+	stalled := make(chan Channel, 1)
+	server := NewWithConfig(sconn, &SessionConfig{ReadBuffer: 1024, AcceptQueue: 1})
+	client := NewWithConfig(conn, &SessionConfig{
+		StallThreshold: 10 * time.Millisecond,
+		OnStall:        func(ch Channel) { stalled <- ch },
+		StallTimeout:   100 * time.Millisecond,
+	})
+	defer server.Close()
+	defer client.Close()
+
+	ch, err := client.Open(context.Background())
+	fatal(err, t)
+	sch, err := server.Accept()
+	fatal(err, t)
+
+	start := time.Now()
+	n, err := ch.Write(make([]byte, 2048))
+	if err != ErrWindowStalled || n != 1024 {
+		t.Fatalf("expected ErrWindowStalled after 1024 bytes, got %d, %v", n, err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("write failed after %v", waited)
+	}
+	select {
+	case c := <-stalled:
+		if c.ID() != ch.ID() {
+			t.Fatalf("OnStall called with channel %d", c.ID())
+		}
+	default:
+		t.Fatal("OnStall was not called")
+	}
+
+	// the channel can be written once the peer reads
+	_, err = io.ReadFull(sch, make([]byte, 1024))
+	fatal(err, t)
+	_, err = ch.Write(make([]byte, 1024))
+	fatal(err, t)
+	_, err = io.ReadFull(sch, make([]byte, 1024))
+	fatal(err, t)
+}
@@ -0,0 +1,466 @@
+package mux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roachadam/qtalk-go/mux/frame"
+)
+
+// carriedFlag is set in the IDs of the channels opened by the peer that
+// accepted the carrier, so the IDs chosen by each side never collide.
+const carriedFlag = 1 << 31
+
+// carriedMaxPacket is the largest data frame carried, which keeps frames of
+// other channels from waiting long behind one.
+const carriedMaxPacket = 1 << 15
+
+// singleChannel carries the channels of a session that negotiated
+// FeatureSingleChannel on carrier channels, instead of opening a channel of
+// the session for each.
+type singleChannel struct {
+	s *session
+
+	hello     chan struct{} // closed once the peer hello was handled
+	helloOnce sync.Once
+	ended     chan struct{} // closed once the session ended
+	inbox     chan Channel  // carried channels opened by the peer
+
+	// mu protects carrier, the one used for opens, opening, closed once a
+	// carrier being opened is, and carriers, all those not ended
+	mu       sync.Mutex
+	carrier  *carrier
+	opening  chan struct{}
+	carriers map[*carrier]bool
+}
+
+func newSingleChannel(s *session) *singleChannel {
+	return &singleChannel{
+		s:     s,
+		hello: make(chan struct{}),
+		ended: make(chan struct{}),
+		inbox: make(chan Channel, s.config.AcceptQueue),
+
+		carriers: make(map[*carrier]bool),
+	}
+}
+
+// helloDone is called once the peer hello was handled.
+func (sc *singleChannel) helloDone() {
+	sc.helloOnce.Do(func() { close(sc.hello) })
+}
+
+// end is called once the session ended, waking carriers waiting for
+// channels to be read.
+func (sc *singleChannel) end() {
+	close(sc.ended)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for c := range sc.carriers {
+		c.mu.Lock()
+		for _, cc := range c.chans {
+			cc.closing.Store(true)
+			cc.room.L.Lock()
+			cc.room.Broadcast()
+			cc.room.L.Unlock()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// negotiated waits for the peer hello and returns whether the session
+// carries its channels on a single channel.
+func (sc *singleChannel) negotiated(ctx context.Context) (bool, error) {
+	select {
+	case <-sc.hello:
+	case <-sc.ended:
+		return false, net.ErrClosed
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	_, features := sc.s.Protocol()
+	return features.Has(FeatureSingleChannel), nil
+}
+
+// open opens a carried channel, opening the carrier first unless the peer
+// already opened one.
+func (sc *singleChannel) open(ctx context.Context) (Channel, error) {
+	sc.s.goAwayMu.RLock()
+	gone := sc.s.goneAway
+	sc.s.goAwayMu.RUnlock()
+	if gone {
+		return nil, ErrGoAway
+	}
+	for {
+		sc.mu.Lock()
+		c, opening := sc.carrier, sc.opening
+		if c == nil && opening == nil {
+			sc.opening = make(chan struct{})
+		}
+		sc.mu.Unlock()
+		if c != nil {
+			return c.open(ctx)
+		}
+		if opening != nil {
+			select {
+			case <-opening:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		ch, err := sc.s.openRetry(ctx)
+		sc.mu.Lock()
+		close(sc.opening)
+		sc.opening = nil
+		sc.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return sc.carry(ch.(*channel), true).open(ctx)
+	}
+}
+
+// queue queues a carried channel opened by the peer for Accept, holding up
+// the carrier until it is queued. Like opens of the session, it fails once
+// the queue was full for AcceptTimeout, or right away with RejectBusy.
+func (sc *singleChannel) queue(cc *carriedChannel) (bool, error) {
+	select {
+	case sc.inbox <- cc:
+		return true, nil
+	default:
+	}
+	if sc.s.config.RejectBusy {
+		return false, nil
+	}
+	timeout := sc.s.config.AcceptTimeout
+	if timeout <= 0 {
+		timeout = openTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case sc.inbox <- cc:
+		return true, nil
+	case <-t.C:
+		return false, nil
+	case <-sc.ended:
+		return false, io.EOF
+	}
+}
+
+// carry starts carrying channels on ch, opened by this side if outbound. It
+// is used for opens unless another carrier already is.
+func (sc *singleChannel) carry(ch *channel, outbound bool) *carrier {
+	c := &carrier{
+		sc:    sc,
+		ch:    ch,
+		enc:   frame.NewEncoder(ch),
+		opens: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		chans: make(map[uint32]*carriedChannel),
+	}
+	if !outbound {
+		c.flag = carriedFlag
+	}
+	sc.mu.Lock()
+	if sc.carrier == nil {
+		sc.carrier = c
+	}
+	sc.carriers[c] = true
+	sc.mu.Unlock()
+	go c.loop()
+	return c
+}
+
+// carrier is a channel of the session carrying other channels, each frame
+// of which is framed within it like a frame of the session.
+type carrier struct {
+	sc   *singleChannel
+	ch   *channel
+	enc  *frame.Encoder
+	flag uint32
+
+	// opens holds the channel this side opened until it is closed, so
+	// channels are opened one at a time
+	opens chan struct{}
+	done  chan struct{} // closed once the carrier ended
+
+	mu     sync.Mutex
+	chans  map[uint32]*carriedChannel
+	nextID uint32
+	closed bool
+}
+
+// open opens a carried channel once the previous one this side opened was
+// closed by both sides.
+func (c *carrier) open(ctx context.Context) (Channel, error) {
+	select {
+	case c.opens <- struct{}{}:
+	case <-c.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		<-c.opens
+		return nil, net.ErrClosed
+	}
+	c.nextID = (c.nextID + 1) &^ carriedFlag
+	return c.newChannel(c.nextID|c.flag, true), nil
+}
+
+// newChannel adds a carried channel. It must be called with mu held.
+func (c *carrier) newChannel(id uint32, outbound bool) *carriedChannel {
+	cc := &carriedChannel{
+		c:          c,
+		id:         id,
+		outbound:   outbound,
+		pending:    newBuffer(),
+		room:       sync.NewCond(new(sync.Mutex)),
+		readBuffer: int(readBufferSize(c.sc.s.config.ReadBuffer)),
+	}
+	c.chans[id] = cc
+	return cc
+}
+
+func (c *carrier) remove(cc *carriedChannel) {
+	c.mu.Lock()
+	delete(c.chans, cc.id)
+	c.mu.Unlock()
+	if cc.outbound {
+		<-c.opens
+	}
+}
+
+// loop reads the frames of carried channels until the carrier ends.
+func (c *carrier) loop() {
+	dec := frame.NewDecoder(c.ch)
+	var err error
+	for err == nil {
+		var msg frame.Message
+		if msg, err = dec.Decode(); err == nil {
+			err = c.handle(msg)
+		}
+	}
+	c.ch.Close()
+
+	c.mu.Lock()
+	c.closed = true
+	chans := make([]*carriedChannel, 0, len(c.chans))
+	for _, cc := range c.chans {
+		chans = append(chans, cc)
+	}
+	c.mu.Unlock()
+	for _, cc := range chans {
+		cc.close()
+	}
+	close(c.done)
+
+	c.sc.mu.Lock()
+	if c.sc.carrier == c {
+		c.sc.carrier = nil
+	}
+	delete(c.sc.carriers, c)
+	c.sc.mu.Unlock()
+}
+
+// handle handles a frame of a carried channel, which opens the channel if
+// its ID is a new one of the peer.
+func (c *carrier) handle(msg frame.Message) error {
+	switch msg.(type) {
+	case *frame.DataMessage, *frame.EOFMessage, *frame.CloseMessage:
+	default:
+		return fmt.Errorf("qmux: invalid carried frame %v", msg)
+	}
+	id, _ := msg.Channel()
+	c.mu.Lock()
+	cc := c.chans[id]
+	if cc == nil {
+		if id&carriedFlag == c.flag {
+			// a channel of ours closed by both sides
+			c.mu.Unlock()
+			return nil
+		}
+		cc = c.newChannel(id, false)
+		c.mu.Unlock()
+		queued, err := c.sc.queue(cc)
+		if err != nil {
+			return err
+		}
+		if !queued {
+			// refused like an open of the session when the accept
+			// queue is full
+			cc.Close()
+		}
+	} else {
+		c.mu.Unlock()
+	}
+	return cc.handle(msg)
+}
+
+// carriedChannel is a channel carried on a carrier. Without a window of its
+// own, a channel holding ReadBuffer bytes not yet read holds up the other
+// channels of the carrier until it is read.
+type carriedChannel struct {
+	c        *carrier
+	id       uint32
+	outbound bool
+
+	pending *buffer
+
+	// room protects unread, the data received but not yet read, and is
+	// signaled once it is below readBuffer or the channel is closed
+	room       *sync.Cond
+	unread     int
+	readBuffer int
+
+	// writeMu serializes writes and protects sentClose
+	writeMu   sync.Mutex
+	sentClose bool
+
+	closing atomic.Bool // closed locally, so data received is dropped
+	closed  atomic.Bool // closed by both sides or the end of the carrier
+
+	closeMu sync.Mutex
+	onClose []func()
+}
+
+func (cc *carriedChannel) ID() uint32 {
+	return cc.id
+}
+
+// RemoteID returns the ID of the channel, which is the same for both peers.
+func (cc *carriedChannel) RemoteID() uint32 {
+	return cc.id
+}
+
+func (cc *carriedChannel) Read(p []byte) (int, error) {
+	n, err := cc.pending.Read(p)
+	if n > 0 {
+		cc.room.L.Lock()
+		cc.unread -= n
+		cc.room.Broadcast()
+		cc.room.L.Unlock()
+	}
+	return n, err
+}
+
+func (cc *carriedChannel) Write(data []byte) (int, error) {
+	var n int
+	for len(data) > 0 {
+		packet := data
+		if len(packet) > carriedMaxPacket {
+			packet = packet[:carriedMaxPacket]
+		}
+		if err := cc.send(frame.DataMessage{
+			ChannelID: cc.id,
+			Length:    uint32(len(packet)),
+			Data:      packet,
+		}); err != nil {
+			return n, err
+		}
+		n += len(packet)
+		data = data[len(packet):]
+	}
+	return n, nil
+}
+
+func (cc *carriedChannel) CloseWrite() error {
+	return cc.send(frame.EOFMessage{ChannelID: cc.id})
+}
+
+func (cc *carriedChannel) Close() error {
+	cc.closing.Store(true)
+	cc.room.L.Lock()
+	cc.room.Broadcast()
+	cc.room.L.Unlock()
+	return cc.send(frame.CloseMessage{ChannelID: cc.id})
+}
+
+func (cc *carriedChannel) SetReadDeadline(t time.Time) error {
+	cc.pending.setDeadline(t)
+	return nil
+}
+
+func (cc *carriedChannel) OnClose(f func()) {
+	cc.closeMu.Lock()
+	closed := cc.closed.Load()
+	if !closed {
+		cc.onClose = append(cc.onClose, f)
+	}
+	cc.closeMu.Unlock()
+	if closed {
+		go f()
+	}
+}
+
+// send writes a frame of the channel on the carrier, or returns io.EOF once
+// the channel was closed.
+func (cc *carriedChannel) send(msg frame.Message) error {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	if cc.sentClose || cc.closed.Load() {
+		return io.EOF
+	}
+	if _, ok := msg.(frame.CloseMessage); ok {
+		cc.sentClose = true
+	}
+	return cc.c.enc.Encode(msg)
+}
+
+func (cc *carriedChannel) handle(msg frame.Message) error {
+	switch m := msg.(type) {
+	case *frame.DataMessage:
+		if m.Length > carriedMaxPacket || m.Length != uint32(len(m.Data)) {
+			return fmt.Errorf("qmux: invalid carried packet of %d bytes", len(m.Data))
+		}
+		cc.receive(m.Data)
+	case *frame.EOFMessage:
+		cc.pending.eof()
+	case *frame.CloseMessage:
+		cc.send(frame.CloseMessage{ChannelID: cc.id})
+		cc.c.remove(cc)
+		cc.close()
+	}
+	return nil
+}
+
+// receive buffers data for reading once there is room for it.
+func (cc *carriedChannel) receive(data []byte) {
+	cc.room.L.Lock()
+	for cc.unread >= cc.readBuffer && !cc.closing.Load() {
+		cc.room.Wait()
+	}
+	drop := cc.closing.Load()
+	if !drop {
+		cc.unread += len(data)
+	}
+	cc.room.L.Unlock()
+	if !drop {
+		cc.pending.write(data)
+	}
+}
+
+// close ends the channel once closed by both sides or with the carrier.
+func (cc *carriedChannel) close() {
+	if cc.closed.Swap(true) {
+		return
+	}
+	cc.pending.eof()
+	cc.closeMu.Lock()
+	onClose := cc.onClose
+	cc.onClose = nil
+	cc.closeMu.Unlock()
+	for _, f := range onClose {
+		go f()
+	}
+}
@@ -3,11 +3,22 @@ package mux
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"path"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 func testExchange(t *testing.T, sess Session) {
@@ -74,13 +85,22 @@ func startListener(t *testing.T, l Listener) {
 			fatal(err, t)
 		})
 
+		// accept while the client's channel is read, so its open does not
+		// time out on a loaded machine
+		accepted := make(chan Channel, 1)
+		go func() {
+			ch, err := sess.Accept()
+			fatal(err, t)
+			accepted <- ch
+		}()
+
 		ch, err := sess.Open(context.Background())
 		fatal(err, t)
 		b, err := ioutil.ReadAll(ch)
 		fatal(err, t)
 		ch.Close()
 
-		ch, err = sess.Accept()
+		ch = <-accepted
 		_, err = ch.Write(b)
 		fatal(err, t)
 		err = ch.CloseWrite()
@@ -110,6 +130,39 @@ func TestUnix(t *testing.T) {
 	testExchange(t, sess)
 }
 
+func TestNamedPipe(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		if _, err := ListenNamedPipe("qmux", nil); err != ErrNamedPipeUnsupported {
+			t.Fatalf("expected ErrNamedPipeUnsupported, got %v", err)
+		}
+		t.Skip("named pipes are only supported on windows")
+	}
+	name := fmt.Sprintf("qmux-test-%d", time.Now().UnixNano())
+	l, err := ListenNamedPipe(name, &NamedPipeConfig{SecurityDescriptor: "D:P(A;;GA;;;OW)"})
+	fatal(err, t)
+	if _, err := ListenNamedPipe(name, nil); err == nil {
+		t.Fatal("expected listening on an existing pipe to fail")
+	}
+	startListener(t, l)
+
+	sess, err := DialNamedPipe(`\\.\pipe\` + name)
+	fatal(err, t)
+	testExchange(t, sess)
+}
+
+func TestPipePath(t *testing.T) {
+	for name, path := range map[string]string{
+		"qtalk":             `\\.\pipe\qtalk`,
+		"/qtalk":            `\\.\pipe\qtalk`,
+		`\\.\pipe\qtalk`:    `\\.\pipe\qtalk`,
+		`\\host\pipe\qtalk`: `\\host\pipe\qtalk`,
+	} {
+		if got := pipePath(name); got != path {
+			t.Errorf("pipePath(%q) = %q, expected %q", name, got, path)
+		}
+	}
+}
+
 func TestIO(t *testing.T) {
 	pr1, pw1 := io.Pipe()
 	pr2, pw2 := io.Pipe()
@@ -123,6 +176,42 @@ func TestIO(t *testing.T) {
 	testExchange(t, sess)
 }
 
+func TestMessageTransport(t *testing.T) {
+	// subjects of an in-memory broker delivering messages in order
+	subject := func() (chan []byte, func([]byte) error) {
+		msgs := make(chan []byte, 64)
+		return msgs, func(msg []byte) error {
+			msgs <- msg
+			return nil
+		}
+	}
+	aToB, publishA := subject()
+	bToA, publishB := subject()
+	a := NewMessageTransport(publishA)
+	b := NewMessageTransport(publishB)
+	go func() {
+		for msg := range aToB {
+			b.Deliver(msg)
+		}
+	}()
+	go func() {
+		for msg := range bToA {
+			a.Deliver(msg)
+		}
+	}()
+	t.Cleanup(func() {
+		close(aToB)
+		close(bToA)
+	})
+
+	l, err := ListenIO(a, a)
+	fatal(err, t)
+	startListener(t, l)
+	sess, err := DialIO(b, b)
+	fatal(err, t)
+	testExchange(t, sess)
+}
+
 func TestWS(t *testing.T) {
 	l, err := ListenWS("127.0.0.1:0")
 	fatal(err, t)
@@ -132,3 +221,249 @@ func TestWS(t *testing.T) {
 	fatal(err, t)
 	testExchange(t, sess)
 }
+
+func TestWSSubprotocol(t *testing.T) {
+	l, err := ListenWSConfig("127.0.0.1:0", &WSConfig{
+		Codecs:      []string{"cbor", "json"},
+		CheckOrigin: AllowOrigins("https://app.example.com"),
+	})
+	fatal(err, t)
+	defer l.Close()
+	addr := l.Addr().String()
+
+	accepted := make(chan Session, 1)
+	go func() {
+		sess, err := l.Accept()
+		if err == nil {
+			accepted <- sess
+		}
+	}()
+	sess, err := DialWSConfig(addr, &WSConfig{
+		Codecs:             []string{"msgpack", "json"},
+		Origin:             "https://app.example.com",
+		RequireSubprotocol: true,
+	})
+	fatal(err, t)
+	defer sess.Close()
+	if p := sess.(Subprotocoler).Subprotocol(); p != "qtalk.v1.json" {
+		t.Fatalf("dialed subprotocol %q", p)
+	}
+	if p := (<-accepted).(Subprotocoler).Subprotocol(); p != "qtalk.v1.json" {
+		t.Fatalf("accepted subprotocol %q", p)
+	}
+
+	for name, config := range map[string]*WSConfig{
+		"origin":   {Origin: "https://evil.example.com"},
+		"codec":    {Origin: "https://app.example.com", Codecs: []string{"msgpack"}},
+		"required": {Origin: "https://app.example.com"},
+	} {
+		if name == "required" {
+			// the server selects nothing for clients offering nothing
+			config.RequireSubprotocol = true
+		}
+		if _, err := DialWSConfig(addr, config); err == nil {
+			t.Fatalf("%s: expected handshake to fail", name)
+		}
+	}
+
+	version, codec, err := ParseWSSubprotocol(WSSubprotocol(2, "json"))
+	fatal(err, t)
+	if version != 2 || codec != "json" {
+		t.Fatalf("parsed %d %q", version, codec)
+	}
+	for _, p := range []string{"qtalk.json", "qtalk.v0.json", "qtalk.v1.", "mqtt"} {
+		if _, _, err := ParseWSSubprotocol(p); err == nil {
+			t.Fatalf("expected %q to be invalid", p)
+		}
+	}
+}
+
+// testTLSConfig returns a config with a self-signed certificate for
+// 127.0.0.1 and a client config trusting it.
+func testTLSConfig(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fatal(err, t)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	fatal(err, t)
+	cert, err := x509.ParseCertificate(der)
+	fatal(err, t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestTLS(t *testing.T) {
+	srvConfig, clientConfig := testTLSConfig(t)
+	l, err := ListenTLS("127.0.0.1:0", srvConfig)
+	fatal(err, t)
+	startListener(t, l)
+
+	sess, err := DialTLS(l.Addr().String(), clientConfig)
+	fatal(err, t)
+	testExchange(t, sess)
+}
+
+func TestLimit(t *testing.T) {
+	l, err := ListenTCP("127.0.0.1:0")
+	fatal(err, t)
+	ll := Limit(l, 1)
+	defer ll.Close()
+
+	accepted := make(chan Session)
+	go func() {
+		for {
+			sess, err := ll.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- sess
+		}
+	}()
+
+	first, err := DialTCP(l.Addr().String())
+	fatal(err, t)
+	sess := <-accepted
+	second, err := DialTCP(l.Addr().String())
+	fatal(err, t)
+	defer second.Close()
+	select {
+	case <-accepted:
+		t.Fatal("accepted session over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// ending the first session makes room for the second
+	first.Close()
+	sess.Close()
+	select {
+	case sess := <-accepted:
+		sess.Close()
+	case <-time.After(time.Second):
+		t.Fatal("session not accepted after another ended")
+	}
+
+	fatal(ll.Close(), t)
+	if _, ok := <-accepted; ok {
+		t.Fatal("unexpected session after close")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(err, t)
+	l := ListenerFrom(ProxyProtocol(nl))
+	defer l.Close()
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12)
+	v2 = append(v2, 203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x10, 0x92)
+	for _, tt := range []struct {
+		header string
+		want   string
+	}{
+		{"PROXY TCP4 198.51.100.22 10.0.0.1 35646 4242\r\n", "198.51.100.22:35646"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 443 4242\r\n", "[2001:db8::1]:443"},
+		{string(v2), "203.0.113.7:12345"},
+		{"PROXY UNKNOWN\r\n", ""},
+	} {
+		conn, err := net.Dial("tcp", nl.Addr().String())
+		fatal(err, t)
+		_, err = conn.Write([]byte(tt.header))
+		fatal(err, t)
+		client := New(conn)
+		sess, err := l.Accept()
+		fatal(err, t)
+
+		// the session works over the connection after the header
+		go func() {
+			ch, err := client.Open(context.Background())
+			if err == nil {
+				ch.Write([]byte("hello"))
+				ch.Close()
+			}
+		}()
+		ch, err := sess.Accept()
+		fatal(err, t)
+		b, err := ioutil.ReadAll(ch)
+		fatal(err, t)
+		if string(b) != "hello" {
+			t.Fatalf("unexpected data: %q", b)
+		}
+
+		want := tt.want
+		if want == "" {
+			want = conn.LocalAddr().String()
+		}
+		if addr := sess.(RemoteAddrer).RemoteAddr(); addr.String() != want {
+			t.Fatalf("remote address with header %q = %s; want %s", tt.header, addr, want)
+		}
+		client.Close()
+		sess.Close()
+	}
+
+	// connections without a header fail
+	sess, err := DialTCP(nl.Addr().String())
+	fatal(err, t)
+	defer sess.Close()
+	go sess.Open(context.Background())
+	ssess, err := l.Accept()
+	fatal(err, t)
+	if err := ssess.Wait(); !errors.Is(err, errProxyHeader) {
+		t.Fatal("unexpected error without header:", err)
+	}
+}
+
+// BenchmarkTCPLargeWrite measures transferring 100MB over a single
+// channel, which is written in frames of the maximum packet size.
+func BenchmarkTCPLargeWrite(b *testing.B) {
+	l, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	data := make([]byte, 100<<20)
+	go func() {
+		sess, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer sess.Close()
+		for {
+			ch, err := sess.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, ch)
+			ch.Close()
+		}
+	}()
+
+	sess, err := DialTCP(l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sess.Close()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch, err := sess.Open(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ch.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		ch.Close()
+	}
+}
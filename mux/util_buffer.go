@@ -2,7 +2,9 @@ package mux
 
 import (
 	"io"
+	"os"
 	"sync"
+	"time"
 )
 
 // buffer provides a linked list buffer for data exchange
@@ -16,6 +18,12 @@ type buffer struct {
 	tail *element // the buffer that will be read last
 
 	closed bool
+	// err is returned instead of io.EOF once a closed buffer is drained
+	err error
+
+	// deadline for blocking reads, zero means no deadline
+	deadline time.Time
+	timer    *time.Timer
 }
 
 // An element represents a single link in a linked list.
@@ -55,6 +63,39 @@ func (b *buffer) eof() {
 	b.Cond.L.Unlock()
 }
 
+// fail closes the buffer like eof, making reads return err instead of
+// io.EOF.
+func (b *buffer) fail(err error) {
+	b.Cond.L.Lock()
+	b.closed = true
+	b.err = err
+	b.Cond.Signal()
+	b.Cond.L.Unlock()
+}
+
+// setDeadline sets the deadline for blocked and future reads. A zero
+// value for t means reads will not time out.
+func (b *buffer) setDeadline(t time.Time) {
+	b.Cond.L.Lock()
+	defer b.Cond.L.Unlock()
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		if d := time.Until(t); d > 0 {
+			b.timer = time.AfterFunc(d, func() {
+				b.Cond.L.Lock()
+				b.Cond.Broadcast()
+				b.Cond.L.Unlock()
+			})
+		}
+	}
+	// wake any blocked reader to re-check the deadline
+	b.Cond.Broadcast()
+}
+
 // Read reads data from the internal buffer in buf.  Reads will block
 // if no data is available, or until the buffer is closed.
 func (b *buffer) Read(buf []byte) (n int, err error) {
@@ -84,6 +125,13 @@ func (b *buffer) Read(buf []byte) (n int, err error) {
 		// check to see if the buffer is closed.
 		if b.closed {
 			err = io.EOF
+			if b.err != nil {
+				err = b.err
+			}
+			break
+		}
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			err = os.ErrDeadlineExceeded
 			break
 		}
 		// out of buffers, wait for producer
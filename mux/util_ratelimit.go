@@ -0,0 +1,46 @@
+package mux
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting bytes per second. Tokens can
+// go negative, which makes waiters sleep off the debt in order.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  int     // maximum tokens
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a full bucket allowing rate bytes per second
+// with bursts of up to burst bytes.
+func newRateLimiter(rate, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens, blocking until the bucket has recovered from
+// any deficit. Callers should not take more than burst at once.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(d)
+}
@@ -3,6 +3,7 @@ package mux
 import (
 	"io"
 	"sync"
+	"time"
 )
 
 // window represents the buffer available to clients
@@ -35,6 +36,13 @@ func (w *window) add(win uint32) bool {
 	return true
 }
 
+// available returns the window available without waiting.
+func (w *window) available() uint32 {
+	w.L.Lock()
+	defer w.L.Unlock()
+	return w.win
+}
+
 // close sets the window to closed, so all reservations fail
 // immediately.
 func (w *window) close() {
@@ -45,17 +53,32 @@ func (w *window) close() {
 }
 
 // reserve reserves win from the available window capacity.
-// If no capacity remains, reserve will block. reserve may
-// return less than requested.
-func (w *window) reserve(win uint32) (uint32, error) {
+// If no capacity remains, reserve will block, for up to timeout
+// if positive, after which it returns ErrWindowStalled. reserve
+// may return less than requested.
+func (w *window) reserve(win uint32, timeout time.Duration) (uint32, error) {
 	var err error
+	var expired bool
+	if timeout > 0 && w.available() == 0 {
+		t := time.AfterFunc(timeout, func() {
+			w.L.Lock()
+			expired = true
+			w.Broadcast()
+			w.L.Unlock()
+		})
+		defer t.Stop()
+	}
 	w.L.Lock()
 	w.writeWaiters++
 	w.Broadcast()
-	for w.win == 0 && !w.closed {
+	for w.win == 0 && !w.closed && !expired {
 		w.Wait()
 	}
 	w.writeWaiters--
+	if w.win == 0 && !w.closed {
+		w.L.Unlock()
+		return 0, ErrWindowStalled
+	}
 	if w.win < win {
 		win = w.win
 	}
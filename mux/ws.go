@@ -0,0 +1,166 @@
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// ErrWSSubprotocol is returned by DialWSConfig if the server selected no
+// subprotocol and the config requires one, and rejects the handshakes of
+// clients when listening if no subprotocol can be selected.
+var ErrWSSubprotocol = errors.New("qmux: no websocket subprotocol negotiated")
+
+// wsSubprotocolPrefix begins the WebSocket subprotocols of qtalk.
+const wsSubprotocolPrefix = "qtalk.v"
+
+// WSSubprotocol returns the WebSocket subprotocol advertising protocol
+// version and the name of a codec, like "qtalk.v1.json". Browser peers
+// offer it in the Sec-WebSocket-Protocol header.
+func WSSubprotocol(version int, codec string) string {
+	return wsSubprotocolPrefix + strconv.Itoa(version) + "." + codec
+}
+
+// ParseWSSubprotocol returns the protocol version and codec name of a
+// subprotocol returned by WSSubprotocol.
+func ParseWSSubprotocol(subprotocol string) (version int, codec string, err error) {
+	ok := strings.HasPrefix(subprotocol, wsSubprotocolPrefix)
+	if ok {
+		s := strings.TrimPrefix(subprotocol, wsSubprotocolPrefix)
+		var v string
+		v, codec, ok = strings.Cut(s, ".")
+		version, err = strconv.Atoi(v)
+		ok = ok && err == nil && version > 0 && codec != ""
+	}
+	if !ok {
+		return 0, "", fmt.Errorf("qmux: invalid websocket subprotocol %q", subprotocol)
+	}
+	return version, codec, nil
+}
+
+// Subprotocoler is implemented by sessions able to report the WebSocket
+// subprotocol negotiated by the peers, which includes sessions created by
+// DialWS and ListenWS.
+type Subprotocoler interface {
+	// Subprotocol returns the negotiated subprotocol, or an empty string if
+	// none was negotiated.
+	Subprotocol() string
+}
+
+func (s *session) Subprotocol() string {
+	if c, ok := s.t.(Subprotocoler); ok {
+		return c.Subprotocol()
+	}
+	return ""
+}
+
+// WSConfig configures the handshake of WebSocket sessions.
+type WSConfig struct {
+	// Codecs lists the names of the codecs of the sessions in order of
+	// preference. Dialing offers a subprotocol for each of them with every
+	// protocol version up to ProtocolVersion, and listening selects the
+	// first subprotocol offered by the client with one of them and a
+	// supported version. If empty, dialing offers no subprotocol and
+	// listening selects the first valid one.
+	Codecs []string
+
+	// RequireSubprotocol fails dialing if the server selects no
+	// subprotocol, and rejects clients offering none when listening.
+	// Clients offering subprotocols of which none can be selected are
+	// always rejected.
+	RequireSubprotocol bool
+
+	// CheckOrigin reports whether to accept the handshake of a request
+	// when listening, which servers of browser peers use to reject
+	// requests from other sites. If nil, requests without an Origin
+	// header are rejected.
+	CheckOrigin func(r *http.Request) bool
+
+	// Origin is the Origin header sent when dialing. If empty, it is an
+	// http URL of the address.
+	Origin string
+}
+
+// AllowOrigins returns a CheckOrigin function accepting requests with one
+// of the Origin headers given, like "https://example.com".
+func AllowOrigins(origins ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		for _, o := range origins {
+			if strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// offers returns the subprotocols offered when dialing.
+func (c *WSConfig) offers() []string {
+	var offers []string
+	for _, codec := range c.Codecs {
+		for v := ProtocolVersion; v > 0; v-- {
+			offers = append(offers, WSSubprotocol(v, codec))
+		}
+	}
+	return offers
+}
+
+// handshake checks the origin of a request when listening and selects the
+// subprotocol.
+func (c *WSConfig) handshake(config *websocket.Config, r *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if c.CheckOrigin != nil {
+		if !c.CheckOrigin(r) {
+			return fmt.Errorf("origin %q not allowed", r.Header.Get("Origin"))
+		}
+	} else if config.Origin == nil {
+		return errors.New("null origin")
+	}
+
+	offered := config.Protocol
+	config.Protocol = nil
+	if len(offered) == 0 {
+		if c.RequireSubprotocol {
+			return ErrWSSubprotocol
+		}
+		return nil
+	}
+	for _, p := range offered {
+		version, codec, err := ParseWSSubprotocol(p)
+		if err != nil || version > ProtocolVersion {
+			continue
+		}
+		if len(c.Codecs) == 0 || contains(c.Codecs, codec) {
+			config.Protocol = []string{p}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: none of %v supported", ErrWSSubprotocol, offered)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket connection reporting its subprotocol.
+type wsConn struct {
+	*websocket.Conn
+	subprotocol string
+}
+
+func (c *wsConn) Subprotocol() string {
+	return c.subprotocol
+}
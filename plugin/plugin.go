@@ -0,0 +1,405 @@
+// Package plugin implements plugins as subprocesses talking qtalk over stdio.
+//
+// A Host launches the plugin command and establishes a session over its stdin
+// and stdout. The plugin process runs a Guest, which answers a handshake used
+// by the Host to check protocol versions and agree on features. Both sides can
+// then make calls to each other, so typed interfaces can be exposed either way
+// using fn.HandlerFrom on one side and a typed client on the other. Since stdout
+// carries the session, plugins must only log to stderr.
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+	"github.com/roachadam/qtalk-go/talk"
+)
+
+// HandshakeSelector is the selector of the handshake handler served by Guests.
+const HandshakeSelector = "plugin.handshake"
+
+// ErrNotRunning is returned when calling a plugin that is not running.
+var ErrNotRunning = errors.New("plugin: not running")
+
+// Handshake is exchanged when a plugin starts. The Host sends its Handshake
+// and the Guest replies with its own.
+type Handshake struct {
+	// Name identifies the plugin or host.
+	Name string
+
+	// ProtocolVersion is the version of the application protocol between
+	// host and plugin. The Host refuses plugins with a different version.
+	ProtocolVersion int
+
+	// Features are optional capabilities. Only features listed by both
+	// sides are enabled.
+	Features []string
+}
+
+// intersect returns the features in both a and b, in the order of a.
+func intersect(a, b []string) []string {
+	var out []string
+	for _, f := range a {
+		for _, ff := range b {
+			if f == ff {
+				out = append(out, f)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Host runs a plugin subprocess and makes calls to it.
+type Host struct {
+	// Cmd returns the command to start the plugin. It is called again
+	// for each restart. Stdin and Stdout must not be set.
+	Cmd func() *exec.Cmd
+
+	// Handshake is sent to the plugin when it starts.
+	Handshake Handshake
+
+	// Handler responds to calls made by the plugin. It is optional.
+	Handler rpc.Handler
+
+	// Codec used for calls, defaulting to codec.JSONCodec.
+	Codec codec.Codec
+
+	// MaxRestarts is how many times the plugin is restarted after
+	// exiting unexpectedly. Zero disables restarting, and a negative
+	// value restarts indefinitely.
+	MaxRestarts int
+
+	// OnExit is called with the error returned by waiting on the plugin
+	// process each time it exits, before any restart.
+	OnExit func(err error)
+
+	// HandshakeTimeout limits how long starting the plugin and performing
+	// the handshake may take, defaulting to 10 seconds.
+	HandshakeTimeout time.Duration
+
+	mu       sync.Mutex
+	peer     *talk.Peer
+	cmd      *exec.Cmd
+	remote   Handshake
+	features []string
+	restarts int
+	starting bool
+	closed   bool
+	closing  chan struct{}
+	done     chan struct{}
+}
+
+// Start launches the plugin and performs the handshake.
+func (h *Host) Start(ctx context.Context) error {
+	h.mu.Lock()
+	if h.peer != nil || h.starting {
+		h.mu.Unlock()
+		return fmt.Errorf("plugin: already started")
+	}
+	h.starting = true
+	h.closed = false
+	h.closing = make(chan struct{})
+	h.mu.Unlock()
+
+	p, err := h.launch(ctx)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.starting = false
+	if err != nil {
+		return err
+	}
+	if h.closed {
+		p.kill()
+		return ErrNotRunning
+	}
+	h.run(p)
+	return nil
+}
+
+// process is a launched plugin process.
+type process struct {
+	peer   *talk.Peer
+	cmd    *exec.Cmd
+	remote Handshake
+}
+
+func (p *process) kill() {
+	p.peer.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// launch starts the plugin process and performs the handshake.
+func (h *Host) launch(ctx context.Context) (*process, error) {
+	timeout := h.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := h.Cmd()
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	sess, err := mux.DialIO(w, r)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	cd := h.Codec
+	if cd == nil {
+		cd = codec.JSONCodec{}
+	}
+	peer := talk.NewPeer(sess, cd)
+	if h.Handler != nil {
+		peer.Handle("", h.Handler)
+	}
+	go peer.Respond()
+
+	p := &process{peer: peer, cmd: cmd}
+	if _, err := peer.Call(ctx, HandshakeSelector, h.Handshake, &p.remote); err != nil {
+		p.kill()
+		return nil, fmt.Errorf("plugin: handshake: %w", err)
+	}
+	if p.remote.ProtocolVersion != h.Handshake.ProtocolVersion {
+		p.kill()
+		return nil, fmt.Errorf("plugin: %s has protocol version %d, expected %d",
+			p.remote.Name, p.remote.ProtocolVersion, h.Handshake.ProtocolVersion)
+	}
+	return p, nil
+}
+
+// run makes p the running plugin and monitors it. It expects h.mu to be held.
+func (h *Host) run(p *process) {
+	h.peer = p.peer
+	h.cmd = p.cmd
+	h.remote = p.remote
+	h.features = intersect(h.Handshake.Features, p.remote.Features)
+	h.done = make(chan struct{})
+	go h.monitor(p, h.done)
+}
+
+// monitor waits for the plugin process to exit and restarts it if needed.
+// The lock is not held while waiting between restarts or launching the
+// plugin, so the Host can be used and closed meanwhile.
+func (h *Host) monitor(p *process, done chan struct{}) {
+	defer close(done)
+	err := p.cmd.Wait()
+	p.peer.Close()
+	if h.OnExit != nil {
+		h.OnExit(err)
+	}
+
+	h.mu.Lock()
+	h.peer = nil
+	closing := h.closing
+	h.mu.Unlock()
+
+	for {
+		h.mu.Lock()
+		if h.closed || (h.MaxRestarts >= 0 && h.restarts >= h.MaxRestarts) {
+			h.mu.Unlock()
+			return
+		}
+		h.restarts++
+		// back off a little more for each restart
+		delay := time.Duration(h.restarts) * 100 * time.Millisecond
+		h.mu.Unlock()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-closing:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-closing:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		p, err := h.launch(ctx)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		h.mu.Lock()
+		if h.closed {
+			h.mu.Unlock()
+			p.kill()
+			return
+		}
+		h.run(p)
+		h.mu.Unlock()
+		return
+	}
+}
+
+// Remote returns the handshake of the running plugin.
+func (h *Host) Remote() Handshake {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.remote
+}
+
+// Features returns the features enabled by both host and plugin.
+func (h *Host) Features() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.features
+}
+
+// Restarts returns how many times the plugin has been restarted.
+func (h *Host) Restarts() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.restarts
+}
+
+// Running returns whether the plugin process is currently running.
+func (h *Host) Running() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.peer != nil
+}
+
+// Call makes a call to the running plugin, returning ErrNotRunning if it has
+// exited and was not restarted.
+func (h *Host) Call(ctx context.Context, selector string, args any, replies ...any) (*rpc.Response, error) {
+	h.mu.Lock()
+	peer := h.peer
+	h.mu.Unlock()
+	if peer == nil {
+		return nil, ErrNotRunning
+	}
+	return peer.Call(ctx, selector, args, replies...)
+}
+
+// Close stops the plugin without restarting it.
+func (h *Host) Close() error {
+	h.mu.Lock()
+	if !h.closed && h.closing != nil {
+		close(h.closing)
+	}
+	h.closed = true
+	peer, cmd, done := h.peer, h.cmd, h.done
+	h.mu.Unlock()
+	if peer != nil {
+		// closing the session closes stdin, which should end a well
+		// behaved plugin, otherwise it is killed.
+		peer.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			cmd.Process.Kill()
+		}
+	}
+	if done != nil {
+		// also waits for a restart in progress to stop
+		<-done
+	}
+	return nil
+}
+
+// Guest is run by the plugin process to serve the Host.
+type Guest struct {
+	// Handshake is replied to the Host handshake.
+	Handshake Handshake
+
+	// Handler responds to calls made by the Host.
+	Handler rpc.Handler
+
+	// Codec used for calls, defaulting to codec.JSONCodec.
+	Codec codec.Codec
+
+	// OnHandshake is called with the Host handshake. It is optional.
+	OnHandshake func(Handshake)
+
+	mu   sync.Mutex
+	peer *talk.Peer
+}
+
+// Serve serves the Host over stdin and stdout using ServeIO.
+func (g *Guest) Serve() error {
+	return g.ServeIO(os.Stdout, os.Stdin)
+}
+
+// ServeIO serves the Host over the given writer and reader until the session
+// ends, returning the error ending the session unless it was closed by the Host.
+func (g *Guest) ServeIO(w io.WriteCloser, r io.ReadCloser) error {
+	sess, err := mux.DialIO(w, r)
+	if err != nil {
+		return err
+	}
+	cd := g.Codec
+	if cd == nil {
+		cd = codec.JSONCodec{}
+	}
+	peer := talk.NewPeer(sess, cd)
+	peer.Handle(HandshakeSelector, rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var hs Handshake
+		if err := c.Receive(&hs); err != nil {
+			r.Return(err)
+			return
+		}
+		if g.OnHandshake != nil {
+			g.OnHandshake(hs)
+		}
+		r.Return(g.Handshake)
+	}))
+	if g.Handler != nil {
+		peer.Handle("", g.Handler)
+	}
+
+	g.mu.Lock()
+	g.peer = peer
+	g.mu.Unlock()
+
+	peer.Respond()
+	// the Host closing the session ends it with io.EOF
+	if err := sess.Wait(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Call makes a call to the Host while serving.
+func (g *Guest) Call(ctx context.Context, selector string, args any, replies ...any) (*rpc.Response, error) {
+	g.mu.Lock()
+	peer := g.peer
+	g.mu.Unlock()
+	if peer == nil {
+		return nil, ErrNotRunning
+	}
+	return peer.Call(ctx, selector, args, replies...)
+}
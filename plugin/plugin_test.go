@@ -0,0 +1,203 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+func TestMain(m *testing.M) {
+	switch os.Getenv("PLUGIN_TEST_GUEST") {
+	case "":
+	case "hang":
+		// never answers the handshake
+		select {}
+	default:
+		runGuest()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runGuest() {
+	mux := rpc.NewRespondMux()
+	mux.Handle("echo", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var in string
+		c.Receive(&in)
+		r.Return(in)
+	}))
+	mux.Handle("callback", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		c.Receive(nil)
+		var out string
+		if _, err := c.Caller.Call(c.Context, "host", nil, &out); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(out)
+	}))
+	mux.Handle("crash", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		os.Exit(1)
+	}))
+	g := &Guest{
+		Handshake: Handshake{Name: "guest", ProtocolVersion: 1, Features: []string{"b", "c"}},
+		Handler:   mux,
+	}
+	g.Serve()
+}
+
+func testHost(version int) *Host {
+	return &Host{
+		Cmd: func() *exec.Cmd {
+			cmd := exec.Command(os.Args[0], "-test.run=^$")
+			cmd.Env = append(os.Environ(), "PLUGIN_TEST_GUEST=1")
+			return cmd
+		},
+		Handshake: Handshake{Name: "host", ProtocolVersion: version, Features: []string{"a", "b"}},
+		Handler: rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+			r.Return("from host")
+		}),
+	}
+}
+
+func TestHost(t *testing.T) {
+	ctx := context.Background()
+	h := testHost(1)
+	if err := h.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if h.Remote().Name != "guest" {
+		t.Fatal("unexpected remote handshake:", h.Remote())
+	}
+	if f := h.Features(); len(f) != 1 || f[0] != "b" {
+		t.Fatal("unexpected features:", f)
+	}
+
+	var out string
+	if _, err := h.Call(ctx, "echo", "hello", &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != "hello" {
+		t.Fatal("unexpected return:", out)
+	}
+
+	if _, err := h.Call(ctx, "callback", nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != "from host" {
+		t.Fatal("unexpected return:", out)
+	}
+}
+
+func TestHostVersionMismatch(t *testing.T) {
+	h := testHost(2)
+	if err := h.Start(context.Background()); err == nil {
+		h.Close()
+		t.Fatal("expected error")
+	}
+}
+
+func TestHostRestart(t *testing.T) {
+	ctx := context.Background()
+	h := testHost(1)
+	h.MaxRestarts = 1
+	exited := make(chan error, 2)
+	h.OnExit = func(err error) { exited <- err }
+	if err := h.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	h.Call(ctx, "crash", nil, nil)
+	select {
+	case err := <-exited:
+		if err == nil {
+			t.Fatal("expected exit error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("plugin did not exit")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !h.Running() || h.Restarts() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("plugin did not restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var out string
+	if _, err := h.Call(ctx, "echo", "again", &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != "again" {
+		t.Fatal("unexpected return:", out)
+	}
+}
+
+func TestHostCloseDuringRestart(t *testing.T) {
+	ctx := context.Background()
+	var hang atomic.Bool
+	h := testHost(1)
+	h.Cmd = func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), "PLUGIN_TEST_GUEST=1")
+		if hang.Load() {
+			cmd.Env = append(os.Environ(), "PLUGIN_TEST_GUEST=hang")
+		}
+		return cmd
+	}
+	h.MaxRestarts = -1
+	h.HandshakeTimeout = 100 * time.Millisecond
+	if err := h.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	hang.Store(true)
+	h.Call(ctx, "crash", nil, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Restarts() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("plugin was not restarted")
+		}
+		// the host does not block while restarting
+		h.Running()
+		h.Remote()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- h.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("close did not return")
+	}
+	if h.Running() {
+		t.Fatal("plugin running after close")
+	}
+}
+
+type brokenPipe struct{}
+
+var errBroken = errors.New("broken")
+
+func (brokenPipe) Read(p []byte) (int, error)  { return 0, errBroken }
+func (brokenPipe) Write(p []byte) (int, error) { return len(p), nil }
+func (brokenPipe) Close() error                { return nil }
+
+func TestGuestServeError(t *testing.T) {
+	g := &Guest{}
+	err := g.ServeIO(brokenPipe{}, brokenPipe{})
+	if !errors.Is(err, errBroken) || !errors.Is(err, mux.ErrTransportClosed) {
+		t.Fatal("expected session error, got:", err)
+	}
+}
@@ -0,0 +1,116 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// AdaptiveLimit is a limit of the calls a Client makes at once that adapts
+// to how the server is coping, with additive increase and multiplicative
+// decrease (AIMD). Each call completing in time raises the limit by one
+// call per limit's worth of calls, and each congested call lowers it by
+// Backoff, so callers back off when the server degrades instead of piling
+// on. Calls beyond the limit are queued as with Client.MaxCalls:
+//
+//	client.Limiter = &rpc.AdaptiveLimit{Max: 64, Latency: 200 * time.Millisecond}
+//
+// Calls are congested if they take longer than Latency, or fail opening
+// their channel, time out or are rejected by a busy server. Errors returned
+// by handlers are not congestion. An AdaptiveLimit can be shared by the
+// clients of a server.
+type AdaptiveLimit struct {
+	// Min and Max bound the limit. If zero, they are 1 and 1000.
+	Min, Max int
+
+	// Initial is the limit to start from. If zero, it is Min.
+	Initial int
+
+	// Latency is the longest a call can take without being congested. If
+	// zero, it is twice the lowest latency observed, so the limit follows
+	// how much calls slow down.
+	Latency time.Duration
+
+	// Backoff is the factor the limit is multiplied by for congested
+	// calls. If zero, it is 0.9.
+	Backoff float64
+
+	mu     sync.Mutex
+	limit  float64
+	lowest time.Duration
+}
+
+func (l *AdaptiveLimit) bounds() (min, max float64) {
+	min, max = float64(l.Min), float64(l.Max)
+	if min <= 0 {
+		min = 1
+	}
+	if max <= 0 {
+		max = 1000
+	}
+	return min, math.Max(min, max)
+}
+
+// init sets the initial limit. It is called with l.mu held.
+func (l *AdaptiveLimit) init() {
+	if l.limit == 0 {
+		min, max := l.bounds()
+		l.limit = math.Min(math.Max(float64(l.Initial), min), max)
+	}
+}
+
+// Limit returns the current limit of calls in flight.
+func (l *AdaptiveLimit) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return int(l.limit)
+}
+
+// observe adjusts the limit to a completed call.
+func (l *AdaptiveLimit) observe(latency time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		// the caller gave up, which says nothing about the server
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	min, max := l.bounds()
+	if err == nil && (l.lowest == 0 || latency < l.lowest) {
+		l.lowest = latency
+	}
+	threshold := l.Latency
+	if threshold == 0 {
+		threshold = 2 * l.lowest
+	}
+	if congested(err) || (threshold > 0 && latency > threshold) {
+		backoff := l.Backoff
+		if backoff <= 0 || backoff >= 1 {
+			backoff = 0.9
+		}
+		l.limit = math.Max(min, l.limit*backoff)
+		return
+	}
+	l.limit = math.Min(max, l.limit+1/l.limit)
+}
+
+// congested returns whether err signals congestion rather than a failure of
+// the call itself.
+func congested(err error) bool {
+	var remote RemoteError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &remote):
+		return string(remote) == ErrBusy.Error()
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, mux.ErrOpenTimeout),
+		errors.Is(err, mux.ErrOpenRejected):
+		return true
+	}
+	return false
+}
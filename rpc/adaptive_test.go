@@ -0,0 +1,82 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+func TestAdaptiveLimit(t *testing.T) {
+	l := &AdaptiveLimit{Min: 2, Max: 12, Initial: 10, Latency: 10 * time.Millisecond}
+	if n := l.Limit(); n != 10 {
+		t.Fatalf("initial limit %d, expected 10", n)
+	}
+	for i := 0; i < 11; i++ {
+		l.observe(time.Millisecond, nil)
+	}
+	if n := l.Limit(); n != 11 {
+		t.Fatalf("limit %d after a window of fast calls, expected 11", n)
+	}
+	// handler errors and cancelled calls are not congestion
+	l.observe(time.Millisecond, RemoteError("not found"))
+	l.observe(time.Second, context.Canceled)
+	if n := l.Limit(); n != 11 {
+		t.Fatalf("limit %d after handler errors, expected 11", n)
+	}
+	for _, err := range []error{nil, RemoteError(ErrBusy.Error()), mux.ErrServerBusy, context.DeadlineExceeded} {
+		latency := time.Millisecond
+		if err == nil {
+			latency = time.Second
+		}
+		before := l.Limit()
+		l.observe(latency, err)
+		if n := l.Limit(); n >= before {
+			t.Fatalf("limit %d after congested call failing with %v, expected less than %d", n, err, before)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		l.observe(time.Second, nil)
+	}
+	if n := l.Limit(); n != 2 {
+		t.Fatalf("limit %d, expected the minimum", n)
+	}
+
+	// without a latency, calls are congested if twice the lowest latency
+	l = &AdaptiveLimit{Initial: 10}
+	l.observe(time.Millisecond, nil)
+	l.observe(time.Millisecond, errors.New("closed"))
+	before := l.Limit()
+	l.observe(3*time.Millisecond, nil)
+	if n := l.Limit(); n >= before {
+		t.Fatalf("limit %d after slow call, expected less than %d", n, before)
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	release := make(chan struct{})
+	client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		<-release
+		r.Return()
+	}))
+	defer client.Close()
+	client.Limiter = &AdaptiveLimit{Max: 1}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.Call(context.Background(), "block", nil)
+			errs <- err
+		}()
+	}
+	waitFor(t, func() bool {
+		active, queued := client.queue.stats()
+		return active == 1 && queued == 1
+	})
+	close(release)
+	fatal(t, <-errs)
+	fatal(t, <-errs)
+}
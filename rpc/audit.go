@@ -0,0 +1,268 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+)
+
+// AuditRecord is the record of a call written by an Auditor. Records form a
+// hash chain, each including the hash of the one before, so changing,
+// removing or reordering records is detected by VerifyAudit.
+type AuditRecord struct {
+	// Seq numbers the records of an Auditor from 1.
+	Seq       uint64
+	Time      time.Time
+	Identity  string `json:",omitempty"`
+	Selector  string
+	SessionID string
+	// ArgsDigest is the hex SHA-256 digest of the canonical JSON encoding
+	// of the argument values received by the handler, which records what
+	// was asked for without storing the arguments themselves.
+	ArgsDigest string
+	// Status is "ok", "continued", "error" or "panic", as for CallLog.
+	Status string
+	Error  string `json:",omitempty"`
+
+	// Prev is the Hash of the previous record, or empty for the first.
+	Prev string
+	// Hash is the hex SHA-256 digest of the canonical JSON encoding of the
+	// record without its Hash.
+	Hash string
+}
+
+// hash returns the Hash of r.
+func (r AuditRecord) hash() (string, error) {
+	r.Hash = ""
+	b, err := codec.CanonicalJSON(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditSink stores audit records, such as in an append-only file or by
+// calling a remote audit service.
+type AuditSink interface {
+	WriteAudit(r AuditRecord) error
+}
+
+// Auditor records the calls of the handlers it wraps to a sink, for
+// deployments that must account for who called what:
+//
+//	audit := &rpc.Auditor{
+//		Sink: rpc.AuditWriter(f),
+//		Identity: func(c *rpc.Call) string {
+//			return srv.Tags(c.Caller.(*rpc.Client).Session)["user"]
+//		},
+//	}
+//	mux.Handle("admin.", audit.Handler(admin))
+//
+// Records are written once the handler returns, in the order of the chain,
+// so a slow sink delays the response of every audited call. Errors writing
+// records are logged.
+type Auditor struct {
+	Sink AuditSink
+
+	// Identity, if set, returns the authenticated identity of the caller,
+	// such as a session tag set when authenticating it.
+	Identity func(c *Call) string
+
+	// ErrorLog specifies an optional logger for errors writing records.
+	// If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+
+	mu   sync.Mutex
+	seq  uint64
+	prev string
+}
+
+// Resume continues the chain of an existing log after its last record, so
+// an Auditor writing to the log of a previous run keeps it verifiable.
+func (a *Auditor) Resume(last AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq, a.prev = last.Seq, last.Hash
+}
+
+// Handler returns a handler recording the calls to h. A handler with a
+// Match method like a RespondMux keeps being registered as a submux, and
+// every handler it matches is recorded.
+func (a *Auditor) Handler(h Handler) Handler {
+	ah := &auditHandler{Handler: h, a: a}
+	if m, ok := h.(matcher); ok {
+		return &auditMatcher{auditHandler: ah, m: m}
+	}
+	return ah
+}
+
+type auditHandler struct {
+	Handler
+	a *Auditor
+}
+
+// auditMatcher is the auditHandler of a submux.
+type auditMatcher struct {
+	*auditHandler
+	m matcher
+}
+
+func (h *auditMatcher) Match(selector string) (Handler, string) {
+	sub, pattern := h.m.Match(selector)
+	if sub == nil {
+		return nil, ""
+	}
+	return &auditHandler{Handler: sub, a: h.a}, pattern
+}
+
+func (h *auditHandler) RespondRPC(r Responder, c *Call) {
+	rec := AuditRecord{
+		Time:      time.Now().UTC(),
+		Selector:  c.Selector,
+		SessionID: c.SessionID,
+	}
+	if h.a.Identity != nil {
+		rec.Identity = h.a.Identity(c)
+	}
+	args := &recordingDecoder{Decoder: c.Decoder}
+	c.Decoder = args
+	resp, _ := r.(*responder)
+
+	defer func() {
+		p := recover()
+		var l CallLog
+		if resp != nil {
+			if resp.header.Error != nil {
+				l.Error = *resp.header.Error
+			}
+			l.Continued = resp.header.Continue
+		}
+		if p != nil {
+			l.Panicked, l.Error = true, fmt.Sprint(p)
+		}
+		rec.Status, rec.Error = l.Status(), l.Error
+		digest := sha256.New()
+		for _, v := range args.values {
+			b, err := codec.CanonicalJSON(v)
+			if err != nil {
+				b = []byte(err.Error())
+			}
+			digest.Write(b)
+			digest.Write([]byte{'\n'})
+		}
+		rec.ArgsDigest = hex.EncodeToString(digest.Sum(nil))
+		if err := h.a.write(rec); err != nil {
+			h.a.logf("rpc: audit of %s: %v", c.Selector, err)
+		}
+		if p != nil {
+			panic(p)
+		}
+	}()
+	h.Handler.RespondRPC(r, c)
+}
+
+func (a *Auditor) write(rec AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec.Seq, rec.Prev = a.seq+1, a.prev
+	hash, err := rec.hash()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+	if err := a.Sink.WriteAudit(rec); err != nil {
+		return err
+	}
+	a.seq, a.prev = rec.Seq, rec.Hash
+	return nil
+}
+
+func (a *Auditor) logf(format string, args ...any) {
+	if a.ErrorLog != nil {
+		a.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// VerifyAudit checks records are an unbroken chain, each with a valid hash
+// and following the one before it. The first record may continue an
+// earlier part of the log.
+func VerifyAudit(records []AuditRecord) error {
+	for i, r := range records {
+		hash, err := r.hash()
+		if err != nil {
+			return err
+		}
+		if hash != r.Hash {
+			return fmt.Errorf("rpc: audit record %d has been altered", r.Seq)
+		}
+		if i > 0 && (r.Prev != records[i-1].Hash || r.Seq != records[i-1].Seq+1) {
+			return fmt.Errorf("rpc: audit record %d does not follow record %d", r.Seq, records[i-1].Seq)
+		}
+	}
+	return nil
+}
+
+// AuditWriter returns an AuditSink writing records to w as lines of JSON,
+// such as to a file opened for appending.
+func AuditWriter(w io.Writer) AuditSink {
+	return &auditWriter{enc: json.NewEncoder(w)}
+}
+
+type auditWriter struct {
+	enc *json.Encoder
+}
+
+func (w *auditWriter) WriteAudit(r AuditRecord) error {
+	return w.enc.Encode(r)
+}
+
+// ReadAudit reads the records written by AuditWriter from r.
+func ReadAudit(r io.Reader) ([]AuditRecord, error) {
+	var records []AuditRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec AuditRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// AuditCaller returns an AuditSink calling selector with each record, such
+// as on a session with a remote audit service.
+func AuditCaller(c Caller, selector string, timeout time.Duration) AuditSink {
+	return &auditCaller{c: c, selector: selector, timeout: timeout}
+}
+
+type auditCaller struct {
+	c        Caller
+	selector string
+	timeout  time.Duration
+}
+
+func (s *auditCaller) WriteAudit(r AuditRecord) error {
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	_, err := s.c.Call(ctx, s.selector, r)
+	return err
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestAuditor(t *testing.T) {
+	var log syncBuffer
+	audit := &Auditor{
+		Sink:     AuditWriter(&log),
+		Identity: func(c *Call) string { return "alice" },
+	}
+	client, _ := newTestPair(audit.Handler(HandlerFunc(func(r Responder, c *Call) {
+		var n int
+		if err := c.Receive(&n); err != nil {
+			r.Return(err)
+			return
+		}
+		if n < 0 {
+			r.Return(errors.New("negative"))
+			return
+		}
+		r.Return(n)
+	})))
+	defer client.Close()
+
+	ctx := context.Background()
+	for _, n := range []int{1, -1, 1} {
+		client.Call(ctx, "delete", n)
+	}
+	// records are written once the handler returned, after responding
+	var records []AuditRecord
+	for i := 0; i < 1000 && len(records) < 3; i++ {
+		var err error
+		records, err = ReadAudit(bytes.NewReader(log.Bytes()))
+		fatal(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	if len(records) != 3 {
+		t.Fatalf("%d records, expected 3", len(records))
+	}
+	fatal(t, VerifyAudit(records))
+	first, second, third := records[0], records[1], records[2]
+	if first.Seq != 1 || first.Identity != "alice" || first.Selector != "/delete" || first.Status != "ok" || first.Prev != "" {
+		t.Fatalf("unexpected record: %+v", first)
+	}
+	if second.Status != "error" || second.Error != "negative" || second.ArgsDigest == first.ArgsDigest {
+		t.Fatalf("unexpected record: %+v", second)
+	}
+	if third.ArgsDigest != first.ArgsDigest {
+		t.Fatal("digests of equal args differ")
+	}
+
+	altered := append([]AuditRecord(nil), records...)
+	altered[1].Status = "ok"
+	if err := VerifyAudit(altered); err == nil {
+		t.Fatal("altered record verified")
+	}
+	if err := VerifyAudit([]AuditRecord{first, third}); err == nil {
+		t.Fatal("chain with removed record verified")
+	}
+	if err := VerifyAudit(records[1:]); err != nil {
+		t.Fatal("part of the chain failed to verify:", err)
+	}
+
+	// a resumed auditor continues the chain
+	var next syncBuffer
+	resumed := &Auditor{Sink: AuditWriter(&next)}
+	resumed.Resume(third)
+	fatal(t, resumed.write(AuditRecord{Selector: "/next"}))
+	more, err := ReadAudit(bytes.NewReader(next.Bytes()))
+	fatal(t, err)
+	fatal(t, VerifyAudit(append(records, more...)))
+}
+
+func TestAuditCaller(t *testing.T) {
+	records := make(chan AuditRecord, 1)
+	client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+		var rec AuditRecord
+		if err := c.Receive(&rec); err != nil {
+			r.Return(err)
+			return
+		}
+		records <- rec
+		r.Return()
+	}))
+	defer client.Close()
+
+	audit := &Auditor{Sink: AuditCaller(client, "audit.write", 0)}
+	fatal(t, audit.write(AuditRecord{Selector: "/delete", Status: "ok"}))
+	if rec := <-records; rec.Seq != 1 || VerifyAudit([]AuditRecord{rec}) != nil {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+}
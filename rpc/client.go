@@ -3,6 +3,9 @@ package rpc
 import (
 	"context"
 	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/roachadam/qtalk-go/codec"
 	"github.com/roachadam/qtalk-go/mux"
@@ -20,6 +23,35 @@ func (e RemoteError) Error() string {
 type Client struct {
 	mux.Session
 	codec codec.Codec
+
+	// ValidateReply, if set, is called with the response of each call whose
+	// replies were decoded successfully, before Call returns. If it returns an
+	// error, Call returns that error with the response. It can be used to check
+	// replies from untrusted peers against a schema or invariants.
+	ValidateReply func(selector string, resp *Response) error
+
+	// MaxCalls, if positive, limits the calls in flight at once, so when
+	// the session is congested further calls wait in a queue in order of
+	// their priority, set with WithPriority, rather than all waiting on
+	// channel opens alike. Queued calls fail once their context is done.
+	// A call is in flight until Call returns. It is ignored if Limiter is
+	// set.
+	MaxCalls int
+
+	// Limiter, if set, adapts the calls in flight at once to the latency
+	// and errors of calls, instead of MaxCalls.
+	Limiter *AdaptiveLimit
+
+	// MaxQueued, if positive, limits the calls waiting for one of MaxCalls.
+	// When the queue is full, the queued call of lowest priority fails with
+	// ErrCallShed, or the new call if none has a lower priority.
+	MaxQueued int
+
+	// TraceStream, if set, is called with the values sent and received with
+	// the Response of continued calls.
+	TraceStream StreamTracer
+
+	queue callQueue
 }
 
 // NewClient takes a session and codec to make a client for making RPC calls.
@@ -33,7 +65,10 @@ func NewClient(session mux.Session, codec codec.Codec) *Client {
 // Call makes synchronous calls to the remote selector passing args and putting the reply
 // value in reply. Both args and reply can be nil. Args can be a channel of interface{}
 // values for asynchronously streaming multiple values from another goroutine, however
-// the call will still block until a response is sent. If there is an error making the call
+// the call will still block until a response is sent. Args can also be a function
+// yielding values, such as an iter.Seq[any], to stream values without a goroutine and
+// channel. Values are sent as they are yielded until it returns or the call fails.
+// If there is an error making the call
 // an error is returned, and if an error is returned by the remote handler a RemoteError
 // is returned.
 //
@@ -41,14 +76,94 @@ func NewClient(session mux.Session, codec codec.Codec) *Client {
 // if the call is continued, meaning the underlying channel will be kept open for either
 // streaming back more results or using the channel as a full duplex byte stream.
 func (c *Client) Call(ctx context.Context, selector string, args any, replies ...any) (*Response, error) {
-	ch, err := c.Session.Open(ctx)
+	if max := c.maxCalls(); max > 0 {
+		if err := c.queue.acquire(ctx, max, c.MaxQueued); err != nil {
+			return nil, err
+		}
+		defer func() { c.queue.release(c.maxCalls()) }()
+	}
+	start := time.Now()
+	resp, err := sessionCall(ctx, c.Session, c.codec, selector, args, replies...)
+	if c.Limiter != nil {
+		c.Limiter.observe(time.Since(start), err)
+	}
+	if err == nil && c.TraceStream != nil && resp.Continue {
+		resp.trace = &streamTrace{
+			ctx:       ctx,
+			tracer:    c.TraceStream,
+			selector:  cleanSelector(selector),
+			sessionID: resp.SessionID,
+			channelID: resp.ChannelID,
+			counter:   resp.counter,
+		}
+	}
+	if err == nil && c.ValidateReply != nil {
+		err = c.ValidateReply(selector, resp)
+	}
+	return resp, err
+}
+
+// maxCalls returns the limit of calls in flight, or zero if unlimited.
+func (c *Client) maxCalls() int {
+	if c.Limiter != nil {
+		return c.Limiter.Limit()
+	}
+	return c.MaxCalls
+}
+
+// sessionCall opens a channel on sess to make a call. The channel is closed
+// to abort the call if ctx is done before it returns, in which case the
+// context error is returned.
+func sessionCall(ctx context.Context, sess mux.Session, cd codec.Codec, selector string, args any, replies ...any) (*Response, error) {
+	start := time.Now()
+	ch, err := sess.Open(ctx)
 	if err != nil {
 		return nil, err
 	}
-	// If the context is cancelled before the call completes, call Close() to
-	// abort the current operation.
+	defer closeOnDone(ctx, ch)()
+	resp, err := call(ctx, ch, cd, argCounts(sess), selector, args, replies...)
+	if resp != nil {
+		resp.Duration = time.Since(start)
+		resp.SessionID = sessionID(sess)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return resp, ctxErr
+	}
+	return resp, err
+}
+
+// countingChannel counts the bytes written to and read from a channel.
+type countingChannel struct {
+	mux.Channel
+	sent, received atomic.Int64
+}
+
+func (c *countingChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+func (c *countingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+// OnClose implements mux.CloseNotifier if the channel does, so the
+// channels of calls handed out by Continue can notify their closing.
+func (c *countingChannel) OnClose(f func()) {
+	onClose(c.Channel, f)
+}
+
+// closeOnDone closes ch if ctx is done before the returned function is
+// called, to abort the current operation. Contexts that are never done
+// don't start a goroutine.
+func closeOnDone(ctx context.Context, ch mux.Channel) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
 	done := make(chan struct{})
-	defer close(done)
 	go func() {
 		select {
 		case <-ctx.Done():
@@ -56,36 +171,119 @@ func (c *Client) Call(ctx context.Context, selector string, args any, replies ..
 		case <-done:
 		}
 	}()
-	resp, err := call(ctx, ch, c.codec, selector, args, replies...)
-	if ctxErr := ctx.Err(); ctxErr != nil {
-		return resp, ctxErr
+	return func() { close(done) }
+}
+
+// argCounts returns whether calls on sess send the number of arguments in
+// the call header and end streamed arguments with an empty frame, which is
+// only done when negotiated with the peer for compatibility.
+func argCounts(sess mux.Session) bool {
+	n, ok := sess.(mux.Negotiator)
+	if !ok {
+		return false
 	}
-	return resp, err
+	_, features := n.Protocol()
+	return features.Has(mux.FeatureCallArgs)
+}
+
+// remoteChannelID returns the remote ID of ch, or zero if it is not a
+// mux.RemoteIDer.
+func remoteChannelID(ch mux.Channel) uint32 {
+	if r, ok := ch.(mux.RemoteIDer); ok {
+		return r.RemoteID()
+	}
+	return 0
+}
+
+// sessionID returns the ID of sess, or "" if it is not a mux.Identifier.
+func sessionID(sess mux.Session) string {
+	if id, ok := sess.(mux.Identifier); ok {
+		return id.ID()
+	}
+	return ""
+}
+
+// seqOf returns args as a function yielding the values to stream, if it is
+// one. Iterators are accepted as their own type when supported.
+func seqOf(args any) (func(yield func(any) bool), bool) {
+	if seq, ok := args.(func(yield func(any) bool)); ok {
+		return seq, true
+	}
+	return iterSeqOf(args)
 }
 
-func call(ctx context.Context, ch mux.Channel, cd codec.Codec, selector string, args any, replies ...any) (*Response, error) {
-	framer := &FrameCodec{Codec: cd}
-	enc := framer.Encoder(ch)
-	dec := framer.Decoder(ch)
+// clientCall holds the state of a call, allocated with its Response.
+type clientCall struct {
+	resp    Response
+	header  CallHeader
+	framer  FrameCodec
+	counter countingChannel
+	enc     frameEncoder
+	dec     frameDecoder
+}
+
+func call(ctx context.Context, ch mux.Channel, cd codec.Codec, counted bool, selector string, args any, replies ...any) (*Response, error) {
+	cc := &clientCall{}
+	cc.framer.Codec = cd
+	cc.counter.Channel = ch
+	cc.enc = frameEncoder{w: &cc.counter, c: cd}
+	cc.dec = frameDecoder{r: &cc.counter, c: cd}
+	counter, enc, dec := &cc.counter, &cc.enc, &cc.dec
 
 	// request
-	err := enc.Encode(CallHeader{
-		Selector: selector,
-	})
+	argCh, isChan := args.(chan interface{})
+	argSeq, isSeq := seqOf(args)
+	cc.header = CallHeader{Selector: selector, Chain: callChain(ctx)}
+	switch {
+	case counted && (isChan || isSeq):
+		cc.header.Args = streamArgs
+	case counted:
+		cc.header.Args = 1
+	}
+	err := enc.Encode(&cc.header)
 	if err != nil {
 		ch.Close()
 		return nil, err
 	}
 
-	argCh, isChan := args.(chan interface{})
 	switch {
 	case isChan:
-		for arg := range argCh {
-			if err := enc.Encode(arg); err != nil {
+	stream:
+		for {
+			// the sender of args may stall, so ctx is watched directly
+			select {
+			case arg, ok := <-argCh:
+				if !ok {
+					break stream
+				}
+				if err := enc.Encode(arg); err != nil {
+					ch.Close()
+					return nil, err
+				}
+			case <-ctx.Done():
 				ch.Close()
-				return nil, err
+				return nil, ctx.Err()
 			}
 		}
+		// the handler may have already responded and closed the channel,
+		// in which case the response is still read below
+		if counted {
+			counter.Write(endFrame)
+		}
+	case isSeq:
+		argSeq(func(arg any) bool {
+			if err = ctx.Err(); err == nil {
+				err = enc.Encode(arg)
+			}
+			return err == nil
+		})
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+		if counted {
+			counter.Write(endFrame)
+		}
 	default:
 		if err := enc.Encode(args); err != nil {
 			ch.Close()
@@ -94,22 +292,28 @@ func call(ctx context.Context, ch mux.Channel, cd codec.Codec, selector string,
 	}
 
 	// response
-	var header ResponseHeader
-	err = dec.Decode(&header)
+	resp := &cc.resp
+	err = dec.Decode(&resp.ResponseHeader)
 	if err != nil {
 		ch.Close()
 		return nil, err
 	}
 
-	if !header.Continue {
+	if !resp.Continue {
 		defer ch.Close()
 	}
 
-	resp := &Response{
-		ResponseHeader: header,
-		Channel:        ch,
-		codec:          framer,
-	}
+	resp.Channel = ch
+	resp.ChannelID = ch.ID()
+	resp.RemoteChannelID = remoteChannelID(ch)
+	resp.codec = &cc.framer
+	resp.enc = enc
+	resp.dec = dec
+	resp.counter = counter
+	defer func() {
+		resp.BytesSent = counter.sent.Load()
+		resp.BytesReceived = counter.received.Load()
+	}()
 	if len(replies) == 1 {
 		resp.Reply = replies[0]
 	} else if len(replies) > 1 {
@@ -123,13 +327,60 @@ func call(ctx context.Context, ch mux.Channel, cd codec.Codec, selector string,
 		// read into throwaway buffer
 		var buf []byte
 		dec.Decode(&buf)
-	} else {
-		for _, r := range replies {
-			if err := dec.Decode(r); err != nil {
-				return resp, err
-			}
+	} else if err := decodeReplies(dec, replies); err != nil {
+		if resp.Continue {
+			ch.Close()
 		}
+		return resp, err
 	}
 
 	return resp, nil
 }
+
+// ReplyError is returned by calls when replies fail to decode. The replies
+// that could be read are still decoded, so Failed tells which are valid, and
+// the channel of the call is closed.
+type ReplyError struct {
+	// Index is the first reply that failed, and Failed all of them, which
+	// includes the replies not received when the channel ended.
+	Index  int
+	Failed []int
+	// Replies is the number of replies of the call.
+	Replies int
+	Err     error
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("rpc: decoding reply %d of %d: %v", e.Index+1, e.Replies, e.Err)
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// decodeReplies decodes each frame into the reply for it, draining the
+// frames of all replies even if some fail to decode.
+func decodeReplies(dec *frameDecoder, replies []any) error {
+	var rerr *ReplyError
+	var ended bool
+	for i, r := range replies {
+		// no frame is left to read once the stream of values ended or the
+		// channel failed
+		var err error
+		if !ended {
+			err = dec.Decode(r)
+			ended = err == io.EOF || dec.readErr != nil
+		}
+		if err == nil && !ended {
+			continue
+		}
+		if rerr == nil {
+			rerr = &ReplyError{Index: i, Replies: len(replies), Err: err}
+		}
+		rerr.Failed = append(rerr.Failed, i)
+	}
+	if rerr == nil {
+		return nil
+	}
+	return rerr
+}
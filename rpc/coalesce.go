@@ -0,0 +1,183 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+)
+
+// CoalescingCaller is a Caller that collapses concurrent identical calls,
+// with the same selector, args and types of replies, into a single call
+// whose reply is shared, so bursts of calls to expensive handlers only run
+// them once:
+//
+//	c := &rpc.CoalescingCaller{Caller: client}
+//	c.Call(ctx, "report.build", args, &report)
+//
+// Args are compared by their canonical JSON encoding, and calls with args
+// that are streamed or cannot be encoded as JSON are not coalesced. Each
+// caller receives its own copy of the reply values, copied by encoding them
+// with encoding/json, and its own Response without a Channel.
+//
+// The shared call is made with the context of the first call, but is only
+// cancelled once all the calls waiting for it are cancelled. Calls
+// continued by the handler can't be shared, so their callers make their
+// calls separately.
+type CoalescingCaller struct {
+	Caller
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call shared by the calls waiting for it.
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	resp    *Response
+	replies []any
+	err     error
+}
+
+// Call makes a call, or waits for an identical call in flight to share its
+// reply.
+func (c *CoalescingCaller) Call(ctx context.Context, selector string, args any, replies ...any) (*Response, error) {
+	key, ok := coalesceKey(selector, args, replies)
+	if !ok {
+		return c.Caller.Call(ctx, selector, args, replies...)
+	}
+
+	c.mu.Lock()
+	if c.flights == nil {
+		c.flights = make(map[string]*flight)
+	}
+	f, ok := c.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		var fctx context.Context
+		fctx, f.cancel = context.WithCancel(detachedContext{ctx})
+		c.flights[key] = f
+		go c.fly(fctx, key, f, selector, args, replies)
+	}
+	f.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		c.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			// later calls make a new call instead of sharing a cancelled one
+			f.cancel()
+			if c.flights[key] == f {
+				delete(c.flights, key)
+			}
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+	if f.resp != nil && f.resp.Continue {
+		return c.Caller.Call(ctx, selector, args, replies...)
+	}
+	if f.err == nil {
+		for i, r := range replies {
+			if r == nil {
+				continue
+			}
+			if err := copyReply(r, f.replies[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var resp *Response
+	if f.resp != nil {
+		shared := *f.resp
+		resp = &shared
+		resp.Reply = nil
+		if len(replies) == 1 {
+			resp.Reply = replies[0]
+		} else if len(replies) > 1 {
+			resp.Reply = replies
+		}
+	}
+	return resp, f.err
+}
+
+// fly makes the shared call of f, decoding into new values of the types of
+// replies.
+func (c *CoalescingCaller) fly(ctx context.Context, key string, f *flight, selector string, args any, replies []any) {
+	f.replies = make([]any, len(replies))
+	for i, r := range replies {
+		if r != nil {
+			f.replies[i] = reflect.New(reflect.TypeOf(r).Elem()).Interface()
+		}
+	}
+	f.resp, f.err = c.Caller.Call(ctx, selector, args, f.replies...)
+	if f.resp != nil {
+		if f.resp.Continue && f.resp.Channel != nil {
+			f.resp.Channel.Close()
+		}
+		f.resp.Channel = nil
+	}
+
+	c.mu.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mu.Unlock()
+	f.cancel()
+	close(f.done)
+}
+
+// coalesceKey returns the key identical calls share, or false if the call
+// can't be coalesced.
+func coalesceKey(selector string, args any, replies []any) (string, bool) {
+	if _, ok := args.(chan interface{}); ok {
+		return "", false
+	}
+	if _, ok := seqOf(args); ok {
+		return "", false
+	}
+	b, err := codec.CanonicalJSON(args)
+	if err != nil {
+		return "", false
+	}
+	var key strings.Builder
+	key.WriteString(cleanSelector(selector))
+	key.WriteByte(0)
+	key.Write(b)
+	for _, r := range replies {
+		if r != nil && reflect.TypeOf(r).Kind() != reflect.Pointer {
+			return "", false
+		}
+		fmt.Fprintf(&key, "\x00%T", r)
+	}
+	return key.String(), true
+}
+
+// copyReply copies the shared reply into the reply of a caller.
+func copyReply(dst, src any) error {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// detachedContext keeps the values of a context without its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (c detachedContext) Value(key any) any         { return c.parent.Value(key) }
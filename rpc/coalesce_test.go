@@ -0,0 +1,125 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingCaller replies with its args once released, counting its calls.
+type blockingCaller struct {
+	release chan struct{}
+	calls   int32
+}
+
+func (c *blockingCaller) Call(ctx context.Context, selector string, args any, replies ...any) (*Response, error) {
+	atomic.AddInt32(&c.calls, 1)
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	b, _ := json.Marshal(args)
+	for _, r := range replies {
+		json.Unmarshal(b, r)
+	}
+	return &Response{}, nil
+}
+
+func (c *CoalescingCaller) waiting(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f := c.flights[key]; f != nil {
+		return f.waiters
+	}
+	return 0
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalescingCaller(t *testing.T) {
+	inner := &blockingCaller{release: make(chan struct{})}
+	c := &CoalescingCaller{Caller: inner}
+	key, _ := coalesceKey("report", map[string]int{"a": 1, "b": 2}, []any{new(map[string]int)})
+
+	var wg sync.WaitGroup
+	replies := make([]map[string]int, 5)
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// equal args in another order are identical
+			args := map[string]any{"b": 2, "a": 1}
+			if _, err := c.Call(context.Background(), "report", args, &replies[i]); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	// a cancelled call doesn't cancel the shared call
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := c.Call(ctx, "report", map[string]int{"a": 1, "b": 2}, new(map[string]int))
+		errs <- err
+	}()
+	waitFor(t, func() bool { return c.waiting(key) == 6 })
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatal("unexpected error:", err)
+	}
+
+	close(inner.release)
+	wg.Wait()
+	if calls := atomic.LoadInt32(&inner.calls); calls != 1 {
+		t.Fatalf("%d calls made, expected 1", calls)
+	}
+	replies[0]["a"] = 3
+	for _, r := range replies[1:] {
+		if r["a"] != 1 || r["b"] != 2 {
+			t.Fatal("unexpected reply:", r)
+		}
+	}
+
+	// calls after the shared call returned make a new call
+	var reply map[string]int
+	_, err := c.Call(context.Background(), "report", map[string]int{"a": 1}, &reply)
+	fatal(t, err)
+	if calls := atomic.LoadInt32(&inner.calls); calls != 2 || reply["a"] != 1 {
+		t.Fatalf("%d calls made replying %v", calls, reply)
+	}
+}
+
+func TestCoalescingCallerCancel(t *testing.T) {
+	inner := &blockingCaller{release: make(chan struct{})}
+	c := &CoalescingCaller{Caller: inner}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := c.Call(ctx, "report", nil)
+		errs <- err
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt32(&inner.calls) == 1 })
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatal("unexpected error:", err)
+	}
+	// the cancelled call is not shared with later calls
+	close(inner.release)
+	_, err := c.Call(context.Background(), "report", nil)
+	fatal(t, err)
+	if calls := atomic.LoadInt32(&inner.calls); calls != 2 {
+		t.Fatalf("%d calls made, expected 2", calls)
+	}
+}
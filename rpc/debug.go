@@ -0,0 +1,76 @@
+package rpc
+
+import (
+	"sort"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// DebugSelector is the conventional selector used to register the
+// DebugHandler of a Server.
+const DebugSelector = "qtalk.debug"
+
+// SessionDebug is the debug information of a session in the reply of a
+// DebugHandler.
+type SessionDebug struct {
+	ID         string
+	RemoteAddr string            `json:",omitempty"`
+	Tags       map[string]string `json:",omitempty"`
+
+	// Events are the recent events of the session, kept if it was created
+	// with mux.SessionConfig.EventLog set.
+	Events []mux.Event `json:",omitempty"`
+}
+
+// DebugHandler returns a handler that replies with a SessionDebug for each
+// session being served whose tags match the query given as argument, sorted
+// by session ID. The query is the same as for FindSessions, and no
+// argument matches all sessions. It can be used to find out what happened on
+// the session of a peer reporting a stuck stream:
+//
+//	mux.Handle(rpc.DebugSelector, srv.DebugHandler())
+//
+// The reply describes the peers of the server, so the handler should only be
+// reachable by operators, such as by checking the tags of the caller.
+func (s *Server) DebugHandler() Handler {
+	return HandlerFunc(func(r Responder, c *Call) {
+		var query string
+		if err := c.Receive(&query); err != nil {
+			r.Return(err)
+			return
+		}
+		match, err := parseTagQuery(query)
+		if err != nil {
+			r.Return(err)
+			return
+		}
+		s.mu.Lock()
+		var sessions []SessionDebug
+		for _, served := range s.sessions {
+			if !match(served.tags) {
+				continue
+			}
+			d := SessionDebug{ID: sessionID(served.sess)}
+			if len(served.tags) > 0 {
+				d.Tags = make(map[string]string, len(served.tags))
+				for k, v := range served.tags {
+					d.Tags[k] = v
+				}
+			}
+			if ra, ok := served.sess.(mux.RemoteAddrer); ok {
+				if addr := ra.RemoteAddr(); addr != nil {
+					d.RemoteAddr = addr.String()
+				}
+			}
+			if el, ok := served.sess.(mux.EventLogger); ok {
+				d.Events = el.Events()
+			}
+			sessions = append(sessions, d)
+		}
+		s.mu.Unlock()
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].ID < sessions[j].ID
+		})
+		r.Return(sessions)
+	})
+}
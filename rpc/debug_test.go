@@ -0,0 +1,62 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+func TestServerDebugHandler(t *testing.T) {
+	ctx := context.Background()
+
+	srv := &Server{Codec: codec.JSONCodec{}}
+	m := NewRespondMux()
+	m.Handle(DebugSelector, srv.DebugHandler())
+	m.Handle("login", HandlerFunc(func(r Responder, c *Call) {
+		var name string
+		fatal(t, c.Receive(&name))
+		srv.Tag(c.Caller.(*Client).Session, "name", name)
+		r.Return()
+	}))
+	srv.Handler = m
+
+	login := func(name string) *Client {
+		ar, bw := io.Pipe()
+		br, aw := io.Pipe()
+		sessA := mux.NewWithConfig(pipeConn{ar, aw}, &mux.SessionConfig{EventLog: 16})
+		go srv.Respond(sessA, nil)
+		client := NewClient(mux.New(pipeConn{br, bw}), codec.JSONCodec{})
+		_, err := client.Call(ctx, "login", name)
+		fatal(t, err)
+		return client
+	}
+	a := login("a")
+	defer a.Close()
+	b := login("b")
+	defer b.Close()
+
+	var sessions []SessionDebug
+	_, err := a.Call(ctx, DebugSelector, nil, &sessions)
+	fatal(t, err)
+	if len(sessions) != 2 || sessions[0].ID > sessions[1].ID {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+
+	_, err = a.Call(ctx, DebugSelector, "name=b", &sessions)
+	fatal(t, err)
+	if len(sessions) != 1 || sessions[0].Tags["name"] != "b" {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+	// the login call opened and closed a channel
+	events := sessions[0].Events
+	if len(events) != 2 || events[0].Kind != mux.EventOpen || events[1].Kind != mux.EventClose || !events[0].Inbound {
+		t.Fatalf("unexpected events: %v", events)
+	}
+
+	if _, err := a.Call(ctx, DebugSelector, "=x", &sessions); err == nil {
+		t.Fatal("expected invalid query error")
+	}
+}
@@ -4,14 +4,49 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"sync"
 
 	"github.com/roachadam/qtalk-go/codec"
 )
 
 // FrameCodec is a special codec used to actually read/write other
-// codecs to a transport using a length prefix.
+// codecs to a transport using a length prefix. Frames are buffered in
+// pooled buffers, so the embedded codec should not retain the Writer or
+// Reader it is given beyond encoding or decoding a single value. Each frame
+// is encoded and decoded independently of the others, by a new Encoder or
+// Decoder of the embedded codec, or by the one of the previous frame after
+// resetting it if it implements codec.ResetEncoder or codec.ResetDecoder.
+//
+// Frames of at least StreamSize bytes are decoded by the embedded codec
+// directly from the Reader, limited to the frame, instead of being read into
+// a buffer first. This avoids holding both the encoding and the decoded value
+// of large values in memory, unless the codec implements codec.Buffered and
+// needs the whole frame. If StreamSize is zero, frames larger than 64KiB are
+// streamed, and a negative value disables streaming.
 type FrameCodec struct {
 	codec.Codec
+	StreamSize int
+}
+
+// maxPooledFrame is the largest frame buffer kept in framePool, so a few
+// large values don't keep their buffers alive indefinitely.
+const maxPooledFrame = 1 << 16
+
+// framePool holds buffers used to encode and decode frames.
+var framePool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getFrameBuffer() *bytes.Buffer {
+	buf := framePool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putFrameBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledFrame {
+		framePool.Put(buf)
+	}
 }
 
 // Encoder returns a frame encoder that first encodes a value
@@ -28,19 +63,41 @@ func (c *FrameCodec) Encoder(w io.Writer) codec.Encoder {
 type frameEncoder struct {
 	w io.Writer
 	c codec.Codec
+
+	// enc is the resettable encoder of the embedded codec, if it has one
+	enc codec.ResetEncoder
+}
+
+// encoder returns an encoder of the embedded codec writing to w.
+func (e *frameEncoder) encoder(w io.Writer) codec.Encoder {
+	if e.enc != nil {
+		e.enc.Reset(w)
+		return e.enc
+	}
+	enc := e.c.Encoder(w)
+	e.enc, _ = enc.(codec.ResetEncoder)
+	return enc
 }
 
 func (e *frameEncoder) Encode(v interface{}) error {
-	var buf bytes.Buffer
-	enc := e.c.Encoder(&buf)
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf)
+
+	// reserve the length prefix so the frame is written with one Write
+	var prefix [4]byte
+	buf.Write(prefix[:])
+	enc := e.encoder(buf)
 	err := enc.Encode(v)
+	if e.enc != nil {
+		// don't keep the pooled buffer
+		e.enc.Reset(nil)
+	}
 	if err != nil {
 		return err
 	}
 	b := buf.Bytes()
-	prefix := make([]byte, 4)
-	binary.BigEndian.PutUint32(prefix, uint32(len(b)))
-	_, err = e.w.Write(append(prefix, b...))
+	binary.BigEndian.PutUint32(b, uint32(len(b)-len(prefix)))
+	_, err = e.w.Write(b)
 	if err != nil {
 		return err
 	}
@@ -52,30 +109,128 @@ func (e *frameEncoder) Encode(v interface{}) error {
 // embedded codec to decode those bytes into a value.
 func (c *FrameCodec) Decoder(r io.Reader) codec.Decoder {
 	return &frameDecoder{
-		r: r,
-		c: c.Codec,
+		r:          r,
+		c:          c.Codec,
+		streamSize: c.StreamSize,
 	}
 }
 
+// endFrame is an empty frame, which ends a stream of values.
+var endFrame = []byte{0, 0, 0, 0}
+
 type frameDecoder struct {
-	r io.Reader
-	c codec.Codec
+	r          io.Reader
+	c          codec.Codec
+	streamSize int
+	prefix     [4]byte
+	peeked     bool
+	frame      bytes.Reader
+
+	// dec is the resettable decoder of the embedded codec, if it has one
+	dec codec.ResetDecoder
+
+	// readErr is the last error reading from r, after which frames are no
+	// longer aligned, as opposed to errors of the codec decoding a frame
+	readErr error
+}
+
+// decoder returns a decoder of the embedded codec reading from r.
+func (d *frameDecoder) decoder(r io.Reader) codec.Decoder {
+	if d.dec != nil {
+		d.dec.Reset(r)
+		return d.dec
+	}
+	dec := d.c.Decoder(r)
+	d.dec, _ = dec.(codec.ResetDecoder)
+	return dec
+}
+
+// streams returns whether a frame of size bytes is decoded from the reader.
+func (d *frameDecoder) streams(size uint32) bool {
+	threshold := d.streamSize
+	switch {
+	case threshold < 0:
+		return false
+	case threshold == 0:
+		threshold = maxPooledFrame + 1
+	}
+	if int64(size) < int64(threshold) {
+		return false
+	}
+	b, ok := d.c.(codec.Buffered)
+	return !ok || !b.Buffered()
+}
+
+// decodeStream decodes a frame of size bytes from the reader, discarding
+// any of it left unread by the codec to keep the following frames aligned.
+func (d *frameDecoder) decodeStream(size uint32, v interface{}) error {
+	lr := &io.LimitedReader{R: d.r, N: int64(size)}
+	err := d.decoder(lr).Decode(v)
+	_, cerr := io.Copy(io.Discard, lr)
+	if cerr == nil && lr.N > 0 {
+		cerr = io.ErrUnexpectedEOF
+	}
+	if cerr != nil {
+		d.readErr = cerr
+	}
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// peek reads the length of the next frame without consuming the frame.
+func (d *frameDecoder) peek() (uint32, error) {
+	if !d.peeked {
+		if _, err := io.ReadFull(d.r, d.prefix[:]); err != nil {
+			d.readErr = err
+			return 0, err
+		}
+		d.peeked = true
+	}
+	return binary.BigEndian.Uint32(d.prefix[:]), nil
+}
+
+// unread returns the length prefix read by peek, if any, for reading the
+// frame directly from the underlying reader.
+func (d *frameDecoder) unread() []byte {
+	if !d.peeked {
+		return nil
+	}
+	d.peeked = false
+	prefix := d.prefix
+	return prefix[:]
 }
 
+// Decode decodes the next frame into v. It returns io.EOF for an empty
+// frame ending a stream of values.
 func (d *frameDecoder) Decode(v interface{}) error {
-	prefix := make([]byte, 4)
-	_, err := io.ReadFull(d.r, prefix)
+	size, err := d.peek()
 	if err != nil {
 		return err
 	}
-	size := binary.BigEndian.Uint32(prefix)
-	buf := make([]byte, size)
-	_, err = io.ReadFull(d.r, buf)
+	d.peeked = false
+	if size == 0 {
+		return io.EOF
+	}
+	if d.streams(size) {
+		return d.decodeStream(size, v)
+	}
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf)
+	buf.Grow(int(size))
+	b := buf.Bytes()[:size]
+	_, err = io.ReadFull(d.r, b)
 	if err != nil {
+		d.readErr = err
 		return err
 	}
-	dec := d.c.Decoder(bytes.NewBuffer(buf))
-	err = dec.Decode(v)
+	if u, ok := d.c.(codec.Unmarshaler); ok {
+		return u.Unmarshal(b, v)
+	}
+	d.frame.Reset(b)
+	err = d.decoder(&d.frame).Decode(v)
+	d.frame.Reset(nil)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,206 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+)
+
+// decoderOnly hides the Unmarshal method of a codec.
+type decoderOnly struct {
+	codec.Codec
+}
+
+func TestFrameCodec(t *testing.T) {
+	for _, cd := range []codec.Codec{codec.JSONCodec{}, decoderOnly{codec.JSONCodec{}}} {
+		var buf bytes.Buffer
+		c := &FrameCodec{Codec: cd}
+		enc := c.Encoder(&buf)
+		dec := c.Decoder(&buf)
+
+		for _, in := range []string{"Hello", "", "world"} {
+			fatal(t, enc.Encode(in))
+		}
+		buf.Write(endFrame)
+		for _, in := range []string{"Hello", "", "world"} {
+			var out string
+			fatal(t, dec.Decode(&out))
+			if out != in {
+				t.Fatalf("decoded %q, expected %q", out, in)
+			}
+		}
+		if err := dec.Decode(nil); err != io.EOF {
+			t.Fatalf("expected EOF for empty frame, got %v", err)
+		}
+	}
+}
+
+// decodeRecorder records how values are decoded with a codec.
+type decodeRecorder struct {
+	codec.JSONCodec
+	buffered             bool
+	decoders, unmarshals int
+}
+
+func (c *decodeRecorder) Decoder(r io.Reader) codec.Decoder {
+	c.decoders++
+	return c.JSONCodec.Decoder(r)
+}
+
+func (c *decodeRecorder) Unmarshal(data []byte, v interface{}) error {
+	c.unmarshals++
+	return c.JSONCodec.Unmarshal(data, v)
+}
+
+func (c *decodeRecorder) Buffered() bool { return c.buffered }
+
+func TestFrameCodecStream(t *testing.T) {
+	large := strings.Repeat("x", 100)
+	for _, tt := range []struct {
+		streamSize int
+		buffered   bool
+		streamed   bool
+	}{
+		{streamSize: 16, streamed: true},
+		{streamSize: 16, buffered: true},
+		{streamSize: 0},
+		{streamSize: -1},
+	} {
+		var buf bytes.Buffer
+		rec := &decodeRecorder{buffered: tt.buffered}
+		c := &FrameCodec{Codec: rec, StreamSize: tt.streamSize}
+		enc := c.Encoder(&buf)
+		dec := c.Decoder(&buf)
+		for _, in := range []string{large, "small", large} {
+			fatal(t, enc.Encode(in))
+		}
+		for _, in := range []string{large, "small", large} {
+			var out string
+			fatal(t, dec.Decode(&out))
+			if out != in {
+				t.Fatalf("decoded %q, expected %q", out, in)
+			}
+		}
+		if streamed := rec.decoders == 2 && rec.unmarshals == 1; streamed != tt.streamed {
+			t.Errorf("stream size %d buffered %v: %d streamed and %d buffered decodes",
+				tt.streamSize, tt.buffered, rec.decoders, rec.unmarshals)
+		}
+	}
+
+	// frames are kept aligned when the codec fails or leaves bytes unread
+	var buf bytes.Buffer
+	c := &FrameCodec{Codec: codec.JSONCodec{}, StreamSize: 1}
+	enc := c.Encoder(&buf)
+	dec := c.Decoder(&buf)
+	fatal(t, enc.Encode(large))
+	fatal(t, enc.Encode(large))
+	var n int
+	if err := dec.Decode(&n); err == nil {
+		t.Fatal("expected error decoding string as int")
+	}
+	var out string
+	fatal(t, dec.Decode(&out))
+	if out != large {
+		t.Fatalf("decoded %q after error", out)
+	}
+}
+
+// encodeRecorder counts the encoders created by a codec.
+type encodeRecorder struct {
+	codec.JSONCodec
+	encoders int
+}
+
+func (c *encodeRecorder) Encoder(w io.Writer) codec.Encoder {
+	c.encoders++
+	return c.JSONCodec.Encoder(w)
+}
+
+// fixedEncoder hides the Reset method of an encoder.
+type fixedEncoder struct {
+	codec.Encoder
+}
+
+// fixedCodec returns encoders that cannot be reset, such as encoders that
+// keep state between values.
+type fixedCodec struct {
+	encodeRecorder
+}
+
+func (c *fixedCodec) Encoder(w io.Writer) codec.Encoder {
+	return fixedEncoder{c.encodeRecorder.Encoder(w)}
+}
+
+func TestFrameCodecReuse(t *testing.T) {
+	reset := &encodeRecorder{}
+	fixed := &fixedCodec{}
+	for _, tt := range []struct {
+		cd       codec.Codec
+		rec      *encodeRecorder
+		encoders int
+	}{
+		{cd: reset, rec: reset, encoders: 1},
+		{cd: fixed, rec: &fixed.encodeRecorder, encoders: 3},
+	} {
+		var buf bytes.Buffer
+		c := &FrameCodec{Codec: tt.cd}
+		enc := c.Encoder(&buf)
+		dec := c.Decoder(&buf)
+		for _, in := range []string{"a", "b", "c"} {
+			fatal(t, enc.Encode(in))
+		}
+		for _, in := range []string{"a", "b", "c"} {
+			var out string
+			fatal(t, dec.Decode(&out))
+			if out != in {
+				t.Fatalf("decoded %q, expected %q", out, in)
+			}
+		}
+		if tt.rec.encoders != tt.encoders {
+			t.Fatalf("%d encoders created for 3 frames, expected %d", tt.rec.encoders, tt.encoders)
+		}
+	}
+}
+
+func BenchmarkFrameCodec(b *testing.B) {
+	var buf bytes.Buffer
+	c := &FrameCodec{Codec: codec.JSONCodec{}}
+	enc := c.Encoder(&buf)
+	dec := c.Decoder(&buf)
+	in := CallHeader{Selector: "/users/get"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(in); err != nil {
+			b.Fatal(err)
+		}
+		var out CallHeader
+		if err := dec.Decode(&out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnaryCall(b *testing.B) {
+	client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+		var name string
+		if err := c.Receive(&name); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return("Hello " + name)
+	}))
+	defer client.Close()
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out string
+		if _, err := client.Call(ctx, "hello", "world", &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
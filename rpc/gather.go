@@ -0,0 +1,111 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// GatherOptions configures how Gather makes its calls. The zero value makes
+// all calls at once and waits for all of them to complete.
+type GatherOptions struct {
+	// Parallelism limits the number of calls in flight at once. Zero means
+	// no limit.
+	Parallelism int
+
+	// Quorum makes Gather return as soon as that many calls have
+	// succeeded, cancelling the calls still in flight. A Quorum of 1
+	// returns the first success. Zero waits for all calls.
+	Quorum int
+}
+
+// GatherResult is the result of calling one of the callers passed to Gather.
+type GatherResult[T any] struct {
+	Reply T
+	Err   error
+
+	// Done is false for callers that were not called or were cancelled
+	// because a quorum was reached first.
+	Done bool
+}
+
+// QuorumError is returned by Gather when fewer calls succeeded than the
+// required quorum.
+type QuorumError struct {
+	Succeeded int
+	Quorum    int
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("rpc: gather quorum not reached: %d of %d succeeded", e.Succeeded, e.Quorum)
+}
+
+// Gather calls selector with args on all callers concurrently, decoding each
+// reply into a T. Results are returned in the same order as callers, each
+// having either a Reply or the Err of its call. The optional opts limit
+// parallelism or set a quorum of successes to wait for.
+//
+// Errors of individual calls are only reported in their results. If a quorum
+// was set and not reached, a *QuorumError is returned. Otherwise the returned
+// error is only non-nil if ctx was cancelled before all calls completed.
+func Gather[T any](ctx context.Context, callers []Caller, selector string, args any, opts *GatherOptions) ([]GatherResult[T], error) {
+	var o GatherOptions
+	if opts != nil {
+		o = *opts
+	}
+	parallelism := o.Parallelism
+	if parallelism <= 0 || parallelism > len(callers) {
+		parallelism = len(callers)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]GatherResult[T], len(callers))
+	var (
+		mu        sync.Mutex
+		succeeded int
+		wg        sync.WaitGroup
+	)
+	sem := make(chan struct{}, parallelism)
+	for i, caller := range callers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, caller Caller) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var reply T
+			_, err := caller.Call(ctx, selector, args, &reply)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if o.Quorum > 0 && succeeded >= o.Quorum {
+				// cancelled after the quorum was reached
+				return
+			}
+			results[i] = GatherResult[T]{Reply: reply, Err: err, Done: true}
+			if err == nil {
+				succeeded++
+				if o.Quorum > 0 && succeeded >= o.Quorum {
+					cancel()
+				}
+			}
+		}(i, caller)
+	}
+	wg.Wait()
+
+	if o.Quorum > 0 {
+		if succeeded >= o.Quorum {
+			return results, nil
+		}
+		return results, &QuorumError{Succeeded: succeeded, Quorum: o.Quorum}
+	}
+	return results, ctx.Err()
+}
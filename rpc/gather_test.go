@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatherCaller replies with its value after its delay, or returns its error.
+type gatherCaller struct {
+	value    int
+	err      error
+	delay    time.Duration
+	inflight *int32
+	max      *int32
+}
+
+func (c *gatherCaller) Call(ctx context.Context, selector string, args any, reply ...any) (*Response, error) {
+	if c.inflight != nil {
+		n := atomic.AddInt32(c.inflight, 1)
+		defer atomic.AddInt32(c.inflight, -1)
+		for {
+			m := atomic.LoadInt32(c.max)
+			if n <= m || atomic.CompareAndSwapInt32(c.max, m, n) {
+				break
+			}
+		}
+	}
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	*reply[0].(*int) = c.value
+	return &Response{}, nil
+}
+
+func TestGather(t *testing.T) {
+	ctx := context.Background()
+	failed := errors.New("failed")
+
+	t.Run("all", func(t *testing.T) {
+		callers := []Caller{
+			&gatherCaller{value: 1},
+			&gatherCaller{err: failed},
+			&gatherCaller{value: 3, delay: 10 * time.Millisecond},
+		}
+		results, err := Gather[int](ctx, callers, "value", nil, nil)
+		fatal(t, err)
+		if results[0].Reply != 1 || results[1].Err != failed || results[2].Reply != 3 {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+		for _, r := range results {
+			if !r.Done {
+				t.Fatalf("unexpected results: %+v", results)
+			}
+		}
+	})
+
+	t.Run("parallelism", func(t *testing.T) {
+		var inflight, max int32
+		var callers []Caller
+		for i := 0; i < 10; i++ {
+			callers = append(callers, &gatherCaller{value: i, delay: 5 * time.Millisecond, inflight: &inflight, max: &max})
+		}
+		results, err := Gather[int](ctx, callers, "value", nil, &GatherOptions{Parallelism: 3})
+		fatal(t, err)
+		if max > 3 {
+			t.Fatalf("%d calls in flight, expected at most 3", max)
+		}
+		for i, r := range results {
+			if r.Reply != i {
+				t.Fatalf("unexpected results: %+v", results)
+			}
+		}
+	})
+
+	t.Run("first success", func(t *testing.T) {
+		callers := []Caller{
+			&gatherCaller{value: 1, delay: time.Second},
+			&gatherCaller{err: failed},
+			&gatherCaller{value: 3, delay: 10 * time.Millisecond},
+		}
+		start := time.Now()
+		results, err := Gather[int](ctx, callers, "value", nil, &GatherOptions{Quorum: 1})
+		fatal(t, err)
+		if time.Since(start) > 500*time.Millisecond {
+			t.Fatal("slow call was not cancelled")
+		}
+		if results[0].Done || results[2].Reply != 3 {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+	})
+
+	t.Run("quorum not reached", func(t *testing.T) {
+		callers := []Caller{
+			&gatherCaller{value: 1},
+			&gatherCaller{err: failed},
+			&gatherCaller{err: failed},
+		}
+		_, err := Gather[int](ctx, callers, "value", nil, &GatherOptions{Quorum: 2})
+		var qerr *QuorumError
+		if !errors.As(err, &qerr) || qerr.Succeeded != 1 {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
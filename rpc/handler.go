@@ -3,8 +3,11 @@ package rpc
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 // A Handler responds to an RPC request.
@@ -47,12 +50,52 @@ func NotFoundHandler() Handler {
 //
 // Since RespondMux is also a Handler, you can use them for submuxing. If a pattern matches a handler that
 // is a RespondMux, it will trim the matching selector prefix before matching against the sub RespondMux.
+//
+// Further normalization of selectors and patterns can be configured with Policy.
 type RespondMux struct {
+	// Policy configures optional selector normalization. It should be set
+	// before registering handlers.
+	Policy SelectorPolicy
+
 	m  map[string]muxEntry
 	es []muxEntry // slice of entries sorted from longest to shortest.
 	mu sync.RWMutex
 }
 
+// SelectorPolicy configures normalization a RespondMux applies to selectors
+// and patterns in addition to normalizing them to the path form.
+type SelectorPolicy struct {
+	// FoldCase makes selectors match patterns regardless of case.
+	FoldCase bool
+
+	// TrimTrailingSeparator makes a selector ending in a separator match the
+	// handler for the selector without it if there is no exact match, so
+	// "foo.bar." is handled by the handler for "foo.bar".
+	TrimTrailingSeparator bool
+
+	// RejectInvalid makes selectors that are not valid UTF-8 or that contain
+	// whitespace or control characters match no handler. Registering such a
+	// pattern panics.
+	RejectInvalid bool
+}
+
+// normalize returns the canonical form of selector s under the policy, or
+// false if the policy rejects it.
+func (p SelectorPolicy) normalize(s string) (string, bool) {
+	if p.RejectInvalid {
+		if !utf8.ValidString(s) || strings.IndexFunc(s, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r)
+		}) != -1 {
+			return "", false
+		}
+	}
+	s = cleanSelector(s)
+	if p.FoldCase {
+		s = strings.ToLower(s)
+	}
+	return s, true
+}
+
 type muxEntry struct {
 	h       Handler
 	pattern string
@@ -77,9 +120,11 @@ func cleanSelector(s string) string {
 // NewRespondMux allocates and returns a new RespondMux.
 func NewRespondMux() *RespondMux { return new(RespondMux) }
 
-// RespondRPC dispatches the call to the handler whose pattern most closely matches the selector.
+// RespondRPC dispatches the call to the handler whose pattern most closely matches the selector,
+// setting the Pattern and Rest of the call.
 func (m *RespondMux) RespondRPC(r Responder, c *Call) {
-	h, _ := m.Handler(c)
+	var h Handler
+	h, c.Pattern, c.Rest = m.handler(c)
 	h.RespondRPC(r, c)
 }
 
@@ -90,47 +135,129 @@ func (m *RespondMux) RespondRPC(r Responder, c *Call) {
 // returns the FallbackHandler or if not set, a "not found" handler
 // with an empty pattern.
 func (m *RespondMux) Handler(c *Call) (h Handler, pattern string) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	h, pattern, _ = m.handler(c)
+	return
+}
 
-	h, pattern = m.Match(c.Selector)
+// handler is Handler also returning the rest of the selector, like match.
+func (m *RespondMux) handler(c *Call) (h Handler, pattern, rest string) {
+	h, pattern, rest = m.match(c.Selector)
 	if h == nil {
-		h, pattern = NotFoundHandler(), ""
+		return NotFoundHandler(), "", ""
 	}
-	return
+	return h, pattern, rest
 }
 
-// Remove removes and returns the handler for the selector.
+// Remove removes and returns the handler for the selector. Calls already
+// dispatched to the handler are not affected.
 func (m *RespondMux) Remove(selector string) (h Handler) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	selector = cleanSelector(selector)
-	h = m.m[selector].h
+	selector, valid := m.Policy.normalize(selector)
+	if !valid {
+		return nil
+	}
+	e, ok := m.m[selector]
+	if !ok && selector[len(selector)-1] != '/' {
+		// submuxes are registered as prefix patterns
+		selector += "/"
+		e, ok = m.m[selector]
+	}
+	if !ok {
+		return nil
+	}
 	delete(m.m, selector)
+	if selector[len(selector)-1] == '/' {
+		m.es = removeSorted(m.es, selector)
+	}
+	return e.h
+}
 
-	return
+// Replace registers the handler for the given pattern like Handle, but
+// replaces any existing handler for the pattern instead of panicking. It
+// returns the replaced handler, or nil if there was none.
+func (m *RespondMux) Replace(pattern string, handler Handler) (old Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.handle(pattern, handler, true)
+}
+
+// swapMu is held by Swap, which locks two muxes at once.
+var swapMu sync.Mutex
+
+// Swap atomically exchanges the routing tables of m and n, so a new set of
+// handlers can be built on n and then swapped in while m is serving calls.
+// Afterwards n holds the previous handlers of m. The Policy of each mux is
+// swapped along with its handlers, since their patterns were normalized by it.
+func (m *RespondMux) Swap(n *RespondMux) {
+	if m == n {
+		return
+	}
+	// swaps are serialized so concurrent swaps of the same muxes in
+	// either order can't deadlock
+	swapMu.Lock()
+	defer swapMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	m.m, n.m = n.m, m.m
+	m.es, n.es = n.es, m.es
+	m.Policy, n.Policy = n.Policy, m.Policy
 }
 
 // Match finds a handler given a selector string.
 // Most-specific (longest) pattern wins. If a pattern handler
 // is a submux, it will call Match with the selector minus the
-// pattern.
+// pattern, and the returned pattern joins both patterns.
 func (m *RespondMux) Match(selector string) (h Handler, pattern string) {
-	selector = cleanSelector(selector)
+	h, pattern, _ = m.match(selector)
+	return
+}
 
+// match is Match also returning the rest of the normalized selector after
+// a prefix pattern, normalized under the same lock as the lookup since Swap
+// replaces the Policy.
+func (m *RespondMux) match(selector string) (h Handler, pattern, rest string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	selector, valid := m.Policy.normalize(selector)
+	if !valid {
+		return nil, "", ""
+	}
+	h, pattern = m.lookup(selector)
+	if strings.HasSuffix(pattern, "/") {
+		rest = strings.TrimPrefix(selector, pattern)
+	}
+	return h, pattern, rest
+}
+
+// lookup finds the handler for a normalized selector with m.mu held.
+func (m *RespondMux) lookup(selector string) (h Handler, pattern string) {
 	// Check for exact match first.
 	v, ok := m.m[selector]
 	if ok {
 		return v.h, v.pattern
 	}
+	if m.Policy.TrimTrailingSeparator && len(selector) > 1 && strings.HasSuffix(selector, "/") {
+		if v, ok := m.m[strings.TrimSuffix(selector, "/")]; ok {
+			return v.h, v.pattern
+		}
+	}
 
 	// Check for longest valid match.  m.es contains all patterns
 	// that end in / sorted from longest to shortest.
 	for _, e := range m.es {
 		if strings.HasPrefix(selector, e.pattern) {
 			if m, ok := e.h.(matcher); ok {
-				return m.Match(strings.TrimPrefix(selector, e.pattern))
+				h, pattern := m.Match(strings.TrimPrefix(selector, e.pattern))
+				if h == nil {
+					return nil, ""
+				}
+				return h, e.pattern + strings.TrimPrefix(pattern, "/")
 			}
 			return e.h, e.pattern
 		}
@@ -144,8 +271,17 @@ func (m *RespondMux) Match(selector string) (h Handler, pattern string) {
 func (m *RespondMux) Handle(pattern string, handler Handler) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.handle(pattern, handler, false)
+}
 
-	pattern = cleanSelector(pattern)
+// handle registers the handler with m.mu held, returning the handler it
+// replaced if replace is set.
+func (m *RespondMux) handle(pattern string, handler Handler, replace bool) (old Handler) {
+	normalized, valid := m.Policy.normalize(pattern)
+	if !valid {
+		panic("rpc: invalid pattern " + strconv.Quote(pattern))
+	}
+	pattern = normalized
 	if _, ok := handler.(matcher); ok && pattern[len(pattern)-1] != '/' {
 		pattern = pattern + "/"
 	}
@@ -153,8 +289,11 @@ func (m *RespondMux) Handle(pattern string, handler Handler) {
 	if handler == nil {
 		panic("rpc: nil handler")
 	}
-	if _, exist := m.m[pattern]; exist {
-		panic("rpc: multiple registrations for " + pattern)
+	if e, exist := m.m[pattern]; exist {
+		if !replace {
+			panic("rpc: multiple registrations for " + pattern)
+		}
+		old = e.h
 	}
 
 	if m.m == nil {
@@ -163,8 +302,12 @@ func (m *RespondMux) Handle(pattern string, handler Handler) {
 	e := muxEntry{h: handler, pattern: pattern}
 	m.m[pattern] = e
 	if pattern[len(pattern)-1] == '/' {
+		if old != nil {
+			m.es = removeSorted(m.es, pattern)
+		}
 		m.es = appendSorted(m.es, e)
 	}
+	return old
 }
 
 func appendSorted(es []muxEntry, e muxEntry) []muxEntry {
@@ -181,3 +324,12 @@ func appendSorted(es []muxEntry, e muxEntry) []muxEntry {
 	es[i] = e
 	return es
 }
+
+func removeSorted(es []muxEntry, pattern string) []muxEntry {
+	for i, e := range es {
+		if e.pattern == pattern {
+			return append(es[:i:i], es[i+1:]...)
+		}
+	}
+	return es
+}
@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HeartbeatSelector is the conventional selector used to register a
+// HeartbeatHandler, which a Watchdog calls to check a peer is responsive.
+const HeartbeatSelector = "qtalk.heartbeat"
+
+// HeartbeatHandler returns a handler that replies to heartbeats.
+func HeartbeatHandler() Handler {
+	return HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		r.Return()
+	})
+}
+
+// Health is the liveness of a Caller as observed by a Watchdog.
+type Health int
+
+const (
+	// HealthUnknown is the health before the first heartbeat completes.
+	HealthUnknown Health = iota
+	Healthy
+	Unhealthy
+)
+
+func (h Health) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Unhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// Watchdog periodically calls the HeartbeatSelector of a Caller and tracks
+// whether it is responsive, so applications can react to an unresponsive peer
+// before their own calls time out. It is independent of any keepalive of the
+// underlying session. The zero value uses the defaults of its fields and
+// must have Caller set before calling Run.
+type Watchdog struct {
+	Caller Caller
+
+	// Interval is the time between heartbeats. If zero, 5 seconds is used.
+	Interval time.Duration
+
+	// Timeout limits how long each heartbeat may take. If zero, Interval
+	// is used.
+	Timeout time.Duration
+
+	// Failures is the number of consecutive failed heartbeats after which
+	// the Caller is unhealthy. If zero, 1 is used. A single successful
+	// heartbeat makes it healthy again.
+	Failures int
+
+	// OnChange, if set, is called from Run when the health changes, with
+	// the error of the last heartbeat if it failed.
+	OnChange func(h Health, err error)
+
+	mu       sync.Mutex
+	health   Health
+	err      error
+	failures int
+}
+
+// Run sends heartbeats until ctx is done, returning the context error. The
+// first heartbeat is sent immediately.
+func (w *Watchdog) Run(ctx context.Context) error {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.Check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Check sends a single heartbeat and updates the health with its result,
+// returning the error of the heartbeat. Heartbeats aborted because ctx was
+// done do not change the health.
+func (w *Watchdog) Check(ctx context.Context) error {
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = w.Interval
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	hctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := w.Caller.Call(hctx, HeartbeatSelector, nil)
+	if ctx.Err() != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	prev := w.health
+	w.err = err
+	if err == nil {
+		w.failures = 0
+		w.health = Healthy
+	} else {
+		w.failures++
+		max := w.Failures
+		if max <= 0 {
+			max = 1
+		}
+		if w.failures >= max {
+			w.health = Unhealthy
+		}
+	}
+	health := w.health
+	w.mu.Unlock()
+
+	if health != prev && w.OnChange != nil {
+		w.OnChange(health, err)
+	}
+	return err
+}
+
+// Health returns the current health of the Caller.
+func (w *Watchdog) Health() Health {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.health
+}
+
+// Err returns the error of the last heartbeat, or nil if it succeeded.
+func (w *Watchdog) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
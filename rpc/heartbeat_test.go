@@ -0,0 +1,69 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	var down int32
+	mux := NewRespondMux()
+	mux.Handle(HeartbeatSelector, HandlerFunc(func(r Responder, c *Call) {
+		if atomic.LoadInt32(&down) == 1 {
+			r.Return(errors.New("down"))
+			return
+		}
+		HeartbeatHandler().RespondRPC(r, c)
+	}))
+	client, _ := newTestPair(mux)
+	defer client.Close()
+
+	changes := make(chan Health, 4)
+	w := &Watchdog{
+		Caller:   client,
+		Interval: 5 * time.Millisecond,
+		Failures: 2,
+		OnChange: func(h Health, err error) {
+			if (h == Unhealthy) != (err != nil) {
+				t.Errorf("unexpected error for %s: %v", h, err)
+			}
+			changes <- h
+		},
+	}
+	if h := w.Health(); h != HealthUnknown {
+		t.Fatal("unexpected initial health:", h)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	expect := func(want Health) {
+		t.Helper()
+		select {
+		case h := <-changes:
+			if h != want {
+				t.Fatalf("health changed to %s, expected %s", h, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("health did not change to %s", want)
+		}
+	}
+	expect(Healthy)
+	atomic.StoreInt32(&down, 1)
+	expect(Unhealthy)
+	if _, ok := w.Err().(RemoteError); !ok {
+		t.Fatal("unexpected heartbeat error:", w.Err())
+	}
+	atomic.StoreInt32(&down, 0)
+	expect(Healthy)
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal("unexpected error:", err)
+	}
+}
@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// CloseCodeIdle is the code of the channel error the peer reads when a
+// continued call is closed for being idle longer than the
+// ContinueIdleTimeout of the server.
+const CloseCodeIdle uint32 = 1
+
+// idleChannel is the channel of a call, closed by the server once the call
+// is continued and neither side reads or writes it for timeout.
+type idleChannel struct {
+	*countingChannel
+	srv      *Server
+	selector string
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	last   int64 // bytes of the call at the last check
+	closed bool
+}
+
+// start starts watching the channel once the call is continued.
+func (c *idleChannel) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer == nil && !c.closed {
+		c.last = c.bytes()
+		c.timer = time.AfterFunc(c.timeout, c.check)
+	}
+}
+
+func (c *idleChannel) bytes() int64 {
+	return c.sent.Load() + c.received.Load()
+}
+
+// check closes the channel if no bytes were read or written since the last
+// check, so it is closed after being idle for between one and two timeouts.
+func (c *idleChannel) check() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if n := c.bytes(); n != c.last {
+		c.last = n
+		c.timer.Reset(c.timeout)
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	var err error
+	if ec, ok := c.Channel.(mux.ErrorCloser); ok {
+		err = ec.CloseWithError(CloseCodeIdle, "rpc: continued call idle")
+	} else {
+		err = c.Channel.Close()
+	}
+	// the channel was already closed by the peer if closing fails
+	if err == nil {
+		c.srv.idleClosed.Add(1)
+		c.srv.logf("rpc: closing %s on channel %d idle for %v", c.selector, c.ID(), c.timeout)
+	}
+}
+
+func (c *idleChannel) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+	return c.countingChannel.Close()
+}
@@ -0,0 +1,47 @@
+//go:build go1.23
+
+package rpc
+
+import (
+	"io"
+	"iter"
+)
+
+func iterSeqOf(args any) (func(yield func(any) bool), bool) {
+	seq, ok := args.(iter.Seq[any])
+	return seq, ok
+}
+
+// Replies returns an iterator over values of type T received from a continued
+// response, such as one streaming replies from a server:
+//
+//	for v, err := range rpc.Replies[string](resp) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(v)
+//	}
+//
+// Iteration ends when the remote side closes the channel. An error receiving
+// a value is yielded with the zero T and ends the iteration. The response
+// channel is closed once iteration ends, including when stopped early.
+func Replies[T any](resp *Response) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		defer resp.Channel.Close()
+		for {
+			var v T
+			err := resp.Receive(&v)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+	}
+}
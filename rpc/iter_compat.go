@@ -0,0 +1,7 @@
+//go:build !go1.23
+
+package rpc
+
+func iterSeqOf(args any) (func(yield func(any) bool), bool) {
+	return nil, false
+}
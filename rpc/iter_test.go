@@ -0,0 +1,76 @@
+//go:build go1.23
+
+package rpc
+
+import (
+	"context"
+	"iter"
+	"slices"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+func TestIterArgs(t *testing.T) {
+	client, _ := newTestPairConfig(HandlerFunc(func(r Responder, c *Call) {
+		var args []string
+		for c.More() {
+			var arg string
+			fatal(t, c.Receive(&arg))
+			args = append(args, arg)
+		}
+		r.Return(args)
+	}), &mux.SessionConfig{Features: mux.FeatureCallArgs})
+	defer client.Close()
+
+	var seq iter.Seq[any] = func(yield func(any) bool) {
+		for _, arg := range []string{"one", "two"} {
+			if !yield(arg) {
+				return
+			}
+		}
+	}
+	var out []string
+	_, err := client.Call(context.Background(), "", seq, &out)
+	fatal(t, err)
+	if !slices.Equal(out, []string{"one", "two"}) {
+		t.Fatalf("unexpected return: %#v", out)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+		var n int
+		fatal(t, c.Receive(&n))
+		ch, err := r.Continue(nil)
+		fatal(t, err)
+		defer ch.Close()
+		for i := 0; i < n; i++ {
+			// the caller may stop receiving and close the channel
+			if err := r.Send(i); err != nil {
+				return
+			}
+		}
+	}))
+	defer client.Close()
+	ctx := context.Background()
+
+	resp, err := client.Call(ctx, "", 3, nil)
+	fatal(t, err)
+	var got []int
+	for v, err := range Replies[int](resp) {
+		fatal(t, err)
+		got = append(got, v)
+	}
+	if !slices.Equal(got, []int{0, 1, 2}) {
+		t.Fatalf("unexpected replies: %v", got)
+	}
+
+	resp, err = client.Call(ctx, "", 3, nil)
+	fatal(t, err)
+	for _, err := range Replies[string](resp) {
+		if err == nil {
+			t.Fatal("expected error decoding int as string")
+		}
+	}
+}
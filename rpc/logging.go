@@ -0,0 +1,271 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+)
+
+// CallLog is the entry logged for a call by handlers returned by
+// WithLogging.
+type CallLog struct {
+	Selector  string
+	SessionID string
+	Start     time.Time
+	// Duration is the time until the handler returned.
+	Duration time.Duration
+	// Error is the error the handler responded with, or the panic it
+	// raised if Panicked is set.
+	Error     string
+	Continued bool
+	Panicked  bool
+	// BytesReceived and BytesSent are the number of bytes of the call read
+	// and written until the handler returned, including the call header
+	// and framing. Bytes read or written directly on a continued channel
+	// are not included.
+	BytesReceived int64
+	BytesSent     int64
+
+	// Sampled is set if Args and Reply were recorded for the call, in
+	// which case they are the argument values the handler received and
+	// the values it responded with, after redaction.
+	Sampled bool
+	Args    []any
+	Reply   []any
+}
+
+// Status returns "ok", "continued", "error" or "panic".
+func (l CallLog) Status() string {
+	switch {
+	case l.Panicked:
+		return "panic"
+	case l.Error != "":
+		return "error"
+	case l.Continued:
+		return "continued"
+	default:
+		return "ok"
+	}
+}
+
+// String formats the entry as a single line of an access log, with Args and
+// Reply encoded as JSON if sampled.
+func (l CallLog) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "rpc: %s session=%s status=%s duration=%v recv=%d sent=%d",
+		l.Selector, l.SessionID, l.Status(), l.Duration, l.BytesReceived, l.BytesSent)
+	if l.Error != "" {
+		fmt.Fprintf(&b, " error=%q", l.Error)
+	}
+	if l.Sampled {
+		fmt.Fprintf(&b, " args=%s reply=%s", logJSON(l.Args), logJSON(l.Reply))
+	}
+	return b.String()
+}
+
+func logJSON(v []any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%q", err.Error())
+	}
+	return string(b)
+}
+
+// LogOptions configure the handlers returned by WithLogging.
+type LogOptions struct {
+	// Log is called with the entry of each call once its handler returns.
+	// If nil, entries are printed to Logger.
+	Log func(CallLog)
+
+	// Logger is the logger entries are printed to if Log is nil. If nil,
+	// the log package's standard logger is used.
+	Logger *log.Logger
+
+	// SampleRate is the fraction of calls, from 0 to 1, whose argument and
+	// reply values are recorded in their entry.
+	SampleRate float64
+
+	// Redact, if set, returns the value to record in place of an argument
+	// or reply value v of a sampled call to selector, so sensitive fields
+	// are not logged. It must not modify v, which is still used by the
+	// handler or sent to the caller. RedactFields returns a Redact func
+	// for fields by name.
+	Redact func(selector string, v any) any
+}
+
+// WithLogging returns a handler that logs every call to h with its
+// selector, duration, status and sizes, as an access log:
+//
+//	mux.Handle("users.", rpc.WithLogging(users, rpc.LogOptions{
+//		SampleRate: 0.01,
+//		Redact:     rpc.RedactFields("Password", "Token"),
+//	}))
+//
+// A handler with a Match method like a RespondMux keeps being registered as
+// a submux, and every handler it matches is logged.
+func WithLogging(h Handler, opts LogOptions) Handler {
+	lh := &logHandler{Handler: h, opts: opts}
+	if m, ok := h.(matcher); ok {
+		return &logMatcher{logHandler: lh, m: m}
+	}
+	return lh
+}
+
+type logHandler struct {
+	Handler
+	opts LogOptions
+}
+
+// logMatcher is the logHandler of a submux.
+type logMatcher struct {
+	*logHandler
+	m matcher
+}
+
+func (h *logMatcher) Match(selector string) (Handler, string) {
+	sub, pattern := h.m.Match(selector)
+	if sub == nil {
+		return nil, ""
+	}
+	return &logHandler{Handler: sub, opts: h.opts}, pattern
+}
+
+func (h *logHandler) RespondRPC(r Responder, c *Call) {
+	entry := CallLog{
+		Selector:  c.Selector,
+		SessionID: c.SessionID,
+		Start:     time.Now(),
+		Sampled:   h.opts.SampleRate > 0 && rand.Float64() < h.opts.SampleRate,
+	}
+	// the responder of the server is not wrapped, so handlers like proxies
+	// depending on it keep working
+	resp, _ := r.(*responder)
+	var counter *countingChannel
+	if resp != nil {
+		counter = resp.counter
+		resp.record = entry.Sampled
+	}
+	var args *recordingDecoder
+	if entry.Sampled {
+		args = &recordingDecoder{Decoder: c.Decoder}
+		c.Decoder = args
+	}
+
+	defer func() {
+		p := recover()
+		entry.Duration = time.Since(entry.Start)
+		if counter != nil {
+			entry.BytesReceived = counter.received.Load()
+			entry.BytesSent = counter.sent.Load()
+		}
+		if resp != nil {
+			if resp.header.Error != nil {
+				entry.Error = *resp.header.Error
+			}
+			entry.Continued = resp.header.Continue
+		}
+		if p != nil {
+			entry.Panicked = true
+			entry.Error = fmt.Sprint(p)
+		}
+		if entry.Sampled {
+			entry.Args = h.redact(c.Selector, args.values)
+			if resp != nil && resp.header.Error == nil {
+				entry.Reply = h.redact(c.Selector, resp.values)
+			}
+		}
+		h.log(entry)
+		if p != nil {
+			panic(p)
+		}
+	}()
+	h.Handler.RespondRPC(r, c)
+}
+
+func (h *logHandler) redact(selector string, values []any) []any {
+	if h.opts.Redact == nil || values == nil {
+		return values
+	}
+	redacted := make([]any, len(values))
+	for i, v := range values {
+		redacted[i] = h.opts.Redact(selector, v)
+	}
+	return redacted
+}
+
+func (h *logHandler) log(entry CallLog) {
+	switch {
+	case h.opts.Log != nil:
+		h.opts.Log(entry)
+	case h.opts.Logger != nil:
+		h.opts.Logger.Print(entry)
+	default:
+		log.Print(entry)
+	}
+}
+
+// recordingDecoder records the values decoded by the handler.
+type recordingDecoder struct {
+	codec.Decoder
+	values []any
+}
+
+func (d *recordingDecoder) Decode(v any) error {
+	err := d.Decoder.Decode(v)
+	if err == nil {
+		d.values = append(d.values, v)
+	}
+	return err
+}
+
+func (d *recordingDecoder) peek() (uint32, error) {
+	if p, ok := d.Decoder.(peeker); ok {
+		return p.peek()
+	}
+	return 1, nil
+}
+
+// RedactFields returns a Redact func for LogOptions replacing the values of
+// object fields and map keys with the given names, matched case
+// insensitively as encoding/json does, with "[REDACTED]" at any depth.
+// Values are converted to their generic JSON form to be redacted.
+func RedactFields(names ...string) func(selector string, v any) any {
+	redacted := make(map[string]bool, len(names))
+	for _, name := range names {
+		redacted[strings.ToLower(name)] = true
+	}
+	return func(_ string, v any) any {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return v
+		}
+		var generic any
+		if err := json.Unmarshal(b, &generic); err != nil {
+			return v
+		}
+		return redactValue(generic, redacted)
+	}
+}
+
+func redactValue(v any, redacted map[string]bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if redacted[strings.ToLower(k)] {
+				v[k] = "[REDACTED]"
+			} else {
+				v[k] = redactValue(e, redacted)
+			}
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = redactValue(e, redacted)
+		}
+	}
+	return v
+}
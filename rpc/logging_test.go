@@ -0,0 +1,91 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestWithLogging(t *testing.T) {
+	type login struct {
+		User     string
+		Password string
+	}
+	entries := make(chan CallLog, 1)
+	mux := NewRespondMux()
+	mux.Handle("login", HandlerFunc(func(r Responder, c *Call) {
+		var args login
+		if err := c.Receive(&args); err != nil {
+			r.Return(err)
+			return
+		}
+		if args.Password != "secret" {
+			r.Return(errors.New("wrong password"))
+			return
+		}
+		r.Return(map[string]string{"user": args.User, "token": "t0ken"})
+	}))
+	mux.Handle("panic", HandlerFunc(func(r Responder, c *Call) {
+		panic("boom")
+	}))
+	logged := WithLogging(mux, LogOptions{
+		Log:        func(l CallLog) { entries <- l },
+		SampleRate: 1,
+		Redact:     RedactFields("password", "token"),
+	})
+	client, _ := newTestPair(logged)
+	defer client.Close()
+	ctx := context.Background()
+
+	var reply map[string]string
+	_, err := client.Call(ctx, "login", login{User: "bob", Password: "secret"}, &reply)
+	fatal(t, err)
+	l := <-entries
+	if l.Selector != "/login" || l.Status() != "ok" || l.BytesReceived == 0 || l.BytesSent == 0 || l.Duration <= 0 {
+		t.Fatalf("unexpected entry: %+v", l)
+	}
+	line := l.String()
+	if strings.Contains(line, "secret") || strings.Contains(line, "t0ken") ||
+		!strings.Contains(line, `args=[{"Password":"[REDACTED]","User":"bob"}]`) ||
+		!strings.Contains(line, `reply=[{"token":"[REDACTED]","user":"bob"}]`) {
+		t.Fatalf("unexpected log line: %s", line)
+	}
+	if reply["token"] != "t0ken" {
+		t.Fatal("redaction changed the reply:", reply)
+	}
+
+	_, err = client.Call(ctx, "login", login{User: "bob"}, &reply)
+	if l := <-entries; l.Status() != "error" || l.Error != "wrong password" || l.Reply != nil {
+		t.Fatalf("unexpected entry for %v: %+v", err, l)
+	}
+
+	_, err = client.Call(ctx, "panic", nil)
+	if l := <-entries; l.Status() != "panic" || l.Error != "boom" || err == nil {
+		t.Fatalf("unexpected entry for %v: %+v", err, l)
+	}
+}
+
+// lineWriter sends the lines written to it on a channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestWithLoggingUnsampled(t *testing.T) {
+	lines := make(lineWriter, 1)
+	client, _ := newTestPair(WithLogging(HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		r.Return("hello")
+	}), LogOptions{Logger: log.New(lines, "", 0)}))
+	defer client.Close()
+
+	_, err := client.Call(context.Background(), "hello", "secret")
+	fatal(t, err)
+	if line := <-lines; !strings.HasPrefix(line, "rpc: /hello session=") || strings.Contains(line, "secret") {
+		t.Fatalf("unexpected log line: %s", line)
+	}
+}
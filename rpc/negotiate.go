@@ -0,0 +1,165 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// NamedCodec is a codec offered for negotiation under the name both sides
+// know it by, such as "json" or "cbor".
+type NamedCodec struct {
+	Name string
+	codec.Codec
+}
+
+// ErrNoCommonCodec is returned by NegotiateCodec if the server supports
+// none of the codecs offered, or does not negotiate codecs.
+var ErrNoCommonCodec = errors.New("rpc: no common codec")
+
+// codecsMagic starts the payload of the frames negotiating a codec. The
+// zero byte starts no call header of the codecs in this module, so calls
+// are not mistaken for a negotiation.
+const codecsMagic = "\x00qtalk-codecs\x00"
+
+// maxCodecsFrame is the largest payload of a negotiation frame, so the
+// first frame of a call is only read ahead if it is small.
+const maxCodecsFrame = 1024
+
+// codecsFrame returns the frame negotiating names, which is framed like
+// the values of calls but not encoded by a codec.
+func codecsFrame(names []string) []byte {
+	payload := codecsMagic + strings.Join(names, ",")
+	b := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	return append(b, payload...)
+}
+
+// readCodecsFrame reads the first frame of ch, returning the names it
+// lists if it negotiates codecs. Otherwise ok is false, and read holds the
+// bytes read, which are only the length prefix of frames too large to
+// negotiate.
+func readCodecsFrame(ch io.Reader) (names []string, read []byte, ok bool, err error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(ch, prefix[:]); err != nil {
+		return nil, nil, false, err
+	}
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size < uint32(len(codecsMagic)) || size > maxCodecsFrame {
+		return nil, prefix[:], false, nil
+	}
+	read = make([]byte, 4+size)
+	copy(read, prefix[:])
+	if _, err := io.ReadFull(ch, read[4:]); err != nil {
+		return nil, nil, false, err
+	}
+	payload := string(read[4:])
+	if !strings.HasPrefix(payload, codecsMagic) {
+		return nil, read, false, nil
+	}
+	if payload = payload[len(codecsMagic):]; payload != "" {
+		names = strings.Split(payload, ",")
+	}
+	return names, nil, true, nil
+}
+
+// NegotiateCodec agrees on the codec of sess with a Server that has
+// Codecs, returning the first of its Codecs offered in codecs, so the server
+// decides by its preference. The result is used to make a Client with
+// NewClient, and by a Server responding to calls back on sess, such as with
+// CodecSelector. It must be called before other calls on sess, since the
+// server selects the codec of a session on its first channel, and returns
+// ErrNoCommonCodec listing the codecs of both sides if none agree.
+func NegotiateCodec(ctx context.Context, sess mux.Session, codecs ...NamedCodec) (NamedCodec, error) {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		if c.Name == "" || strings.ContainsAny(c.Name, ",\x00") || c.Codec == nil {
+			return NamedCodec{}, fmt.Errorf("rpc: invalid codec %q", c.Name)
+		}
+		names[i] = c.Name
+	}
+	frame := codecsFrame(names)
+	if len(frame)-4 > maxCodecsFrame {
+		return NamedCodec{}, fmt.Errorf("rpc: %d codecs exceed a negotiation frame", len(codecs))
+	}
+
+	ch, err := sess.Open(ctx)
+	if err != nil {
+		return NamedCodec{}, err
+	}
+	defer ch.Close()
+	stop := closeOnDone(ctx, ch)
+	remote, ok, err := func() ([]string, bool, error) {
+		defer stop()
+		if _, err := ch.Write(frame); err != nil {
+			return nil, false, err
+		}
+		remote, _, ok, err := readCodecsFrame(ch)
+		return remote, ok, err
+	}()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return NamedCodec{}, ctxErr
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return NamedCodec{}, err
+	}
+	if !ok {
+		// a server without Codecs responds to the frame as a malformed call
+		return NamedCodec{}, fmt.Errorf("%w: server does not negotiate codecs", ErrNoCommonCodec)
+	}
+	if len(remote) == 1 {
+		for _, c := range codecs {
+			if c.Name == remote[0] {
+				return c, nil
+			}
+		}
+	}
+	return NamedCodec{}, fmt.Errorf("%w: offered %s, server has %s", ErrNoCommonCodec,
+		strings.Join(names, ", "), strings.Join(remote, ", "))
+}
+
+// negotiateCodec reads the first frame of the first channel of a session,
+// which negotiates its codec if it lists codecs. Then the codec agreed on
+// is stored for the session, replacing its caller, and replied, or else the
+// Codecs of the server, and the channel is closed. Otherwise the channel is
+// a call, and the bytes read of it are returned to be decoded before the
+// rest.
+func (s *Server) negotiateCodec(ctx context.Context, served *servedSession, ch mux.Channel) (read []byte, isCall bool) {
+	defer closeOnDone(ctx, ch)()
+	offered, read, ok, err := readCodecsFrame(ch)
+	if err != nil {
+		ch.Close()
+		return nil, false
+	}
+	if !ok {
+		return read, true
+	}
+	defer ch.Close()
+	for _, c := range s.Codecs {
+		for _, name := range offered {
+			if c.Name != name {
+				continue
+			}
+			// a caller made before, such as by FindSessions, has
+			// the codec selected without negotiating
+			s.mu.Lock()
+			served.codec = c.Codec
+			served.caller = nil
+			s.mu.Unlock()
+			ch.Write(codecsFrame([]string{name}))
+			return nil, false
+		}
+	}
+	names := make([]string, len(s.Codecs))
+	for i, c := range s.Codecs {
+		names[i] = c.Name
+	}
+	ch.Write(codecsFrame(names))
+	return nil, false
+}
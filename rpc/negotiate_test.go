@@ -0,0 +1,134 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// newNegotiatePair serves srv on a session, returning the other side.
+func newNegotiatePair(srv *Server) mux.Session {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA := mux.New(pipeConn{ar, aw})
+	sessB := mux.New(pipeConn{br, bw})
+	go srv.Respond(sessA, nil)
+	return sessB
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	ctx := context.Background()
+	jsonCodec := NamedCodec{Name: "json", Codec: codec.JSONCodec{}}
+	cborCodec := NamedCodec{Name: "cbor", Codec: codec.CBORCodec{}}
+
+	echo := HandlerFunc(func(r Responder, c *Call) {
+		var v any
+		c.Receive(&v)
+		r.Return(v)
+	})
+	newServer := func(codecs ...NamedCodec) *Server {
+		return &Server{Handler: echo, Codecs: codecs}
+	}
+
+	t.Run("server preference", func(t *testing.T) {
+		sess := newNegotiatePair(newServer(cborCodec, jsonCodec))
+		defer sess.Close()
+		nc, err := NegotiateCodec(ctx, sess, jsonCodec, cborCodec)
+		fatal(t, err)
+		if nc.Name != "cbor" {
+			t.Fatal("unexpected codec:", nc.Name)
+		}
+		// bytes are only decoded as such by CBOR
+		var reply any
+		_, err = NewClient(sess, nc).Call(ctx, "echo", []byte("raw"), &reply)
+		fatal(t, err)
+		if b, ok := reply.([]byte); !ok || string(b) != "raw" {
+			t.Fatalf("unexpected reply %#v", reply)
+		}
+	})
+
+	t.Run("no common codec", func(t *testing.T) {
+		sess := newNegotiatePair(newServer(cborCodec))
+		defer sess.Close()
+		_, err := NegotiateCodec(ctx, sess, jsonCodec)
+		if !errors.Is(err, ErrNoCommonCodec) || !strings.Contains(err.Error(), "server has cbor") {
+			t.Fatal("unexpected error:", err)
+		}
+	})
+
+	t.Run("not negotiating", func(t *testing.T) {
+		// peers not negotiating use the first of Codecs
+		sess := newNegotiatePair(newServer(jsonCodec, cborCodec))
+		defer sess.Close()
+		var reply string
+		_, err := NewClient(sess, codec.JSONCodec{}).Call(ctx, "echo", "hello", &reply)
+		fatal(t, err)
+		if reply != "hello" {
+			t.Fatal("unexpected reply:", reply)
+		}
+	})
+
+	t.Run("calls back after negotiating", func(t *testing.T) {
+		back := HandlerFunc(func(r Responder, c *Call) {
+			var v, reply any
+			c.Receive(&v)
+			if _, err := c.Caller.Call(c.Context, "echo", v, &reply); err != nil {
+				r.Return(err)
+				return
+			}
+			r.Return(reply)
+		})
+		srv := newServer(cborCodec, jsonCodec)
+		srv.Handler = back
+		sess := newNegotiatePair(srv)
+		defer sess.Close()
+		go (&Server{Codec: codec.JSONCodec{}, Handler: echo}).Respond(sess, nil)
+
+		// a caller found before negotiating has the first of Codecs
+		for {
+			found, err := srv.FindSessions("")
+			fatal(t, err)
+			if len(found) > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		nc, err := NegotiateCodec(ctx, sess, jsonCodec)
+		fatal(t, err)
+		var reply string
+		_, err = NewClient(sess, nc).Call(ctx, "back", "hello", &reply)
+		fatal(t, err)
+		if reply != "hello" {
+			t.Fatal("unexpected reply:", reply)
+		}
+		found, err := srv.FindSessions("")
+		fatal(t, err)
+		_, err = found[0].Call(ctx, "echo", "again", &reply)
+		fatal(t, err)
+		if reply != "again" {
+			t.Fatal("unexpected reply:", reply)
+		}
+	})
+
+	t.Run("server without codecs", func(t *testing.T) {
+		sess := newNegotiatePair(&Server{Handler: echo, Codec: codec.JSONCodec{}})
+		defer sess.Close()
+		_, err := NegotiateCodec(ctx, sess, jsonCodec)
+		if !errors.Is(err, ErrNoCommonCodec) || !strings.Contains(err.Error(), "does not negotiate") {
+			t.Fatal("unexpected error:", err)
+		}
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		_, err := NegotiateCodec(ctx, nil, NamedCodec{Name: "a,b", Codec: codec.JSONCodec{}})
+		if err == nil {
+			t.Fatal("expected an error for an invalid name")
+		}
+	})
+}
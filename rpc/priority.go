@@ -0,0 +1,157 @@
+package rpc
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrCallShed is returned by Client.Call for calls dropped from a full call
+// queue to make room for calls of higher priority.
+var ErrCallShed = errors.New("rpc: call shed from full queue")
+
+type priorityKey struct{}
+
+// WithPriority returns a context for making calls with priority p. Calls
+// queued by a Client with MaxCalls set start in order of priority, higher
+// first, and calls of lower priority are shed first. The default priority
+// is zero.
+func WithPriority(ctx context.Context, p int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityOf returns the priority of calls made with ctx.
+func PriorityOf(ctx context.Context) int {
+	p, _ := ctx.Value(priorityKey{}).(int)
+	return p
+}
+
+// callQueue limits the calls in flight of a Client, queuing the others by
+// priority.
+type callQueue struct {
+	mu      sync.Mutex
+	active  int
+	seq     uint64
+	waiters waiterHeap
+}
+
+type queuedCall struct {
+	priority int
+	seq      uint64
+	index    int
+	ready    chan struct{}
+	err      error
+}
+
+// acquire waits until the call can start with fewer than max calls in
+// flight, or fails if ctx is done or the call is shed from a queue of
+// maxQueued calls.
+func (q *callQueue) acquire(ctx context.Context, max, maxQueued int) error {
+	q.mu.Lock()
+	if q.active < max && len(q.waiters) == 0 {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+	w := &queuedCall{priority: PriorityOf(ctx), seq: q.seq, ready: make(chan struct{})}
+	q.seq++
+	if maxQueued > 0 && len(q.waiters) >= maxQueued {
+		victim := q.lowest()
+		if victim.priority >= w.priority {
+			q.mu.Unlock()
+			return ErrCallShed
+		}
+		heap.Remove(&q.waiters, victim.index)
+		victim.err = ErrCallShed
+		close(victim.ready)
+	}
+	heap.Push(&q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return w.err
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		select {
+		case <-w.ready:
+			if w.err == nil {
+				// started just now, so pass the slot on
+				q.releaseLocked(max)
+			}
+		default:
+			heap.Remove(&q.waiters, w.index)
+		}
+		return ctx.Err()
+	}
+}
+
+// lowest returns the queued call of lowest priority, the latest of those
+// with the same priority.
+func (q *callQueue) lowest() *queuedCall {
+	var low *queuedCall
+	for _, w := range q.waiters {
+		if low == nil || w.priority < low.priority || (w.priority == low.priority && w.seq > low.seq) {
+			low = w
+		}
+	}
+	return low
+}
+
+// release ends a call in flight, starting queued calls while fewer than max
+// are in flight. The max can differ from the one the call was acquired with.
+func (q *callQueue) release(max int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked(max)
+}
+
+func (q *callQueue) releaseLocked(max int) {
+	q.active--
+	for q.active < max && len(q.waiters) > 0 {
+		w := heap.Pop(&q.waiters).(*queuedCall)
+		q.active++
+		close(w.ready)
+	}
+}
+
+// stats returns the calls in flight and queued.
+func (q *callQueue) stats() (active, queued int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active, len(q.waiters)
+}
+
+// waiterHeap orders queued calls by priority, then by arrival.
+type waiterHeap []*queuedCall
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*queuedCall)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return w
+}
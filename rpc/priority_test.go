@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientPriority(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+		var name string
+		c.Receive(&name)
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+		<-release
+		r.Return()
+	}))
+	defer client.Close()
+	client.MaxCalls = 1
+	client.MaxQueued = 2
+
+	errs := make(map[string]chan error)
+	call := func(name string, priority int) {
+		done := make(chan error, 1)
+		errs[name] = done
+		go func() {
+			_, err := client.Call(WithPriority(context.Background(), priority), "call", name)
+			done <- err
+		}()
+	}
+	queued := func(active, queued int) {
+		t.Helper()
+		waitFor(t, func() bool {
+			a, q := client.queue.stats()
+			return a == active && q == queued
+		})
+	}
+
+	call("a", 0)
+	queued(1, 0)
+	call("b", 0)
+	queued(1, 1)
+
+	// queued calls fail once their context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.Call(WithPriority(ctx, 10), "call", "f"); err != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	queued(1, 1)
+
+	call("c", 5)
+	queued(1, 2)
+	// the queue is full, so the lowest priority call is shed
+	call("d", 1)
+	if err := <-errs["b"]; err != ErrCallShed {
+		t.Fatal("expected b to be shed, got", err)
+	}
+	queued(1, 2)
+	call("e", 0)
+	if err := <-errs["e"]; err != ErrCallShed {
+		t.Fatal("expected e to be shed, got", err)
+	}
+
+	close(release)
+	for _, name := range []string{"a", "c", "d"} {
+		fatal(t, <-errs[name])
+	}
+	if len(order) != 3 || order[0] != "a" || order[1] != "c" || order[2] != "d" {
+		t.Fatal("unexpected order of calls:", order)
+	}
+	queued(0, 0)
+}
@@ -1,39 +1,154 @@
 package rpc
 
-import "io"
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+)
 
 // ProxyHandler returns a handler that tries its best to proxy the
 // call to the dst Client, regardless of call style and assuming the
 // same encoding.
 func ProxyHandler(dst *Client) Handler {
 	return HandlerFunc(func(r Responder, c *Call) {
-		ch, err := dst.Session.Open(c.Context)
-		if err != nil {
-			r.Return(err)
-			return
-		}
+		proxyCall(dst, r, c)
+	})
+}
 
-		framer := &FrameCodec{Codec: dst.codec}
-		enc := framer.Encoder(ch)
-		err = enc.Encode(CallHeader{
-			Selector: c.Selector,
-		})
-		if err != nil {
-			ch.Close()
-			r.Return(err)
-			return
-		}
+func proxyCall(dst *Client, r Responder, c *Call) {
+	ch, err := dst.Session.Open(c.Context)
+	if err != nil {
+		r.Return(err)
+		return
+	}
 
-		go func() {
-			io.Copy(ch, c.ch)
-			ch.CloseWrite()
-		}()
-		go func() {
-			io.Copy(c.ch, ch)
-			c.ch.Close()
-		}()
-
-		r.(*responder).responded = true
-		r.(*responder).header.Continue = true
-	})
+	framer := &FrameCodec{Codec: dst.codec}
+	enc := framer.Encoder(ch)
+	header := CallHeader{Selector: c.Selector, Chain: c.Chain}
+	if argCounts(dst.Session) {
+		header.Args = c.Args
+	}
+	err = enc.Encode(header)
+	if err != nil {
+		ch.Close()
+		r.Return(err)
+		return
+	}
+
+	src := r.(*responder).channel()
+	go func() {
+		io.Copy(ch, src)
+		ch.CloseWrite()
+	}()
+	go func() {
+		io.Copy(c.ch, ch)
+		c.ch.Close()
+	}()
+
+	r.(*responder).responded = true
+	r.(*responder).header.Continue = true
+}
+
+// ErrNoBackend is returned to callers of a WeightedProxy without backends
+// of positive weight.
+var ErrNoBackend = errors.New("rpc: no backend to proxy to")
+
+// Backend is a destination of a WeightedProxy.
+type Backend struct {
+	Client *Client
+
+	// Weight is the share of calls proxied to the backend relative to the
+	// weights of the others. Backends with no weight get no calls.
+	Weight int
+
+	// Name identifies the backend for sticky routing, so the identities
+	// routed to it stay with it when backends are added or removed. If
+	// empty, the index of the backend is used.
+	Name string
+}
+
+// WeightedProxy is a handler proxying each call like ProxyHandler to one of
+// its Backends, chosen by weight. Registered for selector patterns of a
+// RespondMux, a gateway can canary a new deployment of handlers:
+//
+//	mux.Handle("users.", &rpc.WeightedProxy{Backends: []rpc.Backend{
+//		{Client: stable, Weight: 95},
+//		{Client: canary, Weight: 5},
+//	}})
+//
+// Weights are changed by replacing the proxy with RespondMux.Replace.
+type WeightedProxy struct {
+	Backends []Backend
+
+	// Identity, if set, returns the identity of the caller, such as a
+	// session tag set when authenticating it. Calls of the same identity
+	// are routed to the same backend as long as the backends and weights
+	// stay the same, and when they change only the identities of the
+	// changed share move. Calls with an empty identity are routed
+	// randomly.
+	Identity func(c *Call) string
+}
+
+func (p *WeightedProxy) RespondRPC(r Responder, c *Call) {
+	var identity string
+	if p.Identity != nil {
+		identity = p.Identity(c)
+	}
+	b := p.pick(identity)
+	if b == nil {
+		c.Receive(nil)
+		r.Return(ErrNoBackend)
+		return
+	}
+	proxyCall(b.Client, r, c)
+}
+
+// pick returns the backend for a call by identity, or nil if there is none.
+func (p *WeightedProxy) pick(identity string) *Backend {
+	if identity == "" {
+		total := 0
+		for _, b := range p.Backends {
+			if b.Weight > 0 {
+				total += b.Weight
+			}
+		}
+		if total == 0 {
+			return nil
+		}
+		n := rand.Intn(total)
+		for i, b := range p.Backends {
+			if b.Weight <= 0 {
+				continue
+			}
+			if n -= b.Weight; n < 0 {
+				return &p.Backends[i]
+			}
+		}
+	}
+	// weighted rendezvous hashing gives each backend its share of the
+	// identities, keeping most of them in place as backends change
+	var best *Backend
+	bestScore := 0.0
+	for i, b := range p.Backends {
+		if b.Weight <= 0 {
+			continue
+		}
+		name := b.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		h := fnv.New64a()
+		h.Write([]byte(identity))
+		h.Write([]byte{0})
+		h.Write([]byte(name))
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(b.Weight) / -math.Log(u)
+		if best == nil || score > bestScore {
+			best, bestScore = &p.Backends[i], score
+		}
+	}
+	return best
 }
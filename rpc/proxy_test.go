@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"testing"
 )
 
@@ -64,3 +65,78 @@ func TestProxyHandlerBytestream(t *testing.T) {
 		t.Fatal("unexpected return data:", string(b))
 	}
 }
+
+func TestWeightedProxy(t *testing.T) {
+	ctx := context.Background()
+	backend := func(name string) *Client {
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			c.Receive(nil)
+			r.Return(name)
+		}))
+		return client
+	}
+	stable, canary, drained := backend("stable"), backend("canary"), backend("drained")
+	defer stable.Close()
+	defer canary.Close()
+	defer drained.Close()
+
+	var identity string
+	proxy := &WeightedProxy{
+		Backends: []Backend{
+			{Client: stable, Weight: 3, Name: "stable"},
+			{Client: canary, Weight: 1, Name: "canary"},
+			{Client: drained, Weight: 0, Name: "drained"},
+		},
+		Identity: func(c *Call) string { return identity },
+	}
+	frontmux := NewRespondMux()
+	frontmux.Handle("users.", proxy)
+	client, _ := newTestPair(frontmux)
+	defer client.Close()
+
+	// calls of an identity stick to a backend
+	identity = "alice"
+	var first string
+	_, err := client.Call(ctx, "users.get", nil, &first)
+	fatal(t, err)
+	for i := 0; i < 5; i++ {
+		var out string
+		_, err := client.Call(ctx, "users.get", nil, &out)
+		fatal(t, err)
+		if out != first {
+			t.Fatalf("call of the same identity routed to %s after %s", out, first)
+		}
+	}
+
+	// identities and random calls are shared by weight
+	for _, sticky := range []bool{true, false} {
+		counts := make(map[string]int)
+		for i := 0; i < 4000; i++ {
+			id := ""
+			if sticky {
+				id = "user" + strconv.Itoa(i)
+			}
+			counts[proxy.pick(id).Name]++
+		}
+		if counts["drained"] != 0 || counts["canary"] < 800 || counts["canary"] > 1200 {
+			t.Fatalf("unexpected shares of calls: %v", counts)
+		}
+	}
+
+	// changing the canary's weight only moves identities to or from it
+	heavier := &WeightedProxy{Backends: append([]Backend(nil), proxy.Backends...)}
+	heavier.Backends[1].Weight = 3
+	for i := 0; i < 1000; i++ {
+		id := "user" + strconv.Itoa(i)
+		before, after := proxy.pick(id).Name, heavier.pick(id).Name
+		if before != after && after != "canary" {
+			t.Fatalf("%s moved from %s to %s", id, before, after)
+		}
+	}
+
+	frontmux.Replace("users.", &WeightedProxy{})
+	_, err = client.Call(ctx, "users.get", nil)
+	if err == nil || err.Error() != RemoteError(ErrNoBackend.Error()).Error() {
+		t.Fatal("unexpected error without backends:", err)
+	}
+}
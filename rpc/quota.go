@@ -0,0 +1,248 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Usage is the usage accounted to an identity.
+type Usage struct {
+	Calls int64
+	// BytesReceived and BytesSent are the bytes of calls read and written
+	// until their handlers returned, as reported by CallLog.
+	BytesReceived int64
+	BytesSent     int64
+	// StreamTime is the time handlers of continued calls ran for, which is
+	// how long they streamed for handlers streaming until they return.
+	StreamTime time.Duration
+}
+
+// Bytes returns the bytes received and sent.
+func (u Usage) Bytes() int64 {
+	return u.BytesReceived + u.BytesSent
+}
+
+func (u Usage) add(o Usage) Usage {
+	return Usage{
+		Calls:         u.Calls + o.Calls,
+		BytesReceived: u.BytesReceived + o.BytesReceived,
+		BytesSent:     u.BytesSent + o.BytesSent,
+		StreamTime:    u.StreamTime + o.StreamTime,
+	}
+}
+
+// Quota limits the Usage of an identity. Zero fields are unlimited.
+type Quota struct {
+	Calls      int64         `json:",omitempty"`
+	Bytes      int64         `json:",omitempty"`
+	StreamTime time.Duration `json:",omitempty"`
+}
+
+// exceeded returns which limit of q u has reached, if any.
+func (q Quota) exceeded(u Usage) string {
+	switch {
+	case q.Calls > 0 && u.Calls >= q.Calls:
+		return fmt.Sprintf("%d of %d calls", u.Calls, q.Calls)
+	case q.Bytes > 0 && u.Bytes() >= q.Bytes:
+		return fmt.Sprintf("%d of %d bytes", u.Bytes(), q.Bytes)
+	case q.StreamTime > 0 && u.StreamTime >= q.StreamTime:
+		return fmt.Sprintf("%v of %v streaming", u.StreamTime, q.StreamTime)
+	}
+	return ""
+}
+
+// UsageStore stores the usage of identities, such as in a database shared
+// by the servers of a gateway. Stores resetting usage periodically make the
+// quotas periodic.
+type UsageStore interface {
+	// Usage returns the usage of identity.
+	Usage(identity string) (Usage, error)
+	// AddUsage adds u to the usage of identity.
+	AddUsage(identity string, u Usage) error
+}
+
+// MemoryUsage is a UsageStore keeping usage in memory.
+type MemoryUsage struct {
+	mu    sync.Mutex
+	usage map[string]Usage
+}
+
+func (m *MemoryUsage) Usage(identity string) (Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage[identity], nil
+}
+
+func (m *MemoryUsage) AddUsage(identity string, u Usage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usage == nil {
+		m.usage = make(map[string]Usage)
+	}
+	m.usage[identity] = m.usage[identity].add(u)
+	return nil
+}
+
+// Reset clears the usage of all identities, such as at the start of each
+// quota period.
+func (m *MemoryUsage) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage = nil
+}
+
+// ErrQuotaExceeded is returned to callers whose identity has reached its
+// quota. Callers receive it as a RemoteError naming the exceeded limit.
+var ErrQuotaExceeded = errors.New("rpc: quota exceeded")
+
+// UsageSelector is the selector the handler returned by
+// Accountant.UsageHandler is conventionally registered at.
+const UsageSelector = "rpc.usage"
+
+// UsageReport is the reply of the UsageHandler of an Accountant.
+type UsageReport struct {
+	Identity string
+	Usage    Usage
+	Quota    Quota
+}
+
+// Accountant accounts the usage of the calls of the handlers it wraps to the
+// identity of their callers, and enforces their quotas:
+//
+//	acct := &rpc.Accountant{
+//		Identity: func(c *rpc.Call) string {
+//			return srv.Tags(c.Caller.(*rpc.Client).Session)["tenant"]
+//		},
+//		Quota: func(tenant string) rpc.Quota { return plans[tenant] },
+//	}
+//	mux.Handle("/", acct.Handler(api))
+//	mux.Handle(rpc.UsageSelector, acct.UsageHandler())
+//
+// Calls of identities that reached a limit of their quota fail with
+// ErrQuotaExceeded without invoking the handler. Usage is added once the
+// handler returns, so concurrent calls can exceed a quota by the calls in
+// progress.
+type Accountant struct {
+	// Store stores the usage. If nil, usage is kept in memory.
+	Store UsageStore
+
+	// Identity returns the identity of the caller, such as a session tag
+	// set when authenticating it.
+	Identity func(c *Call) string
+
+	// Quota, if set, returns the quota of an identity.
+	Quota func(identity string) Quota
+
+	// ErrorLog specifies an optional logger for errors of the Store. If
+	// nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+
+	once  sync.Once
+	store UsageStore
+}
+
+func (a *Accountant) usageStore() UsageStore {
+	a.once.Do(func() {
+		a.store = a.Store
+		if a.store == nil {
+			a.store = &MemoryUsage{}
+		}
+	})
+	return a.store
+}
+
+func (a *Accountant) quota(identity string) Quota {
+	if a.Quota == nil {
+		return Quota{}
+	}
+	return a.Quota(identity)
+}
+
+// Handler returns a handler accounting the calls to h. A handler with a
+// Match method like a RespondMux keeps being registered as a submux, and
+// every handler it matches is accounted.
+func (a *Accountant) Handler(h Handler) Handler {
+	qh := &quotaHandler{Handler: h, a: a}
+	if m, ok := h.(matcher); ok {
+		return &quotaMatcher{quotaHandler: qh, m: m}
+	}
+	return qh
+}
+
+// UsageHandler returns a handler replying with the UsageReport of the
+// identity of the caller.
+func (a *Accountant) UsageHandler() Handler {
+	return HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		identity := a.Identity(c)
+		usage, err := a.usageStore().Usage(identity)
+		if err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(UsageReport{Identity: identity, Usage: usage, Quota: a.quota(identity)})
+	})
+}
+
+type quotaHandler struct {
+	Handler
+	a *Accountant
+}
+
+// quotaMatcher is the quotaHandler of a submux.
+type quotaMatcher struct {
+	*quotaHandler
+	m matcher
+}
+
+func (h *quotaMatcher) Match(selector string) (Handler, string) {
+	sub, pattern := h.m.Match(selector)
+	if sub == nil {
+		return nil, ""
+	}
+	return &quotaHandler{Handler: sub, a: h.a}, pattern
+}
+
+func (h *quotaHandler) RespondRPC(r Responder, c *Call) {
+	store := h.a.usageStore()
+	identity := h.a.Identity(c)
+	usage, err := store.Usage(identity)
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	if limit := h.a.quota(identity).exceeded(usage); limit != "" {
+		r.Return(fmt.Errorf("%w: %s used %s", ErrQuotaExceeded, identity, limit))
+		return
+	}
+
+	start := time.Now()
+	resp, _ := r.(*responder)
+	defer func() {
+		u := Usage{Calls: 1}
+		if resp != nil {
+			if resp.counter != nil {
+				u.BytesReceived = resp.counter.received.Load()
+				u.BytesSent = resp.counter.sent.Load()
+			}
+			if resp.header.Continue {
+				u.StreamTime = time.Since(start)
+			}
+		}
+		if err := store.AddUsage(identity, u); err != nil {
+			h.a.logf("rpc: adding usage of %s: %v", identity, err)
+		}
+	}()
+	h.Handler.RespondRPC(r, c)
+}
+
+func (a *Accountant) logf(format string, args ...any) {
+	if a.ErrorLog != nil {
+		a.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountant(t *testing.T) {
+	store := &MemoryUsage{}
+	acct := &Accountant{
+		Store:    store,
+		Identity: func(c *Call) string { return "tenant" },
+		Quota:    func(string) Quota { return Quota{Calls: 3} },
+	}
+	mux := NewRespondMux()
+	mux.Handle("echo", acct.Handler(HandlerFunc(func(r Responder, c *Call) {
+		var s string
+		if err := c.Receive(&s); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(s)
+	})))
+	mux.Handle("stream", acct.Handler(HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		ch, err := r.Continue()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+		time.Sleep(10 * time.Millisecond)
+	})))
+	mux.Handle(UsageSelector, acct.UsageHandler())
+	client, _ := newTestPair(mux)
+	defer client.Close()
+	ctx := context.Background()
+
+	_, err := client.Call(ctx, "echo", "hello")
+	fatal(t, err)
+	resp, err := client.Call(ctx, "stream", nil)
+	fatal(t, err)
+	resp.Receive(nil)
+
+	// usage is added once the handlers returned
+	var report UsageReport
+	for i := 0; i < 1000; i++ {
+		_, err := client.Call(ctx, UsageSelector, nil, &report)
+		fatal(t, err)
+		if report.Usage.Calls == 2 && report.Usage.StreamTime > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	u := report.Usage
+	if report.Identity != "tenant" || report.Quota.Calls != 3 || u.Calls != 2 ||
+		u.BytesReceived == 0 || u.BytesSent == 0 || u.StreamTime < 10*time.Millisecond {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	_, err = client.Call(ctx, "echo", "hello")
+	fatal(t, err)
+	for i := 0; i < 1000; i++ {
+		if u, _ := store.Usage("tenant"); u.Calls == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, err = client.Call(ctx, "echo", "hello")
+	var remote RemoteError
+	if !errors.As(err, &remote) || !strings.Contains(err.Error(), ErrQuotaExceeded.Error()+": tenant used 3 of 3 calls") {
+		t.Fatal("unexpected error:", err)
+	}
+
+	store.Reset()
+	_, err = client.Call(ctx, "echo", "hello")
+	fatal(t, err)
+}
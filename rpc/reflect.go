@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"sort"
+	"strings"
+)
+
+// ReflectSelector is the conventional selector used to register a
+// ReflectionHandler, allowing peers to discover what a server handles.
+const ReflectSelector = "qtalk.reflect"
+
+// Reflection is the reply value of a ReflectionHandler.
+type Reflection struct {
+	// Selectors are the normalized patterns registered on the RespondMux,
+	// including patterns of any submuxes.
+	Selectors []string
+
+	// Schemas are the schemas of handlers registered using WithSchema,
+	// keyed by their normalized pattern.
+	Schemas map[string]Schema `json:",omitempty"`
+}
+
+// ReflectionHandler returns a handler that replies with a Reflection
+// describing the patterns and schemas currently registered on m.
+func ReflectionHandler(m *RespondMux) Handler {
+	return HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		r.Return(Reflection{Selectors: m.Patterns(), Schemas: m.Schemas()})
+	})
+}
+
+// Patterns returns the sorted list of registered patterns in their normalized
+// form. Patterns of submuxes are included prefixed by their parent pattern.
+func (m *RespondMux) Patterns() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var patterns []string
+	for pattern, e := range m.m {
+		h := e.h
+		if sm, ok := h.(*schemaMatcher); ok {
+			h = sm.Handler
+		}
+		sub, ok := h.(*RespondMux)
+		if !ok {
+			patterns = append(patterns, pattern)
+			continue
+		}
+		for _, p := range sub.Patterns() {
+			patterns = append(patterns, pattern+strings.TrimPrefix(p, "/"))
+		}
+	}
+	sort.Strings(patterns)
+	return patterns
+}
@@ -2,6 +2,11 @@ package rpc
 
 import (
 	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/roachadam/qtalk-go/codec"
 	"github.com/roachadam/qtalk-go/mux"
@@ -27,28 +32,144 @@ type Caller interface {
 // CallHeader is the first value encoded over the channel to make a call.
 type CallHeader struct {
 	Selector string
+
+	// Args is the number of argument values following the header, or -1 if
+	// they are a stream of values ending with an empty frame. It is zero if
+	// not known, as with older clients. Clients only send it on sessions that
+	// negotiated mux.FeatureCallArgs.
+	Args int `json:",omitempty"`
+
+	// Chain is the selectors of the calls this call was made in handling,
+	// outermost first, when made with the Context of a Call. Servers use it
+	// to reject calls nested deeper than their MaxCallDepth.
+	Chain []string `json:",omitempty"`
 }
 
+// streamArgs is the CallHeader Args value of streamed arguments.
+const streamArgs = -1
+
 // Call is used on the responding side of a call and is passed to the handler.
 // Call has a Caller so it can be used to make calls back to the calling side.
+//
+// The Caller of calls served by a Server is a *Client shared by all calls on
+// the session, created by Server.NewCaller if set. Calls back are served by
+// the calling side concurrently with its other calls, so handlers can call
+// back synchronously and nest calls back and forth, provided the calling
+// side serves its session. Each level of nesting holds a handler goroutine
+// and a channel until it returns, so handlers waiting on each other in a
+// cycle deadlock. Calls back should use the Call Context, so they end with
+// the session.
+//
+// The Context of calls served by a Server is cancelled once the channel of
+// the call is closed, by the caller, by the handler returning or closing a
+// continued call, or by the end of the session, so handlers streaming on a
+// continued call can stop producing once the caller is gone.
 type Call struct {
 	CallHeader
 
 	Caller  Caller
 	Decoder codec.Decoder
 	Context context.Context
-	ch      mux.Channel
+
+	// Pattern is the normalized pattern of the handler a RespondMux
+	// dispatched the call to, and for prefix patterns Rest is the
+	// remainder of the normalized selector after it.
+	Pattern string
+	Rest    string
+
+	// ChannelID and RemoteChannelID are the local and remote IDs of the
+	// channel of the call, matching the RemoteChannelID and ChannelID of
+	// the Response on the calling side. RemoteChannelID is zero unless the
+	// channel is a mux.RemoteIDer. SessionID is the ID of the local
+	// session it was accepted on, if it is a mux.Identifier.
+	ChannelID       uint32
+	RemoteChannelID uint32
+	SessionID       string
+
+	ch mux.Channel
+
+	// closed, if set, is closed once ch is closed, before the Context is
+	// cancelled for it
+	closed chan struct{}
+
+	received int
+
+	// trace, if set, traces values received from streamed args or after
+	// continuing the call
+	trace *streamTrace
+	resp  *responder
 }
 
 // Receive will decode an incoming value from the underlying channel. It can be
 // called more than once when multiple values are expected, but should always be
 // called once in a handler. It can be called with nil to discard the value.
+// Receive returns io.EOF once all values of streamed arguments were received.
+//
+// If the Call Context has a deadline and the channel supports read deadlines,
+// it is used as the read deadline of the channel while decoding and Receive
+// will return context.DeadlineExceeded once it passes. The channel should not
+// be used for further decoding after that. The deadline is cleared before
+// Receive returns, so it does not apply to a continued channel.
 func (c *Call) Receive(v interface{}) error {
 	if v == nil {
 		var discard []byte
 		v = &discard
 	}
-	return c.Decoder.Decode(v)
+	if d, ok := c.ch.(mux.ReadDeadliner); ok && c.Context != nil {
+		if deadline, ok := c.Context.Deadline(); ok {
+			if err := d.SetReadDeadline(deadline); err != nil {
+				return err
+			}
+			defer d.SetReadDeadline(time.Time{})
+		}
+	}
+	var traced bool
+	var before int64
+	var start time.Time
+	if c.trace != nil && (c.Args == streamArgs || (c.resp != nil && c.resp.header.Continue)) {
+		traced = true
+		before, start = c.trace.start(false)
+	}
+	err := c.Decoder.Decode(v)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = context.DeadlineExceeded
+	}
+	if traced {
+		c.trace.event(false, before, start, err)
+	}
+	if err == nil {
+		c.received++
+	}
+	return err
+}
+
+// More returns whether more argument values remain to be received, so
+// handlers accepting a variable number of arguments know when to stop
+// calling Receive. For streamed arguments it may block until the next value
+// or the end of the stream arrives, reading the length of the next frame
+// ahead. The channel returned by Responder.Continue returns those bytes
+// first, so reading it directly afterwards still starts at that frame. If
+// the client did not send the number of arguments, More assumes a single
+// argument value.
+func (c *Call) More() bool {
+	switch {
+	case c.Args > 0:
+		return c.received < c.Args
+	case c.Args == streamArgs:
+		if d, ok := c.Decoder.(peeker); ok {
+			size, err := d.peek()
+			return err == nil && size != 0
+		}
+		return true
+	default:
+		return c.received == 0
+	}
+}
+
+// peeker is implemented by decoders able to report the size of the next
+// frame without consuming it.
+type peeker interface {
+	peek() (uint32, error)
 }
 
 // ResponseHeader is the value encoded over the channel to indicate a response.
@@ -66,17 +187,74 @@ type Response struct {
 	Reply   interface{}
 	Channel mux.Channel
 
+	// ChannelID and RemoteChannelID are the local and remote IDs of the
+	// channel used for the call, the latter if it is a mux.RemoteIDer, and
+	// SessionID the ID of the session it was opened on, if it is a
+	// mux.Identifier.
+	ChannelID       uint32
+	RemoteChannelID uint32
+	SessionID       string
+
+	// Duration is the time from opening the call channel until the reply
+	// was received.
+	Duration time.Duration
+
+	// BytesSent and BytesReceived are the number of bytes written and read
+	// on the channel until the reply was received, including framing.
+	BytesSent     int64
+	BytesReceived int64
+
 	codec codec.Codec
+	enc   codec.Encoder
+	dec   codec.Decoder
+	trace *streamTrace
+
+	// counter counts the bytes of the call on Channel
+	counter *countingChannel
+
+	// streamErr is the error ending a stream received with ReceiveStream
+	streamErr error
+
+	// autoGrant is the credits granted each time as many values were
+	// received by ReceiveStream, counted by received
+	autoGrant int
+	received  int
 }
 
 // Send encodes a value over the underlying channel if it is still open.
 func (r *Response) Send(v interface{}) error {
-	return r.codec.Encoder(r.Channel).Encode(v)
+	if r.enc == nil {
+		r.enc = r.codec.Encoder(r.Channel)
+	}
+	if r.trace == nil {
+		return r.enc.Encode(v)
+	}
+	before, start := r.trace.start(true)
+	err := r.enc.Encode(v)
+	r.trace.event(true, before, start, err)
+	return err
+}
+
+// SendContext is like Send, but gives up once ctx is done, such as when
+// the handler stopped reading and the channel has no window left. The
+// channel is closed when giving up, since a value may have been partially
+// sent, and the error of ctx is returned.
+func (r *Response) SendContext(ctx context.Context, v interface{}) error {
+	return sendContext(ctx, r.Channel, func() error { return r.Send(v) })
 }
 
 // Receive decodes a value from the underlying channel if it is still open.
 func (r *Response) Receive(v interface{}) error {
-	return r.codec.Decoder(r.Channel).Decode(v)
+	if r.dec == nil {
+		r.dec = r.codec.Decoder(r.Channel)
+	}
+	if r.trace == nil {
+		return r.dec.Decode(v)
+	}
+	before, start := r.trace.start(false)
+	err := r.dec.Decode(v)
+	r.trace.event(false, before, start, err)
+	return err
 }
 
 // Responder is used by handlers to initiate a response and send values to the caller.
@@ -86,12 +264,20 @@ type Responder interface {
 
 	// Continue sets the response to keep the channel open after sending a return value,
 	// and returns the underlying channel for you to take control of. If called, you
-	// become responsible for closing the channel.
+	// become responsible for closing the channel. It is a mux.CloseNotifier if the
+	// channels of the session are, to stop producing once the caller is gone.
 	Continue(...any) (mux.Channel, error)
 
 	// Send encodes a value over the underlying channel, but does not initiate a response,
 	// so it must be used after calling Continue.
 	Send(interface{}) error
+
+	// SendContext is like Send, but gives up once ctx is done, such as when
+	// the caller stopped reading and the channel has no window left, so
+	// streaming handlers can abandon slow callers. The channel is closed
+	// when giving up, since a value may have been partially sent, and the
+	// error of ctx is returned.
+	SendContext(ctx context.Context, v interface{}) error
 }
 
 type responder struct {
@@ -99,10 +285,122 @@ type responder struct {
 	header    *ResponseHeader
 	ch        mux.Channel
 	c         codec.Codec
+	enc       codec.Encoder
+
+	// dec is the decoder of the call, which may have peeked at the next frame
+	dec *frameDecoder
+
+	// counter, if set, is ch counting the bytes of the call, which values
+	// are sent on
+	counter *countingChannel
+
+	// values are the values responded with, kept if record is set
+	record bool
+	values []any
+
+	// trace, if set, traces values sent once streaming after continuing
+	// the call
+	trace     *streamTrace
+	streaming bool
+
+	// idle, if set, is ch closed when idle once the call is continued
+	idle *idleChannel
+}
+
+// channel returns the channel of the call for reading it directly, which
+// first returns any frame prefix the call decoder peeked at in Call.More.
+func (r *responder) channel() mux.Channel {
+	if r.dec != nil {
+		if prefix := r.dec.unread(); prefix != nil {
+			return &prefixChannel{Channel: r.ch, prefix: prefix}
+		}
+	}
+	return r.ch
+}
+
+// prefixChannel is a channel returning prefix before reading the channel.
+type prefixChannel struct {
+	mux.Channel
+	prefix []byte
+}
+
+func (c *prefixChannel) OnClose(f func()) {
+	onClose(c.Channel, f)
+}
+
+// onClose calls f once ch is closed, if ch is a mux.CloseNotifier, and
+// reports whether it is.
+func onClose(ch mux.Channel, f func()) bool {
+	if cn, ok := ch.(mux.CloseNotifier); ok {
+		cn.OnClose(f)
+		return true
+	}
+	return false
+}
+
+func (c *prefixChannel) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Channel.Read(p)
 }
 
 func (r *responder) Send(v interface{}) error {
-	return r.c.Encoder(r.ch).Encode(v)
+	if r.enc == nil {
+		var w io.Writer = r.ch
+		if r.counter != nil {
+			w = r.counter
+		}
+		r.enc = r.c.Encoder(w)
+	}
+	if r.trace == nil || !r.streaming {
+		return r.enc.Encode(v)
+	}
+	before, start := r.trace.start(true)
+	err := r.enc.Encode(v)
+	r.trace.event(true, before, start, err)
+	return err
+}
+
+func (r *responder) SendContext(ctx context.Context, v interface{}) error {
+	return sendContext(ctx, r.ch, func() error { return r.Send(v) })
+}
+
+// sendContext calls send, closing ch if ctx is done before it returns to
+// abort a send blocked on the peer.
+func sendContext(ctx context.Context, ch mux.Channel, send func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return send()
+	}
+	var mu sync.Mutex
+	var returned, aborted bool
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !returned {
+				aborted = true
+				ch.Close()
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+	err := send()
+	mu.Lock()
+	returned = true
+	mu.Unlock()
+	close(done)
+	if aborted {
+		return ctx.Err()
+	}
+	return err
 }
 
 func (r *responder) Return(v ...any) error {
@@ -110,12 +408,15 @@ func (r *responder) Return(v ...any) error {
 }
 
 func (r *responder) Continue(v ...any) (mux.Channel, error) {
-	return r.ch, r.respond(v, true)
+	return r.channel(), r.respond(v, true)
 }
 
 func (r *responder) respond(values []any, continue_ bool) error {
 	r.responded = true
 	r.header.Continue = continue_
+	if r.record {
+		r.values = values
+	}
 
 	// if values is a single error, set values to [nil]
 	// and put error in header
@@ -149,6 +450,27 @@ func (r *responder) respond(values []any, continue_ bool) error {
 	if !continue_ {
 		return r.ch.Close()
 	}
+	r.streaming = true
+	if r.idle != nil {
+		r.idle.start()
+	}
 
 	return nil
 }
+
+type callChainKey struct{}
+
+// withCallChain returns a context for handling a call to selector nested in
+// the calls of chain, for calls made with it to be nested in the call.
+func withCallChain(ctx context.Context, chain []string, selector string) context.Context {
+	nested := make([]string, len(chain)+1)
+	copy(nested, chain)
+	nested[len(chain)] = selector
+	return context.WithValue(ctx, callChainKey{}, nested)
+}
+
+// callChain returns the chain of calls being handled with ctx.
+func callChain(ctx context.Context) []string {
+	chain, _ := ctx.Value(callChainKey{}).([]string)
+	return chain
+}
@@ -1,11 +1,18 @@
 package rpc
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -21,10 +28,26 @@ func fatal(t *testing.T, err error) {
 }
 
 func newTestPair(handler Handler) (*Client, *Server) {
+	return newTestPairConfig(handler, nil)
+}
+
+// pipeConn joins the ends of two pipes into a transport.
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (c pipeConn) Close() error {
+	c.PipeWriter.Close()
+	return c.PipeReader.Close()
+}
+
+// newTestPairConfig is newTestPair with sessions using config.
+func newTestPairConfig(handler Handler, config *mux.SessionConfig) (*Client, *Server) {
 	ar, bw := io.Pipe()
 	br, aw := io.Pipe()
-	sessA, _ := mux.DialIO(aw, ar)
-	sessB, _ := mux.DialIO(bw, br)
+	sessA := mux.NewWithConfig(pipeConn{ar, aw}, config)
+	sessB := mux.NewWithConfig(pipeConn{br, bw}, config)
 
 	srv := &Server{
 		Codec:   codec.JSONCodec{},
@@ -36,12 +59,6 @@ func newTestPair(handler Handler) (*Client, *Server) {
 }
 
 func TestServerNoCodec(t *testing.T) {
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("did not panic from unset codec")
-		}
-	}()
-
 	ar, _ := io.Pipe()
 	_, aw := io.Pipe()
 	sessA, _ := mux.DialIO(aw, ar)
@@ -49,8 +66,506 @@ func TestServerNoCodec(t *testing.T) {
 	srv := &Server{
 		Handler: NotFoundHandler(),
 	}
-	go sessA.Close()
-	srv.Respond(sessA, nil)
+	if err := srv.Respond(sessA, nil); err != ErrNilCodec {
+		t.Fatalf("expected nil codec error, got %v", err)
+	}
+}
+
+func TestServerServeSession(t *testing.T) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA, _ := mux.DialIO(aw, ar)
+	sessB, _ := mux.DialIO(bw, br)
+	client := NewClient(sessB, codec.JSONCodec{})
+
+	srv := &Server{
+		Codec: codec.JSONCodec{},
+		Handler: HandlerFunc(func(r Responder, c *Call) {
+			r.Return("pong")
+		}),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ServeSession(context.Background(), sessA)
+	}()
+
+	var out string
+	_, err := client.Call(context.Background(), "ping", nil, &out)
+	fatal(t, err)
+	if out != "pong" {
+		t.Fatal("unexpected reply:", out)
+	}
+	client.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal("unexpected error serving closed session:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeSession did not return after session was closed")
+	}
+}
+
+func TestServerPanic(t *testing.T) {
+	var logs bytes.Buffer
+	client, srv := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		panic("boom")
+	}))
+	defer client.Close()
+	srv.ErrorLog = log.New(&logs, "", 0)
+
+	_, err := client.Call(context.Background(), "explode", nil)
+	if err != RemoteError(ErrInternal.Error()) {
+		t.Fatalf("expected internal error, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "panic serving /explode: boom") ||
+		!strings.Contains(logs.String(), "goroutine") {
+		t.Fatalf("expected panic and stack to be logged, got %q", logs.String())
+	}
+}
+
+// flakyListener returns temporary errors before its sessions, then err.
+type flakyListener struct {
+	temporary int
+	sessions  []mux.Session
+	err       error
+}
+
+func (l *flakyListener) Accept() (mux.Session, error) {
+	if l.temporary > 0 {
+		l.temporary--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	if len(l.sessions) > 0 {
+		sess := l.sessions[0]
+		l.sessions = l.sessions[1:]
+		return sess, nil
+	}
+	return nil, l.err
+}
+
+func (l *flakyListener) Close() error   { return nil }
+func (l *flakyListener) Addr() net.Addr { return nil }
+
+func TestServerServeMuxTemporary(t *testing.T) {
+	var logs bytes.Buffer
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA := mux.New(pipeConn{ar, aw})
+	sessB := mux.New(pipeConn{br, bw})
+	defer sessB.Close()
+
+	l := &flakyListener{temporary: 3, sessions: []mux.Session{sessA}, err: net.ErrClosed}
+	srv := &Server{
+		Codec:    codec.JSONCodec{},
+		Handler:  HandlerFunc(func(r Responder, c *Call) { r.Return("ok") }),
+		ErrorLog: log.New(&logs, "", 0),
+	}
+	if err := srv.ServeMux(l); err != net.ErrClosed {
+		t.Fatal("unexpected error:", err)
+	}
+	if n := strings.Count(logs.String(), "too many open files; retrying"); n != 3 {
+		t.Fatalf("expected 3 retries to be logged, got %q", logs.String())
+	}
+
+	// the session accepted after the errors is served
+	var out string
+	_, err := NewClient(sessB, codec.JSONCodec{}).Call(context.Background(), "test", nil, &out)
+	fatal(t, err)
+	if out != "ok" {
+		t.Fatal("unexpected reply:", out)
+	}
+}
+
+func TestServerRespondContext(t *testing.T) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA, _ := mux.DialIO(aw, ar)
+	sessB, _ := mux.DialIO(bw, br)
+	client := NewClient(sessB, codec.JSONCodec{})
+	defer client.Close()
+
+	started := make(chan struct{})
+	srv := &Server{
+		Codec: codec.JSONCodec{},
+		Handler: HandlerFunc(func(r Responder, c *Call) {
+			c.Receive(nil)
+			close(started)
+			<-c.Context.Done()
+			r.Return(c.Context.Err())
+		}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	responded := make(chan error, 1)
+	go func() {
+		responded <- srv.Respond(sessA, ctx)
+	}()
+
+	called := make(chan error)
+	go func() {
+		_, err := client.Call(context.Background(), "wait", nil)
+		called <- err
+	}()
+	<-started
+	cancel()
+
+	// the in-flight call is drained before the session is closed
+	if err := <-called; err == nil || !strings.Contains(err.Error(), "context canceled") {
+		t.Fatalf("expected call context to be cancelled, got %v", err)
+	}
+	select {
+	case err := <-responded:
+		if err != context.Canceled {
+			t.Fatal("expected Respond to return context error, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Respond did not return after context was cancelled")
+	}
+	if _, err := client.Call(context.Background(), "wait", nil); err == nil {
+		t.Fatal("expected call after Respond returned to fail")
+	}
+}
+
+// blockingReply is a reply that blocks encoding until released.
+type blockingReply struct {
+	encoding chan struct{}
+	release  chan struct{}
+}
+
+func (b blockingReply) MarshalJSON() ([]byte, error) {
+	close(b.encoding)
+	<-b.release
+	return []byte(`"done"`), nil
+}
+
+// countingCodec is a JSON codec counting the values it encodes.
+type countingCodec struct {
+	codec.JSONCodec
+	n *int32
+}
+
+func (c countingCodec) Encoder(w io.Writer) codec.Encoder {
+	atomic.AddInt32(c.n, 1)
+	return c.JSONCodec.Encoder(w)
+}
+
+func TestServerCaller(t *testing.T) {
+	ctx := context.Background()
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA := mux.New(pipeConn{ar, aw})
+	sessB := mux.New(pipeConn{br, bw})
+	defer sessB.Close()
+
+	// both sides serve calls decrementing n and calling back with it until
+	// it reaches zero, so calls nest back and forth
+	var mu sync.Mutex
+	callers := map[Caller]bool{}
+	nested := func(record bool) Handler {
+		return HandlerFunc(func(r Responder, c *Call) {
+			var n int
+			fatal(t, c.Receive(&n))
+			if record {
+				mu.Lock()
+				callers[c.Caller] = true
+				mu.Unlock()
+			}
+			if n == 0 {
+				r.Return(0)
+				return
+			}
+			var depth int
+			if _, err := c.Caller.Call(c.Context, "nested", n-1, &depth); err != nil {
+				r.Return(err)
+				return
+			}
+			r.Return(depth + 1)
+		})
+	}
+	var created, validated int32
+	srv := &Server{
+		Codec:   codec.JSONCodec{},
+		Handler: nested(true),
+		NewCaller: func(sess mux.Session, cd codec.Codec) *Client {
+			atomic.AddInt32(&created, 1)
+			client := NewClient(sess, cd)
+			client.ValidateReply = func(selector string, resp *Response) error {
+				atomic.AddInt32(&validated, 1)
+				return nil
+			}
+			return client
+		},
+	}
+	go srv.Respond(sessA, nil)
+	peer := &Server{Codec: codec.JSONCodec{}, Handler: nested(false)}
+	go peer.Respond(sessB, nil)
+
+	client := NewClient(sessB, codec.JSONCodec{})
+	for i := 0; i < 2; i++ {
+		var depth int
+		_, err := client.Call(ctx, "nested", 6, &depth)
+		fatal(t, err)
+		if depth != 6 {
+			t.Fatal("unexpected depth:", depth)
+		}
+	}
+	if len(callers) != 1 || atomic.LoadInt32(&created) != 1 {
+		t.Fatalf("expected one caller for the session, got %d created %d", len(callers), created)
+	}
+	// the server side makes 3 of the 6 nested calls of each call
+	if n := atomic.LoadInt32(&validated); n != 6 {
+		t.Fatal("unexpected number of validated replies of calls back:", n)
+	}
+	clients, err := srv.FindSessions("")
+	fatal(t, err)
+	if len(clients) != 1 || !callers[clients[0]] {
+		t.Fatal("FindSessions did not return the caller of the session")
+	}
+}
+
+func TestServerSingleChannel(t *testing.T) {
+	ctx := context.Background()
+	var opens int32
+	config := &mux.SessionConfig{
+		SingleChannel: true,
+		OnChannelOpen: func(mux.Channel, bool) { atomic.AddInt32(&opens, 1) },
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(t, err)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(t, err)
+	sconn, err := l.Accept()
+	fatal(t, err)
+	sessA := mux.NewWithConfig(sconn, &mux.SessionConfig{SingleChannel: true})
+	sessB := mux.NewWithConfig(conn, config)
+	defer sessB.Close()
+
+	m := NewRespondMux()
+	m.Handle("echo", HandlerFunc(func(r Responder, c *Call) {
+		var v any
+		c.Receive(&v)
+		r.Return(v)
+	}))
+	m.Handle("back", HandlerFunc(func(r Responder, c *Call) {
+		var v, reply any
+		c.Receive(&v)
+		if _, err := c.Caller.Call(c.Context, "echo", v, &reply); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(reply)
+	}))
+	m.Handle("count", HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		StreamReplies(r, func(send func(v any) error) error {
+			for i := 0; i < 3; i++ {
+				if err := send(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}))
+	go (&Server{Codec: codec.JSONCodec{}, Handler: m}).Respond(sessA, nil)
+	go (&Server{Codec: codec.JSONCodec{}, Handler: m}).Respond(sessB, nil)
+	client := NewClient(sessB, codec.JSONCodec{})
+
+	// calls are carried one at a time, calls back included
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			selector := "echo"
+			if i%2 == 1 {
+				selector = "back"
+			}
+			var reply int
+			_, err := client.Call(ctx, selector, i, &reply)
+			if err == nil && reply != i {
+				err = fmt.Errorf("unexpected reply %d to %d", reply, i)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	resp, err := client.Call(ctx, "count", nil)
+	fatal(t, err)
+	var n, received int
+	for err = resp.ReceiveStream(&n); err == nil; err = resp.ReceiveStream(&n) {
+		received++
+	}
+	if err != io.EOF || received != 3 {
+		t.Fatalf("received %d values and %v", received, err)
+	}
+	if n := atomic.LoadInt32(&opens); n != 1 {
+		t.Fatalf("opened %d channels of the session, expected 1", n)
+	}
+}
+
+func TestServerMaxCallDepth(t *testing.T) {
+	ctx := context.Background()
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA := mux.New(pipeConn{ar, aw})
+	sessB := mux.New(pipeConn{br, bw})
+	defer sessB.Close()
+
+	// the handlers call back until n reaches zero, without a limit on the
+	// client side
+	ping := HandlerFunc(func(r Responder, c *Call) {
+		var n int
+		fatal(t, c.Receive(&n))
+		if n > 0 {
+			if _, err := c.Caller.Call(c.Context, "ping", n-1); err != nil {
+				r.Return(err)
+				return
+			}
+		}
+		r.Return()
+	})
+	srv := &Server{Codec: codec.JSONCodec{}, Handler: ping, MaxCallDepth: 4}
+	go srv.Respond(sessA, nil)
+	peer := &Server{Codec: codec.JSONCodec{}, Handler: ping, MaxCallDepth: -1}
+	go peer.Respond(sessB, nil)
+
+	client := NewClient(sessB, codec.JSONCodec{})
+	_, err := client.Call(ctx, "ping", 5)
+	fatal(t, err)
+
+	_, err = client.Call(ctx, "ping", 6)
+	if err == nil || !strings.Contains(err.Error(), ErrCallDepth.Error()) ||
+		!strings.Contains(err.Error(), "/ping nested in 6 calls exceeds 4") {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestServerMalformedCall(t *testing.T) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA := mux.New(pipeConn{ar, aw})
+	sessB := mux.New(pipeConn{br, bw})
+	defer sessB.Close()
+
+	malformed := make(chan error, 1)
+	srv := &Server{
+		Codec:    codec.JSONCodec{},
+		Handler:  NotFoundHandler(),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+		OnMalformedCall: func(sess mux.Session, err error) {
+			malformed <- err
+		},
+	}
+	go srv.Respond(sessA, nil)
+
+	ch, err := sessB.Open(context.Background())
+	fatal(t, err)
+	defer ch.Close()
+	_, err = ch.Write([]byte{0, 0, 0, 5, '{', 'n', 'o', 'p', 'e'})
+	fatal(t, err)
+
+	// the caller is told instead of waiting for the channel to close
+	var header ResponseHeader
+	fatal(t, (&FrameCodec{Codec: codec.JSONCodec{}}).Decoder(ch).Decode(&header))
+	if header.Error == nil || !strings.HasPrefix(*header.Error, ErrMalformedCall.Error()) {
+		t.Fatalf("unexpected response %+v", header)
+	}
+	if err := <-malformed; err == nil {
+		t.Fatal("expected the decoding error")
+	}
+	if n := srv.Stats().MalformedCalls; n != 1 {
+		t.Fatalf("expected 1 malformed call, got %d", n)
+	}
+}
+
+func TestServerContinueIdleTimeout(t *testing.T) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	sessA := mux.New(pipeConn{ar, aw})
+	sessB := mux.New(pipeConn{br, bw})
+	defer sessB.Close()
+
+	srv := &Server{
+		Codec:               codec.JSONCodec{},
+		ErrorLog:            log.New(ioutil.Discard, "", 0),
+		ContinueIdleTimeout: 100 * time.Millisecond,
+		Handler: HandlerFunc(func(r Responder, c *Call) {
+			var n int
+			fatal(t, c.Receive(&n))
+			// the channel is left open after sending
+			r.Continue()
+			for i := 0; i < n; i++ {
+				time.Sleep(10 * time.Millisecond)
+				r.Send(i)
+			}
+		}),
+	}
+	go srv.Respond(sessA, nil)
+	client := NewClient(sessB, codec.JSONCodec{})
+
+	// sending keeps the channel open past the timeout
+	resp, err := client.Call(context.Background(), "", 5)
+	fatal(t, err)
+	for i := 0; i < 5; i++ {
+		var v int
+		fatal(t, resp.Receive(&v))
+	}
+	var v int
+	if err := resp.Receive(&v); err == nil {
+		t.Fatal("expected the idle channel to be closed")
+	}
+	// the close is counted after it is sent
+	for i := 0; i < 100 && srv.Stats().IdleClosed == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := srv.Stats().IdleClosed; n != 1 {
+		t.Fatalf("expected 1 idle channel closed, got %d", n)
+	}
+}
+
+func TestServerCodecSelector(t *testing.T) {
+	const featureCounting mux.Features = 1 << 20
+	var counted int32
+	srv := &Server{
+		Codec: codec.JSONCodec{},
+		CodecSelector: func(sess mux.Session) codec.Codec {
+			if _, features := sess.(mux.Negotiator).Protocol(); features.Has(featureCounting) {
+				return countingCodec{n: &counted}
+			}
+			return nil
+		},
+		Handler: HandlerFunc(func(r Responder, c *Call) {
+			r.Return("ok")
+		}),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(t, err)
+	defer l.Close()
+	for _, features := range []mux.Features{featureCounting, 0} {
+		// sessions exchanging a hello need buffered transports, since
+		// both sides may write at once
+		conn, err := net.Dial("tcp", l.Addr().String())
+		fatal(t, err)
+		sconn, err := l.Accept()
+		fatal(t, err)
+		go srv.Respond(mux.NewWithConfig(sconn, &mux.SessionConfig{Features: featureCounting}), nil)
+		client := NewClient(mux.NewWithConfig(conn, &mux.SessionConfig{Features: features}), codec.JSONCodec{})
+
+		before := atomic.LoadInt32(&counted)
+		var out string
+		_, err = client.Call(context.Background(), "", nil, &out)
+		fatal(t, err)
+		client.Close()
+		if used := atomic.LoadInt32(&counted) != before; used != (features != 0) {
+			t.Fatalf("selected codec used %v with features %s", used, features)
+		}
+	}
 }
 
 func TestRespondMux(t *testing.T) {
@@ -219,6 +734,188 @@ func TestRespondMux(t *testing.T) {
 		}
 	})
 
+	t.Run("remove prefix handler", func(t *testing.T) {
+		sub := NewRespondMux()
+		sub.Handle("bar", NotFoundHandler())
+		mux := NewRespondMux()
+		mux.Handle("foo", sub)
+		mux.Handle("baz.", NotFoundHandler())
+
+		if h := mux.Remove("foo"); h != sub {
+			t.Fatal("unexpected removed handler:", h)
+		}
+		mux.Remove("baz.")
+		for _, sel := range []string{"foo.bar", "baz.qux"} {
+			if h, _ := mux.Match(sel); h != nil {
+				t.Fatalf("removed handler matched %s", sel)
+			}
+		}
+	})
+
+	t.Run("replace handler", func(t *testing.T) {
+		returning := func(v string) Handler {
+			return HandlerFunc(func(r Responder, c *Call) {
+				r.Return(v)
+			})
+		}
+		mux := NewRespondMux()
+		if old := mux.Replace("foo.", returning("v1")); old != nil {
+			t.Fatal("unexpected replaced handler")
+		}
+
+		client, _ := newTestPair(mux)
+		defer client.Close()
+
+		var out string
+		_, err := client.Call(ctx, "foo.bar", nil, &out)
+		fatal(t, err)
+		if out != "v1" {
+			t.Fatal("unexpected return:", out)
+		}
+
+		if old := mux.Replace("foo.", returning("v2")); old == nil {
+			t.Fatal("expected replaced handler")
+		}
+		_, err = client.Call(ctx, "foo.bar", nil, &out)
+		fatal(t, err)
+		if out != "v2" {
+			t.Fatal("unexpected return:", out)
+		}
+		if len(mux.es) != 1 {
+			t.Fatalf("expected 1 prefix entry after replacing, got %d", len(mux.es))
+		}
+	})
+
+	t.Run("swap table", func(t *testing.T) {
+		mux := NewRespondMux()
+		mux.Handle("foo", HandlerFunc(func(r Responder, c *Call) {
+			r.Return("foo")
+		}))
+		client, _ := newTestPair(mux)
+		defer client.Close()
+
+		table := NewRespondMux()
+		table.Handle("bar", HandlerFunc(func(r Responder, c *Call) {
+			r.Return("bar")
+		}))
+		mux.Swap(table)
+
+		var out string
+		_, err := client.Call(ctx, "bar", nil, &out)
+		fatal(t, err)
+		if out != "bar" {
+			t.Fatal("unexpected return:", out)
+		}
+		if _, err := client.Call(ctx, "foo", nil, nil); err == nil {
+			t.Fatal("expected error calling swapped out handler")
+		}
+		if h, _ := table.Match("foo"); h == nil {
+			t.Fatal("expected previous handlers after swap")
+		}
+
+		// swapping in opposite orders concurrently must not deadlock
+		var wg sync.WaitGroup
+		for _, pair := range [][2]*RespondMux{{mux, table}, {table, mux}} {
+			wg.Add(1)
+			go func(a, b *RespondMux) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					a.Swap(b)
+				}
+			}(pair[0], pair[1])
+		}
+		wg.Wait()
+	})
+
+	t.Run("selector policy", func(t *testing.T) {
+		mux := NewRespondMux()
+		mux.Policy = SelectorPolicy{FoldCase: true, TrimTrailingSeparator: true, RejectInvalid: true}
+		mux.Handle("Foo.Bar", NotFoundHandler())
+		mux.Handle("baz.", NotFoundHandler())
+
+		for sel, want := range map[string]string{
+			"foo.bar":   "/foo/bar",
+			"FOO.BAR.":  "/foo/bar",
+			"Baz.Qux":   "/baz/",
+			"foo.bar\n": "",
+			"foo bar":   "",
+			"\xff":      "",
+		} {
+			if _, pattern := mux.Match(sel); pattern != want {
+				t.Errorf("Match(%q) pattern = %q; want %q", sel, pattern, want)
+			}
+		}
+
+		func() {
+			defer func() {
+				if p := recover(); p == nil || !strings.Contains(fmt.Sprint(p), `"foo bar"`) {
+					t.Errorf("unexpected panic for invalid pattern: %v", p)
+				}
+			}()
+			mux.Handle("foo bar", NotFoundHandler())
+		}()
+
+		// the policy is swapped along with the patterns it normalized
+		table := NewRespondMux()
+		mux.Swap(table)
+		if !table.Policy.FoldCase || mux.Policy.FoldCase {
+			t.Fatal("expected policies to be swapped")
+		}
+		if _, pattern := table.Match("FOO.BAR"); pattern != "/foo/bar" {
+			t.Fatalf("unexpected pattern after swap: %q", pattern)
+		}
+
+		// calls dispatched during swaps normalize with the swapped policy
+		noop := HandlerFunc(func(r Responder, c *Call) {})
+		a, b := NewRespondMux(), NewRespondMux()
+		a.Policy.FoldCase = true
+		a.Handle("baz.", noop)
+		b.Handle("Baz.", noop)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				a.Swap(b)
+			}
+		}()
+		for i := 0; i < 1000; i++ {
+			c := &Call{}
+			c.Selector = "Baz.Qux"
+			a.RespondRPC(nil, c)
+			if c.Rest != "Qux" && c.Rest != "qux" {
+				t.Fatalf("unexpected rest %q of pattern %q", c.Rest, c.Pattern)
+			}
+		}
+		<-done
+	})
+
+	t.Run("matched pattern", func(t *testing.T) {
+		var pattern, rest string
+		h := HandlerFunc(func(r Responder, c *Call) {
+			pattern, rest = c.Pattern, c.Rest
+			r.Return(nil)
+		})
+		sub := NewRespondMux()
+		sub.Handle("bar.", h)
+		mux := NewRespondMux()
+		mux.Handle("foo", sub)
+		mux.Handle("baz", h)
+
+		client, _ := newTestPair(mux)
+		defer client.Close()
+
+		_, err := client.Call(ctx, "foo.bar.qux.quux", nil, nil)
+		fatal(t, err)
+		if pattern != "/foo/bar/" || rest != "qux/quux" {
+			t.Fatalf("unexpected pattern %q and rest %q", pattern, rest)
+		}
+		_, err = client.Call(ctx, "baz", nil, nil)
+		fatal(t, err)
+		if pattern != "/baz" || rest != "" {
+			t.Fatalf("unexpected pattern %q and rest %q", pattern, rest)
+		}
+	})
+
 	t.Run("bad handler: nil", func(t *testing.T) {
 		defer func() {
 			if r := recover(); r == nil {
@@ -309,6 +1006,31 @@ func TestRPC(t *testing.T) {
 		}
 	})
 
+	t.Run("multi-return rpc reply error", func(t *testing.T) {
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			fatal(t, c.Receive(nil))
+			r.Return("one", "two", "three")
+		}))
+		defer client.Close()
+
+		// the reply after the one failing is still decoded
+		var out string
+		var out2 int
+		var out3 string
+		var out4 string
+		_, err := client.Call(ctx, "", nil, &out, &out2, &out3, &out4)
+		var rerr *ReplyError
+		if !errors.As(err, &rerr) {
+			t.Fatal("unexpected error:", err)
+		}
+		if rerr.Index != 1 || rerr.Replies != 4 || fmt.Sprint(rerr.Failed) != "[1 3]" {
+			t.Fatalf("unexpected reply error %+v", rerr)
+		}
+		if out != "one" || out3 != "three" {
+			t.Fatalf("unexpected replies %q %q", out, out3)
+		}
+	})
+
 	t.Run("server streaming rpc", func(t *testing.T) {
 		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
 			var in string
@@ -459,25 +1181,354 @@ func TestRPC(t *testing.T) {
 		}
 	})
 
-	t.Run("call timeout", func(t *testing.T) {
-		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
-			time.Sleep(200 * time.Millisecond)
-			fatal(t, c.Receive(nil))
-			_, err := r.Continue(nil)
+	t.Run("remaining args", func(t *testing.T) {
+		client, _ := newTestPairConfig(HandlerFunc(func(r Responder, c *Call) {
+			var args []string
+			for c.More() {
+				var arg string
+				fatal(t, c.Receive(&arg))
+				args = append(args, arg)
+			}
+			if c.Args == streamArgs {
+				if err := c.Receive(nil); err != io.EOF {
+					t.Errorf("expected EOF after streamed args, got %v", err)
+				}
+			}
+			r.Return(args)
+		}), &mux.SessionConfig{Features: mux.FeatureCallArgs})
+		defer client.Close()
+
+		var out []string
+		_, err := client.Call(ctx, "", "one", &out)
+		fatal(t, err)
+		if len(out) != 1 || out[0] != "one" {
+			t.Fatalf("unexpected return: %#v", out)
+		}
+
+		for _, n := range []int{0, 3} {
+			sender := make(chan interface{})
+			go func() {
+				for i := 0; i < n; i++ {
+					sender <- "arg"
+				}
+				close(sender)
+			}()
+			_, err = client.Call(ctx, "", sender, &out)
 			fatal(t, err)
+			if len(out) != n {
+				t.Fatalf("received %d args, expected %d", len(out), n)
+			}
+		}
+	})
 
-			var rcv string
-			for i := 0; i < 3; i++ {
-				fatal(t, c.Receive(&rcv))
-				if rcv != "Hello world" {
-					t.Fatalf("unexpected server receive [%d]: %#v", i, rcv)
+	t.Run("yielded args", func(t *testing.T) {
+		var streamed bool
+		client, _ := newTestPairConfig(HandlerFunc(func(r Responder, c *Call) {
+			streamed = c.Args == streamArgs
+			var args []string
+			for c.More() {
+				var arg string
+				fatal(t, c.Receive(&arg))
+				args = append(args, arg)
+			}
+			r.Return(args)
+		}), &mux.SessionConfig{Features: mux.FeatureCallArgs})
+		defer client.Close()
+
+		var out []string
+		_, err := client.Call(ctx, "", func(yield func(any) bool) {
+			for _, arg := range []string{"one", "two", "three"} {
+				if !yield(arg) {
+					return
 				}
 			}
-			fatal(t, r.Send(rcv))
-			fatal(t, r.Send(rcv))
-			fatal(t, r.Send(rcv))
+		}, &out)
+		fatal(t, err)
+		if !streamed || len(out) != 3 || out[2] != "three" {
+			t.Fatalf("unexpected return: %#v", out)
+		}
+
+		// yielding stops when the call fails
+		cctx, cancel := context.WithCancel(ctx)
+		var yielded int
+		_, err = client.Call(cctx, "", func(yield func(any) bool) {
+			for yield("arg") {
+				if yielded++; yielded == 2 {
+					cancel()
+				}
+			}
+		}, &out)
+		if err != context.Canceled || yielded != 2 {
+			t.Fatalf("unexpected error after %d values: %v", yielded, err)
+		}
+	})
+
+	t.Run("arg counts not negotiated", func(t *testing.T) {
+		// without a hello the call header and arg stream match older peers
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			var args []string
+			for i := 0; i < 2; i++ {
+				var arg string
+				fatal(t, c.Receive(&arg))
+				args = append(args, arg)
+			}
+			r.Return(c.Args, args)
+		}))
+		defer client.Close()
+
+		sender := make(chan interface{}, 2)
+		sender <- "one"
+		sender <- "two"
+		close(sender)
+		var argCount int
+		var args []string
+		resp, err := client.Call(ctx, "", sender, &argCount, &args)
+		fatal(t, err)
+		if argCount != 0 || len(args) != 2 {
+			t.Fatalf("unexpected return: %d %#v", argCount, args)
+		}
+		var sent bytes.Buffer
+		framer := &FrameCodec{Codec: codec.JSONCodec{}}
+		fatal(t, framer.Encoder(&sent).Encode(CallHeader{}))
+		fatal(t, framer.Encoder(&sent).Encode("one"))
+		fatal(t, framer.Encoder(&sent).Encode("two"))
+		if resp.BytesSent != int64(sent.Len()) {
+			t.Fatalf("sent %d bytes, expected %d without end frame", resp.BytesSent, sent.Len())
+		}
+	})
+
+	t.Run("more then continue", func(t *testing.T) {
+		client, _ := newTestPairConfig(HandlerFunc(func(r Responder, c *Call) {
+			if !c.More() {
+				t.Error("expected streamed args")
+			}
+			ch, err := r.Continue()
+			fatal(t, err)
+			defer ch.Close()
+			// the frame peeked by More is still read from the channel
+			dec := (&FrameCodec{Codec: codec.JSONCodec{}}).Decoder(ch)
+			var arg string
+			fatal(t, dec.Decode(&arg))
+			if arg != "one" {
+				t.Errorf("unexpected arg: %q", arg)
+			}
+			if err := dec.Decode(nil); err != io.EOF {
+				t.Errorf("expected end of args, got %v", err)
+			}
+		}), &mux.SessionConfig{Features: mux.FeatureCallArgs})
+		defer client.Close()
+
+		sender := make(chan interface{}, 1)
+		sender <- "one"
+		close(sender)
+		resp, err := client.Call(ctx, "", sender, nil)
+		fatal(t, err)
+		if !resp.Continue {
+			t.Fatal("expected continue")
+		}
+		resp.Channel.Close()
+	})
+
+	t.Run("response metadata", func(t *testing.T) {
+		var served *Call
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			var in string
+			fatal(t, c.Receive(&in))
+			time.Sleep(10 * time.Millisecond)
+			served = c
+			r.Return(in)
+		}))
+		defer client.Close()
+
+		var out string
+		resp, err := client.Call(ctx, "echo", "Hello world", &out)
+		fatal(t, err)
+		if resp.Duration < 10*time.Millisecond {
+			t.Fatalf("unexpected duration: %s", resp.Duration)
+		}
+		if resp.ChannelID != resp.Channel.ID() {
+			t.Fatalf("unexpected channel ID: %d", resp.ChannelID)
+		}
+		if resp.SessionID == "" || resp.SessionID != client.Session.(mux.Identifier).ID() {
+			t.Fatalf("unexpected session ID: %q", resp.SessionID)
+		}
+		// both sides refer to the channel by the same pair of IDs
+		if served.ChannelID != resp.RemoteChannelID || served.RemoteChannelID != resp.ChannelID {
+			t.Fatalf("call channel %d/%d does not match response channel %d/%d",
+				served.ChannelID, served.RemoteChannelID, resp.ChannelID, resp.RemoteChannelID)
+		}
+		if served.SessionID == "" || served.SessionID == resp.SessionID {
+			t.Fatalf("unexpected call session ID: %q", served.SessionID)
+		}
+
+		// compare to the size of the frames encoded on their own
+		var sent, received bytes.Buffer
+		framer := &FrameCodec{Codec: codec.JSONCodec{}}
+		fatal(t, framer.Encoder(&sent).Encode(CallHeader{Selector: "echo"}))
+		fatal(t, framer.Encoder(&sent).Encode("Hello world"))
+		fatal(t, framer.Encoder(&received).Encode(resp.ResponseHeader))
+		fatal(t, framer.Encoder(&received).Encode("Hello world"))
+		if resp.BytesSent != int64(sent.Len()) || resp.BytesReceived != int64(received.Len()) {
+			t.Fatalf("sent %d and received %d bytes, expected %d and %d",
+				resp.BytesSent, resp.BytesReceived, sent.Len(), received.Len())
+		}
+	})
+
+	t.Run("validate reply", func(t *testing.T) {
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			var in int
+			fatal(t, c.Receive(&in))
+			r.Return(in)
+		}))
+		defer client.Close()
+
+		errNegative := errors.New("negative reply")
+		client.ValidateReply = func(selector string, resp *Response) error {
+			if selector != "echo" {
+				t.Errorf("unexpected selector: %s", selector)
+			}
+			if *resp.Reply.(*int) < 0 {
+				return errNegative
+			}
+			return nil
+		}
+
+		var out int
+		_, err := client.Call(ctx, "echo", 1, &out)
+		fatal(t, err)
+		if _, err := client.Call(ctx, "echo", -1, &out); err != errNegative {
+			t.Fatal("unexpected error:", err)
+		}
+	})
+
+	t.Run("cancel while streaming args", func(t *testing.T) {
+		received := make(chan struct{})
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			var in string
+			fatal(t, c.Receive(&in))
+			close(received)
+			r.Return(c.Receive(&in))
+		}))
+		defer client.Close()
+
+		ctx, cancel := context.WithCancel(ctx)
+		sender := make(chan interface{})
+		go func() {
+			// the sender stalls without closing the channel
+			sender <- "Hello world"
+			<-received
+			cancel()
+		}()
+
+		called := make(chan error, 1)
+		go func() {
+			_, err := client.Call(ctx, "", sender, nil)
+			called <- err
+		}()
+		select {
+		case err := <-called:
+			if err != context.Canceled {
+				t.Fatal("expected context error, got", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("call streaming args was not aborted")
+		}
+	})
+
+	t.Run("cancel while decoding reply", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		encoding := make(chan struct{})
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			fatal(t, c.Receive(nil))
+			r.Return(blockingReply{encoding: encoding, release: release})
+		}))
+		defer client.Close()
+
+		ctx, cancel := context.WithCancel(ctx)
+		go func() {
+			// the response header has been sent when the reply is encoded
+			<-encoding
+			cancel()
+		}()
+
+		called := make(chan error, 1)
+		go func() {
+			var out string
+			_, err := client.Call(ctx, "", nil, &out)
+			called <- err
+		}()
+		select {
+		case err := <-called:
+			if err != context.Canceled {
+				t.Fatal("expected context error, got", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("call decoding reply was not aborted")
+		}
+	})
+
+	t.Run("receive deadline cleared", func(t *testing.T) {
+		read := make(chan error, 1)
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			ctx, cancel := context.WithTimeout(c.Context, 20*time.Millisecond)
+			defer cancel()
+			c.Context = ctx
+
+			fatal(t, c.Receive(nil))
+			ch, err := r.Continue(nil)
+			fatal(t, err)
+			defer ch.Close()
+			_, err = io.ReadFull(ch, make([]byte, 2))
+			read <- err
+		}))
+		defer client.Close()
+
+		resp, err := client.Call(ctx, "", nil, nil)
+		fatal(t, err)
+		time.Sleep(50 * time.Millisecond)
+		_, err = resp.Channel.Write([]byte("hi"))
+		fatal(t, err)
+		fatal(t, <-read)
+	})
+
+	t.Run("receive deadline", func(t *testing.T) {
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			ctx, cancel := context.WithTimeout(c.Context, 50*time.Millisecond)
+			defer cancel()
+			c.Context = ctx
+
+			var in string
+			fatal(t, c.Receive(&in))
+			r.Return(c.Receive(&in))
+		}))
+		defer client.Close()
+
+		sender := make(chan interface{})
+		go func() {
+			sender <- "Hello world"
+			time.Sleep(100 * time.Millisecond)
+			close(sender)
+		}()
+
+		_, err := client.Call(ctx, "", sender, nil)
+		expectedError := "remote: context deadline exceeded"
+		if fmt.Sprintf("%v", err) != expectedError {
+			t.Fatalf("expected error: %v\ngot: %v", expectedError, err)
+		}
+	})
+
+	t.Run("call timeout", func(t *testing.T) {
+		// the handler outlives the call, which the client abandons, so it
+		// only blocks: receiving and responding would fail once the
+		// channel is closed, and must not touch t once the test has
+		// completed
+		release := make(chan struct{})
+		client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+			<-release
 		}))
 		defer client.Close()
+		defer close(release)
 
 		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
 		defer cancel()
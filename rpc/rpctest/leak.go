@@ -0,0 +1,107 @@
+package rpctest
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// LeakTimeout is how long CheckLeaks waits for goroutines to exit before
+// reporting them, since sessions end their loops asynchronously after Close.
+var LeakTimeout = 2 * time.Second
+
+// modulePrefix begins the functions of this module in stack traces.
+const modulePrefix = "github.com/roachadam/qtalk-go/"
+
+// GoroutineSnapshot is the set of goroutines running when it was taken.
+type GoroutineSnapshot struct {
+	ids map[string]bool
+}
+
+// SnapshotGoroutines returns a snapshot of the running goroutines, against
+// which goroutines started afterwards are found with Leaked.
+func SnapshotGoroutines() *GoroutineSnapshot {
+	s := &GoroutineSnapshot{ids: make(map[string]bool)}
+	for _, g := range goroutines() {
+		s.ids[g.id] = true
+	}
+	return s
+}
+
+// Leaked returns the stacks of goroutines started since the snapshot that
+// run code of this module, such as session loops and call handlers, waiting
+// up to timeout for them to exit first.
+func (s *GoroutineSnapshot) Leaked(timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		var leaked []string
+		for _, g := range goroutines() {
+			if !s.ids[g.id] && strings.Contains(g.stack, modulePrefix) {
+				leaked = append(leaked, g.stack)
+			}
+		}
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			return leaked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// CheckLeaks fails t if goroutines running code of this module that were
+// started during the test are still running once it and its cleanups
+// registered before CheckLeaks are done, waiting up to LeakTimeout for
+// them to exit. It catches session loops, respond goroutines and timers
+// left running by a missing Close:
+//
+//	func TestCalls(t *testing.T) {
+//		rpctest.CheckLeaks(t)
+//		client, _ := rpctest.NewPair(handler, codec.JSONCodec{})
+//		defer client.Close()
+//		...
+//	}
+//
+// Tests using it should not run in parallel with other tests, whose
+// goroutines would be reported.
+func CheckLeaks(t testing.TB) {
+	t.Helper()
+	s := SnapshotGoroutines()
+	t.Cleanup(func() {
+		if leaked := s.Leaked(LeakTimeout); len(leaked) > 0 {
+			t.Errorf("%d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+	})
+}
+
+type goroutine struct {
+	id    string
+	stack string
+}
+
+// goroutines returns the running goroutines other than the calling one.
+func goroutines() []goroutine {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var gs []goroutine
+	// the first stack is of the calling goroutine
+	for i, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if i == 0 {
+			continue
+		}
+		// stacks begin with "goroutine <id> [<state>]:"
+		fields := strings.Fields(string(stack))
+		if len(fields) < 2 || fields[0] != "goroutine" {
+			continue
+		}
+		gs = append(gs, goroutine{id: fields[1], stack: string(stack)})
+	}
+	return gs
+}
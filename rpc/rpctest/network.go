@@ -0,0 +1,182 @@
+package rpctest
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Profile describes the conditions of a simulated network link, applied to
+// each direction of the link independently.
+type Profile struct {
+	Name string
+	// Latency is the one-way delay of the link.
+	Latency time.Duration
+	// Jitter is the most the delay of writes varies from Latency. Bytes
+	// are still delivered in order.
+	Jitter time.Duration
+	// Bandwidth is the number of bytes per second the link carries, or
+	// zero for no limit. Writes block until their bytes are sent.
+	Bandwidth int
+}
+
+// Preset profiles of common networks.
+var (
+	LAN       = Profile{Name: "lan", Latency: 250 * time.Microsecond, Jitter: 50 * time.Microsecond, Bandwidth: 125_000_000}
+	ThreeG    = Profile{Name: "3g", Latency: 100 * time.Millisecond, Jitter: 30 * time.Millisecond, Bandwidth: 48_000}
+	Satellite = Profile{Name: "satellite", Latency: 300 * time.Millisecond, Jitter: 20 * time.Millisecond, Bandwidth: 250_000}
+)
+
+// Profiles are the preset profiles by name.
+var Profiles = map[string]Profile{
+	LAN.Name:       LAN,
+	ThreeG.Name:    ThreeG,
+	Satellite.Name: Satellite,
+}
+
+// Pipe returns the two ends of an in-memory link with the conditions of p.
+// Bytes written to one end are read from the other once they went through
+// the link. Closing an end ends the reads of the other after the bytes in
+// flight arrive.
+func (p Profile) Pipe() (io.ReadWriteCloser, io.ReadWriteCloser) {
+	ab, ba := newLink(p), newLink(p)
+	return &linkEnd{r: ba, w: ab}, &linkEnd{r: ab, w: ba}
+}
+
+// NewProfilePair is like NewPair, but connects the Client and Server by a
+// link with the conditions of p:
+//
+//	func BenchmarkSync(b *testing.B) {
+//		for _, p := range []rpctest.Profile{rpctest.LAN, rpctest.ThreeG} {
+//			b.Run(p.Name, func(b *testing.B) {
+//				client, _ := rpctest.NewProfilePair(handler, codec.JSONCodec{}, p)
+//				defer client.Close()
+//				...
+//			})
+//		}
+//	}
+func NewProfilePair(handler rpc.Handler, codec codec.Codec, p Profile) (*rpc.Client, *rpc.Server) {
+	a, b := p.Pipe()
+	srv := &rpc.Server{
+		Codec:   codec,
+		Handler: handler,
+	}
+	go srv.Respond(mux.New(a), nil)
+
+	return rpc.NewClient(mux.New(b), codec), srv
+}
+
+// packet is the bytes of a write in flight.
+type packet struct {
+	b       []byte
+	deliver time.Time
+}
+
+// link is one direction of a simulated link.
+type link struct {
+	p   Profile
+	rnd *rand.Rand
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	packets []packet
+	busy    time.Time // when the link has sent the bytes written so far
+	last    time.Time // delivery time of the last packet
+	eof     bool      // the writing end is closed
+	closed  bool      // the reading end is closed
+}
+
+func newLink(p Profile) *link {
+	l := &link{p: p, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *link) write(b []byte) (int, error) {
+	l.mu.Lock()
+	if l.eof || l.closed {
+		l.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	now := time.Now()
+	sent := now
+	if l.busy.After(now) {
+		sent = l.busy
+	}
+	if l.p.Bandwidth > 0 {
+		sent = sent.Add(time.Duration(int64(len(b)) * int64(time.Second) / int64(l.p.Bandwidth)))
+	}
+	l.busy = sent
+	deliver := sent.Add(l.p.Latency)
+	if l.p.Jitter > 0 {
+		deliver = deliver.Add(time.Duration(l.rnd.Int63n(int64(2*l.p.Jitter))) - l.p.Jitter)
+	}
+	if deliver.Before(l.last) {
+		deliver = l.last
+	}
+	l.last = deliver
+	l.packets = append(l.packets, packet{b: append([]byte(nil), b...), deliver: deliver})
+	l.mu.Unlock()
+	l.cond.Broadcast()
+	time.Sleep(time.Until(sent))
+	return len(b), nil
+}
+
+func (l *link) read(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		if l.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if len(l.packets) > 0 {
+			p := &l.packets[0]
+			wait := time.Until(p.deliver)
+			if wait <= 0 {
+				n := copy(b, p.b)
+				p.b = p.b[n:]
+				if len(p.b) == 0 {
+					l.packets = l.packets[1:]
+				}
+				return n, nil
+			}
+			t := time.AfterFunc(wait, l.cond.Broadcast)
+			l.cond.Wait()
+			t.Stop()
+			continue
+		}
+		if l.eof {
+			return 0, io.EOF
+		}
+		l.cond.Wait()
+	}
+}
+
+func (l *link) close(reader bool) {
+	l.mu.Lock()
+	if reader {
+		l.closed = true
+	} else {
+		l.eof = true
+	}
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+type linkEnd struct {
+	r, w *link
+}
+
+func (e *linkEnd) Read(b []byte) (int, error)  { return e.r.read(b) }
+func (e *linkEnd) Write(b []byte) (int, error) { return e.w.write(b) }
+
+func (e *linkEnd) Close() error {
+	e.w.close(false)
+	e.r.close(true)
+	return nil
+}
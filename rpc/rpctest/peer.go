@@ -0,0 +1,169 @@
+package rpctest
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/mux/frame"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// Peer is the remote end of a session played frame by frame by a test,
+// which can send frames in any order, including ones a real session never
+// would, and assert the frames the session sends back:
+//
+//	peer, sess := rpctest.NewPeer(t, nil)
+//	peer.Send(frame.OpenMessage{SenderID: 1, WindowSize: 1 << 16, MaxPacketSize: 1})
+//	peer.Expect(frame.OpenFailureMessage{ChannelID: 1})
+//	peer.Send(frame.DataMessage{ChannelID: 5, Length: 1, Data: []byte{0}})
+//	peer.ExpectClosed()
+//	if err := sess.Wait(); !errors.Is(err, mux.ErrProtocol) {
+//		t.Fatal(err)
+//	}
+//
+// Failures of a Peer fail the test, so its methods must be called from the
+// goroutine running it.
+type Peer struct {
+	// Timeout limits waiting for the frames of the session, defaulting
+	// to 5s.
+	Timeout time.Duration
+
+	t        testing.TB
+	conn     io.ReadWriteCloser
+	enc      *frame.Encoder
+	received chan frame.Message
+	err      error // decoding error, once received is closed
+}
+
+// NewPeer returns a Peer and the session it is the remote end of, created
+// with the optional config. The session is closed when the test ends.
+func NewPeer(t testing.TB, config *mux.SessionConfig) (*Peer, mux.Session) {
+	a, b := Profile{}.Pipe()
+	p := &Peer{
+		t:        t,
+		conn:     a,
+		enc:      frame.NewEncoder(a),
+		received: make(chan frame.Message, 64),
+	}
+	sess := mux.NewWithConfig(b, config)
+	t.Cleanup(func() {
+		sess.Close()
+		a.Close()
+	})
+	go p.receive(frame.NewDecoder(a))
+	return p, sess
+}
+
+func (p *Peer) receive(dec *frame.Decoder) {
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			p.err = err
+			close(p.received)
+			return
+		}
+		p.received <- msg
+	}
+}
+
+// Send writes msgs to the session in order.
+func (p *Peer) Send(msgs ...frame.Message) {
+	p.t.Helper()
+	for _, msg := range msgs {
+		if err := p.enc.Encode(msg); err != nil {
+			p.t.Fatalf("rpctest: peer sending %v: %v", msg, err)
+		}
+	}
+}
+
+// SendBytes writes b to the session as is, such as the start of a frame
+// to truncate it.
+func (p *Peer) SendBytes(b []byte) {
+	p.t.Helper()
+	if _, err := p.conn.Write(b); err != nil {
+		p.t.Fatalf("rpctest: peer sending %d bytes: %v", len(b), err)
+	}
+}
+
+// SendValues writes each of vs encoded with c and length prefixed like the
+// values of calls in a data frame of the channel with the ID of the session,
+// which for a call is the header followed by the arguments.
+func (p *Peer) SendValues(channelID uint32, c codec.Codec, vs ...any) {
+	p.t.Helper()
+	for _, v := range vs {
+		var buf bytes.Buffer
+		if err := (&rpc.FrameCodec{Codec: c}).Encoder(&buf).Encode(v); err != nil {
+			p.t.Fatalf("rpctest: peer encoding %v: %v", v, err)
+		}
+		p.Send(frame.DataMessage{
+			ChannelID: channelID,
+			Length:    uint32(buf.Len()),
+			Data:      buf.Bytes(),
+		})
+	}
+}
+
+// Next returns the next frame sent by the session, failing if none arrives
+// within Timeout or the session closed the connection.
+func (p *Peer) Next() frame.Message {
+	p.t.Helper()
+	msg, ok := p.next()
+	if !ok {
+		p.t.Fatalf("rpctest: peer expected a frame, connection ended: %v", p.err)
+	}
+	return msg
+}
+
+// Expect fails unless the next frame sent by the session is msg, and
+// returns the frame.
+func (p *Peer) Expect(msg frame.Message) frame.Message {
+	p.t.Helper()
+	got := p.Next()
+	if !sameMessage(got, msg) {
+		p.t.Fatalf("rpctest: peer received %v, expected %v", got, msg)
+	}
+	return got
+}
+
+// ExpectClosed fails unless the session closes the connection without
+// sending more frames, such as after a protocol error.
+func (p *Peer) ExpectClosed() {
+	p.t.Helper()
+	if msg, ok := p.next(); ok {
+		p.t.Fatalf("rpctest: peer received %v, expected the connection to end", msg)
+	}
+}
+
+// Close closes the connection to the session.
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
+
+func (p *Peer) next() (frame.Message, bool) {
+	p.t.Helper()
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case msg, ok := <-p.received:
+		return msg, ok
+	case <-t.C:
+		p.t.Fatalf("rpctest: peer timed out after %v waiting for the session", timeout)
+		return nil, false
+	}
+}
+
+// sameMessage reports whether frames are equal, as decoded frames are
+// pointers to messages.
+func sameMessage(a, b frame.Message) bool {
+	va, vb := reflect.Indirect(reflect.ValueOf(a)), reflect.Indirect(reflect.ValueOf(b))
+	return reflect.DeepEqual(va.Interface(), vb.Interface())
+}
@@ -1,7 +1,12 @@
 package rpctest
 
 import (
+	"context"
+	"errors"
 	"io"
+	"reflect"
+	"testing"
+	"time"
 
 	"github.com/roachadam/qtalk-go/codec"
 	"github.com/roachadam/qtalk-go/mux"
@@ -25,3 +30,107 @@ func NewPair(handler rpc.Handler, codec codec.Codec) (*rpc.Client, *rpc.Server)
 
 	return rpc.NewClient(sessB, codec), srv
 }
+
+// Case is a call made by TestHandler and the response expected for it.
+type Case struct {
+	// Name names the subtest of the case, defaulting to the selector.
+	Name     string
+	Selector string
+	Args     any
+
+	// Reply is the expected reply, compared to the reply decoded into a new
+	// value of its type. If nil, the reply is not checked.
+	Reply any
+	// Error is the expected error message returned by the handler, or empty
+	// if the call is expected to succeed.
+	Error string
+	// Stream are the values the handler is expected to send after
+	// continuing the call, each decoded into a new value of its type,
+	// before closing the channel.
+	Stream []any
+
+	// Timeout limits the call including its stream, defaulting to 5s.
+	Timeout time.Duration
+}
+
+// TestHandler makes the calls of cases in order to handler over an
+// in-memory pair using JSON, checking each response in a subtest:
+//
+//	rpctest.TestHandler(t, mux, []rpctest.Case{
+//		{Selector: "add", Args: []int{2, 3}, Reply: 5},
+//		{Selector: "div", Args: []int{1, 0}, Error: "division by zero"},
+//		{Selector: "count", Args: 3, Stream: []any{1, 2, 3}},
+//	})
+func TestHandler(t *testing.T, handler rpc.Handler, cases []Case) {
+	t.Helper()
+	client, _ := NewPair(handler, codec.JSONCodec{})
+	defer client.Close()
+	for _, tc := range cases {
+		name := tc.Name
+		if name == "" {
+			name = tc.Selector
+		}
+		t.Run(name, func(t *testing.T) {
+			testCase(t, client, tc)
+		})
+	}
+}
+
+func testCase(t *testing.T, client *rpc.Client, tc Case) {
+	t.Helper()
+	timeout := tc.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var replies []any
+	var reply reflect.Value
+	if tc.Reply != nil {
+		reply = reflect.New(reflect.TypeOf(tc.Reply))
+		replies = append(replies, reply.Interface())
+	}
+	resp, err := client.Call(ctx, tc.Selector, tc.Args, replies...)
+	if tc.Error != "" {
+		var remote rpc.RemoteError
+		if !errors.As(err, &remote) || string(remote) != tc.Error {
+			t.Fatalf("expected error %q, got %v", tc.Error, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tc.Reply != nil && !reflect.DeepEqual(reply.Elem().Interface(), tc.Reply) {
+		t.Errorf("reply %#v, expected %#v", reply.Elem().Interface(), tc.Reply)
+	}
+	if !resp.Continue {
+		if len(tc.Stream) > 0 {
+			t.Fatalf("expected the call to continue with %d values", len(tc.Stream))
+		}
+		return
+	}
+	defer resp.Channel.Close()
+	go func() {
+		<-ctx.Done()
+		resp.Channel.Close()
+	}()
+	for i, want := range tc.Stream {
+		v := reflect.New(reflect.TypeOf(want))
+		if err := resp.Receive(v.Interface()); err != nil {
+			t.Fatalf("receiving stream value %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v.Elem().Interface(), want) {
+			t.Errorf("stream value %d is %#v, expected %#v", i, v.Elem().Interface(), want)
+		}
+	}
+	var extra any
+	if err := resp.Receive(&extra); err != io.EOF {
+		if err == nil {
+			t.Errorf("unexpected stream value %#v", extra)
+		} else {
+			t.Errorf("expected end of stream, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/mux/frame"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+func TestTestHandler(t *testing.T) {
+	mux := rpc.NewRespondMux()
+	mux.Handle("add", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var args []int
+		if err := c.Receive(&args); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(args[0] + args[1])
+	}))
+	mux.Handle("div", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var args []int
+		if err := c.Receive(&args); err != nil {
+			r.Return(err)
+			return
+		}
+		if args[1] == 0 {
+			r.Return(errors.New("division by zero"))
+			return
+		}
+		r.Return(args[0] / args[1])
+	}))
+	mux.Handle("count", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var n int
+		if err := c.Receive(&n); err != nil {
+			r.Return(err)
+			return
+		}
+		ch, err := r.Continue()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+		for i := 1; i <= n; i++ {
+			if err := r.Send(i); err != nil {
+				return
+			}
+		}
+	}))
+
+	TestHandler(t, mux, []Case{
+		{Selector: "add", Args: []int{2, 3}, Reply: 5},
+		{Selector: "div", Args: []int{6, 3}, Reply: 2},
+		{Name: "div by zero", Selector: "div", Args: []int{1, 0}, Error: "division by zero"},
+		{Selector: "count", Args: 3, Stream: []any{1, 2, 3}},
+		{Name: "count none", Selector: "count", Args: 0},
+	})
+}
+
+func TestProfile(t *testing.T) {
+	p := Profile{Latency: 20 * time.Millisecond, Jitter: 5 * time.Millisecond, Bandwidth: 1 << 20}
+	client, _ := NewProfilePair(rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var b []byte
+		if err := c.Receive(&b); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(len(b))
+	}), codec.JSONCodec{}, p)
+	defer client.Close()
+
+	// a call takes at least a round trip
+	start := time.Now()
+	var n int
+	if _, err := client.Call(context.Background(), "len", nil, &n); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 2*(p.Latency-p.Jitter) {
+		t.Fatalf("call took %v, expected at least a round trip", d)
+	}
+
+	// 128KiB take 125ms to send at 1MiB/s, encoded as base64 even longer
+	start = time.Now()
+	if _, err := client.Call(context.Background(), "len", make([]byte, 128<<10), &n); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 125*time.Millisecond || n != 128<<10 {
+		t.Fatalf("call took %v replying %d, expected at least 125ms", d, n)
+	}
+}
+
+func TestProfilePipe(t *testing.T) {
+	a, b := Profiles["lan"].Pipe()
+	go func() {
+		a.Write([]byte("hello "))
+		a.Write([]byte("world"))
+		a.Close()
+	}()
+	got, err := io.ReadAll(b)
+	if err != nil || string(got) != "hello world" {
+		t.Fatalf("read %q: %v", got, err)
+	}
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("expected closed pipe writing to closed end, got %v", err)
+	}
+	b.Close()
+	if _, err := b.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Fatalf("expected closed pipe, got %v", err)
+	}
+}
+
+func TestCheckLeaks(t *testing.T) {
+	CheckLeaks(t)
+	client, _ := NewPair(rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		c.Receive(nil)
+		r.Return("ok")
+	}), codec.JSONCodec{})
+	defer client.Close()
+	if _, err := client.Call(context.Background(), "", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoroutineSnapshotLeaked(t *testing.T) {
+	s := SnapshotGoroutines()
+	client, _ := NewPair(rpc.NotFoundHandler(), codec.JSONCodec{})
+	if leaked := s.Leaked(10 * time.Millisecond); len(leaked) == 0 {
+		t.Fatal("expected the session loops to be reported")
+	}
+	client.Close()
+	if leaked := s.Leaked(LeakTimeout); len(leaked) > 0 {
+		t.Fatalf("unexpected leaked goroutines:\n%s", strings.Join(leaked, "\n\n"))
+	}
+}
+
+func TestStress(t *testing.T) {
+	CheckLeaks(t)
+	Stress(t, StressConfig{Seed: 1, Workers: 4, Ops: 50})
+	Stress(t, StressConfig{Workers: 2, Ops: 20, Churn: 1, Profile: LAN})
+}
+
+func TestPeer(t *testing.T) {
+	t.Run("bad open", func(t *testing.T) {
+		peer, sess := NewPeer(t, nil)
+		peer.Send(frame.OpenMessage{SenderID: 1, WindowSize: 1 << 16, MaxPacketSize: 1})
+		peer.Expect(frame.OpenFailureMessage{ChannelID: 1})
+
+		// the open is confirmed once accepted
+		accepted := make(chan mux.Channel, 1)
+		go func() {
+			ch, _ := sess.Accept()
+			accepted <- ch
+		}()
+		peer.Send(frame.OpenMessage{SenderID: 2, WindowSize: 1 << 16, MaxPacketSize: 1 << 15})
+		confirm, ok := peer.Next().(*frame.OpenConfirmMessage)
+		if !ok || confirm.ChannelID != 2 {
+			t.Fatalf("expected a confirm of channel 2, got %v", confirm)
+		}
+		(<-accepted).Close()
+		peer.Expect(frame.CloseMessage{ChannelID: 2})
+	})
+
+	t.Run("unexpected message", func(t *testing.T) {
+		peer, sess := NewPeer(t, nil)
+		peer.Send(frame.DataMessage{ChannelID: 5, Length: 1, Data: []byte{0}})
+		peer.ExpectClosed()
+		if err := sess.Wait(); !errors.Is(err, mux.ErrProtocol) {
+			t.Fatalf("expected a protocol error, got %v", err)
+		}
+	})
+
+	t.Run("truncated frame", func(t *testing.T) {
+		peer, sess := NewPeer(t, nil)
+		b := frame.OpenMessage{SenderID: 1, WindowSize: 1 << 16, MaxPacketSize: 1 << 15}.Bytes()
+		peer.SendBytes(b[:len(b)-2])
+		peer.Close()
+		if err := sess.Wait(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected an unexpected EOF, got %v", err)
+		}
+	})
+
+	t.Run("call", func(t *testing.T) {
+		peer, sess := NewPeer(t, nil)
+		go (&rpc.Server{Codec: codec.JSONCodec{}, Handler: rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+			var s string
+			c.Receive(&s)
+			r.Return(s)
+		})}).Respond(sess, nil)
+		peer.Send(frame.OpenMessage{SenderID: 7, WindowSize: 1 << 16, MaxPacketSize: 1 << 15})
+		confirm := peer.Next().(*frame.OpenConfirmMessage)
+		peer.SendValues(confirm.SenderID, codec.JSONCodec{}, rpc.CallHeader{Selector: "echo"}, "hello")
+		var data []byte
+		for {
+			msg := peer.Next()
+			if _, ok := msg.(*frame.CloseMessage); ok {
+				break
+			}
+			if m, ok := msg.(*frame.DataMessage); ok {
+				data = append(data, m.Data...)
+			}
+		}
+		if !strings.Contains(string(data), `"hello"`) {
+			t.Fatalf("unexpected response %q", data)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package rpctest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+// StressConfig configures a Stress run. The weights set how often each
+// operation is picked relative to the others, and if all are zero the
+// operations are picked evenly.
+type StressConfig struct {
+	// Seed seeds the random choices of the run, so a failing run can be
+	// repeated. If zero, a seed is chosen and logged.
+	Seed int64
+
+	// Workers is the number of goroutines making operations at once, and
+	// Ops the number of operations each makes. They default to 8 and 100.
+	Workers int
+	Ops     int
+
+	// Unary is a call echoing a random payload.
+	Unary int
+	// Stream is a call streaming a random number of values back.
+	Stream int
+	// Callback is a call nesting calls back and forth between the peers.
+	Callback int
+	// Churn is a streaming call abandoned after a few values, closing
+	// its channel while the handler is still sending.
+	Churn int
+
+	// Timeout limits each operation, defaulting to 10s.
+	Timeout time.Duration
+
+	// Profile sets the conditions of the link between the peers, which is
+	// unlimited by default.
+	Profile Profile
+}
+
+// stress operations and their selectors
+const (
+	stressUnary = iota
+	stressStream
+	stressCallback
+	stressChurn
+)
+
+// Stress runs a random mix of operations from concurrent workers across a
+// pair of peers serving each other, failing t on any unexpected result.
+// Running it with the race detector shakes out ordering bugs of sessions
+// and calls:
+//
+//	func TestStress(t *testing.T) {
+//		rpctest.Stress(t, rpctest.StressConfig{Seed: 42, Churn: 2, Unary: 1})
+//	}
+func Stress(t testing.TB, config StressConfig) {
+	t.Helper()
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	t.Logf("rpctest: stress seed %d", config.Seed)
+	if config.Workers <= 0 {
+		config.Workers = 8
+	}
+	if config.Ops <= 0 {
+		config.Ops = 100
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	weights := []int{config.Unary, config.Stream, config.Callback, config.Churn}
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		weights, total = []int{1, 1, 1, 1}, 4
+	}
+
+	a, b := config.Profile.Pipe()
+	sessA, sessB := mux.New(a), mux.New(b)
+	handler := stressHandler()
+	go (&rpc.Server{Codec: codec.JSONCodec{}, Handler: handler}).Respond(sessA, nil)
+	go (&rpc.Server{Codec: codec.JSONCodec{}, Handler: handler}).Respond(sessB, nil)
+	client := rpc.NewClient(sessB, codec.JSONCodec{})
+	defer sessA.Close()
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < config.Workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(config.Seed + int64(w)))
+			for i := 0; i < config.Ops; i++ {
+				n := rnd.Intn(total)
+				op := 0
+				for n >= weights[op] {
+					n -= weights[op]
+					op++
+				}
+				if err := stressOp(client, op, rnd, config.Timeout); err != nil {
+					t.Errorf("rpctest: worker %d op %d (seed %d): %v", w, i, config.Seed, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// stressHandler returns the handlers served by both peers of Stress.
+func stressHandler() rpc.Handler {
+	m := rpc.NewRespondMux()
+	m.Handle("stress.echo", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var s string
+		if err := c.Receive(&s); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(s)
+	}))
+	m.Handle("stress.count", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var n int
+		if err := c.Receive(&n); err != nil {
+			r.Return(err)
+			return
+		}
+		rpc.StreamReplies(r, func(send func(v any) error) error {
+			for i := 0; i < n; i++ {
+				if err := send(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}))
+	m.Handle("stress.callback", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var depth int
+		if err := c.Receive(&depth); err != nil {
+			r.Return(err)
+			return
+		}
+		if depth == 0 {
+			r.Return(0)
+			return
+		}
+		var reply int
+		if _, err := c.Caller.Call(c.Context, "stress.callback", depth-1, &reply); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return(reply + 1)
+	}))
+	return m
+}
+
+func stressOp(client *rpc.Client, op int, rnd *rand.Rand, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	switch op {
+	case stressUnary:
+		payload := strings.Repeat("x", rnd.Intn(4096))
+		var reply string
+		if _, err := client.Call(ctx, "stress.echo", payload, &reply); err != nil {
+			return fmt.Errorf("unary: %w", err)
+		}
+		if reply != payload {
+			return fmt.Errorf("unary: echoed %d bytes, sent %d", len(reply), len(payload))
+		}
+	case stressStream, stressChurn:
+		n := rnd.Intn(50) + 1
+		abandon := -1
+		if op == stressChurn {
+			n += 1000
+			abandon = rnd.Intn(10)
+		}
+		resp, err := client.Call(ctx, "stress.count", n)
+		if err != nil {
+			return fmt.Errorf("stream: %w", err)
+		}
+		defer resp.Channel.Close()
+		for i := 0; ; i++ {
+			if i == abandon {
+				return nil
+			}
+			var v int
+			err := resp.ReceiveStream(&v)
+			if err == io.EOF && i == n {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("stream: value %d of %d: %w", i, n, err)
+			}
+			if v != i {
+				return fmt.Errorf("stream: received %d, expected %d", v, i)
+			}
+		}
+	case stressCallback:
+		depth := rnd.Intn(4) + 1
+		var reply int
+		if _, err := client.Call(ctx, "stress.callback", depth, &reply); err != nil {
+			return fmt.Errorf("callback: %w", err)
+		}
+		if reply != depth {
+			return fmt.Errorf("callback: nested %d calls, expected %d", reply, depth)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+)
+
+// Schema holds JSON Schemas describing the args and reply values of a handler.
+// Schemas are represented as decoded JSON objects so they can be written by
+// hand or generated from Go types using SchemaOf.
+type Schema struct {
+	Args  map[string]any `json:",omitempty"`
+	Reply map[string]any `json:",omitempty"`
+
+	// StreamArgs indicates args are sent as a stream of values, and
+	// StreamReplies that the handler continues the call to send more values
+	// after the reply. They describe the handler and are not enforced.
+	StreamArgs    bool `json:",omitempty"`
+	StreamReplies bool `json:",omitempty"`
+}
+
+// WithSchema returns a handler that validates args against s.Args before
+// passing them to h. The schema is included in the Reflection of any
+// RespondMux the returned handler is registered on.
+//
+// A single argument value is received and validated before h is invoked, so
+// invalid calls are responded to with an error without invoking h. Streamed
+// arguments are validated as h receives them, making Receive return the
+// validation error. Values are decoded generically for validation and then
+// converted to the values passed to Receive using encoding/json.
+//
+// A handler with a Match method like a RespondMux keeps being registered as
+// a submux, and the schema applies to every handler it matches.
+func WithSchema(h Handler, s Schema) Handler {
+	sh := &schemaHandler{Handler: h, schema: s}
+	if m, ok := h.(matcher); ok {
+		return &schemaMatcher{schemaHandler: sh, m: m}
+	}
+	return sh
+}
+
+type schemaHandler struct {
+	Handler
+	schema Schema
+}
+
+// schemaMatcher is the schemaHandler of a submux.
+type schemaMatcher struct {
+	*schemaHandler
+	m matcher
+}
+
+func (h *schemaMatcher) Match(selector string) (Handler, string) {
+	sub, pattern := h.m.Match(selector)
+	if sub == nil {
+		return nil, ""
+	}
+	return &schemaHandler{Handler: sub, schema: h.schema}, pattern
+}
+
+func (h *schemaHandler) RespondRPC(r Responder, c *Call) {
+	if h.schema.Args == nil {
+		h.Handler.RespondRPC(r, c)
+		return
+	}
+	dec := &validatingDecoder{Decoder: c.Decoder, schema: h.schema.Args}
+	if c.Args != streamArgs {
+		if err := dec.read(); err != nil {
+			r.Return(err)
+			return
+		}
+	}
+	c.Decoder = dec
+	h.Handler.RespondRPC(r, c)
+}
+
+// validatingDecoder validates values against a schema before converting them
+// to the value passed to Decode.
+type validatingDecoder struct {
+	codec.Decoder
+	schema map[string]any
+
+	pending    any
+	hasPending bool
+}
+
+// read decodes and validates the next value, keeping it for the next Decode.
+func (d *validatingDecoder) read() error {
+	var v any
+	if err := d.Decoder.Decode(&v); err != nil {
+		return err
+	}
+	if err := Validate(d.schema, v); err != nil {
+		return fmt.Errorf("invalid args: %w", err)
+	}
+	d.pending, d.hasPending = v, true
+	return nil
+}
+
+func (d *validatingDecoder) Decode(v any) error {
+	if !d.hasPending {
+		if err := d.read(); err != nil {
+			return err
+		}
+	}
+	raw := d.pending
+	d.pending, d.hasPending = nil, false
+	if p, ok := v.(*any); ok {
+		*p = raw
+		return nil
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (d *validatingDecoder) peek() (uint32, error) {
+	if d.hasPending {
+		return 1, nil
+	}
+	if p, ok := d.Decoder.(peeker); ok {
+		return p.peek()
+	}
+	return 1, nil
+}
+
+// Schemas returns the schemas of handlers registered on the RespondMux using
+// WithSchema, keyed by their normalized pattern. Schemas of submuxes are
+// included keyed by the pattern prefixed with their parent pattern.
+func (m *RespondMux) Schemas() map[string]Schema {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	schemas := make(map[string]Schema)
+	for pattern, e := range m.m {
+		switch h := e.h.(type) {
+		case *schemaHandler:
+			schemas[pattern] = h.schema
+		case *RespondMux:
+			for p, s := range h.Schemas() {
+				schemas[pattern+strings.TrimPrefix(p, "/")] = s
+			}
+		case *schemaMatcher:
+			sub, ok := h.m.(*RespondMux)
+			if !ok {
+				schemas[pattern] = h.schema
+				break
+			}
+			// handlers of the submux have its schema unless they have
+			// their own
+			for _, p := range sub.Patterns() {
+				schemas[pattern+strings.TrimPrefix(p, "/")] = h.schema
+			}
+			for p, s := range sub.Schemas() {
+				schemas[pattern+strings.TrimPrefix(p, "/")] = s
+			}
+		}
+	}
+	return schemas
+}
+
+// Schema returns the schema of the pattern matching selector, preferring an
+// exact match over the longest matching prefix pattern.
+func (r Reflection) Schema(selector string) (Schema, bool) {
+	selector = cleanSelector(selector)
+	if s, ok := r.Schemas[selector]; ok {
+		return s, true
+	}
+	var patterns []string
+	for p := range r.Schemas {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(selector, p) {
+			patterns = append(patterns, p)
+		}
+	}
+	if len(patterns) == 0 {
+		return Schema{}, false
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		return len(patterns[i]) > len(patterns[j])
+	})
+	return r.Schemas[patterns[0]], true
+}
+
+// ValidateReply validates the reply of a response against the reply schema of
+// selector. Its signature matches Client.ValidateReply so a client can check
+// replies against schemas published by the remote side. Replies are converted
+// to generic values for validation using encoding/json.
+func (r Reflection) ValidateReply(selector string, resp *Response) error {
+	s, ok := r.Schema(selector)
+	if !ok || s.Reply == nil || resp.Reply == nil {
+		return nil
+	}
+	b, err := json.Marshal(resp.Reply)
+	if err != nil {
+		return err
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := Validate(s.Reply, v); err != nil {
+		return fmt.Errorf("invalid reply: %w", err)
+	}
+	return nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// SchemaOf returns a JSON Schema describing how values of the type of v are
+// encoded as JSON. Struct fields are named by their json tags and are
+// required unless they are pointers or tagged omitempty. Fields of untagged
+// embedded structs are promoted as with encoding/json.
+func SchemaOf(v any) map[string]any {
+	if v == nil {
+		return map[string]any{}
+	}
+	return schemaOf(reflect.TypeOf(v), make(map[reflect.Type]bool))
+}
+
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), seen)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			// recursive types are left unconstrained
+			return map[string]any{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		props := make(map[string]any)
+		var required []string
+		for _, f := range structFields(t, seen) {
+			props[f.name] = f.schema
+			if f.required {
+				required = append(required, f.name)
+			}
+		}
+		s := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	default:
+		return map[string]any{}
+	}
+}
+
+type schemaField struct {
+	name     string
+	schema   map[string]any
+	required bool
+}
+
+// structFields returns the properties of the fields of struct type t in
+// order, promoting the fields of untagged embedded structs like
+// encoding/json. Fields of t take precedence over promoted fields of the
+// same name, and fields promoted from embedded pointers are not required.
+func structFields(t reflect.Type, seen map[reflect.Type]bool) []schemaField {
+	type field struct {
+		reflect.StructField
+		name, opts string
+		embedded   reflect.Type
+	}
+	var fields []field
+	direct := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := field{StructField: t.Field(i)}
+		f.name, f.opts, _ = strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && f.name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			// embedded pointers to unexported structs are ignored
+			if ft.Kind() == reflect.Struct && ft != timeType {
+				if f.IsExported() || f.Type.Kind() != reflect.Pointer {
+					f.embedded = ft
+					fields = append(fields, f)
+				}
+				continue
+			}
+		}
+		if !f.IsExported() || (f.name == "-" && f.opts == "") {
+			continue
+		}
+		if f.name == "" {
+			f.name = f.Name
+		}
+		direct[f.name] = true
+		fields = append(fields, f)
+	}
+
+	var out []schemaField
+	promoted := make(map[string]bool)
+	for _, f := range fields {
+		if f.embedded == nil {
+			out = append(out, schemaField{
+				name:     f.name,
+				schema:   schemaOf(f.Type, seen),
+				required: f.Type.Kind() != reflect.Pointer && !strings.Contains(f.opts, "omitempty"),
+			})
+			continue
+		}
+		if seen[f.embedded] {
+			continue
+		}
+		seen[f.embedded] = true
+		for _, pf := range structFields(f.embedded, seen) {
+			if direct[pf.name] || promoted[pf.name] {
+				continue
+			}
+			promoted[pf.name] = true
+			pf.required = pf.required && f.Type.Kind() != reflect.Pointer
+			out = append(out, pf)
+		}
+		delete(seen, f.embedded)
+	}
+	return out
+}
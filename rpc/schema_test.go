@@ -0,0 +1,192 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	var schema map[string]any
+	fatal(t, json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["name"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "pattern": "^[a-z]+$"},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "maxItems": 2, "items": {"enum": ["a", "b"]}}
+		}
+	}`), &schema))
+
+	for _, tt := range []struct {
+		in   string
+		path string
+	}{
+		{`{"name": "bob", "age": 3, "tags": ["a"]}`, ""},
+		{`{"age": 3}`, "-"},
+		{`{"name": ""}`, "/name"},
+		{`{"name": "Bob"}`, "/name"},
+		{`{"name": "bob", "age": 1.5}`, "/age"},
+		{`{"name": "bob", "age": -1}`, "/age"},
+		{`{"name": "bob", "tags": ["a", "c"]}`, "/tags/1"},
+		{`{"name": "bob", "tags": ["a", "b", "a"]}`, "/tags"},
+		{`{"name": "bob", "other": 1}`, "-"},
+		{`"bob"`, "-"},
+	} {
+		var v any
+		fatal(t, json.Unmarshal([]byte(tt.in), &v))
+		err := Validate(schema, v)
+		var serr *SchemaError
+		switch {
+		case tt.path == "" && err != nil:
+			t.Errorf("Validate(%s) unexpected error: %v", tt.in, err)
+		case tt.path == "":
+		case !errors.As(err, &serr):
+			t.Errorf("Validate(%s) unexpected error: %v", tt.in, err)
+		case tt.path != "-" && serr.Path != tt.path:
+			t.Errorf("Validate(%s) error path = %q; want %q", tt.in, serr.Path, tt.path)
+		}
+	}
+}
+
+func TestSchemaOf(t *testing.T) {
+	type node struct {
+		Name     string    `json:"name"`
+		Note     string    `json:"note,omitempty"`
+		Parent   *node     `json:"parent"`
+		Children []node    `json:"children"`
+		Created  time.Time `json:"created"`
+		Attrs    map[string]float64
+		Data     []byte
+		Ignored  string `json:"-"`
+		internal int
+	}
+	s := SchemaOf(node{})
+	b, err := json.Marshal(s)
+	fatal(t, err)
+	want := `{"properties":{"Attrs":{"additionalProperties":{"type":"number"},"type":"object"},` +
+		`"Data":{"type":"string"},` +
+		`"children":{"items":{"type":"object"},"type":"array"},` +
+		`"created":{"format":"date-time","type":"string"},` +
+		`"name":{"type":"string"},"note":{"type":"string"},"parent":{"type":"object"}},` +
+		`"required":["name","children","created","Attrs","Data"],"type":"object"}`
+	if string(b) != want {
+		t.Fatalf("unexpected schema:\n%s", b)
+	}
+}
+
+func TestSchemaOfEmbedded(t *testing.T) {
+	type Base struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	type Extra struct {
+		Note string `json:"note"`
+	}
+	type item struct {
+		Base
+		*Extra
+		Name  string `json:"name,omitempty"`
+		Count int    `json:"count"`
+	}
+	b, err := json.Marshal(SchemaOf(item{}))
+	fatal(t, err)
+	want := `{"properties":{"count":{"type":"integer"},"id":{"type":"string"},` +
+		`"name":{"type":"string"},"note":{"type":"string"}},` +
+		`"required":["id","count"],"type":"object"}`
+	if string(b) != want {
+		t.Fatalf("unexpected schema:\n%s", b)
+	}
+}
+
+func TestWithSchemaSubmux(t *testing.T) {
+	ctx := context.Background()
+
+	sub := NewRespondMux()
+	sub.Handle("echo", HandlerFunc(func(r Responder, c *Call) {
+		var s string
+		fatal(t, c.Receive(&s))
+		r.Return(s)
+	}))
+	mux := NewRespondMux()
+	mux.Handle("str", WithSchema(sub, Schema{Args: map[string]any{"type": "string"}}))
+
+	client, _ := newTestPair(mux)
+	defer client.Close()
+
+	var out string
+	_, err := client.Call(ctx, "str.echo", "hello", &out)
+	fatal(t, err)
+	if out != "hello" {
+		t.Fatal("unexpected reply:", out)
+	}
+	_, err = client.Call(ctx, "str.echo", 42, &out)
+	if _, ok := err.(RemoteError); !ok || !strings.Contains(err.Error(), "invalid args") {
+		t.Fatal("unexpected error:", err)
+	}
+	if s, ok := mux.Schemas()["/str/echo"]; !ok || s.Args["type"] != "string" {
+		t.Fatal("unexpected schemas:", mux.Schemas())
+	}
+	if p := mux.Patterns(); len(p) != 1 || p[0] != "/str/echo" {
+		t.Fatal("unexpected patterns:", p)
+	}
+}
+
+func TestWithSchema(t *testing.T) {
+	ctx := context.Background()
+
+	type user struct {
+		Name string `json:"name"`
+	}
+	argSchema := SchemaOf(user{})
+	argSchema["additionalProperties"] = false
+
+	var invoked int
+	mux := NewRespondMux()
+	mux.Handle("users.add", WithSchema(HandlerFunc(func(r Responder, c *Call) {
+		invoked++
+		var u user
+		fatal(t, c.Receive(&u))
+		r.Return(strings.ToUpper(u.Name))
+	}), Schema{
+		Args:  argSchema,
+		Reply: map[string]any{"type": "string", "maxLength": 3},
+	}))
+	mux.Handle(ReflectSelector, ReflectionHandler(mux))
+
+	client, _ := newTestPair(mux)
+	defer client.Close()
+
+	var out string
+	_, err := client.Call(ctx, "users.add", user{Name: "bob"}, &out)
+	fatal(t, err)
+	if out != "BOB" {
+		t.Fatal("unexpected reply:", out)
+	}
+	_, err = client.Call(ctx, "users.add", map[string]any{"name": "bob", "admin": true}, &out)
+	if _, ok := err.(RemoteError); !ok || !strings.Contains(err.Error(), "invalid args") {
+		t.Fatal("unexpected error:", err)
+	}
+	if invoked != 1 {
+		t.Fatal("handler invoked for invalid args")
+	}
+
+	var ref Reflection
+	_, err = client.Call(ctx, ReflectSelector, nil, &ref)
+	fatal(t, err)
+	if s, ok := ref.Schema("users.add"); !ok || !reflect.DeepEqual(s.Reply["maxLength"], float64(3)) {
+		t.Fatal("unexpected reflected schema:", ref.Schemas)
+	}
+
+	client.ValidateReply = ref.ValidateReply
+	_, err = client.Call(ctx, "users.add", user{Name: "alice"}, &out)
+	var serr *SchemaError
+	if !errors.As(err, &serr) {
+		t.Fatal("unexpected error:", err)
+	}
+}
@@ -0,0 +1,246 @@
+package rpc
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// SchemaError is returned by Validate for a value that does not match a schema.
+type SchemaError struct {
+	// Path is the JSON Pointer of the invalid value, empty for the root value.
+	Path   string
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Path == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Reason)
+}
+
+// Validate checks a generically decoded value, as produced by decoding into an
+// interface{}, against a JSON Schema. It supports the type, enum, const,
+// properties, required, additionalProperties, items, prefixItems, minItems,
+// maxItems, minLength, maxLength, pattern, minimum and maximum keywords,
+// ignoring any others. A non-nil error is a *SchemaError.
+func Validate(schema map[string]any, v any) error {
+	return validate(schema, v, "")
+}
+
+func validate(schema map[string]any, v any, path string) error {
+	fail := func(format string, args ...any) error {
+		return &SchemaError{Path: path, Reason: fmt.Sprintf(format, args...)}
+	}
+	rv := reflect.ValueOf(v)
+	kind := jsonKind(rv)
+
+	if t, ok := schema["type"]; ok {
+		types := stringsOf(t)
+		matched := false
+		for _, typ := range types {
+			if typ == kind || (typ == "number" && kind == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("expected %s, got %s", strings.Join(types, " or "), kind)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, v) {
+		return fail("expected %v", c)
+	}
+	if e, ok := schema["enum"]; ok {
+		found := false
+		ev := reflect.ValueOf(e)
+		if ev.Kind() == reflect.Slice {
+			for i := 0; i < ev.Len(); i++ {
+				if jsonEqual(ev.Index(i).Interface(), v) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return fail("value not in enum %v", e)
+		}
+	}
+
+	switch kind {
+	case "string":
+		s := rv.String()
+		if n, ok := numberOf(schema["minLength"]); ok && float64(utf8.RuneCountInString(s)) < n {
+			return fail("shorter than %v", n)
+		}
+		if n, ok := numberOf(schema["maxLength"]); ok && float64(utf8.RuneCountInString(s)) > n {
+			return fail("longer than %v", n)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fail("invalid pattern %q: %v", p, err)
+			}
+			if !re.MatchString(s) {
+				return fail("does not match pattern %q", p)
+			}
+		}
+	case "number", "integer":
+		f, _ := numberOf(v)
+		if n, ok := numberOf(schema["minimum"]); ok && f < n {
+			return fail("less than %v", n)
+		}
+		if n, ok := numberOf(schema["maximum"]); ok && f > n {
+			return fail("greater than %v", n)
+		}
+	case "array":
+		if n, ok := numberOf(schema["minItems"]); ok && float64(rv.Len()) < n {
+			return fail("fewer than %v items", n)
+		}
+		if n, ok := numberOf(schema["maxItems"]); ok && float64(rv.Len()) > n {
+			return fail("more than %v items", n)
+		}
+		prefix, _ := schema["prefixItems"].([]any)
+		for i := 0; i < rv.Len() && i < len(prefix); i++ {
+			if item, ok := schemaOfKeyword(prefix[i]); ok {
+				if err := validate(item, rv.Index(i).Interface(), fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+		if items, ok := schemaOfKeyword(schema["items"]); ok {
+			for i := len(prefix); i < rv.Len(); i++ {
+				if err := validate(items, rv.Index(i).Interface(), fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "object":
+		fields := make(map[string]any, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			fields[fmt.Sprint(iter.Key().Interface())] = iter.Value().Interface()
+		}
+		for _, name := range stringsOf(schema["required"]) {
+			if _, ok := fields[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fieldPath := path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+			if prop, ok := schemaOfKeyword(props[name]); ok {
+				if err := validate(prop, fields[name], fieldPath); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, ok := props[name]; ok {
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return fail("unexpected property %q", name)
+				}
+			case map[string]any:
+				if err := validate(extra, fields[name], fieldPath); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// jsonKind returns the JSON Schema type name of a generically decoded value.
+func jsonKind(rv reflect.Value) string {
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return "null"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map:
+		return "object"
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return "null"
+		}
+		return jsonKind(rv.Elem())
+	default:
+		return rv.Kind().String()
+	}
+}
+
+// numberOf returns v as a float64 if it is a number of any type.
+func numberOf(v any) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// stringsOf returns a keyword value that is a string or a list of strings,
+// as []string or []interface{}, as a []string.
+func stringsOf(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []any:
+		var s []string
+		for _, e := range v {
+			if str, ok := e.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	default:
+		return nil
+	}
+}
+
+func schemaOfKeyword(v any) (map[string]any, bool) {
+	s, ok := v.(map[string]any)
+	return s, ok
+}
+
+// jsonEqual compares values for enum and const, treating numbers of any type
+// with the same value as equal.
+func jsonEqual(a, b any) bool {
+	if x, ok := numberOf(a); ok {
+		y, ok := numberOf(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -1,10 +1,19 @@
 package rpc
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/roachadam/qtalk-go/codec"
 	"github.com/roachadam/qtalk-go/mux"
@@ -14,18 +23,175 @@ import (
 type Server struct {
 	Handler Handler
 	Codec   codec.Codec
-	sess    mux.Session
+
+	// ErrorLog specifies an optional logger for errors reading calls and
+	// panics recovered from handlers. If nil, logging is done via the log
+	// package's standard logger.
+	ErrorLog *log.Logger
+
+	// CrashOnPanic disables recovering panics in handlers, so they crash
+	// the program as they would in any other goroutine. This can be useful
+	// during development.
+	CrashOnPanic bool
+
+	// CodecSelector, if set, returns the codec to use for calls on a
+	// session, so peers using different codecs can be served together. It
+	// is called when the first channel of the session is accepted, once the
+	// session hello has been exchanged, so it can check mux.Negotiator.Protocol.
+	// If it returns nil, Codec is used.
+	CodecSelector func(sess mux.Session) codec.Codec
+
+	// Codecs, if set, are the codecs peers can agree on with
+	// NegotiateCodec, in order of preference. Their first channel then
+	// negotiates the codec of the session, which is used instead of
+	// CodecSelector and Codec. Sessions of peers not negotiating use those
+	// as before, or the first of Codecs if both are nil.
+	Codecs []NamedCodec
+
+	// NewCaller, if set, returns the Client used as the Caller of calls on
+	// a session and returned for it by FindSessions, so calls back to the
+	// calling side can be configured like other clients, such as with
+	// ValidateReply. It is called once per session with the codec selected
+	// for the session, which the Client should use, and again if the codec
+	// is negotiated after. If nil, NewClient is used.
+	NewCaller func(sess mux.Session, cd codec.Codec) *Client
+
+	// MaxCallDepth is the number of calls a call can be nested in, made by
+	// handlers calling back with the Context of their Call. Deeper calls
+	// fail with ErrCallDepth instead of invoking the handler, so callback
+	// cycles fail fast rather than exhausting the goroutines and channels
+	// of the sessions. If zero, DefaultMaxCallDepth is used, and a
+	// negative value disables the limit.
+	MaxCallDepth int
+
+	// Workers, if positive, bounds the number of handlers running at once
+	// across all sessions of the server. Calls accepted while all workers
+	// are busy wait for one, and calls beyond Queue waiting calls fail
+	// with ErrBusy without invoking a handler. Handlers waiting on calls
+	// back to a side served by the same server hold their worker, so
+	// nesting deeper than Workers can only fail or deadlock. Stats reports
+	// the running and waiting calls.
+	Workers int
+
+	// Queue is the number of calls that can wait for one of the Workers.
+	// If zero, it is the number of Workers, and a negative value makes
+	// calls fail when all workers are busy.
+	Queue int
+
+	// TraceStream, if set, is called with the values sent and received by
+	// handlers of streamed calls: streamed args, and values sent or
+	// received with the Responder and Call after continuing the call.
+	TraceStream StreamTracer
+
+	// OnMalformedCall, if set, is called with the session and the error
+	// decoding the header of a call, after the caller was sent
+	// ErrMalformedCall. Stats counts these calls, so a peer speaking another
+	// codec or protocol version can be noticed without parsing logs.
+	OnMalformedCall func(sess mux.Session, err error)
+
+	// ContinueIdleTimeout, if positive, closes the channels of continued
+	// calls once neither side has read or written them for the timeout,
+	// so handlers forgetting to close them don't leak them. The peer reads
+	// a mux.ChannelError with CloseCodeIdle if the session supports close
+	// errors. Stats counts the channels closed this way, which are also
+	// logged with their selector. Continue then returns a channel
+	// implementing only mux.Channel.
+	ContinueIdleTimeout time.Duration
+
+	sess mux.Session
+
+	mu        sync.Mutex
+	sessions  map[mux.Session]*servedSession
+	listeners map[mux.Listener]struct{}
+	drain     chan struct{} // closed by Shutdown
+
+	workersOnce             sync.Once
+	workers                 chan struct{}
+	active, queued, pending atomic.Int64
+	malformed, idleClosed   atomic.Int64
+}
+
+// ErrInternal is returned to callers when a handler panics. Callers receive
+// it as a RemoteError with the same message.
+var ErrInternal = errors.New("rpc: internal error")
+
+// ErrCallDepth is returned to callers of calls nested deeper than the
+// MaxCallDepth of the server. Callers receive it as a RemoteError
+// describing the chain of nested calls.
+var ErrCallDepth = errors.New("rpc: call nesting too deep")
+
+// ErrMalformedCall is returned to callers when the header of their call
+// cannot be decoded, instead of leaving them waiting for a response. Callers
+// receive it as a RemoteError with the decoding error.
+var ErrMalformedCall = errors.New("rpc: malformed call header")
+
+// DefaultMaxCallDepth is the MaxCallDepth of servers that don't set it.
+const DefaultMaxCallDepth = 32
+
+var errNoSession = errors.New("rpc: server has no session to call")
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
 }
 
 // ServeMux will Accept sessions until the Listener is closed, and will Respond to accepted sessions in their own goroutine.
+// Errors serving a session are logged. After Shutdown, ServeMux closes the
+// Listener and returns ErrServerClosed.
+//
+// Temporary errors accepting sessions, such as running out of file
+// descriptors, are logged and retried with a backoff of up to a second.
+// ServeMux returns any other Accept error.
 func (s *Server) ServeMux(l mux.Listener) error {
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
+	var delay time.Duration
 	for {
 		sess, err := l.Accept()
 		if err != nil {
-			return err
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if !temporary(err) {
+				return err
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			s.logf("rpc: Accept error: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go func() {
+			if err := s.Respond(sess, nil); err != nil {
+				s.logf("rpc.Respond: %v", err)
+			}
+		}()
+	}
+}
+
+// maxAcceptDelay is the longest ServeMux waits to retry a temporary error.
+const maxAcceptDelay = time.Second
+
+// temporary returns whether err accepting a connection is expected to go
+// away, so accepting should be retried.
+func temporary(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return true
 		}
-		go s.Respond(sess, nil)
 	}
+	var ne interface{ Temporary() bool }
+	return errors.As(err, &ne) && ne.Temporary()
 }
 
 // Serve will Accept sessions until the Listener is closed, and will Respond to accepted sessions in their own goroutine.
@@ -33,67 +199,305 @@ func (s *Server) Serve(l net.Listener) error {
 	return s.ServeMux(mux.ListenerFrom(l))
 }
 
+// ErrNilCodec is returned serving a session without a Codec, Codecs or a
+// codec selected by CodecSelector.
+var ErrNilCodec = errors.New("rpc: nil codec")
+
 // Respond will Accept channels until the Session is closed and respond with the server handler in its own goroutine.
 // If Handler was not set, an empty RespondMux is used. If the handler does not initiate a response, a nil value is
-// returned. If the handler does not call Continue, the channel will be closed. Respond will panic if Codec is nil.
+// returned. If the handler does not call Continue, the channel will be closed.
+//
+// If the context is not nil, Call Contexts are derived from it. Otherwise they are derived from a context.Background().
+// Respond is otherwise the same as ServeSession.
+func (s *Server) Respond(sess mux.Session, ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s.ServeSession(ctx, sess)
+}
+
+// ServeSession responds to calls on sess like Respond, so embedders can run
+// their own accept loops and supervise sessions. Call Contexts are derived
+// from ctx and cancelled when ServeSession returns. If ctx is cancelled,
+// ServeSession stops accepting channels, waits for handlers of accepted calls
+// to return, closes the session and returns the context error. After
+// Shutdown, ServeSession drains the session, returning nil once the calls
+// accepted before the peer stopped making calls have returned.
 //
-// If the context is not nil, it will be added to Calls. Otherwise the Call Context will be set to a context.Background().
-func (s *Server) Respond(sess mux.Session, ctx context.Context) {
+// It returns nil when the session is closed, ErrNilCodec if there is no codec
+// for the session, or the error accepting a channel. The session is closed
+// when ServeSession returns.
+func (s *Server) ServeSession(ctx context.Context, sess mux.Session) error {
 	defer sess.Close()
 
-	if s.Codec == nil {
-		panic("rpc.Respond: nil codec")
+	if s.Codec == nil && s.CodecSelector == nil && len(s.Codecs) == 0 {
+		return ErrNilCodec
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	served := s.track(sess)
+	defer s.untrack(served)
+
 	hn := s.Handler
 	if hn == nil {
 		hn = NewRespondMux()
 	}
 
+	// shared by all calls on the session, once the codec is selected
+	var sc *sessionCodec
+
+	chans := make(chan mux.Channel)
+	acceptErr := make(chan error, 1)
+	go func() {
+		for {
+			ch, err := sess.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			select {
+			case chans <- ch:
+			case <-ctx.Done():
+				// no longer accepting calls
+				ch.Close()
+			}
+		}
+	}()
+
+	// calls report finishing so draining sessions can close once idle
+	finished := make(chan struct{})
+	inflight := 0
+	drain := s.draining()
+	var drained, closeIdle bool
+
+	var wg sync.WaitGroup
 	for {
-		ch, err := sess.Accept()
-		if err != nil {
+		select {
+		case <-drain:
+			drain = nil
+			if err := goAway(sess); err == nil {
+				// Accept ends once the peer stops opening channels
+				drained = true
+			} else if closeIdle = true; inflight == 0 {
+				return nil
+			}
+		case <-finished:
+			if inflight--; closeIdle && inflight == 0 {
+				return nil
+			}
+		case ch := <-chans:
+			if ctx.Err() != nil {
+				ch.Close()
+				continue
+			}
+			// the first channel may negotiate the codec instead of
+			// making a call, which the calls after it wait for
+			negotiate := sc == nil && len(s.Codecs) > 0
+			if sc == nil {
+				sc = &sessionCodec{ready: make(chan struct{})}
+				if !negotiate && !s.selectCodec(served, sc) {
+					ch.Close()
+					return fmt.Errorf("%w for session %s", ErrNilCodec, sessionID(sess))
+				}
+			}
+			var admitted bool
+			if !negotiate {
+				admitted = s.admit()
+			}
+			wg.Add(1)
+			inflight++
+			done := func() {
+				wg.Done()
+				select {
+				case finished <- struct{}{}:
+				case <-ctx.Done():
+				}
+			}
+			go func(sc *sessionCodec) {
+				defer done()
+				var read []byte
+				if negotiate {
+					var isCall bool
+					read, isCall = s.negotiateCodec(ctx, served, ch)
+					s.selectCodec(served, sc)
+					if !isCall {
+						return
+					}
+					admitted = s.admit()
+				}
+				// closed once negotiating ends, which ctx bounds
+				<-sc.ready
+				if sc.caller == nil {
+					ch.Close()
+					return
+				}
+				if !admitted {
+					s.respond(busyHandler, sc.caller, sc.framer, ch, read, ctx)
+					return
+				}
+				if !s.acquire(ctx) {
+					ch.Close()
+					return
+				}
+				defer s.release()
+				s.respond(hn, sc.caller, sc.framer, ch, read, ctx)
+			}(sc)
+		case err := <-acceptErr:
 			if err == io.EOF {
-				return
+				if drained {
+					wg.Wait()
+				}
+				return nil
 			}
-			panic(err)
+			return err
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
 		}
-		go s.respond(hn, sess, ch, ctx)
 	}
 }
 
-func (s *Server) respond(hn Handler, sess mux.Session, ch mux.Channel, ctx context.Context) {
-	framer := &FrameCodec{Codec: s.Codec}
-	dec := framer.Decoder(ch)
+func (s *Server) maxCallDepth() int {
+	if s.MaxCallDepth == 0 {
+		return DefaultMaxCallDepth
+	}
+	return s.MaxCallDepth
+}
 
-	var call Call
-	err := dec.Decode(&call)
+// sessionCodec is the codec shared by the calls on a served session, set
+// once ready is closed.
+type sessionCodec struct {
+	ready  chan struct{}
+	caller *Client
+	framer *FrameCodec
+}
+
+// selectCodec sets the codec of sc to the one of the caller of served and
+// closes ready, returning false if there is none.
+func (s *Server) selectCodec(served *servedSession, sc *sessionCodec) bool {
+	defer close(sc.ready)
+	caller := s.caller(served)
+	if caller == nil {
+		return false
+	}
+	sc.caller = caller
+	sc.framer = &FrameCodec{Codec: caller.codec}
+	return true
+}
+
+// codec returns the codec selected for sess.
+func (s *Server) codec(sess mux.Session) codec.Codec {
+	if s.CodecSelector != nil {
+		if cd := s.CodecSelector(sess); cd != nil {
+			return cd
+		}
+	}
+	if s.Codec == nil && len(s.Codecs) > 0 {
+		return s.Codecs[0].Codec
+	}
+	return s.Codec
+}
+
+// serverCall holds the state of a call being responded to, allocated together.
+type serverCall struct {
+	call    Call
+	resp    responder
+	header  ResponseHeader
+	dec     frameDecoder
+	counter countingChannel
+}
+
+func (s *Server) respond(hn Handler, caller *Client, framer *FrameCodec, ch mux.Channel, read []byte, ctx context.Context) {
+	sc := &serverCall{}
+	sc.counter.Channel = ch
+	sc.dec = frameDecoder{r: &sc.counter, c: framer.Codec}
+	if read != nil {
+		// the start of the call was read to check for a negotiation
+		sc.dec.r = io.MultiReader(bytes.NewReader(read), &sc.counter)
+	}
+
+	call := &sc.call
+	err := sc.dec.Decode(call)
 	if err != nil {
-		log.Println("rpc.Respond:", err)
+		// a channel closed before the call is abandoned, not malformed
+		if err != io.EOF {
+			s.malformedCall(caller.Session, framer, ch, err)
+		}
+		ch.Close()
 		return
 	}
 
 	call.Selector = cleanSelector(call.Selector)
-	call.Decoder = dec
-	call.Caller = &Client{
-		Session: sess,
-		codec:   s.Codec,
-	}
-	if ctx == nil {
-		call.Context = context.Background()
-	} else {
-		call.Context = ctx
+	call.Decoder = &sc.dec
+	call.Caller = caller
+	call.Context = withCallChain(ctx, call.Chain, call.Selector)
+	if _, ok := ch.(mux.CloseNotifier); ok {
+		var cancel context.CancelFunc
+		call.Context, cancel = context.WithCancel(call.Context)
+		call.closed = make(chan struct{})
+		onClose(ch, func() {
+			close(call.closed)
+			cancel()
+		})
 	}
+	call.ChannelID = ch.ID()
+	call.RemoteChannelID = remoteChannelID(ch)
+	call.SessionID = sessionID(caller.Session)
 	call.ch = ch
 
-	header := &ResponseHeader{}
-	resp := &responder{
-		ch:     ch,
-		c:      framer,
-		header: header,
+	resp := &sc.resp
+	resp.ch = ch
+	if s.ContinueIdleTimeout > 0 {
+		// reads and writes of the channel returned by Continue are counted
+		// as activity too
+		resp.idle = &idleChannel{
+			countingChannel: &sc.counter,
+			srv:             s,
+			selector:        call.Selector,
+			timeout:         s.ContinueIdleTimeout,
+		}
+		resp.ch = resp.idle
+	}
+	resp.counter = &sc.counter
+	resp.c = framer
+	resp.header = &sc.header
+	resp.dec = &sc.dec
+
+	if s.TraceStream != nil {
+		trace := &streamTrace{
+			ctx:       call.Context,
+			tracer:    s.TraceStream,
+			selector:  call.Selector,
+			sessionID: call.SessionID,
+			channelID: call.ChannelID,
+			counter:   &sc.counter,
+		}
+		call.trace, call.resp = trace, resp
+		resp.trace = trace
+	}
+
+	if max := s.maxCallDepth(); max >= 0 && len(call.Chain) > max {
+		resp.Return(fmt.Errorf("%w: %s nested in %d calls exceeds %d (%s)",
+			ErrCallDepth, call.Selector, len(call.Chain), max, strings.Join(append(call.Chain, call.Selector), " -> ")))
+		ch.Close()
+		return
+	}
+
+	if !s.CrashOnPanic {
+		defer func() {
+			if p := recover(); p != nil {
+				s.logf("rpc: panic serving %s: %v\n%s", call.Selector, p, debug.Stack())
+				if !resp.responded {
+					resp.Return(ErrInternal)
+				}
+				ch.Close()
+			}
+		}()
 	}
 
-	hn.RespondRPC(resp, &call)
+	hn.RespondRPC(resp, call)
 	if !resp.responded {
 		resp.Return()
 	}
@@ -101,96 +505,22 @@ func (s *Server) respond(hn Handler, sess mux.Session, ch mux.Channel, ctx conte
 		ch.Close()
 	}
 }
-func (s *Server) Call(ctx context.Context, selector string, args any, replies ...any) (*Response, error) {
-	ch, err := s.sess.Open(ctx)
-	if err != nil {
-		return nil, err
-	}
-	// If the context is cancelled before the call completes, call Close() to
-	// abort the current operation.
-	done := make(chan struct{})
-	defer close(done)
-	go func() {
-		select {
-		case <-ctx.Done():
-			ch.Close()
-		case <-done:
-		}
-	}()
-	resp, err := call(ctx, ch, s.Codec, selector, args, replies...)
-	if ctxErr := ctx.Err(); ctxErr != nil {
-		return resp, ctxErr
+
+// malformedCall responds to a call whose header failed to decode with err.
+func (s *Server) malformedCall(sess mux.Session, framer *FrameCodec, ch mux.Channel, err error) {
+	s.malformed.Add(1)
+	s.logf("rpc.Respond: %v", err)
+	resp := &responder{ch: ch, c: framer, header: &ResponseHeader{}}
+	resp.Return(fmt.Errorf("%w: %v", ErrMalformedCall, err))
+	if s.OnMalformedCall != nil {
+		s.OnMalformedCall(sess, err)
 	}
-	return resp, err
 }
 
-// func call(ctx context.Context, ch mux.Channel, cd codec.Codec, selector string, args any, replies ...any) (*Response, error) {
-// 	framer := &FrameCodec{Codec: cd}
-// 	enc := framer.Encoder(ch)
-// 	dec := framer.Decoder(ch)
-
-// 	// request
-// 	err := enc.Encode(CallHeader{
-// 		Selector: selector,
-// 	})
-// 	if err != nil {
-// 		ch.Close()
-// 		return nil, err
-// 	}
-
-// 	argCh, isChan := args.(chan interface{})
-// 	switch {
-// 	case isChan:
-// 		for arg := range argCh {
-// 			if err := enc.Encode(arg); err != nil {
-// 				ch.Close()
-// 				return nil, err
-// 			}
-// 		}
-// 	default:
-// 		if err := enc.Encode(args); err != nil {
-// 			ch.Close()
-// 			return nil, err
-// 		}
-// 	}
-
-// 	// response
-// 	var header ResponseHeader
-// 	err = dec.Decode(&header)
-// 	if err != nil {
-// 		ch.Close()
-// 		return nil, err
-// 	}
-
-// 	if !header.Continue {
-// 		defer ch.Close()
-// 	}
-
-// 	resp := &Response{
-// 		ResponseHeader: header,
-// 		Channel:        ch,
-// 		codec:          framer,
-// 	}
-// 	if len(replies) == 1 {
-// 		resp.Reply = replies[0]
-// 	} else if len(replies) > 1 {
-// 		resp.Reply = replies
-// 	}
-// 	if resp.Error != nil {
-// 		return resp, RemoteError(*resp.Error)
-// 	}
-
-// 	if resp.Reply == nil {
-// 		// read into throwaway buffer
-// 		var buf []byte
-// 		dec.Decode(&buf)
-// 	} else {
-// 		for _, r := range replies {
-// 			if err := dec.Decode(r); err != nil {
-// 				return resp, err
-// 			}
-// 		}
-// 	}
-
-// 	return resp, nil
-// }
+// Call makes a call on the session of the server like Client.Call.
+func (s *Server) Call(ctx context.Context, selector string, args any, replies ...any) (*Response, error) {
+	if s.sess == nil {
+		return nil, errNoSession
+	}
+	return sessionCall(ctx, s.sess, s.Codec, selector, args, replies...)
+}
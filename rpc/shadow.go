@@ -0,0 +1,126 @@
+package rpc
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowOptions configure the handlers returned by WithShadow.
+type ShadowOptions struct {
+	// Percent is the percentage of calls, from 0 to 100, duplicated to the
+	// shadow.
+	Percent float64
+
+	// Timeout limits each shadow call. If zero, 10 seconds is used.
+	Timeout time.Duration
+
+	// MaxInFlight limits the shadow calls in progress at once, beyond
+	// which calls are not duplicated, so a slow shadow can't pile up
+	// calls. If zero, 100 is used.
+	MaxInFlight int
+
+	// Done, if set, is called with the error of each shadow call once it
+	// completes, such as to count its failures. The reply is discarded.
+	Done func(selector string, err error)
+}
+
+// WithShadow returns a handler that duplicates a percentage of the calls to
+// h to the shadow Caller, such as a new version of a service, and discards
+// its responses, to validate it against real traffic:
+//
+//	mux.Handle("users.", rpc.WithShadow(users, canary, rpc.ShadowOptions{Percent: 5}))
+//
+// Calls are duplicated with the argument values h received once it
+// returns, in the background so they don't delay or affect the response of
+// h. Arguments h discarded or failed to receive are sent as nil, and
+// calls with streamed arguments are not duplicated.
+//
+// A handler with a Match method like a RespondMux keeps being registered as
+// a submux, and the calls of every handler it matches are duplicated.
+func WithShadow(h Handler, shadow Caller, opts ShadowOptions) Handler {
+	sh := &shadowHandler{Handler: h, s: &shadower{caller: shadow, opts: opts}}
+	if m, ok := h.(matcher); ok {
+		return &shadowMatcher{shadowHandler: sh, m: m}
+	}
+	return sh
+}
+
+// shadower makes the shadow calls of a shadowHandler and its submux.
+type shadower struct {
+	caller   Caller
+	opts     ShadowOptions
+	inFlight atomic.Int64
+}
+
+type shadowHandler struct {
+	Handler
+	s *shadower
+}
+
+// shadowMatcher is the shadowHandler of a submux.
+type shadowMatcher struct {
+	*shadowHandler
+	m matcher
+}
+
+func (h *shadowMatcher) Match(selector string) (Handler, string) {
+	sub, pattern := h.m.Match(selector)
+	if sub == nil {
+		return nil, ""
+	}
+	return &shadowHandler{Handler: sub, s: h.s}, pattern
+}
+
+func (h *shadowHandler) RespondRPC(r Responder, c *Call) {
+	if c.Args == streamArgs || h.s.opts.Percent <= 0 || rand.Float64()*100 >= h.s.opts.Percent {
+		h.Handler.RespondRPC(r, c)
+		return
+	}
+	args := &recordingDecoder{Decoder: c.Decoder}
+	c.Decoder = args
+	defer func() {
+		h.s.call(c, args.values)
+	}()
+	h.Handler.RespondRPC(r, c)
+}
+
+// call duplicates c with args unless too many shadow calls are in flight.
+func (s *shadower) call(c *Call, args []any) {
+	if len(args) > 1 {
+		// args streamed by a client not sending their count
+		return
+	}
+	max := s.opts.MaxInFlight
+	if max <= 0 {
+		max = 100
+	}
+	if s.inFlight.Add(1) > int64(max) {
+		s.inFlight.Add(-1)
+		return
+	}
+	timeout := s.opts.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	// the shadow call keeps the values of the call context, like the
+	// chain of nested calls, but not its cancellation
+	ctx, cancel := context.WithTimeout(detachedContext{c.Context}, timeout)
+	selector := c.Selector
+	var arg any
+	if len(args) > 0 {
+		arg = args[0]
+	}
+	go func() {
+		defer s.inFlight.Add(-1)
+		defer cancel()
+		resp, err := s.caller.Call(ctx, selector, arg)
+		if resp != nil && resp.Continue && resp.Channel != nil {
+			resp.Channel.Close()
+		}
+		if s.opts.Done != nil {
+			s.opts.Done(selector, err)
+		}
+	}()
+}
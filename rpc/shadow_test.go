@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// recordingCaller sends the calls made with it on a channel.
+type recordingCaller chan string
+
+func (c recordingCaller) Call(ctx context.Context, selector string, args any, replies ...any) (*Response, error) {
+	s, _ := args.(*string)
+	if s == nil {
+		c <- selector + " nil"
+	} else {
+		c <- selector + " " + *s
+	}
+	return nil, errors.New("shadow failed")
+}
+
+func TestWithShadow(t *testing.T) {
+	shadow := make(recordingCaller, 10)
+	errs := make(chan error, 10)
+	mux := NewRespondMux()
+	mux.Handle("hello", HandlerFunc(func(r Responder, c *Call) {
+		var name string
+		if err := c.Receive(&name); err != nil {
+			r.Return(err)
+			return
+		}
+		r.Return("hello " + name)
+	}))
+	client, _ := newTestPair(WithShadow(mux, shadow, ShadowOptions{
+		Percent: 100,
+		Done:    func(selector string, err error) { errs <- err },
+	}))
+	defer client.Close()
+
+	// the shadow's failure does not affect the call
+	var reply string
+	_, err := client.Call(context.Background(), "hello", "bob", &reply)
+	fatal(t, err)
+	if reply != "hello bob" {
+		t.Fatal("unexpected reply:", reply)
+	}
+	if call := <-shadow; call != "/hello bob" {
+		t.Fatal("unexpected shadow call:", call)
+	}
+	if err := <-errs; err == nil || err.Error() != "shadow failed" {
+		t.Fatal("unexpected shadow error:", err)
+	}
+}
+
+func TestWithShadowPercent(t *testing.T) {
+	shadow := make(recordingCaller, 10)
+	client, _ := newTestPair(WithShadow(HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		r.Return()
+	}), shadow, ShadowOptions{}))
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := client.Call(context.Background(), "hello", nil)
+		fatal(t, err)
+	}
+	if len(shadow) != 0 {
+		t.Fatal("calls shadowed with zero percent")
+	}
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// ErrServerClosed is returned by ServeMux and Serve after Shutdown.
+var ErrServerClosed = errors.New("rpc: server closed")
+
+// Shutdown gracefully stops the server, so it can be restarted without
+// failing calls, typically after handing its listeners to the replacing
+// process with talk.Handoff. It closes the listeners of ServeMux and Serve,
+// then drains the sessions being served: peers are sent a go away with
+// mux.GoAwayer so their new calls can move to a new session, and each
+// session is closed once the calls made before have returned. Sessions of
+// peers without support for go away are closed once no calls are in
+// flight.
+//
+// Shutdown returns when all sessions are closed, or closes the remaining
+// ones and returns the error of ctx when it is done first. Streaming calls
+// of long lived peers should watch their Context to end in time.
+func (s *Server) Shutdown(ctx context.Context) error {
+	drain := s.draining()
+	s.mu.Lock()
+	select {
+	case <-drain:
+	default:
+		close(s.drain)
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	delay := 5 * time.Millisecond
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.sessions)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			for _, served := range s.sessions {
+				served.sess.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-t.C:
+			if delay *= 2; delay > 500*time.Millisecond {
+				delay = 500 * time.Millisecond
+			}
+			t.Reset(delay)
+		}
+	}
+}
+
+// draining returns the channel closed by Shutdown.
+func (s *Server) draining() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drain == nil {
+		s.drain = make(chan struct{})
+	}
+	return s.drain
+}
+
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.draining():
+		return true
+	default:
+		return false
+	}
+}
+
+// trackListener registers l to be closed by Shutdown, returning false if
+// the server is already shut down.
+func (s *Server) trackListener(l mux.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drain != nil {
+		select {
+		case <-s.drain:
+			return false
+		default:
+		}
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[mux.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(l mux.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+// goAway tells the peer of sess to stop making calls.
+func goAway(sess mux.Session) error {
+	g, ok := sess.(mux.GoAwayer)
+	if !ok {
+		return mux.ErrGoAwayUnsupported
+	}
+	return g.GoAway()
+}
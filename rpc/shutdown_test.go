@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+func TestServerShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config *mux.SessionConfig
+	}{
+		{"go away", &mux.SessionConfig{Features: mux.FeatureGoAway}},
+		{"no hello", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			started, release := make(chan struct{}), make(chan struct{})
+			srv := &Server{
+				Codec: codec.JSONCodec{},
+				Handler: HandlerFunc(func(r Responder, c *Call) {
+					close(started)
+					<-release
+					r.Return("ok")
+				}),
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			fatal(t, err)
+			served := make(chan error, 1)
+			go func() { served <- srv.Serve(l) }()
+
+			goneAway := make(chan struct{})
+			config := &mux.SessionConfig{OnGoAway: func() { close(goneAway) }}
+			if tt.config != nil {
+				config.Features = tt.config.Features
+			}
+			conn, err := net.Dial("tcp", l.Addr().String())
+			fatal(t, err)
+			client := NewClient(mux.NewWithConfig(conn, config), codec.JSONCodec{})
+			defer client.Close()
+
+			replied := make(chan error, 1)
+			go func() {
+				var out string
+				_, err := client.Call(ctx, "slow", nil, &out)
+				replied <- err
+			}()
+			<-started
+
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- srv.Shutdown(ctx) }()
+			if err := <-served; err != ErrServerClosed {
+				t.Fatalf("expected ErrServerClosed, got %v", err)
+			}
+			if tt.config != nil {
+				<-goneAway
+				if _, err := client.Call(ctx, "other", nil, nil); !errors.Is(err, mux.ErrGoAway) {
+					t.Fatalf("expected ErrGoAway, got %v", err)
+				}
+			}
+			select {
+			case err := <-shutdown:
+				t.Fatalf("shut down with a call in flight: %v", err)
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			close(release)
+			fatal(t, <-replied)
+			fatal(t, <-shutdown)
+			if err := client.Session.Wait(); err == nil {
+				t.Fatal("expected the session to be closed")
+			}
+			if err := srv.Serve(l); err != ErrServerClosed {
+				t.Fatalf("expected ErrServerClosed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	srv := &Server{
+		Codec: codec.JSONCodec{},
+		Handler: HandlerFunc(func(r Responder, c *Call) {
+			close(started)
+			<-release
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(t, err)
+	go srv.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(t, err)
+	client := NewClient(mux.New(conn), codec.JSONCodec{})
+	defer client.Close()
+	go client.Call(context.Background(), "stuck", nil, nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if err := client.Session.Wait(); err == nil {
+		t.Fatal("expected the session to be closed")
+	}
+}
@@ -0,0 +1,245 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// StreamHandler returns a handler that hands the channel of each call to fn
+// as a raw byte stream once the argument value was received, which is
+// discarded. The call is continued when fn first reads or writes, so an
+// error returned by fn before that is returned to the caller. The stream is
+// closed when fn returns, and ctx is cancelled once the caller closes the
+// stream or the session ends.
+func StreamHandler(fn func(ctx context.Context, rw io.ReadWriteCloser) error) Handler {
+	return HandlerFunc(func(r Responder, c *Call) {
+		if err := c.Receive(nil); err != nil {
+			r.Return(err)
+			return
+		}
+		s := &handlerStream{r: r}
+		err := fn(c.Context, s)
+		if err != nil && s.ch == nil {
+			r.Return(err)
+			return
+		}
+		if s.open() == nil {
+			s.ch.Close()
+		}
+	})
+}
+
+// handlerStream continues a call on first use.
+type handlerStream struct {
+	r    Responder
+	once sync.Once
+	ch   mux.Channel
+	err  error
+}
+
+func (s *handlerStream) open() error {
+	s.once.Do(func() {
+		s.ch, s.err = s.r.Continue(nil)
+	})
+	return s.err
+}
+
+func (s *handlerStream) Read(p []byte) (int, error) {
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	return s.ch.Read(p)
+}
+
+func (s *handlerStream) Write(p []byte) (int, error) {
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	return s.ch.Write(p)
+}
+
+func (s *handlerStream) Close() error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	return s.ch.Close()
+}
+
+// errNotStream is returned by OpenStream if the call was not continued.
+var errNotStream = errors.New("rpc: call was not continued as a stream")
+
+// OpenStream calls selector with args and returns the channel of the call as a
+// raw byte stream, such as one handled by a StreamHandler. The context only
+// bounds opening the stream. A RemoteError is returned if the handler returned
+// an error instead.
+func (c *Client) OpenStream(ctx context.Context, selector string, args any) (io.ReadWriteCloser, error) {
+	resp, err := c.Call(ctx, selector, args)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Continue {
+		return nil, errNotStream
+	}
+	return resp.Channel, nil
+}
+
+// StreamStatus is the trailer ending a stream of values sent with
+// StreamReplies, telling the caller whether the handler completed the
+// stream.
+type StreamStatus struct {
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+// ErrStreamIncomplete is returned by Response.ReceiveStream if the channel
+// was closed without a StreamStatus, such as when the handler panicked or
+// the session ended mid-stream.
+var ErrStreamIncomplete = errors.New("rpc: stream ended without status")
+
+// StreamReplies continues the call with the values v and calls produce with
+// a function sending values to the caller. Once produce returns, the stream
+// is ended with a StreamStatus reporting the error it returned, if any, and
+// the channel is closed. Callers receive the values with
+// Response.ReceiveStream. It returns the error of produce, or else any
+// error continuing the call or sending the status.
+func StreamReplies(r Responder, produce func(send func(v any) error) error, v ...any) error {
+	ch, err := r.Continue(v...)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	perr := produce(r.Send)
+	status := StreamStatus{OK: perr == nil}
+	if perr != nil {
+		status.Error = perr.Error()
+	}
+	_, err = ch.Write(endFrame)
+	if err == nil {
+		err = r.Send(status)
+	}
+	if perr != nil {
+		return perr
+	}
+	return err
+}
+
+// ReceiveStream decodes the next value of a stream sent with StreamReplies.
+// Once the stream ends it returns io.EOF if the handler completed it, a
+// RemoteError if the handler failed, or ErrStreamIncomplete if the channel
+// was closed without a status, and keeps returning that error afterwards.
+// It grants credits as values are received if AutoGrant was called.
+func (r *Response) ReceiveStream(v any) error {
+	if r.streamErr != nil {
+		return r.streamErr
+	}
+	err := r.Receive(v)
+	if err == nil && r.autoGrant > 0 {
+		r.received++
+		if r.received == r.autoGrant {
+			r.received = 0
+			// a failed grant means the handler is gone, which the next
+			// receive reports
+			r.Grant(r.autoGrant)
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	var status StreamStatus
+	switch err := r.Receive(&status); {
+	case err == io.EOF:
+		r.streamErr = ErrStreamIncomplete
+	case err != nil:
+		r.streamErr = err
+	case !status.OK:
+		r.streamErr = RemoteError(status.Error)
+	default:
+		r.streamErr = io.EOF
+	}
+	return r.streamErr
+}
+
+// errCreditsEnded is returned by the send function of StreamRepliesCredits
+// when the caller can no longer grant credits.
+var errCreditsEnded = errors.New("rpc: caller stopped granting credits")
+
+// StreamRepliesCredits is like StreamReplies, but with credit based flow
+// control: each value sent uses a credit granted by the caller with
+// Response.Grant or Response.AutoGrant, and sending blocks until one is
+// available. This bounds the values buffered when the caller processes
+// them slower than they are produced, not just slower than it reads the
+// channel. Sending also fails once the call context is done or the caller
+// closes the channel. The call argument must have been received.
+func StreamRepliesCredits(r Responder, c *Call, produce func(send func(v any) error) error, v ...any) error {
+	grants := make(chan int)
+	done := make(chan struct{})
+	defer close(done)
+	var grantErr error
+	go func() {
+		defer close(grants)
+		for {
+			var n int
+			if err := c.Receive(&n); err != nil {
+				grantErr = err
+				return
+			}
+			select {
+			case grants <- n:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var ctxDone <-chan struct{}
+	if c.Context != nil {
+		ctxDone = c.Context.Done()
+	}
+	var credits int
+	return StreamReplies(r, func(send func(v any) error) error {
+		return produce(func(v any) error {
+			for credits <= 0 {
+				select {
+				case n, ok := <-grants:
+					if !ok {
+						if grantErr == io.EOF {
+							return errCreditsEnded
+						}
+						return grantErr
+					}
+					credits += n
+				case <-ctxDone:
+					select {
+					case <-c.closed:
+						// the caller closed the channel, which ends
+						// the grants too
+						ctxDone = nil
+						continue
+					default:
+					}
+					return c.Context.Err()
+				}
+			}
+			credits--
+			return send(v)
+		})
+	}, v...)
+}
+
+// Grant sends n credits to a handler streaming with StreamRepliesCredits,
+// allowing it to send n more values.
+func (r *Response) Grant(n int) error {
+	return r.Send(n)
+}
+
+// AutoGrant grants n credits and makes ReceiveStream grant n more each
+// time n values were received, so a handler streaming with
+// StreamRepliesCredits stays at most n values ahead of the caller.
+func (r *Response) AutoGrant(n int) error {
+	r.autoGrant = n
+	r.received = 0
+	return r.Grant(n)
+}
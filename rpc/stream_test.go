@@ -0,0 +1,299 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+func TestStreamHandler(t *testing.T) {
+	ctx := context.Background()
+	mux := NewRespondMux()
+	mux.Handle("echo", StreamHandler(func(ctx context.Context, rw io.ReadWriteCloser) error {
+		_, err := io.Copy(rw, rw)
+		return err
+	}))
+	mux.Handle("fail", StreamHandler(func(ctx context.Context, rw io.ReadWriteCloser) error {
+		return errors.New("no stream")
+	}))
+	mux.Handle("empty", StreamHandler(func(ctx context.Context, rw io.ReadWriteCloser) error {
+		return nil
+	}))
+	mux.Handle("unary", HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		r.Return("reply")
+	}))
+	client, _ := newTestPair(mux)
+	defer client.Close()
+
+	rw, err := client.OpenStream(ctx, "echo", nil)
+	fatal(t, err)
+	_, err = rw.Write([]byte("hello"))
+	fatal(t, err)
+	fatal(t, rw.(interface{ CloseWrite() error }).CloseWrite())
+	b, err := io.ReadAll(rw)
+	fatal(t, err)
+	if string(b) != "hello" {
+		t.Fatalf("unexpected echo: %q", b)
+	}
+	rw.Close()
+
+	if _, err := client.OpenStream(ctx, "fail", nil); err != RemoteError("no stream") {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// the stream is closed when the handler returns
+	rw, err = client.OpenStream(ctx, "empty", nil)
+	fatal(t, err)
+	if n, err := rw.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("expected closed stream, got %d, %v", n, err)
+	}
+
+	if _, err := client.OpenStream(ctx, "unary", nil); err != errNotStream {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestStreamClosed(t *testing.T) {
+	ctx := context.Background()
+	cancelled := make(chan struct{})
+	notified := make(chan struct{})
+	m := NewRespondMux()
+	m.Handle("wait", StreamHandler(func(ctx context.Context, rw io.ReadWriteCloser) error {
+		if _, err := rw.Write([]byte("x")); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		close(cancelled)
+		return nil
+	}))
+	m.Handle("hijack", HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		ch, err := r.Continue()
+		if err != nil {
+			return
+		}
+		ch.(mux.CloseNotifier).OnClose(func() { close(notified) })
+	}))
+	client, _ := newTestPair(m)
+	defer client.Close()
+	wait := func(done chan struct{}, what string) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s not notified of the close", what)
+		}
+	}
+
+	// the context of a stream ends once the caller closes it
+	rw, err := client.OpenStream(ctx, "wait", nil)
+	fatal(t, err)
+	_, err = rw.Read(make([]byte, 1))
+	fatal(t, err)
+	rw.Close()
+	wait(cancelled, "stream handler")
+
+	// continued channels end with the session
+	resp, err := client.Call(ctx, "hijack", nil)
+	fatal(t, err)
+	if !resp.Continue {
+		t.Fatal("expected call to be continued")
+	}
+	client.Close()
+	wait(notified, "continued channel")
+}
+
+func TestSendContext(t *testing.T) {
+	ctx := context.Background()
+	payload := strings.Repeat("x", 4096)
+	sent := make(chan error, 1)
+	received := make(chan struct{})
+	m := NewRespondMux()
+	m.Handle("produce", HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		if _, err := r.Continue(); err != nil {
+			sent <- err
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		for {
+			if err := r.SendContext(ctx, payload); err != nil {
+				sent <- err
+				return
+			}
+		}
+	}))
+	m.Handle("consume", HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		r.Continue()
+		<-received
+	}))
+	client, _ := newTestPairConfig(m, &mux.SessionConfig{ReadBuffer: 1024})
+	defer client.Close()
+
+	// the caller never reads the values
+	_, err := client.Call(ctx, "produce", nil)
+	fatal(t, err)
+	if err := <-sent; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+
+	resp, err := client.Call(ctx, "consume", nil)
+	fatal(t, err)
+	defer close(received)
+	cctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	for err == nil {
+		err = resp.SendContext(cctx, payload)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected Canceled, got %v", err)
+	}
+	if err := resp.SendContext(cctx, payload); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected Canceled, got %v", err)
+	}
+}
+
+func TestReceiveCloseError(t *testing.T) {
+	ctx := context.Background()
+	m := NewRespondMux()
+	m.Handle("produce", HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		ch, err := r.Continue()
+		if err != nil {
+			return
+		}
+		r.Send("first")
+		ch.(mux.ErrorCloser).CloseWithError(1, "source failed")
+	}))
+	client, _ := newTestPairConfig(m, &mux.SessionConfig{Features: mux.FeatureCloseErrors})
+	defer client.Close()
+
+	resp, err := client.Call(ctx, "produce", nil)
+	fatal(t, err)
+	var s string
+	fatal(t, resp.Receive(&s))
+	var cerr *mux.ChannelError
+	if err := resp.Receive(&s); !errors.As(err, &cerr) || cerr.Message != "source failed" {
+		t.Fatalf("expected ChannelError, got %v", err)
+	}
+}
+
+func TestStreamReplies(t *testing.T) {
+	ctx := context.Background()
+	m := NewRespondMux()
+	m.Handle("count", HandlerFunc(func(r Responder, c *Call) {
+		var fail string
+		c.Receive(&fail)
+		StreamReplies(r, func(send func(v any) error) error {
+			for i := 0; i < 3; i++ {
+				if err := send(i); err != nil {
+					return err
+				}
+			}
+			switch fail {
+			case "error":
+				return errors.New("source failed")
+			case "panic":
+				panic("crashed")
+			}
+			return nil
+		}, "started")
+	}))
+
+	for _, tt := range []struct {
+		fail string
+		err  error
+	}{
+		{"", io.EOF},
+		{"error", RemoteError("source failed")},
+		{"panic", ErrStreamIncomplete},
+	} {
+		t.Run(tt.fail, func(t *testing.T) {
+			client, _ := newTestPair(m)
+			defer client.Close()
+
+			var reply string
+			resp, err := client.Call(ctx, "count", tt.fail, &reply)
+			fatal(t, err)
+			if reply != "started" {
+				t.Fatalf("unexpected reply: %q", reply)
+			}
+			var got []int
+			for {
+				var v int
+				if err = resp.ReceiveStream(&v); err != nil {
+					break
+				}
+				got = append(got, v)
+			}
+			if len(got) != 3 || err != tt.err {
+				t.Fatalf("received %v and %v, expected 3 values and %v", got, err, tt.err)
+			}
+			if err := resp.ReceiveStream(nil); err != tt.err {
+				t.Fatalf("expected %v again, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestStreamRepliesCredits(t *testing.T) {
+	ctx := context.Background()
+	var sent int64
+	sendErr := make(chan error, 1)
+	m := NewRespondMux()
+	m.Handle("count", HandlerFunc(func(r Responder, c *Call) {
+		var n int
+		c.Receive(&n)
+		sendErr <- StreamRepliesCredits(r, c, func(send func(v any) error) error {
+			for i := 0; i < n; i++ {
+				if err := send(i); err != nil {
+					return err
+				}
+				atomic.AddInt64(&sent, 1)
+			}
+			return nil
+		})
+	}))
+	client, _ := newTestPair(m)
+	defer client.Close()
+
+	resp, err := client.Call(ctx, "count", 10)
+	fatal(t, err)
+	fatal(t, resp.AutoGrant(2))
+	received := 0
+	for {
+		var v int
+		if err = resp.ReceiveStream(&v); err != nil {
+			break
+		}
+		received++
+		if s := atomic.LoadInt64(&sent); s > int64(received)+2 {
+			t.Fatalf("handler sent %d values with %d received", s, received)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != io.EOF || received != 10 {
+		t.Fatalf("received %d values and %v", received, err)
+	}
+	fatal(t, <-sendErr)
+
+	// without more credits the handler fails once the caller closes
+	resp, err = client.Call(ctx, "count", 10)
+	fatal(t, err)
+	fatal(t, resp.Grant(1))
+	var v int
+	fatal(t, resp.ReceiveStream(&v))
+	resp.Channel.Close()
+	if err := <-sendErr; err != errCreditsEnded {
+		t.Fatalf("expected errCreditsEnded, got %v", err)
+	}
+}
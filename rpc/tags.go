@@ -0,0 +1,199 @@
+package rpc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// servedSession is a session being served by a Server and its tags.
+type servedSession struct {
+	sess   mux.Session
+	caller *Client
+	tags   map[string]string
+
+	// codec is the codec negotiated for the session, if any
+	codec codec.Codec
+}
+
+func (s *Server) track(sess mux.Session) *servedSession {
+	served := &servedSession{sess: sess}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[mux.Session]*servedSession)
+	}
+	s.sessions[sess] = served
+	return served
+}
+
+func (s *Server) untrack(served *servedSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[served.sess] == served {
+		delete(s.sessions, served.sess)
+	}
+}
+
+// caller returns the Client for calls back on a served session, creating it
+// with the selected codec the first time. It returns nil if there is no
+// codec for the session.
+func (s *Server) caller(served *servedSession) *Client {
+	for {
+		s.mu.Lock()
+		caller, cd := served.caller, served.codec
+		s.mu.Unlock()
+		if caller != nil {
+			return caller
+		}
+		negotiated := cd != nil
+		// the hooks are called without holding the lock
+		if cd == nil {
+			cd = s.codec(served.sess)
+		}
+		if cd == nil {
+			return nil
+		}
+		if s.NewCaller != nil {
+			caller = s.NewCaller(served.sess, cd)
+		}
+		if caller == nil {
+			caller = NewClient(served.sess, cd)
+		}
+		s.mu.Lock()
+		if negotiated != (served.codec != nil) {
+			// the codec was negotiated meanwhile
+			s.mu.Unlock()
+			continue
+		}
+		if served.caller == nil {
+			served.caller = caller
+		}
+		caller = served.caller
+		s.mu.Unlock()
+		return caller
+	}
+}
+
+// Tag labels a session being served with key set to value, typically while
+// authenticating it, so it can be found with FindSessions. An empty value
+// removes the label. Tag has no effect on sessions the server is not
+// serving, and labels are removed when the session ends.
+func (s *Server) Tag(sess mux.Session, key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	served, ok := s.sessions[sess]
+	if !ok {
+		return
+	}
+	if value == "" {
+		delete(served.tags, key)
+		return
+	}
+	if served.tags == nil {
+		served.tags = make(map[string]string)
+	}
+	served.tags[key] = value
+}
+
+// Tags returns a copy of the labels of a session being served.
+func (s *Server) Tags(sess mux.Session) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	served, ok := s.sessions[sess]
+	if !ok {
+		return nil
+	}
+	tags := make(map[string]string, len(served.tags))
+	for k, v := range served.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// FindSessions returns clients for calling the sessions being served whose
+// labels match query, sorted by session ID. They are the same clients used as
+// the Caller of calls on the sessions. The query is a comma separated
+// list of terms that must all match, each being key=value, key!=value, or a
+// key that must be set:
+//
+//	user=42
+//	region=eu,role=agent
+//	admin,region!=us
+//
+// An empty query matches all sessions. For sessions without calls yet, the
+// codec is selected when they are found.
+func (s *Server) FindSessions(query string) ([]*Client, error) {
+	match, err := parseTagQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	var found []*servedSession
+	for _, served := range s.sessions {
+		if match(served.tags) {
+			found = append(found, served)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		return sessionID(found[i].sess) < sessionID(found[j].sess)
+	})
+	clients := make([]*Client, 0, len(found))
+	for _, served := range found {
+		if caller := s.caller(served); caller != nil {
+			clients = append(clients, caller)
+		}
+	}
+	return clients, nil
+}
+
+// parseTagQuery returns a function matching labels against a FindSessions
+// query.
+func parseTagQuery(query string) (func(map[string]string) bool, error) {
+	type term struct {
+		key, value string
+		negate     bool
+		exists     bool
+	}
+	var terms []term
+	for _, part := range strings.Split(query, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var t term
+		switch {
+		case strings.Contains(part, "!="):
+			t.key, t.value, _ = strings.Cut(part, "!=")
+			t.negate = true
+		case strings.Contains(part, "="):
+			t.key, t.value, _ = strings.Cut(part, "=")
+		default:
+			t.key, t.exists = part, true
+		}
+		t.key, t.value = strings.TrimSpace(t.key), strings.TrimSpace(t.value)
+		if t.key == "" {
+			return nil, fmt.Errorf("rpc: invalid session query %q", query)
+		}
+		terms = append(terms, t)
+	}
+	return func(tags map[string]string) bool {
+		for _, t := range terms {
+			v, ok := tags[t.key]
+			switch {
+			case t.exists && !ok:
+				return false
+			case t.negate && v == t.value:
+				return false
+			case !t.exists && !t.negate && (!ok || v != t.value):
+				return false
+			}
+		}
+		return true
+	}, nil
+}
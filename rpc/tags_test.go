@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+func TestServerFindSessions(t *testing.T) {
+	ctx := context.Background()
+
+	srv := &Server{Codec: codec.JSONCodec{}}
+	srv.Handler = HandlerFunc(func(r Responder, c *Call) {
+		var tags map[string]string
+		fatal(t, c.Receive(&tags))
+		for k, v := range tags {
+			srv.Tag(c.Caller.(*Client).Session, k, v)
+		}
+		r.Return()
+	})
+
+	// each peer serves pushes from the server, replying with its name
+	login := func(name string, tags map[string]string) *Client {
+		ar, bw := io.Pipe()
+		br, aw := io.Pipe()
+		sessA := mux.New(pipeConn{ar, aw})
+		sessB := mux.New(pipeConn{br, bw})
+		go srv.Respond(sessA, nil)
+		peer := &Server{Codec: codec.JSONCodec{}, Handler: HandlerFunc(func(r Responder, c *Call) {
+			r.Return(name)
+		})}
+		go peer.Respond(sessB, nil)
+		client := NewClient(sessB, codec.JSONCodec{})
+		_, err := client.Call(ctx, "login", tags)
+		fatal(t, err)
+		return client
+	}
+	a := login("a", map[string]string{"user": "42", "region": "eu"})
+	defer a.Close()
+	b := login("b", map[string]string{"user": "7", "region": "eu", "admin": "yes"})
+	defer b.Close()
+	c := login("c", map[string]string{"user": "42", "region": "us"})
+	defer c.Close()
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a", "b", "c"}},
+		{"user=42", []string{"a", "c"}},
+		{"region=eu, user=42", []string{"a"}},
+		{"admin", []string{"b"}},
+		{"region!=us", []string{"a", "b"}},
+		{"user=1", nil},
+	} {
+		clients, err := srv.FindSessions(tt.query)
+		fatal(t, err)
+		got := map[string]bool{}
+		for _, client := range clients {
+			var name string
+			_, err := client.Call(ctx, "name", nil, &name)
+			fatal(t, err)
+			got[name] = true
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("FindSessions(%q) found %v; want %v", tt.query, got, tt.want)
+		}
+		for _, name := range tt.want {
+			if !got[name] {
+				t.Fatalf("FindSessions(%q) found %v; want %v", tt.query, got, tt.want)
+			}
+		}
+	}
+
+	if _, err := srv.FindSessions("=x"); err == nil {
+		t.Fatal("expected error for invalid query")
+	}
+
+	// sessions are no longer found once they end
+	c.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		clients, err := srv.FindSessions("user=42")
+		fatal(t, err)
+		if len(clients) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed session still found")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// TimeSelector is the conventional selector used to register a
+// TimeHandler, which EstimateClockOffset calls to estimate the clock offset
+// of a peer.
+const TimeSelector = "qtalk.time"
+
+// TimeReply is the reply of a TimeHandler, with the times the call was
+// received and replied to by the clock of the handler.
+type TimeReply struct {
+	Received time.Time
+	Sent     time.Time
+}
+
+// TimeHandler returns a handler that replies with its clock.
+func TimeHandler() Handler {
+	return HandlerFunc(func(r Responder, c *Call) {
+		received := time.Now()
+		c.Receive(nil)
+		r.Return(TimeReply{Received: received, Sent: time.Now()})
+	})
+}
+
+// ClockOffset estimates how far the clock of a peer is ahead of the local
+// clock.
+type ClockOffset struct {
+	Offset time.Duration
+	// RTT is the round trip time of the exchange the estimate is from,
+	// excluding the time the peer took to reply. The estimate is off by at
+	// most half of it.
+	RTT time.Duration
+}
+
+// PeerTime returns the time of the peer's clock at local time t.
+func (o ClockOffset) PeerTime(t time.Time) time.Time {
+	return t.Add(o.Offset)
+}
+
+// LocalTime returns the local time at time t of the peer's clock, such as
+// to compare the deadline or timestamp of an event of the peer with local
+// times.
+func (o ClockOffset) LocalTime(t time.Time) time.Time {
+	return t.Add(-o.Offset)
+}
+
+// EstimateClockOffset estimates the clock offset of the peer of c with
+// samples NTP style exchanges with its TimeSelector, using the exchange
+// with the shortest round trip, which was least delayed. If samples is less
+// than one a single exchange is made.
+func EstimateClockOffset(ctx context.Context, c Caller, samples int) (ClockOffset, error) {
+	if samples < 1 {
+		samples = 1
+	}
+	var best ClockOffset
+	var err error
+	found := false
+	for i := 0; i < samples; i++ {
+		var reply TimeReply
+		sent := time.Now()
+		if _, err = c.Call(ctx, TimeSelector, nil, &reply); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		received := time.Now()
+		// the wall clock is used to compare with the peer and the monotonic
+		// clock to measure the round trip
+		sample := ClockOffset{
+			Offset: (reply.Received.Sub(sent.Round(0)) + reply.Sent.Sub(received.Round(0))) / 2,
+			RTT:    received.Sub(sent) - reply.Sent.Sub(reply.Received),
+		}
+		if !found || sample.RTT < best.RTT {
+			best, found = sample, true
+		}
+	}
+	if !found {
+		if err == nil {
+			err = errors.New("rpc: no clock samples")
+		}
+		return ClockOffset{}, err
+	}
+	return best, nil
+}
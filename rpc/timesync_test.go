@@ -0,0 +1,37 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEstimateClockOffset(t *testing.T) {
+	const skew = 3 * time.Second
+	client, _ := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+		// a peer whose clock is ahead
+		received := time.Now().Add(skew)
+		c.Receive(nil)
+		r.Return(TimeReply{Received: received, Sent: time.Now().Add(skew)})
+	}))
+	defer client.Close()
+
+	o, err := EstimateClockOffset(context.Background(), client, 5)
+	fatal(t, err)
+	if diff := o.Offset - skew; diff < -o.RTT/2-time.Millisecond || diff > o.RTT/2+time.Millisecond {
+		t.Fatalf("offset %v with rtt %v, expected %v", o.Offset, o.RTT, skew)
+	}
+	now := time.Now()
+	if !o.LocalTime(o.PeerTime(now)).Equal(now) {
+		t.Fatal("times don't convert back")
+	}
+
+	// the built-in handler has no offset to itself
+	client, _ = newTestPair(TimeHandler())
+	defer client.Close()
+	o, err = EstimateClockOffset(context.Background(), client, 3)
+	fatal(t, err)
+	if o.Offset > o.RTT || o.Offset < -o.RTT || o.RTT <= 0 {
+		t.Fatalf("offset %v with rtt %v, expected none", o.Offset, o.RTT)
+	}
+}
@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"context"
+	"time"
+)
+
+// StreamEvent describes a value sent or received on the channel of a
+// streamed call, reported to the TraceStream hooks of Client and Server.
+type StreamEvent struct {
+	Selector  string
+	SessionID string
+	ChannelID uint32
+
+	// Sent is set for values sent, and unset for values received.
+	Sent bool
+	// Seq counts the values sent or received on the channel, by this event
+	// for the direction of the event, from 1.
+	Seq int
+	// Bytes is the size of the value including framing, and Total the
+	// bytes of the call in the direction of the event so far.
+	Bytes int64
+	Total int64
+	// Duration is how long the value took to send or receive, including
+	// waiting for it.
+	Duration time.Duration
+	// Err is the error sending or receiving the value, such as io.EOF at the
+	// end of a stream.
+	Err error
+}
+
+// StreamTracer is called with the events of streamed calls. Its ctx is the
+// context of the call, which holds the span of the call for tracing
+// packages to add the event to or link a span of the event to:
+//
+//	client.TraceStream = func(ctx context.Context, ev rpc.StreamEvent) {
+//		trace.SpanFromContext(ctx).AddEvent("qtalk.stream", trace.WithAttributes(
+//			attribute.Bool("sent", ev.Sent),
+//			attribute.Int("seq", ev.Seq),
+//			attribute.Int64("bytes", ev.Bytes),
+//		))
+//	}
+//
+// It is called on the goroutine sending or receiving, so it should not
+// block.
+type StreamTracer func(ctx context.Context, ev StreamEvent)
+
+// streamTrace traces the values of one side of a streamed call.
+type streamTrace struct {
+	ctx    context.Context
+	tracer StreamTracer
+
+	selector, sessionID string
+	channelID           uint32
+	counter             *countingChannel
+	sent, received      int
+}
+
+// start returns the bytes count in the direction to trace, and the start
+// time of the operation.
+func (t *streamTrace) start(sent bool) (int64, time.Time) {
+	if t.counter == nil {
+		return 0, time.Now()
+	}
+	if sent {
+		return t.counter.sent.Load(), time.Now()
+	}
+	return t.counter.received.Load(), time.Now()
+}
+
+// event reports a value sent or received since start.
+func (t *streamTrace) event(sent bool, before int64, start time.Time, err error) {
+	ev := StreamEvent{
+		Selector:  t.selector,
+		SessionID: t.sessionID,
+		ChannelID: t.channelID,
+		Sent:      sent,
+		Duration:  time.Since(start),
+		Err:       err,
+	}
+	if sent {
+		t.sent++
+		ev.Seq = t.sent
+	} else {
+		t.received++
+		ev.Seq = t.received
+	}
+	if t.counter != nil {
+		ev.Total, _ = t.start(sent)
+		ev.Bytes = ev.Total - before
+	}
+	t.tracer(t.ctx, ev)
+}
@@ -0,0 +1,91 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+)
+
+type spanKey struct{}
+
+// eventLog collects stream events with the span of their context.
+type eventLog struct {
+	mu     sync.Mutex
+	events []StreamEvent
+	spans  []any
+}
+
+func (l *eventLog) trace(ctx context.Context, ev StreamEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, ev)
+	l.spans = append(l.spans, ctx.Value(spanKey{}))
+}
+
+func TestTraceStream(t *testing.T) {
+	var clientLog, serverLog eventLog
+	done := make(chan struct{})
+	client, srv := newTestPair(HandlerFunc(func(r Responder, c *Call) {
+		defer close(done)
+		c.Receive(nil)
+		ch, err := r.Continue("started")
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+		for i := 0; i < 3; i++ {
+			r.Send(i)
+		}
+		var ack string
+		c.Receive(&ack)
+	}))
+	defer client.Close()
+	srv.TraceStream = serverLog.trace
+	client.TraceStream = clientLog.trace
+
+	ctx := context.WithValue(context.Background(), spanKey{}, "parent")
+	var started string
+	resp, err := client.Call(ctx, "stream", nil, &started)
+	fatal(t, err)
+	for i := 0; i < 3; i++ {
+		var v int
+		fatal(t, resp.Receive(&v))
+	}
+	fatal(t, resp.Send("ack"))
+	<-done
+	if err := resp.Receive(nil); err != io.EOF {
+		t.Fatal("expected end of stream, got", err)
+	}
+
+	if len(clientLog.events) != 5 {
+		t.Fatalf("%d client events, expected 5: %+v", len(clientLog.events), clientLog.events)
+	}
+	for i, ev := range clientLog.events[:3] {
+		if ev.Sent || ev.Seq != i+1 || ev.Bytes == 0 || ev.Err != nil || ev.Selector != "/stream" || clientLog.spans[i] != "parent" {
+			t.Fatalf("unexpected client event %d: %+v", i, ev)
+		}
+	}
+	if ev := clientLog.events[3]; !ev.Sent || ev.Seq != 1 || ev.Bytes == 0 {
+		t.Fatalf("unexpected client send event: %+v", ev)
+	}
+	if ev := clientLog.events[4]; ev.Sent || ev.Seq != 4 || ev.Err != io.EOF {
+		t.Fatalf("unexpected client end event: %+v", ev)
+	}
+
+	// the server traces values after the reply
+	if len(serverLog.events) != 4 {
+		t.Fatalf("%d server events, expected 4: %+v", len(serverLog.events), serverLog.events)
+	}
+	for i, ev := range serverLog.events[:3] {
+		if !ev.Sent || ev.Seq != i+1 || ev.Bytes == 0 || ev.ChannelID != resp.RemoteChannelID {
+			t.Fatalf("unexpected server event %d: %+v", i, ev)
+		}
+	}
+	if ev := serverLog.events[3]; ev.Sent || ev.Seq != 1 || ev.Bytes == 0 {
+		t.Fatalf("unexpected server receive event: %+v", ev)
+	}
+	if last := serverLog.events[2]; last.Total <= last.Bytes {
+		t.Fatalf("total %d should include the reply", last.Total)
+	}
+}
@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VersionedSelector returns selector prefixed with version v using the
+// conventional form, so VersionedSelector(2, "users.get") is "/v2/users/get".
+func VersionedSelector(v int, selector string) string {
+	return fmt.Sprintf("/v%d%s", v, cleanSelector(selector))
+}
+
+// ParseVersion splits a versioned selector such as "v2.users.get" into its
+// version and the normalized remaining selector "/users/get". If the
+// selector is not versioned, ok is false.
+func ParseVersion(selector string) (v int, rest string, ok bool) {
+	selector = cleanSelector(selector)
+	if len(selector) < 3 || selector[1] != 'v' {
+		return 0, "", false
+	}
+	end := strings.IndexByte(selector[1:], '/')
+	if end == -1 {
+		return 0, "", false
+	}
+	v, err := strconv.Atoi(selector[2 : end+1])
+	if err != nil || v < 0 {
+		return 0, "", false
+	}
+	return v, selector[end+1:], true
+}
+
+// Versions calls the ReflectSelector of the remote side and returns the
+// available versions of the unversioned selector, sorted in ascending order.
+// A versioned pattern ending in a separator, such as "v2.", is considered to
+// provide any selector beginning with the rest of the pattern.
+func Versions(ctx context.Context, c Caller, selector string) ([]int, error) {
+	var ref Reflection
+	if _, err := c.Call(ctx, ReflectSelector, nil, &ref); err != nil {
+		return nil, err
+	}
+	selector = cleanSelector(selector)
+	seen := make(map[int]bool)
+	var versions []int
+	for _, p := range ref.Selectors {
+		v, rest, ok := ParseVersion(p)
+		if !ok || seen[v] {
+			continue
+		}
+		if rest == selector || (strings.HasSuffix(rest, "/") && strings.HasPrefix(selector, rest)) {
+			seen[v] = true
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// NegotiateVersion returns the highest version of selector that is both
+// in supported and available on the remote side according to Versions.
+func NegotiateVersion(ctx context.Context, c Caller, selector string, supported ...int) (int, error) {
+	remote, err := Versions(ctx, c, selector)
+	if err != nil {
+		return 0, err
+	}
+	best := -1
+	for _, v := range remote {
+		for _, s := range supported {
+			if v == s && v > best {
+				best = v
+			}
+		}
+	}
+	if best == -1 {
+		return 0, fmt.Errorf("rpc: no mutually supported version for %s (remote has %v)", cleanSelector(selector), remote)
+	}
+	return best, nil
+}
+
+// VersionedCaller is a Caller that pins every call to a version by
+// prefixing selectors using VersionedSelector. It is typically used
+// with the result of NegotiateVersion.
+type VersionedCaller struct {
+	Caller
+	Version int
+}
+
+// Call makes a call using the versioned form of selector.
+func (c VersionedCaller) Call(ctx context.Context, selector string, args any, replies ...any) (*Response, error) {
+	return c.Caller.Call(ctx, VersionedSelector(c.Version, selector), args, replies...)
+}
@@ -0,0 +1,72 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		v    int
+		rest string
+		ok   bool
+	}{
+		{"v2.users.get", 2, "/users/get", true},
+		{"/v10/users/", 10, "/users/", true},
+		{"users.get", 0, "", false},
+		{"view.get", 0, "", false},
+		{"v2", 0, "", false},
+	} {
+		v, rest, ok := ParseVersion(tt.in)
+		if v != tt.v || rest != tt.rest || ok != tt.ok {
+			t.Errorf("ParseVersion(%q) = %d, %q, %v", tt.in, v, rest, ok)
+		}
+	}
+	if s := VersionedSelector(3, "users.get"); s != "/v3/users/get" {
+		t.Fatal("unexpected versioned selector:", s)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	ctx := context.Background()
+
+	v2 := NewRespondMux()
+	v2.Handle("users.get", HandlerFunc(func(r Responder, c *Call) {
+		r.Return("v2")
+	}))
+	mux := NewRespondMux()
+	mux.Handle("v1.users.get", HandlerFunc(func(r Responder, c *Call) {
+		r.Return("v1")
+	}))
+	mux.Handle("v2", v2)
+	mux.Handle("v3.other", NotFoundHandler())
+	mux.Handle(ReflectSelector, ReflectionHandler(mux))
+
+	client, _ := newTestPair(mux)
+	defer client.Close()
+
+	versions, err := Versions(ctx, client, "users.get")
+	fatal(t, err)
+	if !reflect.DeepEqual(versions, []int{1, 2}) {
+		t.Fatal("unexpected versions:", versions)
+	}
+
+	v, err := NegotiateVersion(ctx, client, "users.get", 1, 2, 3)
+	fatal(t, err)
+	if v != 2 {
+		t.Fatal("unexpected version:", v)
+	}
+
+	var out string
+	_, err = VersionedCaller{Caller: client, Version: v}.Call(ctx, "users.get", nil, &out)
+	fatal(t, err)
+	if out != "v2" {
+		t.Fatal("unexpected return:", out)
+	}
+
+	if _, err := NegotiateVersion(ctx, client, "users.get", 3); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrBusy is returned to callers when all the Workers of a server are busy
+// and its Queue is full. Callers receive it as a RemoteError with the same
+// message.
+var ErrBusy = errors.New("rpc: server busy")
+
+var busyHandler = HandlerFunc(func(r Responder, c *Call) {
+	r.Return(ErrBusy)
+})
+
+// ServerStats reports the calls being handled by a Server.
+type ServerStats struct {
+	// Active is the number of handlers running.
+	Active int
+	// Queued is the number of accepted calls waiting for one of the
+	// Workers of the server.
+	Queued int
+	// MalformedCalls is the number of calls whose header could not be
+	// decoded since the server started.
+	MalformedCalls int
+	// IdleClosed is the number of channels of continued calls closed for
+	// being idle longer than the ContinueIdleTimeout of the server.
+	IdleClosed int
+}
+
+// Stats returns the current ServerStats of the server.
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		Active:         int(s.active.Load()),
+		Queued:         int(s.queued.Load()),
+		MalformedCalls: int(s.malformed.Load()),
+		IdleClosed:     int(s.idleClosed.Load()),
+	}
+}
+
+// admit returns whether a call can run or wait for a worker, reserving its
+// place if so.
+func (s *Server) admit() bool {
+	if s.Workers <= 0 {
+		return true
+	}
+	queue := s.Queue
+	if queue == 0 {
+		queue = s.Workers
+	} else if queue < 0 {
+		queue = 0
+	}
+	limit := int64(s.Workers + queue)
+	for {
+		n := s.pending.Load()
+		if n >= limit {
+			return false
+		}
+		if s.pending.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// acquire waits for a worker to handle an admitted call, returning false if
+// ctx is done first.
+func (s *Server) acquire(ctx context.Context) bool {
+	if s.Workers > 0 {
+		s.workersOnce.Do(func() {
+			s.workers = make(chan struct{}, s.Workers)
+		})
+		s.queued.Add(1)
+		defer s.queued.Add(-1)
+		select {
+		case s.workers <- struct{}{}:
+		case <-ctx.Done():
+			s.pending.Add(-1)
+			return false
+		}
+	}
+	s.active.Add(1)
+	return true
+}
+
+// release frees the worker of a handler that returned.
+func (s *Server) release() {
+	s.active.Add(-1)
+	if s.Workers > 0 {
+		<-s.workers
+		s.pending.Add(-1)
+	}
+}
@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+func TestServerWorkers(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	var running, maxRunning int32
+	srv := &Server{Codec: codec.JSONCodec{}, Workers: 2, Queue: 1}
+	srv.Handler = HandlerFunc(func(r Responder, c *Call) {
+		c.Receive(nil)
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-release
+		r.Return()
+	})
+	// calls are closed by both sides at once, which needs buffered
+	// transports
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatal(t, err)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatal(t, err)
+	sconn, err := l.Accept()
+	fatal(t, err)
+	go srv.Respond(mux.New(sconn), nil)
+	client := NewClient(mux.New(conn), codec.JSONCodec{})
+
+	var wg sync.WaitGroup
+	var busy int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Call(ctx, "block", nil)
+			switch {
+			case err == RemoteError(ErrBusy.Error()):
+				atomic.AddInt32(&busy, 1)
+			case err != nil:
+				t.Error(err)
+			}
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for srv.Stats() != (ServerStats{Active: 2, Queued: 1}) || atomic.LoadInt32(&busy) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("unexpected stats:", srv.Stats(), "busy:", atomic.LoadInt32(&busy))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	if max := atomic.LoadInt32(&maxRunning); max != 2 {
+		t.Fatal("unexpected handlers running at once:", max)
+	}
+	deadline = time.Now().Add(time.Second)
+	for srv.Stats() != (ServerStats{}) {
+		if time.Now().After(deadline) {
+			t.Fatal("unexpected stats after calls:", srv.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -16,9 +16,10 @@ var Dialers map[string]Dialer
 
 func init() {
 	Dialers = map[string]Dialer{
-		"tcp":  mux.DialTCP,
-		"unix": mux.DialUnix,
-		"ws":   mux.DialWS,
+		"tcp":   dialTCP,
+		"unix":  mux.DialUnix,
+		"ws":    mux.DialWS,
+		"npipe": mux.DialNamedPipe,
 		"stdio": func(_ string) (mux.Session, error) {
 			return mux.DialStdio()
 		},
@@ -26,8 +27,10 @@ func init() {
 }
 
 // Dial connects to a remote address using a registered transport and returns a Peer.
-// Available transports are "tcp", "unix", "ws", and "stdio". In the case of "stdio",
-// the addr can be left an empty string.
+// Available transports are "tcp", "unix", "ws", "npipe" and "stdio". In the case of "stdio",
+// the addr can be left an empty string. The address of "tcp" can have query
+// parameters setting SocketOptions. The "npipe" transport uses Windows named
+// pipes, with addresses like "qtalk" or `\\.\pipe\qtalk`.
 func Dial(transport, addr string, codec codec.Codec) (*Peer, error) {
 	d, ok := Dialers[transport]
 	if !ok {
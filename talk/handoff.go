@@ -0,0 +1,88 @@
+package talk
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// ListenFDsEnv is the environment variable telling a process started by
+// Handoff how many listeners it inherited.
+const ListenFDsEnv = "QTALK_LISTEN_FDS"
+
+// Handoff starts cmd with the sockets of the listeners, so a replacement
+// process can accept connections on them while this one drains its
+// sessions with rpc.Server.Shutdown, and no connection is refused during a
+// restart:
+//
+//	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+//	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+//	if err := talk.Handoff(cmd, l); err != nil {
+//		log.Fatal(err)
+//	}
+//	srv.Shutdown(ctx)
+//
+// The listeners must have a File method like *net.TCPListener and
+// *net.UnixListener. They are duplicated, so they keep working in this
+// process until closed. The replacement gets them from InheritedListeners.
+// Inheriting sockets is not supported on Windows; use the reuseport
+// SocketOptions instead.
+func Handoff(cmd *exec.Cmd, listeners ...net.Listener) error {
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		// the started process has its own copies
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("talk: cannot hand off listener of type %T", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles[:0:0], files...)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, ListenFDsEnv+"="+strconv.Itoa(len(files)))
+	return cmd.Start()
+}
+
+// InheritedListeners returns the listeners handed off to this process with
+// Handoff, in the order they were passed, or none if it was not started by
+// Handoff. It unsets ListenFDsEnv so processes started later do not
+// inherit it.
+func InheritedListeners() ([]net.Listener, error) {
+	v, ok := os.LookupEnv(ListenFDsEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(ListenFDsEnv)
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("talk: invalid %s %q", ListenFDsEnv, v)
+	}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		// ExtraFiles start after stdin, stdout and stderr
+		f := os.NewFile(uintptr(3+i), "listener"+strconv.Itoa(i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
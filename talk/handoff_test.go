@@ -0,0 +1,90 @@
+package talk
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+func TestHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sockets can't be inherited on windows")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffProcess$")
+	cmd.Env = append(os.Environ(), "QTALK_TEST_HANDOFF=1")
+	cmd.Stderr = os.Stderr
+	if err := Handoff(cmd, l); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	// only the replacement accepts from now on
+	l.Close()
+
+	peer, err := Dial("tcp", l.Addr().String(), codec.JSONCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	var pid int
+	if _, err := peer.Call(context.Background(), "pid", nil, &pid); err != nil {
+		t.Fatal(err)
+	}
+	if pid != cmd.Process.Pid {
+		t.Fatalf("served by %d, expected %d", pid, cmd.Process.Pid)
+	}
+}
+
+// TestHandoffProcess is the replacement process started by TestHandoff.
+func TestHandoffProcess(t *testing.T) {
+	if os.Getenv("QTALK_TEST_HANDOFF") != "1" {
+		t.Skip("started by TestHandoff")
+	}
+	listeners, err := InheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || os.Getenv(ListenFDsEnv) != "" {
+		t.Fatalf("unexpected listeners: %v", listeners)
+	}
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &rpc.Server{
+		Codec: codec.JSONCodec{},
+		Handler: rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+			r.Return(os.Getpid())
+		}),
+	}
+	srv.Respond(mux.New(conn), nil)
+}
+
+func TestReusePort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("reuseport is not supported on windows")
+	}
+	l1, err := Listen("tcp", "127.0.0.1:0?reuseport=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	l2, err := Listen("tcp", l1.Addr().String()+"?reuseport=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.Close()
+	if _, err := Listen("tcp", l1.Addr().String()); err == nil {
+		t.Fatal("expected listening without reuseport to fail")
+	}
+}
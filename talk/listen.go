@@ -0,0 +1,48 @@
+package talk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// A Listener listens on address and returns a mux.Listener for accepting sessions
+type Listener func(addr string) (mux.Listener, error)
+
+// Listeners is map of transport strings to Listeners
+// and includes all builtin transports
+var Listeners map[string]Listener
+
+func init() {
+	Listeners = map[string]Listener{
+		"tcp":   listenTCP,
+		"unix":  mux.ListenUnix,
+		"ws":    mux.ListenWS,
+		"npipe": listenNamedPipe,
+		"stdio": func(_ string) (mux.Listener, error) {
+			return mux.ListenStdio()
+		},
+	}
+}
+
+// Listen listens on a local address using a registered transport. Available
+// transports are "tcp", "unix", "ws", "npipe" and "stdio". In the case of "stdio",
+// the addr can be left an empty string. The address of "tcp" can have query
+// parameters setting SocketOptions. The address of "npipe" can end in an
+// sddl parameter with the security descriptor of the pipe, which is not
+// escaped:
+//
+//	talk.Listen("npipe", `qtalk?sddl=D:P(A;;GA;;;SY)(A;;GA;;;BA)`)
+func Listen(transport, addr string) (mux.Listener, error) {
+	l, ok := Listeners[transport]
+	if !ok {
+		return nil, fmt.Errorf("transport '%s' not in available in Listeners", transport)
+	}
+	return l(addr)
+}
+
+func listenNamedPipe(addr string) (mux.Listener, error) {
+	name, sddl, _ := strings.Cut(addr, "?sddl=")
+	return mux.ListenNamedPipe(name, &mux.NamedPipeConfig{SecurityDescriptor: sddl})
+}
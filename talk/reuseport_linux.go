@@ -0,0 +1,6 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package talk
+
+// soReusePort is SO_REUSEPORT, which the syscall package lacks on linux.
+const soReusePort = 0xf
@@ -0,0 +1,203 @@
+package talk
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roachadam/qtalk-go/mux"
+)
+
+// SocketOptions tune the TCP connections of sessions. The zero value keeps
+// the defaults of the net package.
+//
+// The "tcp" transport of Dial and Listen reads them from query parameters
+// of the address, named after the fields:
+//
+//	talk.Dial("tcp", "example.com:4242?nodelay=false&keepalive=15s&bind=10.0.0.2", codec)
+//	talk.Listen("tcp", ":4242?keepalive=-1&rcvbuf=1048576&sndbuf=1048576&reuseport=true")
+type SocketOptions struct {
+	// NoDelay, if set, enables or disables Nagle's algorithm, which the
+	// net package disables by default.
+	NoDelay *bool
+	// KeepAlive is the interval of TCP keepalive probes. Zero uses the
+	// default interval and a negative value disables keepalives.
+	KeepAlive time.Duration
+	// ReadBuffer and WriteBuffer, if set, are the sizes of the receive and
+	// send buffers of the socket.
+	ReadBuffer  int
+	WriteBuffer int
+	// Bind is the local address to dial from. It is ignored by Listen.
+	Bind string
+	// ReusePort sets SO_REUSEPORT on listeners so several processes can
+	// listen on the same address, letting a replacement process listen
+	// while the one it replaces drains its sessions. The kernel spreads
+	// new connections across the listeners. It is ignored by Dial and not
+	// supported on Windows.
+	ReusePort bool
+}
+
+// ParseSocketOptions splits addr into the address and the SocketOptions in
+// its query parameters: nodelay, keepalive, rcvbuf, sndbuf, bind and
+// reuseport.
+func ParseSocketOptions(addr string) (string, SocketOptions, error) {
+	var opts SocketOptions
+	host, query, ok := strings.Cut(addr, "?")
+	if !ok {
+		return addr, opts, nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", opts, err
+	}
+	for key, vs := range values {
+		v := vs[len(vs)-1]
+		switch key {
+		case "nodelay":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid nodelay option: %w", err)
+			}
+			opts.NoDelay = &b
+		case "keepalive":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				if n, nerr := strconv.Atoi(v); nerr == nil && n < 0 {
+					d, err = -1, nil
+				}
+			}
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid keepalive option: %w", err)
+			}
+			opts.KeepAlive = d
+		case "rcvbuf", "sndbuf":
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return "", opts, fmt.Errorf("invalid %s option %q", key, v)
+			}
+			if key == "rcvbuf" {
+				opts.ReadBuffer = n
+			} else {
+				opts.WriteBuffer = n
+			}
+		case "bind":
+			opts.Bind = v
+		case "reuseport":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return "", opts, fmt.Errorf("invalid reuseport option: %w", err)
+			}
+			opts.ReusePort = b
+		default:
+			return "", opts, fmt.Errorf("unknown socket option %q", key)
+		}
+	}
+	return host, opts, nil
+}
+
+// DialTCP establishes a mux session via TCP connection using the options.
+func (o SocketOptions) DialTCP(addr string) (mux.Session, error) {
+	d := &net.Dialer{KeepAlive: o.KeepAlive}
+	if o.Bind != "" {
+		local, err := net.ResolveTCPAddr("tcp", bindAddr(o.Bind))
+		if err != nil {
+			return nil, err
+		}
+		d.LocalAddr = local
+	}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return mux.New(conn), nil
+}
+
+// ListenTCP creates a TCP listener at the given address, applying the
+// options to accepted connections.
+func (o SocketOptions) ListenTCP(addr string) (mux.Listener, error) {
+	lc := &net.ListenConfig{KeepAlive: o.KeepAlive}
+	if o.ReusePort {
+		lc.Control = reusePort
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return mux.ListenerFrom(&optionListener{Listener: l, opts: o}), nil
+}
+
+// apply sets the options that are not set by dialing or listening.
+func (o SocketOptions) apply(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.NoDelay != nil {
+		if err := tc.SetNoDelay(*o.NoDelay); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindAddr allows binding a host without a port, using any free port.
+func bindAddr(bind string) string {
+	if _, _, err := net.SplitHostPort(bind); err != nil {
+		return net.JoinHostPort(bind, "0")
+	}
+	return bind
+}
+
+type optionListener struct {
+	net.Listener
+	opts SocketOptions
+}
+
+func (l *optionListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := l.opts.apply(conn); err != nil {
+			// the connection is unusable but the listener is not
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func dialTCP(addr string) (mux.Session, error) {
+	addr, opts, err := ParseSocketOptions(addr)
+	if err != nil {
+		return nil, err
+	}
+	return opts.DialTCP(addr)
+}
+
+func listenTCP(addr string) (mux.Listener, error) {
+	addr, opts, err := ParseSocketOptions(addr)
+	if err != nil {
+		return nil, err
+	}
+	return opts.ListenTCP(addr)
+}
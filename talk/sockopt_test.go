@@ -0,0 +1,64 @@
+package talk
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/roachadam/qtalk-go/codec"
+	"github.com/roachadam/qtalk-go/mux"
+	"github.com/roachadam/qtalk-go/rpc"
+)
+
+func TestParseSocketOptions(t *testing.T) {
+	addr, opts, err := ParseSocketOptions("localhost:4242?nodelay=false&keepalive=15s&rcvbuf=1024&sndbuf=2048&bind=10.0.0.2&reuseport=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "localhost:4242" || opts.NoDelay == nil || *opts.NoDelay ||
+		opts.KeepAlive != 15*time.Second || opts.ReadBuffer != 1024 ||
+		opts.WriteBuffer != 2048 || opts.Bind != "10.0.0.2" || !opts.ReusePort {
+		t.Fatalf("unexpected options for %s: %+v", addr, opts)
+	}
+	if _, opts, _ := ParseSocketOptions(":0?keepalive=-1"); opts.KeepAlive >= 0 {
+		t.Fatal("expected keepalives to be disabled:", opts.KeepAlive)
+	}
+	for _, bad := range []string{":0?nodelay=maybe", ":0?rcvbuf=0", ":0?keepalive=soon", ":0?other=1", ":0?reuseport=yes"} {
+		if _, _, err := ParseSocketOptions(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestDialSocketOptions(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0?nodelay=false&rcvbuf=65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		sess, err := l.Accept()
+		if err != nil {
+			return
+		}
+		peer := NewPeer(sess, codec.JSONCodec{})
+		peer.Handle("addr", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+			r.Return(sess.(mux.RemoteAddrer).RemoteAddr().String())
+		}))
+		peer.Respond()
+	}()
+
+	peer, err := Dial("tcp", l.Addr().String()+"?nodelay=true&keepalive=-1&bind=127.0.0.1", codec.JSONCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	var addr string
+	if _, err := peer.Call(context.Background(), "addr", nil, &addr); err != nil {
+		t.Fatal(err)
+	}
+	if host, _, _ := net.SplitHostPort(addr); host != "127.0.0.1" {
+		t.Fatal("unexpected remote address:", addr)
+	}
+}